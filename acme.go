@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// letsEncryptDirectory is the ACME directory of Let's Encrypt. Its staging
+// environment, with much higher rate limits but untrusted certificates, is
+// https://acme-staging-v02.api.letsencrypt.org/directory.
+const letsEncryptDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+
+const (
+	// acmePollInterval and acmePollTimeout are how often and how long to
+	// wait for the CA to validate challenges and issue certificates
+	acmePollInterval = 2 * time.Second
+	acmePollTimeout  = 2 * time.Minute
+
+	acmeChallengePath = "/.well-known/acme-challenge/"
+)
+
+// acmeClient obtains certificates from an ACME CA such as Let's Encrypt,
+// as RFC 8555 describes, proving control of the names with http-01
+// challenges. It is the http.Handler answering those challenges, which
+// the CA asks for on port 80 of each name.
+type acmeClient struct {
+	directoryURL string
+	contact      []string
+	// key is the account key, which signs every request
+	key    *ecdsa.PrivateKey
+	client *http.Client
+	// pollInterval is how often pending authorizations and orders are checked
+	pollInterval time.Duration
+
+	newNonceURL   string
+	newAccountURL string
+	newOrderURL   string
+	// accountURL identifies the account once it is registered
+	accountURL string
+
+	mu    sync.Mutex
+	nonce string
+	// challenges are the key authorizations of pending challenges, by token
+	challenges map[string]string
+}
+
+// acmeProblem is an error response from the CA, RFC 7807 style
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *acmeProblem) Error() string {
+	return fmt.Sprintf("%s: %s", strings.TrimPrefix(p.Type, "urn:ietf:params:acme:error:"), p.Detail)
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeOrder struct {
+	Status         string       `json:"status"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate"`
+	Error          *acmeProblem `json:"error"`
+}
+
+type acmeAuthorization struct {
+	Status     string         `json:"status"`
+	Identifier acmeIdentifier `json:"identifier"`
+	Challenges []struct {
+		Type   string       `json:"type"`
+		URL    string       `json:"url"`
+		Token  string       `json:"token"`
+		Status string       `json:"status"`
+		Error  *acmeProblem `json:"error"`
+	} `json:"challenges"`
+}
+
+func newACMEClient(directoryURL, email string, key *ecdsa.PrivateKey) *acmeClient {
+	c := &acmeClient{
+		directoryURL: directoryURL,
+		key:          key,
+		client:       &http.Client{Timeout: 30 * time.Second},
+		pollInterval: acmePollInterval,
+		challenges:   make(map[string]string),
+	}
+	if email != "" {
+		c.contact = []string{"mailto:" + email}
+	}
+	return c
+}
+
+// register reads the directory of the CA and registers the account key
+// with it, or finds the existing account of the key
+func (c *acmeClient) register() error {
+	resp, err := c.client.Get(c.directoryURL)
+	if err != nil {
+		return fmt.Errorf("acme: directory: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("acme: directory returned %s", resp.Status)
+	}
+	var directory struct {
+		NewNonce   string `json:"newNonce"`
+		NewAccount string `json:"newAccount"`
+		NewOrder   string `json:"newOrder"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&directory); err != nil {
+		return fmt.Errorf("acme: directory: %s", err)
+	}
+	c.newNonceURL, c.newAccountURL, c.newOrderURL = directory.NewNonce, directory.NewAccount, directory.NewOrder
+
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if c.contact != nil {
+		account["contact"] = c.contact
+	}
+	header, _, err := c.post(c.newAccountURL, account, nil)
+	if err != nil {
+		return fmt.Errorf("acme: registering account: %w", err)
+	}
+	if header.Get("Location") == "" {
+		return errors.New("acme: the CA returned no account URL")
+	}
+	c.accountURL = header.Get("Location")
+	log.Printf("ACME: account %s", c.accountURL)
+	return nil
+}
+
+// ServeHTTP answers http-01 challenges and redirects anything else to HTTPS
+func (c *acmeClient) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+		return
+	}
+	c.mu.Lock()
+	keyAuth, ok := c.challenges[strings.TrimPrefix(r.URL.Path, acmeChallengePath)]
+	c.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, keyAuth)
+}
+
+// obtain orders a certificate for hosts and key, and returns its chain,
+// leaf first, once the CA has issued it. The account is registered first
+// if it hasn't been yet.
+func (c *acmeClient) obtain(hosts []string, key crypto.Signer) ([][]byte, error) {
+	if c.accountURL == "" {
+		if err := c.register(); err != nil {
+			return nil, err
+		}
+	}
+
+	var identifiers []acmeIdentifier
+	for _, h := range hosts {
+		identifiers = append(identifiers, acmeIdentifier{Type: "dns", Value: h})
+	}
+	var order acmeOrder
+	header, _, err := c.post(c.newOrderURL, map[string]interface{}{"identifiers": identifiers}, &order)
+	if err != nil {
+		return nil, fmt.Errorf("acme: new order: %w", err)
+	}
+	orderURL := header.Get("Location")
+	if orderURL == "" {
+		return nil, errors.New("acme: the CA returned no order URL")
+	}
+
+	for _, authzURL := range order.Authorizations {
+		if err := c.authorize(authzURL); err != nil {
+			return nil, err
+		}
+	}
+	// The order only becomes ready once the CA has seen every authorization
+	// through, which it may do after answering for the last one
+	if err := c.waitOrder(orderURL, &order, "ready"); err != nil {
+		return nil, err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: hosts}, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := c.post(order.Finalize, map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)}, &order); err != nil {
+		return nil, fmt.Errorf("acme: finalize: %w", err)
+	}
+	if err := c.waitOrder(orderURL, &order, "valid"); err != nil {
+		return nil, err
+	}
+
+	_, body, err := c.post(order.Certificate, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("acme: downloading certificate: %w", err)
+	}
+	var chain [][]byte
+	for block, rest := pem.Decode(body); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			chain = append(chain, block.Bytes)
+		}
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("acme: the CA returned no certificates")
+	}
+	return chain, nil
+}
+
+// waitOrder polls the order at orderURL into order until its status is
+// want, and fails if it becomes invalid or doesn't within acmePollTimeout
+func (c *acmeClient) waitOrder(orderURL string, order *acmeOrder, want string) error {
+	for deadline := time.Now().Add(acmePollTimeout); order.Status != want; {
+		if order.Status == "invalid" {
+			if order.Error != nil {
+				return fmt.Errorf("acme: order: %w", order.Error)
+			}
+			return errors.New("acme: the order is invalid")
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("acme: the order is still %s after %s", order.Status, acmePollTimeout)
+		}
+		time.Sleep(c.pollInterval)
+		if _, _, err := c.post(orderURL, nil, order); err != nil {
+			return fmt.Errorf("acme: order: %w", err)
+		}
+	}
+	return nil
+}
+
+// authorize proves control of the name of an authorization, unless the
+// account already has
+func (c *acmeClient) authorize(authzURL string) error {
+	var authz acmeAuthorization
+	if _, _, err := c.post(authzURL, nil, &authz); err != nil {
+		return fmt.Errorf("acme: authorization: %w", err)
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+	name := authz.Identifier.Value
+
+	var challengeURL, token string
+	for _, ch := range authz.Challenges {
+		if ch.Type == "http-01" {
+			challengeURL, token = ch.URL, ch.Token
+		}
+	}
+	if challengeURL == "" {
+		return fmt.Errorf("acme: %s: the CA offers no http-01 challenge", name)
+	}
+	thumbprint, err := jwkThumbprint(&c.key.PublicKey)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.challenges[token] = token + "." + thumbprint
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.challenges, token)
+		c.mu.Unlock()
+	}()
+
+	log.Printf("ACME: answering the http-01 challenge for %s", name)
+	if _, _, err := c.post(challengeURL, struct{}{}, nil); err != nil {
+		return fmt.Errorf("acme: %s: challenge: %w", name, err)
+	}
+	for deadline := time.Now().Add(acmePollTimeout); ; {
+		time.Sleep(c.pollInterval)
+		if _, _, err := c.post(authzURL, nil, &authz); err != nil {
+			return fmt.Errorf("acme: authorization: %w", err)
+		}
+		switch authz.Status {
+		case "valid":
+			return nil
+		case "pending":
+			if time.Now().After(deadline) {
+				return fmt.Errorf("acme: %s: not validated after %s", name, acmePollTimeout)
+			}
+		default:
+			for _, ch := range authz.Challenges {
+				if ch.Type == "http-01" && ch.Error != nil {
+					return fmt.Errorf("acme: %s: %s", name, ch.Error.Detail)
+				}
+			}
+			return fmt.Errorf("acme: %s: authorization %s", name, authz.Status)
+		}
+	}
+}
+
+// post sends payload to url as a JWS signed by the account key, and
+// returns the response headers and body. The body is decoded into v if it
+// isn't nil. A nil payload is a POST-as-GET. A rejected nonce is retried
+// once, as the CA sends a fresh one with the rejection.
+func (c *acmeClient) post(url string, payload, v interface{}) (http.Header, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := c.postOnce(url, payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode >= 400 {
+			problem := &acmeProblem{Status: resp.StatusCode}
+			json.Unmarshal(body, problem)
+			if problem.Type == "urn:ietf:params:acme:error:badNonce" && attempt == 0 {
+				continue
+			}
+			if problem.Detail == "" {
+				problem.Detail = resp.Status
+			}
+			return nil, nil, problem
+		}
+		if v != nil {
+			if err := json.Unmarshal(body, v); err != nil {
+				return nil, nil, err
+			}
+		}
+		return resp.Header, body, nil
+	}
+}
+
+func (c *acmeClient) postOnce(url string, payload interface{}) (*http.Response, error) {
+	nonce, err := c.takeNonce()
+	if err != nil {
+		return nil, err
+	}
+	protected := map[string]interface{}{"alg": "ES256", "nonce": nonce, "url": url}
+	if c.accountURL != "" {
+		protected["kid"] = c.accountURL
+	} else {
+		protected["jwk"] = jwk(&c.key.PublicKey)
+	}
+	body, err := signJWS(c.key, protected, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if nonce := resp.Header.Get("Replay-Nonce"); nonce != "" {
+		c.mu.Lock()
+		c.nonce = nonce
+		c.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// takeNonce returns the nonce the last response carried, or a new one
+func (c *acmeClient) takeNonce() (string, error) {
+	c.mu.Lock()
+	nonce := c.nonce
+	c.nonce = ""
+	c.mu.Unlock()
+	if nonce != "" {
+		return nonce, nil
+	}
+
+	resp, err := c.client.Head(c.newNonceURL)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if nonce = resp.Header.Get("Replay-Nonce"); nonce == "" {
+		return "", errors.New("acme: the CA sent no nonce")
+	}
+	return nonce, nil
+}
+
+// signJWS returns the flattened JSON serialization of a JWS of payload,
+// signed with ES256
+func signJWS(key *ecdsa.PrivateKey, protected map[string]interface{}, payload interface{}) ([]byte, error) {
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	var encodedPayload string
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		encodedPayload = base64.RawURLEncoding.EncodeToString(data)
+	}
+	encodedHeader := base64.RawURLEncoding.EncodeToString(header)
+
+	digest := sha256.Sum256([]byte(encodedHeader + "." + encodedPayload))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return json.Marshal(map[string]string{
+		"protected": encodedHeader,
+		"payload":   encodedPayload,
+		"signature": base64.RawURLEncoding.EncodeToString(signature),
+	})
+}
+
+// jwk is the JSON Web Key of a P-256 public key
+func jwk(pub *ecdsa.PublicKey) map[string]string {
+	x, y := make([]byte, 32), make([]byte, 32)
+	pub.X.FillBytes(x)
+	pub.Y.FillBytes(y)
+	return map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   base64.RawURLEncoding.EncodeToString(x),
+		"y":   base64.RawURLEncoding.EncodeToString(y),
+	}
+}
+
+// jwkThumbprint is the RFC 7638 thumbprint of a P-256 public key
+func jwkThumbprint(pub *ecdsa.PublicKey) (string, error) {
+	// encoding/json sorts map keys, which is the order thumbprints need
+	data, err := json.Marshal(jwk(pub))
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/muthubro/ready-set-go/certgen"
+)
+
+// fakeACME is an ACME CA implementing as much of RFC 8555 as acmeClient
+// uses. It checks the nonce, URL and signature of every request, rejects
+// the first nonce it is sent so the client has to retry, validates http-01
+// challenges by asking solver for the key authorization, and keeps orders
+// pending for one poll after their authorizations are valid, as real CAs
+// may. Finalizing an order that isn't ready fails with orderNotReady.
+type fakeACME struct {
+	t      *testing.T
+	server *httptest.Server
+	ca     *certgen.Bundle
+
+	mu sync.Mutex
+	// solver answers http-01 challenges, as port 80 of the names would
+	solver http.Handler
+	// answer overrides the key authorization the solver is expected to serve
+	answer       string
+	nonces       map[string]bool
+	rejectNonce  bool
+	nextID       int
+	accounts     map[string]*ecdsa.PublicKey
+	accountByKey map[string]string
+	orders       map[string]*fakeOrder
+	authzs       map[string]*fakeAuthz
+	certs        map[string][]byte
+
+	// newAccounts and pendingPolls count what the client did
+	newAccounts  int
+	pendingPolls int
+}
+
+type fakeOrder struct {
+	account string
+	hosts   []string
+	authzs  []string
+	status  string
+	// readyAfter is how many more polls the order stays pending once its
+	// authorizations are valid
+	readyAfter int
+	cert       string
+}
+
+type fakeAuthz struct {
+	account string
+	host    string
+	token   string
+	status  string
+	problem *acmeProblem
+}
+
+func newFakeACME(t *testing.T) *fakeACME {
+	ca, err := certgen.Generate(certgen.Options{IsCA: true, Subject: pkix.Name{CommonName: "Fake ACME CA"}, ECDSACurve: "P256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeACME{
+		t:            t,
+		ca:           ca,
+		nonces:       make(map[string]bool),
+		rejectNonce:  true,
+		accounts:     make(map[string]*ecdsa.PublicKey),
+		accountByKey: make(map[string]string),
+		orders:       make(map[string]*fakeOrder),
+		authzs:       make(map[string]*fakeAuthz),
+		certs:        make(map[string][]byte),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeACME) directoryURL() string {
+	return f.server.URL + "/directory"
+}
+
+func (f *fakeACME) setSolver(h http.Handler) {
+	f.mu.Lock()
+	f.solver = h
+	f.mu.Unlock()
+}
+
+func (f *fakeACME) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.nextID++
+	nonce := fmt.Sprintf("nonce-%d", f.nextID)
+	f.nonces[nonce] = true
+	w.Header().Set("Replay-Nonce", nonce)
+
+	if r.URL.Path == "/directory" {
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   f.server.URL + "/new-nonce",
+			"newAccount": f.server.URL + "/new-account",
+			"newOrder":   f.server.URL + "/new-order",
+		})
+		return
+	}
+	if r.URL.Path == "/new-nonce" {
+		return
+	}
+
+	account, pub, payload, problem := f.verify(r)
+	if problem != nil {
+		f.fail(w, problem)
+		return
+	}
+
+	kind, id, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch kind {
+	case "new-account":
+		f.newAccount(w, account, pub, payload)
+	case "new-order":
+		f.newOrder(w, account, payload)
+	case "order":
+		f.pollOrder(w, account, id)
+	case "authz":
+		f.pollAuthz(w, account, id)
+	case "challenge":
+		f.challenge(w, account, id)
+	case "finalize":
+		f.finalize(w, account, id, payload)
+	case "cert":
+		if cert, ok := f.certs[id]; ok {
+			w.Header().Set("Content-Type", "application/pem-certificate-chain")
+			w.Write(cert)
+			return
+		}
+		f.fail(w, &acmeProblem{Type: "urn:ietf:params:acme:error:malformed", Status: http.StatusNotFound})
+	default:
+		f.fail(w, &acmeProblem{Type: "urn:ietf:params:acme:error:malformed", Status: http.StatusNotFound})
+	}
+}
+
+// internal fails the test and the request, as t.Fatal can't be called
+// from the server's goroutines
+func (f *fakeACME) internal(w http.ResponseWriter, err error) {
+	f.t.Error(err)
+	f.fail(w, &acmeProblem{Type: "urn:ietf:params:acme:error:serverInternal", Detail: err.Error(), Status: http.StatusInternalServerError})
+}
+
+func (f *fakeACME) fail(w http.ResponseWriter, problem *acmeProblem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// verify checks the JWS of a request, and returns the account that signed
+// it, or for newAccount the thumbprint of the key, its key and the payload
+func (f *fakeACME) verify(r *http.Request) (account string, pub *ecdsa.PublicKey, payload []byte, problem *acmeProblem) {
+	malformed := func(format string, args ...interface{}) (string, *ecdsa.PublicKey, []byte, *acmeProblem) {
+		f.t.Errorf("%s: "+format, append([]interface{}{r.URL.Path}, args...)...)
+		return "", nil, nil, &acmeProblem{Type: "urn:ietf:params:acme:error:malformed", Detail: fmt.Sprintf(format, args...), Status: http.StatusBadRequest}
+	}
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/jose+json" {
+		return malformed("%s with content type %q", r.Method, r.Header.Get("Content-Type"))
+	}
+	var jws struct {
+		Protected, Payload, Signature string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return malformed("%s", err)
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return malformed("protected header: %s", err)
+	}
+	var header struct {
+		Alg   string            `json:"alg"`
+		Nonce string            `json:"nonce"`
+		URL   string            `json:"url"`
+		JWK   map[string]string `json:"jwk"`
+		KID   string            `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return malformed("protected header: %s", err)
+	}
+	if header.Alg != "ES256" {
+		return malformed("alg %q", header.Alg)
+	}
+	if header.URL != f.server.URL+r.URL.Path {
+		return malformed("signed for %s", header.URL)
+	}
+	if !f.nonces[header.Nonce] {
+		return malformed("nonce %q was never issued or was used already", header.Nonce)
+	}
+	delete(f.nonces, header.Nonce)
+	if f.rejectNonce {
+		f.rejectNonce = false
+		return "", nil, nil, &acmeProblem{Type: "urn:ietf:params:acme:error:badNonce", Detail: "try again", Status: http.StatusBadRequest}
+	}
+
+	switch {
+	case header.KID != "" && header.JWK == nil:
+		if pub = f.accounts[header.KID]; pub == nil {
+			return "", nil, nil, &acmeProblem{Type: "urn:ietf:params:acme:error:accountDoesNotExist", Status: http.StatusBadRequest}
+		}
+		account = header.KID
+	case header.JWK != nil && header.KID == "" && r.URL.Path == "/new-account":
+		x, errX := base64.RawURLEncoding.DecodeString(header.JWK["x"])
+		y, errY := base64.RawURLEncoding.DecodeString(header.JWK["y"])
+		if header.JWK["kty"] != "EC" || header.JWK["crv"] != "P-256" || errX != nil || errY != nil {
+			return malformed("jwk %v", header.JWK)
+		}
+		pub = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if account, err = jwkThumbprint(pub); err != nil {
+			return malformed("%s", err)
+		}
+	default:
+		return malformed("needs exactly one of jwk and kid, and jwk only for newAccount")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if err != nil || len(signature) != 64 ||
+		!ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		return malformed("bad signature")
+	}
+	if payload, err = base64.RawURLEncoding.DecodeString(jws.Payload); err != nil {
+		return malformed("payload: %s", err)
+	}
+	return account, pub, payload, nil
+}
+
+func (f *fakeACME) newAccount(w http.ResponseWriter, thumbprint string, pub *ecdsa.PublicKey, payload []byte) {
+	var request struct {
+		TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+		Contact              []string `json:"contact"`
+	}
+	if err := json.Unmarshal(payload, &request); err != nil || !request.TermsOfServiceAgreed {
+		f.fail(w, &acmeProblem{Type: "urn:ietf:params:acme:error:malformed", Detail: "terms not agreed", Status: http.StatusBadRequest})
+		return
+	}
+	status := http.StatusOK
+	url, ok := f.accountByKey[thumbprint]
+	if !ok {
+		f.newAccounts++
+		url = fmt.Sprintf("%s/account/%d", f.server.URL, f.nextID)
+		f.accounts[url] = pub
+		f.accountByKey[thumbprint] = url
+		status = http.StatusCreated
+	}
+	w.Header().Set("Location", url)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "valid", "contact": request.Contact})
+}
+
+func (f *fakeACME) newOrder(w http.ResponseWriter, account string, payload []byte) {
+	var request struct {
+		Identifiers []acmeIdentifier `json:"identifiers"`
+	}
+	if err := json.Unmarshal(payload, &request); err != nil || len(request.Identifiers) == 0 {
+		f.fail(w, &acmeProblem{Type: "urn:ietf:params:acme:error:malformed", Detail: "no identifiers", Status: http.StatusBadRequest})
+		return
+	}
+	id := fmt.Sprint(f.nextID)
+	order := &fakeOrder{account: account, status: "pending", readyAfter: 1}
+	for i, identifier := range request.Identifiers {
+		authzID := fmt.Sprintf("%s-%d", id, i)
+		f.authzs[authzID] = &fakeAuthz{account: account, host: identifier.Value, token: "token-" + authzID, status: "pending"}
+		order.hosts = append(order.hosts, identifier.Value)
+		order.authzs = append(order.authzs, authzID)
+	}
+	f.orders[id] = order
+	w.Header().Set("Location", f.server.URL+"/order/"+id)
+	w.WriteHeader(http.StatusCreated)
+	f.writeOrder(w, id, order)
+}
+
+func (f *fakeACME) writeOrder(w http.ResponseWriter, id string, order *fakeOrder) {
+	body := acmeOrder{Status: order.status, Finalize: f.server.URL + "/finalize/" + id}
+	for _, authzID := range order.authzs {
+		body.Authorizations = append(body.Authorizations, f.server.URL+"/authz/"+authzID)
+	}
+	if order.cert != "" {
+		body.Certificate = f.server.URL + "/cert/" + order.cert
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+func (f *fakeACME) pollOrder(w http.ResponseWriter, account, id string) {
+	order, ok := f.orders[id]
+	if !ok || order.account != account {
+		f.fail(w, &acmeProblem{Type: "urn:ietf:params:acme:error:unauthorized", Status: http.StatusNotFound})
+		return
+	}
+	switch order.status {
+	case "pending":
+		valid := true
+		for _, authzID := range order.authzs {
+			switch f.authzs[authzID].status {
+			case "invalid":
+				order.status = "invalid"
+			case "pending":
+				valid = false
+			}
+		}
+		if valid && order.status == "pending" {
+			if order.readyAfter > 0 {
+				order.readyAfter--
+				f.pendingPolls++
+			} else {
+				order.status = "ready"
+			}
+		}
+	case "processing":
+		order.status = "valid"
+	}
+	f.writeOrder(w, id, order)
+}
+
+func (f *fakeACME) pollAuthz(w http.ResponseWriter, account, id string) {
+	authz, ok := f.authzs[id]
+	if !ok || authz.account != account {
+		f.fail(w, &acmeProblem{Type: "urn:ietf:params:acme:error:unauthorized", Status: http.StatusNotFound})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":     authz.status,
+		"identifier": acmeIdentifier{Type: "dns", Value: authz.host},
+		"challenges": []map[string]interface{}{
+			{"type": "dns-01", "url": f.server.URL + "/challenge/dns-" + id, "token": "dns-" + authz.token, "status": "pending"},
+			{"type": "http-01", "url": f.server.URL + "/challenge/" + id, "token": authz.token, "status": authz.status, "error": authz.problem},
+		},
+	})
+}
+
+// challenge validates an http-01 challenge by asking the solver for the
+// key authorization, as the CA would over port 80 of the name
+func (f *fakeACME) challenge(w http.ResponseWriter, account, id string) {
+	authz, ok := f.authzs[id]
+	if !ok || authz.account != account {
+		f.fail(w, &acmeProblem{Type: "urn:ietf:params:acme:error:unauthorized", Detail: "only http-01 is answered", Status: http.StatusNotFound})
+		return
+	}
+	thumbprint, err := jwkThumbprint(f.accounts[account])
+	if err != nil {
+		f.internal(w, err)
+		return
+	}
+	want := authz.token + "." + thumbprint
+	if f.answer != "" {
+		want = f.answer
+	}
+
+	rec := httptest.NewRecorder()
+	f.solver.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+authz.host+acmeChallengePath+authz.token, nil))
+	if got := rec.Body.String(); rec.Code == http.StatusOK && got == want {
+		authz.status = "valid"
+	} else {
+		authz.status = "invalid"
+		authz.problem = &acmeProblem{Type: "urn:ietf:params:acme:error:unauthorized", Detail: fmt.Sprintf("%s answered %d %q", authz.host, rec.Code, got)}
+	}
+	json.NewEncoder(w).Encode(map[string]string{"type": "http-01", "status": "processing", "token": authz.token})
+}
+
+func (f *fakeACME) finalize(w http.ResponseWriter, account, id string, payload []byte) {
+	order, ok := f.orders[id]
+	if !ok || order.account != account {
+		f.fail(w, &acmeProblem{Type: "urn:ietf:params:acme:error:unauthorized", Status: http.StatusNotFound})
+		return
+	}
+	if order.status != "ready" {
+		f.fail(w, &acmeProblem{Type: "urn:ietf:params:acme:error:orderNotReady", Detail: "the order is " + order.status, Status: http.StatusForbidden})
+		return
+	}
+	var request struct {
+		CSR string `json:"csr"`
+	}
+	json.Unmarshal(payload, &request)
+	der, err := base64.RawURLEncoding.DecodeString(request.CSR)
+	var csr *x509.CertificateRequest
+	if err == nil {
+		csr, err = x509.ParseCertificateRequest(der)
+	}
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err == nil && !slices.Equal(csr.DNSNames, order.hosts) {
+		err = fmt.Errorf("the CSR is for %v, the order for %v", csr.DNSNames, order.hosts)
+	}
+	if err != nil {
+		f.fail(w, &acmeProblem{Type: "urn:ietf:params:acme:error:badCSR", Detail: err.Error(), Status: http.StatusBadRequest})
+		return
+	}
+
+	template, err := certgen.Template(certgen.Options{Hosts: order.hosts, ValidFor: 90 * 24 * time.Hour}, csr.PublicKey)
+	if err != nil {
+		f.internal(w, err)
+		return
+	}
+	cert, err := certgen.Issue(template, csr.PublicKey, f.ca.Certificate, f.ca.Key, nil)
+	if err != nil {
+		f.internal(w, err)
+		return
+	}
+	order.cert = id
+	f.certs[id] = append(certgen.CertificatePEM(cert), f.ca.CertPEM...)
+	order.status = "processing"
+	f.writeOrder(w, id, order)
+}
+
+// testACMEClient is a client of the fake CA whose challenges it answers
+func testACMEClient(t *testing.T, f *fakeACME) *acmeClient {
+	key, err := certgen.GenerateKey(serverKeyCurve, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newACMEClient(f.directoryURL(), "ops@example.com", key.(*ecdsa.PrivateKey))
+	c.pollInterval = time.Millisecond
+	f.setSolver(c)
+	return c
+}
+
+func TestACMEObtain(t *testing.T) {
+	f := newFakeACME(t)
+	c := testACMEClient(t, f)
+	key, err := certgen.GenerateKey(serverKeyCurve, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hosts := []string{"a.example.com", "b.example.com"}
+	chain, err := c.obtain(hosts, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 {
+		t.Fatalf("got a chain of %d certificates, want the leaf and the CA", len(chain))
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.CheckSignatureFrom(f.ca.Certificate); err != nil {
+		t.Errorf("the leaf isn't signed by the CA: %s", err)
+	}
+	if !slices.Equal(leaf.DNSNames, hosts) {
+		t.Errorf("the certificate is for %v, want %v", leaf.DNSNames, hosts)
+	}
+	if !leaf.PublicKey.(*ecdsa.PublicKey).Equal(key.Public()) {
+		t.Error("the certificate isn't for the key")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rejectNonce {
+		t.Error("the client never retried the nonce the CA rejected")
+	}
+	if f.pendingPolls == 0 {
+		t.Error("the order was never polled while pending, so finalize can't have waited for it to be ready")
+	}
+	if c.accountURL == "" || f.newAccounts != 1 {
+		t.Errorf("account %q, %d accounts created", c.accountURL, f.newAccounts)
+	}
+	if len(c.challenges) != 0 {
+		t.Errorf("the client still answers %d challenges", len(c.challenges))
+	}
+}
+
+func TestACMEChallengeFails(t *testing.T) {
+	f := newFakeACME(t)
+	c := testACMEClient(t, f)
+	f.mu.Lock()
+	f.answer = "someone else's key authorization"
+	f.mu.Unlock()
+	key, err := certgen.GenerateKey(serverKeyCurve, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.obtain([]string{"a.example.com"}, key)
+	if err == nil || !strings.Contains(err.Error(), "a.example.com answered 200") {
+		t.Fatalf("got error %v, want the CA's reason the challenge failed", err)
+	}
+	if len(c.challenges) != 0 {
+		t.Errorf("the client still answers %d challenges after failing", len(c.challenges))
+	}
+}
+
+func TestACMEChallengeHandler(t *testing.T) {
+	c := newACMEClient("", "", nil)
+	c.challenges["token"] = "token.thumbprint"
+	for _, tc := range []struct {
+		url      string
+		code     int
+		body     string
+		location string
+	}{
+		{"http://a.example.com" + acmeChallengePath + "token", http.StatusOK, "token.thumbprint", ""},
+		{"http://a.example.com" + acmeChallengePath + "other", http.StatusNotFound, "", ""},
+		{"http://a.example.com:80/weather/London?unit=C", http.StatusMovedPermanently, "", "https://a.example.com/weather/London?unit=C"},
+	} {
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		if rec.Code != tc.code {
+			t.Errorf("%s: status %d, want %d", tc.url, rec.Code, tc.code)
+		}
+		if tc.body != "" && rec.Body.String() != tc.body {
+			t.Errorf("%s: body %q, want %q", tc.url, rec.Body.String(), tc.body)
+		}
+		if got := rec.Header().Get("Location"); got != tc.location {
+			t.Errorf("%s: redirected to %q, want %q", tc.url, got, tc.location)
+		}
+	}
+}
+
+func TestCertManagerRenewal(t *testing.T) {
+	f := newFakeACME(t)
+	dir := t.TempDir()
+	hosts := []string{"weather.example.com"}
+
+	m, err := newCertManager(hosts, dir, f.directoryURL(), "ops@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.obtained || m.cert.Leaf.CheckSignatureFrom(f.ca.Certificate) == nil {
+		t.Fatal("a self-signed certificate isn't served until the CA has issued one")
+	}
+	m.acme.pollInterval = time.Millisecond
+	f.setSolver(m.acme)
+
+	first, err := m.order()
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewed, err := m.order()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.Leaf.SerialNumber.Cmp(first.Leaf.SerialNumber) == 0 {
+		t.Error("renewing returned the same certificate")
+	}
+	if renewed.PrivateKey.(*ecdsa.PrivateKey).Equal(first.PrivateKey) {
+		t.Error("the renewed certificate has the same key")
+	}
+
+	// A restart serves the stored certificate and orders with the same account
+	restarted, err := newCertManager(hosts, dir, f.directoryURL(), "ops@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.obtained || !restarted.cert.Leaf.Equal(renewed.Leaf) {
+		t.Fatal("after a restart the stored certificate isn't served")
+	}
+	if err := restarted.cert.Leaf.CheckSignatureFrom(f.ca.Certificate); err != nil {
+		t.Errorf("the stored certificate isn't the CA's: %s", err)
+	}
+	restarted.acme.pollInterval = time.Millisecond
+	f.setSolver(restarted.acme)
+	if _, err := restarted.order(); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.newAccounts != 1 {
+		t.Errorf("%d accounts were created, want the account key kept across restarts", f.newAccounts)
+	}
+}
+
+// The fake CA must reject finalizing too early, or TestACMEObtain proves nothing
+func TestFakeACMERejectsEarlyFinalize(t *testing.T) {
+	f := newFakeACME(t)
+	c := testACMEClient(t, f)
+	if err := c.register(); err != nil {
+		t.Fatal(err)
+	}
+	var order acmeOrder
+	if _, _, err := c.post(c.newOrderURL, map[string]interface{}{"identifiers": []acmeIdentifier{{Type: "dns", Value: "a.example.com"}}}, &order); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := c.post(order.Finalize, map[string]string{"csr": ""}, nil)
+	if problem, ok := err.(*acmeProblem); !ok || problem.Type != "urn:ietf:params:acme:error:orderNotReady" {
+		t.Errorf("finalizing a pending order: %v, want orderNotReady", err)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+// With --admin-mtls the admin endpoints move to a listener of their own
+// that only lets in clients with a certificate from the server's own CA.
+// The directory holds that CA and the certificates it issued:
+//
+//	ca.pem, ca-key.pem          the CA
+//	server.pem, server-key.pem  the listener's certificate, for --admin-hosts
+//	client.pem, client-key.pem  a certificate for adminClientName, an admin
+//
+// Whatever is missing or expired is generated at startup, so the first
+// start makes them all and deleting the CA rotates everything. Hand the
+// client certificate to whoever administers the server, for example:
+//
+//	curl --cacert ca.pem --cert client.pem --key client-key.pem https://localhost:8443/admin/cache/stats
+//
+// Client certificates in the RBAC policy work too, if the CA issued them.
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/muthubro/ready-set-go/certgen"
+)
+
+// adminClientName is the common name of the generated client certificate
+const adminClientName = "weather-admin"
+
+// serverKeyCurve is the curve of the keys the server generates for itself
+const serverKeyCurve = "P256"
+
+const adminCAValidFor = 10 * 365 * 24 * time.Hour
+
+// adminKeyPair is a certificate and its key in the admin TLS directory
+type adminKeyPair struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// provisionAdminTLS returns the TLS configuration of the admin listener,
+// first generating whatever of the CA and certificates in dir is missing
+// or expired
+func provisionAdminTLS(dir string, hosts []string) (*tls.Config, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	ca, err := loadAdminKeyPair(dir, "ca")
+	if err != nil {
+		return nil, err
+	}
+	if ca == nil || !ca.cert.IsCA || time.Now().After(ca.cert.NotAfter) {
+		ca, err = generateAdminKeyPair(dir, "ca", certgen.Options{
+			IsCA: true,
+			// Verifiers require a CA to allow the usages of what it issues
+			Usage:    certgen.UsageBoth,
+			Subject:  pkix.Name{CommonName: "weather admin CA"},
+			ValidFor: adminCAValidFor,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	server, err := provisionAdminCert(dir, "server", ca, certgen.Options{Hosts: hosts})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := provisionAdminCert(dir, "client", ca, certgen.Options{
+		Usage:   certgen.UsageClient,
+		Subject: pkix.Name{CommonName: adminClientName},
+	}); err != nil {
+		return nil, err
+	}
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{server.cert.Raw},
+			PrivateKey:  server.key,
+			Leaf:        server.cert,
+		}},
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+// provisionAdminCert loads the certificate name from dir, or has ca issue
+// a new one as opts describe if it is missing, expired or from another CA
+func provisionAdminCert(dir, name string, ca *adminKeyPair, opts certgen.Options) (*adminKeyPair, error) {
+	pair, err := loadAdminKeyPair(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	if pair != nil && time.Now().Before(pair.cert.NotAfter) && pair.cert.CheckSignatureFrom(ca.cert) == nil {
+		return pair, nil
+	}
+	opts.Parent, opts.ParentKey = ca.cert, ca.key
+	return generateAdminKeyPair(dir, name, opts)
+}
+
+// loadAdminKeyPair reads name.pem and name-key.pem from dir. It returns nil
+// if either is missing.
+func loadAdminKeyPair(dir, name string) (*adminKeyPair, error) {
+	certPath, keyPath := adminKeyPairPaths(dir, name)
+	certPEM, err := os.ReadFile(certPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s: no certificate found", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", certPath, err)
+	}
+	key, err := certgen.ParsePrivateKeyPEM(keyPEM, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", keyPath, err)
+	}
+	return &adminKeyPair{cert: cert, key: key}, nil
+}
+
+// generateAdminKeyPair generates a certificate and key as opts describe
+// and writes them as name.pem and name-key.pem in dir
+func generateAdminKeyPair(dir, name string, opts certgen.Options) (*adminKeyPair, error) {
+	opts.ECDSACurve = serverKeyCurve
+	bundle, err := certgen.Generate(opts)
+	if err != nil {
+		return nil, fmt.Errorf("%s certificate: %s", name, err)
+	}
+	certPath, keyPath := adminKeyPairPaths(dir, name)
+	if err := os.WriteFile(keyPath, bundle.KeyPEM, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(certPath, bundle.CertPEM, 0644); err != nil {
+		return nil, err
+	}
+	log.Printf("Admin TLS: generated %s, valid until %s", certPath, bundle.Certificate.NotAfter.UTC().Format(time.RFC3339))
+	return &adminKeyPair{cert: bundle.Certificate, key: bundle.Key}, nil
+}
+
+func adminKeyPairPaths(dir, name string) (certPath, keyPath string) {
+	return filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Versions of the /weather API. A version's responses never change once
+// it is released, so clients written against it keep working; new fields
+// go into a new version.
+const (
+	// apiV1 is the original {"city","temp","took"} response, see writeWeatherV1
+	apiV1 = 1
+	// apiV2 adds units, the temperature of each provider and cache
+	// freshness, see writeWeatherV2
+	apiV2 = 2
+
+	latestAPIVersion = apiV2
+)
+
+// apiVersionParam is the Accept parameter choosing the version of an
+// unversioned path, as in Accept: application/json; version=2
+const apiVersionParam = "version"
+
+type apiVersionKey struct{}
+
+// withAPIVersion serves h under /v1/, /v2/ and so on, with the prefix
+// stripped, as well as unversioned. Unversioned requests get the version
+// in their Accept header, or version 1 so that clients from before
+// versioning don't break. h learns the version from apiVersion, and the
+// response says it in API-Version.
+func withAPIVersion(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version, prefix, err := pathAPIVersion(r.URL.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if prefix == "" {
+			w.Header().Add("Vary", "Accept")
+			if version, err = acceptAPIVersion(r); err != nil {
+				http.Error(w, err.Error(), http.StatusNotAcceptable)
+				return
+			}
+		}
+
+		w.Header().Set("API-Version", strconv.Itoa(version))
+		r = r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version))
+		http.StripPrefix(prefix, h).ServeHTTP(w, r)
+	})
+}
+
+// apiVersion is the API version r was made for
+func apiVersion(r *http.Request) int {
+	if version, ok := r.Context().Value(apiVersionKey{}).(int); ok {
+		return version
+	}
+	return apiV1
+}
+
+// pathAPIVersion returns the version a path such as /v2/weather/London
+// starts with and its prefix, /v2. prefix is empty for unversioned paths.
+func pathAPIVersion(path string) (version int, prefix string, err error) {
+	segment, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if len(segment) < 2 || segment[0] != 'v' {
+		return 0, "", nil
+	}
+	version, err = strconv.Atoi(segment[1:])
+	if err != nil {
+		return 0, "", nil
+	}
+	if version < apiV1 || version > latestAPIVersion {
+		return 0, "", unsupportedAPIVersion(segment[1:])
+	}
+	return version, "/" + segment, nil
+}
+
+// acceptAPIVersion returns the version asked for in the Accept header of
+// r, or version 1 if none is
+func acceptAPIVersion(r *http.Request) (int, error) {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		_, params, err := mime.ParseMediaType(accept)
+		if err != nil {
+			continue
+		}
+		if v, ok := params[apiVersionParam]; ok {
+			version, err := strconv.Atoi(v)
+			if err != nil || version < apiV1 || version > latestAPIVersion {
+				return 0, unsupportedAPIVersion(v)
+			}
+			return version, nil
+		}
+	}
+	return apiV1, nil
+}
+
+func unsupportedAPIVersion(version string) error {
+	return fmt.Errorf("unsupported API version %q, want 1 to %d", version, latestAPIVersion)
+}
@@ -0,0 +1,210 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultKeysLimit is the page size of the key listing
+const defaultKeysLimit = 100
+
+type adminHandler struct {
+	lru *LRUCache
+}
+
+// NewAdminHandler returns an http.Handler exposing a JSON admin API for the cache.
+// Paths are relative to where the handler is mounted; use http.StripPrefix
+// to mount it under a prefix such as /admin/cache.
+//
+//	GET    /stats                  cache statistics
+//	GET    /keys?offset=0&limit=100  keys, most recently used first
+//	GET    /keys/{key}             value of a key
+//	DELETE /keys/{key}             delete a key
+//	PUT    /capacity               set the capacity from {"capacity": n}
+//	POST   /flush                  clear the cache
+//	GET    /consistency?repair=1   run CheckConsistency
+//	GET    /entries?format=json    per-entry statistics, see DumpEntries
+func NewAdminHandler(lru *LRUCache) http.Handler {
+	return &adminHandler{lru: lru}
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+
+	switch {
+	case path == "stats":
+		h.allow(w, r, http.MethodGet, h.stats)
+
+	case path == "keys":
+		h.allow(w, r, http.MethodGet, h.keys)
+
+	case strings.HasPrefix(path, "keys/"):
+		key := strings.TrimPrefix(path, "keys/")
+		switch r.Method {
+		case http.MethodGet:
+			h.get(w, key)
+		case http.MethodDelete:
+			h.delete(w, key)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		}
+
+	case path == "capacity":
+		h.allow(w, r, http.MethodPut, h.setCapacity)
+
+	case path == "flush":
+		h.allow(w, r, http.MethodPost, h.flush)
+
+	case path == "consistency":
+		h.allow(w, r, http.MethodGet, h.consistency)
+
+	case path == "entries":
+		h.allow(w, r, http.MethodGet, h.entries)
+
+	default:
+		writeJSONError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (h *adminHandler) allow(w http.ResponseWriter, r *http.Request, method string, fn func(http.ResponseWriter, *http.Request)) {
+	if r.Method != method {
+		methodNotAllowed(w, method)
+		return
+	}
+	fn(w, r)
+}
+
+func (h *adminHandler) stats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write([]byte(h.lru.StatsJSON()))
+}
+
+func (h *adminHandler) keys(w http.ResponseWriter, r *http.Request) {
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultKeysLimit)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	keys := h.lru.Keys()
+	total := len(keys)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys":   keys[offset:end],
+		"offset": offset,
+		"limit":  limit,
+		"total":  total,
+	})
+}
+
+func (h *adminHandler) get(w http.ResponseWriter, key string) {
+	v, ok := h.lru.Get(key)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "key not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"key":   key,
+		"size":  v.Size(),
+		"value": v,
+	})
+}
+
+func (h *adminHandler) delete(w http.ResponseWriter, key string) {
+	if !h.lru.Delete(key) {
+		writeJSONError(w, http.StatusNotFound, "key not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"deleted": key})
+}
+
+func (h *adminHandler) setCapacity(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Capacity *uint64 `json:"capacity"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Capacity == nil {
+		writeJSONError(w, http.StatusBadRequest, `expected {"capacity": n}`)
+		return
+	}
+
+	h.lru.SetCapacity(*body.Capacity)
+	h.stats(w, r)
+}
+
+func (h *adminHandler) flush(w http.ResponseWriter, r *http.Request) {
+	h.lru.Clear()
+	h.stats(w, r)
+}
+
+func (h *adminHandler) consistency(w http.ResponseWriter, r *http.Request) {
+	repair := r.URL.Query().Get("repair")
+	err := h.lru.CheckConsistency(repair == "1" || repair == "true")
+	if err == nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"consistent": true})
+		return
+	}
+
+	report := err.(*InconsistencyError)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"consistent": false,
+		"problems":   report.Problems,
+		"repaired":   report.Repaired,
+	})
+}
+
+func (h *adminHandler) entries(w http.ResponseWriter, r *http.Request) {
+	format := DumpFormat(r.URL.Query().Get("format"))
+	switch format {
+	case "", DumpJSON:
+		format = DumpJSON
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	case DumpCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	default:
+		writeJSONError(w, http.StatusBadRequest, "format must be csv or json")
+		return
+	}
+	h.lru.DumpEntries(w, format)
+}
+
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+	return n, nil
+}
+
+func methodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
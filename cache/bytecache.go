@@ -0,0 +1,51 @@
+package cache
+
+import "time"
+
+// ByteCache is an LRUCache of byte slices, for the common case of caching
+// raw bytes without writing a Value type. Each entry counts its length
+// towards the capacity, so the capacity is in bytes.
+//
+// Slices are copied when set and when read, so callers may reuse or
+// change them freely.
+type ByteCache struct {
+	lru *LRUCache
+}
+
+// NewByteCache creates a ByteCache holding up to capacity bytes.
+// The options are those of NewLRUCache; copy-on-read is always enabled.
+func NewByteCache(capacity uint64, opts ...Option) *ByteCache {
+	opts = append(opts, WithCopyOnRead())
+	return &ByteCache{lru: NewLRUCache(capacity, opts...)}
+}
+
+// Get returns the bytes cached for key
+func (c *ByteCache) Get(key string) ([]byte, bool) {
+	v, ok := c.lru.Get(key)
+	if !ok {
+		return nil, false
+	}
+	b, ok := v.(Bytes)
+	return b, ok
+}
+
+// Set caches value for key
+func (c *ByteCache) Set(key string, value []byte) {
+	c.lru.Set(key, Bytes(value))
+}
+
+// SetWithTTL caches value for key for ttl, see LRUCache.SetWithTTL
+func (c *ByteCache) SetWithTTL(key string, value []byte, ttl time.Duration) {
+	c.lru.SetWithTTL(key, Bytes(value), ttl)
+}
+
+// Delete deletes the entry for key
+func (c *ByteCache) Delete(key string) bool {
+	return c.lru.Delete(key)
+}
+
+// LRU returns the underlying cache, for stats, snapshots and the other
+// operations ByteCache doesn't wrap
+func (c *ByteCache) LRU() *LRUCache {
+	return c.lru
+}
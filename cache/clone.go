@@ -0,0 +1,18 @@
+package cache
+
+// Cloner is implemented by mutable values that can make a deep copy of
+// themselves. See WithCopyOnRead.
+type Cloner interface {
+	Clone() Value
+}
+
+// copyValue returns a copy of v if copy-on-read is enabled and v supports it
+func (lru *LRUCache) copyValue(v Value) Value {
+	if !lru.copyOnRead {
+		return v
+	}
+	if c, ok := v.(Cloner); ok {
+		return c.Clone()
+	}
+	return v
+}
@@ -0,0 +1,34 @@
+package cache
+
+// Close shuts the cache down: it stops the background refresh workers and
+// the Persister attached with NewPersister, which takes a final snapshot.
+// It returns the error of that snapshot, if any.
+//
+// After Close, reads miss, changes to the cache are ignored, and methods
+// that return an error return ErrCacheClosed. Stats, Keys, Items and
+// snapshots keep working, so the final contents can still be inspected.
+// Close is safe to call more than once; later calls do nothing.
+func (lru *LRUCache) Close() error {
+	lru.lock()
+	if lru.closed {
+		lru.unlock()
+		return nil
+	}
+	lru.closed = true
+	p := lru.persister
+	lru.unlock()
+
+	lru.StopRefresh()
+	if p != nil {
+		return p.Stop()
+	}
+	return nil
+}
+
+// isClosed reports whether Close has been called
+func (lru *LRUCache) isClosed() bool {
+	lru.lock()
+	defer lru.unlock()
+
+	return lru.closed
+}
@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+)
+
+// InconsistencyError lists the problems found by CheckConsistency
+type InconsistencyError struct {
+	Problems []string
+
+	// Repaired is set when the problems were fixed
+	Repaired bool
+}
+
+func (e *InconsistencyError) Error() string {
+	return fmt.Sprintf("cache: inconsistent state: %s", strings.Join(e.Problems, "; "))
+}
+
+// CheckConsistency verifies that the hash table and the LRU list agree,
+// that the recorded entry sizes and the total size match the values,
+// that the size is within capacity and that the list is ordered by access time.
+// It returns an *InconsistencyError describing any problems found.
+// If repair is set, the table is rebuilt from the list, sizes are recomputed
+// and entries are evicted down to capacity. Ordering problems are only reported.
+func (lru *LRUCache) CheckConsistency(repair bool) error {
+	lru.lock()
+	defer lru.unlock()
+
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if len(lru.table) != lru.list.Len() {
+		report("table has %d entries but list has %d", len(lru.table), lru.list.Len())
+	}
+
+	var total uint64
+	var prev *entry
+	seen := make(map[string]bool, lru.list.Len())
+	for element := lru.list.Front(); element != nil; element = element.Next() {
+		e := element.Value.(*entry)
+
+		if seen[e.key] {
+			report("key %q is listed more than once", e.key)
+		}
+		seen[e.key] = true
+
+		if lru.table[e.key] != element {
+			report("table entry for %q doesn't point at its list element", e.key)
+		}
+		if actual := e.value.Size(); actual != e.size {
+			report("entry %q records size %d but its value has size %d", e.key, e.size, actual)
+		}
+		if prev != nil && e.timeAccessed.After(prev.timeAccessed) {
+			report("entry %q was accessed after %q but is listed behind it", e.key, prev.key)
+		}
+
+		total += uint64(e.size)
+		prev = e
+	}
+	for key := range lru.table {
+		if !seen[key] {
+			report("table key %q is not in the list", key)
+		}
+	}
+
+	if total != lru.size {
+		report("recorded size is %d but entries add up to %d", lru.size, total)
+	}
+	if lru.size > lru.capacity {
+		report("size %d exceeds capacity %d", lru.size, lru.capacity)
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	if repair {
+		lru.repair()
+	}
+	return &InconsistencyError{Problems: problems, Repaired: repair}
+}
+
+// repair rebuilds the table, tag index and size accounting from the list
+func (lru *LRUCache) repair() {
+	lru.table = make(map[string]*list.Element, lru.list.Len())
+	lru.tags = make(map[string]map[string]struct{})
+	lru.size = 0
+
+	var next *list.Element
+	for element := lru.list.Front(); element != nil; element = next {
+		next = element.Next()
+		e := element.Value.(*entry)
+
+		if lru.table[e.key] != nil {
+			lru.list.Remove(element)
+			continue
+		}
+		e.size = e.value.Size()
+		lru.table[e.key] = element
+		lru.tag(e)
+		lru.size += uint64(e.size)
+	}
+
+	lru.dropView()
+	lru.markModified()
+	lru.checkCapacity()
+}
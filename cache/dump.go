@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// DumpFormat is the output format of DumpEntries
+type DumpFormat string
+
+// Formats supported by DumpEntries
+const (
+	DumpCSV  DumpFormat = "csv"
+	DumpJSON DumpFormat = "json"
+)
+
+// EntryStats describes a single cache entry
+type EntryStats struct {
+	Key      string   `json:"key"`
+	Size     int      `json:"size"`
+	Age      float64  `json:"age_seconds"`
+	Accesses uint64   `json:"accesses"`
+	TTL      *float64 `json:"ttl_seconds"`
+}
+
+// EntryStats returns the statistics of every entry, most recently used first.
+// Age is the time since the value was set, TTL is the remaining lifetime
+// and is nil for entries that don't expire.
+func (lru *LRUCache) EntryStats() []EntryStats {
+	lru.lock()
+	defer lru.unlock()
+
+	now := time.Now()
+	stats := make([]EntryStats, 0, lru.list.Len())
+	for element := lru.list.Front(); element != nil; element = element.Next() {
+		e := element.Value.(*entry)
+		if e.expired(now) {
+			continue
+		}
+
+		s := EntryStats{
+			Key:      e.key,
+			Size:     e.size,
+			Age:      now.Sub(e.timeSet).Seconds(),
+			Accesses: e.accesses,
+		}
+		if !e.expires.IsZero() {
+			ttl := e.expires.Sub(now).Seconds()
+			s.TTL = &ttl
+		}
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// DumpEntries writes the statistics of every entry to w, either as CSV
+// with a header row or as one JSON object per line.
+// The entries are copied first, so the cache isn't locked while writing.
+func (lru *LRUCache) DumpEntries(w io.Writer, format DumpFormat) error {
+	stats := lru.EntryStats()
+
+	switch format {
+	case DumpCSV:
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"key", "size", "age_seconds", "accesses", "ttl_seconds"})
+		for _, s := range stats {
+			ttl := ""
+			if s.TTL != nil {
+				ttl = strconv.FormatFloat(*s.TTL, 'f', 3, 64)
+			}
+			cw.Write([]string{
+				s.Key,
+				strconv.Itoa(s.Size),
+				strconv.FormatFloat(s.Age, 'f', 3, 64),
+				strconv.FormatUint(s.Accesses, 10),
+				ttl,
+			})
+		}
+		cw.Flush()
+		return cw.Error()
+
+	case DumpJSON:
+		encoder := json.NewEncoder(w)
+		for _, s := range stats {
+			if err := encoder.Encode(s); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("cache: unknown dump format %q", format)
+	}
+}
@@ -0,0 +1,29 @@
+package cache
+
+import "errors"
+
+// Errors returned by cache operations, to be tested with errors.Is.
+// Errors wrapping them add the key or the underlying error.
+var (
+	// ErrEntryTooLarge means a value is larger than the whole cache
+	// capacity, so it can't be kept
+	ErrEntryTooLarge = errors.New("cache: entry larger than the cache capacity")
+
+	// ErrCacheClosed means the cache has been closed
+	ErrCacheClosed = errors.New("cache: closed")
+
+	// ErrLoaderFailed means a Loader returned an error, which is wrapped too
+	ErrLoaderFailed = errors.New("cache: loader failed")
+
+	// ErrSnapshotCorrupt means a snapshot couldn't be decoded. The decoding
+	// error is wrapped too.
+	ErrSnapshotCorrupt = errors.New("cache: snapshot corrupt")
+
+	// ErrInvalidNamespace means a namespace name contains the separator
+	// of namespaces and keys
+	ErrInvalidNamespace = errors.New("cache: invalid namespace name")
+
+	// ErrRefreshStopped means StopRefresh has been called, so refreshers
+	// can't be registered any more
+	ErrRefreshStopped = errors.New("cache: refresh stopped")
+)
@@ -0,0 +1,82 @@
+package cache
+
+import "time"
+
+// EntryInfo describes a cache entry to a hook
+type EntryInfo struct {
+	Key     string
+	Size    int
+	Expires time.Time
+	Tags    []string
+}
+
+// Hooks are functions called on cache operations, for logging, tracing
+// or telling other instances to invalidate a key. Any of them may be nil.
+//
+// Hooks are called after the cache lock has been released, so they may
+// use the cache, but hooks for concurrent operations may run concurrently
+// and in any order.
+type Hooks struct {
+	// OnHit is called when Get or Lookup finds a value
+	OnHit func(e EntryInfo)
+	// OnMiss is called when Get or Lookup finds no value, including for
+	// keys cached with SetNegative
+	OnMiss func(key string)
+	// OnSet is called whenever an entry is written: by the Set methods,
+	// SetNegative, Update, LoadItems and filling a miss from the store
+	OnSet func(e EntryInfo)
+	// OnEvict is called when an entry is dropped to stay within capacity.
+	// It is not called for deleted, expired or cleared entries.
+	OnEvict func(e EntryInfo)
+}
+
+// WithHooks sets functions to be called on cache operations
+func WithHooks(hooks Hooks) Option {
+	return func(lru *LRUCache) {
+		lru.hooks = hooks
+	}
+}
+
+// hookEvent is an OnSet or OnEvict call waiting for the lock to be released
+type hookEvent struct {
+	evict bool
+	info  EntryInfo
+}
+
+func (e *entry) info() EntryInfo {
+	info := EntryInfo{Key: e.key, Size: e.size, Expires: e.expires}
+	if len(e.tags) > 0 {
+		info.Tags = append([]string(nil), e.tags...)
+	}
+	return info
+}
+
+// queueSet queues the OnSet hook for e, if there is one
+func (lru *LRUCache) queueSet(e *entry) {
+	if lru.hooks.OnSet != nil {
+		lru.hookEvents = append(lru.hookEvents, hookEvent{info: e.info()})
+	}
+}
+
+// queueEvict queues the OnEvict hook for e, if there is one
+func (lru *LRUCache) queueEvict(e *entry) {
+	if lru.hooks.OnEvict != nil {
+		lru.hookEvents = append(lru.hookEvents, hookEvent{evict: true, info: e.info()})
+	}
+}
+
+// unlock releases the cache lock, then calls the hooks queued while it
+// was held
+func (lru *LRUCache) unlock() {
+	events := lru.hookEvents
+	lru.hookEvents = nil
+	lru.mu.Unlock()
+
+	for _, event := range events {
+		if event.evict {
+			lru.hooks.OnEvict(event.info)
+		} else {
+			lru.hooks.OnSet(event.info)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package cache
+
+import "sync"
+
+// keyLocks hands out one mutex per key, creating it on first use and
+// dropping it once no goroutine holds or waits for it
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// LockKey locks the given key, blocking until it is available.
+// Key locks are independent of the cache lock and of each other, so callers
+// can serialize a multi-step update for one key (e.g. Get, recompute, Set)
+// without blocking other keys or other cache operations.
+// Every LockKey must be paired with an UnlockKey for the same key.
+func (lru *LRUCache) LockKey(key string) {
+	locks := &lru.keyLocks
+
+	locks.mu.Lock()
+	l := locks.locks[key]
+	if l == nil {
+		l = &keyLock{}
+		locks.locks[key] = l
+	}
+	l.refs++
+	locks.mu.Unlock()
+
+	l.mu.Lock()
+}
+
+// UnlockKey unlocks the given key.
+// It panics if the key is not locked.
+func (lru *LRUCache) UnlockKey(key string) {
+	locks := &lru.keyLocks
+
+	locks.mu.Lock()
+	defer locks.mu.Unlock()
+
+	l := locks.locks[key]
+	if l == nil {
+		panic("cache: UnlockKey of unlocked key " + key)
+	}
+	l.refs--
+	if l.refs == 0 {
+		delete(locks.locks, key)
+	}
+	l.mu.Unlock()
+}
+
+// WithKeyLock runs fn while holding the lock for the given key
+func (lru *LRUCache) WithKeyLock(key string, fn func()) {
+	lru.LockKey(key)
+	defer lru.UnlockKey(key)
+	fn()
+}
@@ -0,0 +1,126 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Loader loads the value for a key missing from the cache
+type Loader func(ctx context.Context, key string) (Value, error)
+
+// loadLimits bounds how many loaders GetOrLoad runs at once, in total and
+// for each key. Semaphores are buffered channels; a nil global semaphore
+// and a perKey of zero mean no limit.
+type loadLimits struct {
+	global chan struct{}
+	perKey int
+
+	mu   sync.Mutex
+	keys map[string]*keySlots
+}
+
+type keySlots struct {
+	slots chan struct{}
+	refs  int
+}
+
+// GetOrLoad returns the value cached for key, or loads it with loader
+// and caches it. Loads are limited by WithLoadLimits: callers over the
+// limit wait for a slot, or give up with ctx.Err() when ctx is done.
+// A caller that waited for a slot on the same key finds the value loaded
+// by the one before it instead of loading it again.
+// Keys cached with SetNegative are loaded like missing keys.
+//
+// Loader errors are returned wrapped with ErrLoaderFailed. A value larger
+// than the cache capacity is returned, but not cached, with
+// ErrEntryTooLarge.
+func (lru *LRUCache) GetOrLoad(ctx context.Context, key string, loader Loader) (Value, error) {
+	if lru.isClosed() {
+		return nil, ErrCacheClosed
+	}
+	if v, ok := lru.Get(key); ok {
+		return v, nil
+	}
+
+	release, err := lru.loads.acquire(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if v, _, result := lru.lookup(key); result == Hit {
+		return v, nil
+	}
+
+	v, err := loader(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q: %w", ErrLoaderFailed, key, err)
+	}
+	if lru.tooLarge(v) {
+		return v, fmt.Errorf("%w: %q", ErrEntryTooLarge, key)
+	}
+	lru.Set(key, v)
+	return v, nil
+}
+
+// acquire waits for a slot for key, then for a global slot.
+// The returned function gives both back.
+func (l *loadLimits) acquire(ctx context.Context, key string) (release func(), err error) {
+	var ks *keySlots
+	if l.perKey > 0 {
+		l.mu.Lock()
+		if l.keys == nil {
+			l.keys = make(map[string]*keySlots)
+		}
+		ks = l.keys[key]
+		if ks == nil {
+			ks = &keySlots{slots: make(chan struct{}, l.perKey)}
+			l.keys[key] = ks
+		}
+		ks.refs++
+		l.mu.Unlock()
+
+		select {
+		case ks.slots <- struct{}{}:
+		case <-ctx.Done():
+			l.releaseKey(key, ks, false)
+			return nil, ctx.Err()
+		}
+	}
+
+	if l.global != nil {
+		select {
+		case l.global <- struct{}{}:
+		case <-ctx.Done():
+			l.releaseKey(key, ks, true)
+			return nil, ctx.Err()
+		}
+	}
+
+	return func() {
+		if l.global != nil {
+			<-l.global
+		}
+		l.releaseKey(key, ks, true)
+	}, nil
+}
+
+// releaseKey drops a reference to the slots of key, giving back a slot if
+// one was taken, and forgets the key once nobody uses it
+func (l *loadLimits) releaseKey(key string, ks *keySlots, taken bool) {
+	if ks == nil {
+		return
+	}
+	if taken {
+		<-ks.slots
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ks.refs--
+	if ks.refs == 0 {
+		delete(l.keys, key)
+	}
+}
@@ -12,6 +12,8 @@ import (
 
 // LRUCache represents an LRU Cache object
 type LRUCache struct {
+	// mu guards everything below; take it with lock and release it with
+	// unlock
 	mu sync.Mutex
 
 	list  *list.List
@@ -20,6 +22,55 @@ type LRUCache struct {
 	size uint64
 
 	capacity uint64
+
+	// Eviction starts when the size is over highWater of the capacity
+	// and goes on until it is down to lowWater of it
+	highWater, lowWater float64
+
+	// view is the FrozenView kept up to date by every write once one has
+	// been asked for. viewShared is set while callers may hold it, so the
+	// next write copies it first.
+	view       *FrozenView
+	viewShared bool
+
+	// mutations counts changes to the cache contents
+	mutations uint64
+	// promotions counts the entries put at the front of the list
+	promotions uint64
+
+	keyLocks keyLocks
+
+	// tags maps each tag to the keys of the entries carrying it
+	tags map[string]map[string]struct{}
+
+	namespaces map[string]*Namespace
+
+	// hits and misses count Lookups and are updated atomically;
+	// evictions counts entries dropped to stay within capacity
+	hits      uint64
+	misses    uint64
+	evictions uint64
+
+	negativeTTL time.Duration
+
+	copyOnRead bool
+
+	store        Store
+	storeErrorFn func(op, key string, err error)
+
+	hooks Hooks
+	// hookEvents are the hooks to call once the lock is released
+	hookEvents []hookEvent
+
+	// refresher is set by the first RegisterRefresher
+	refresher      *refresher
+	refreshWorkers int
+
+	loads loadLimits
+
+	// persister is the Persister snapshotting the cache, stopped by Close
+	persister *Persister
+	closed    bool
 }
 
 // Value gives a basic interface for a cache value
@@ -31,6 +82,11 @@ type Value interface {
 type Item struct {
 	Key   string
 	Value Value
+
+	// Expires is when the item expires, zero if it never does
+	Expires time.Time
+
+	Tags []string
 }
 
 type entry struct {
@@ -38,83 +94,261 @@ type entry struct {
 	value        Value
 	size         int
 	timeAccessed time.Time
+
+	// timeSet is when the value was last written
+	timeSet time.Time
+	// writes counts the times the value was replaced, so a refresh can
+	// tell whether it was set while loading
+	writes uint64
+	// expires is zero for entries without a TTL
+	expires  time.Time
+	accesses uint64
+	tags     []string
+	// promoted is the cache's promotions when the entry was last put at
+	// the front
+	promoted uint64
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
 }
 
 // NewLRUCache creates a new LRU Cache
-func NewLRUCache(capacity uint64) *LRUCache {
-	return &LRUCache{
+func NewLRUCache(capacity uint64, opts ...Option) *LRUCache {
+	lru := &LRUCache{
 		list:     list.New(),
 		table:    make(map[string]*list.Element),
 		capacity: capacity,
+		keyLocks: keyLocks{locks: make(map[string]*keyLock)},
+		tags:     make(map[string]map[string]struct{}),
+
+		highWater:      1,
+		lowWater:       1,
+		negativeTTL:    defaultNegativeTTL,
+		refreshWorkers: defaultRefreshWorkers,
+	}
+	for _, opt := range opts {
+		opt(lru)
 	}
+	return lru
 }
 
-// Get returns the value in the cache corresponding to the given key
+// Get returns the value in the cache corresponding to the given key.
+// With a backing store, a miss is read through from the store.
+// Keys cached with SetNegative are reported as misses.
 func (lru *LRUCache) Get(key string) (v Value, ok bool) {
-	lru.mu.Lock()
-	defer lru.mu.Unlock()
+	if v, result := lru.Lookup(key); result == Hit {
+		return v, true
+	}
+	return nil, false
+}
+
+// get moves the entry to the front, unless it is already near it.
+// info.Tags is only filled in if there is an OnHit hook.
+func (lru *LRUCache) get(key string) (v Value, info EntryInfo, ok bool) {
+	lru.lock()
+	defer lru.unlock()
 
 	element := lru.table[key]
-	if element == nil {
-		return nil, false
+	if element == nil || lru.closed {
+		return nil, info, false
 	}
-	lru.moveToFront(element)
-	return element.Value.(*entry).value, true
+	e := element.Value.(*entry)
+	// Reading the clock is a large part of a hit, so it is only read for
+	// entries that need it
+	var now time.Time
+	if !e.expires.IsZero() || lru.refresher != nil {
+		now = time.Now()
+	}
+	if e.expired(now) {
+		lru.removeElement(element)
+		return nil, info, false
+	}
+	if !lru.nearFront(e) {
+		lru.moveToFront(element)
+	}
+	e.accesses++
+	v = lru.copyValue(e.value)
+	info = EntryInfo{Key: key, Size: e.size, Expires: e.expires}
+	if lru.hooks.OnHit != nil {
+		info = e.info()
+	}
+	if lru.refresher != nil && e.needsRefresh(now) {
+		lru.queueRefresh(key)
+	}
+	return v, info, true
 }
 
 // Set creates a new cache entry if it doesn't exist.
-// If it exists, moves it to the front
+// If it exists, updates its value and moves it to the front.
+// With a backing store, the value is written through to the store first
+// and the cache is left unchanged if that fails.
 func (lru *LRUCache) Set(key string, value Value) {
-	lru.mu.Lock()
-	defer lru.mu.Unlock()
+	lru.SetWithTTL(key, value, 0)
+}
+
+// SetWithTTL is like Set, but the entry expires after ttl.
+// A ttl of zero or less means the entry never expires.
+func (lru *LRUCache) SetWithTTL(key string, value Value, ttl time.Duration) {
+	lru.SetWithTags(key, value, ttl)
+}
 
+// SetWithTags is like SetWithTTL, and also tags the entry so it can be
+// dropped together with other entries by InvalidateTag.
+// Setting an existing entry replaces its tags.
+func (lru *LRUCache) SetWithTags(key string, value Value, ttl time.Duration, tags ...string) {
+	if lru.isClosed() || !lru.writeThrough(key, value) {
+		return
+	}
+
+	value = lru.copyValue(value)
+	if len(tags) > 0 {
+		tags = append([]string(nil), tags...)
+	}
+
+	lru.lock()
+	defer lru.unlock()
+
+	if lru.closed {
+		return
+	}
+	expires := expiryFor(ttl)
 	if element := lru.table[key]; element != nil {
-		lru.moveToFront(element)
+		lru.updateInplace(element, value, expires, tags)
 	} else {
-		lru.addNew(key, value)
+		lru.addNew(key, value, expires, tags)
+	}
+}
+
+// GetWithExpiry is like Get, and also returns the remaining lifetime of
+// the entry. ttl is zero for entries that never expire.
+func (lru *LRUCache) GetWithExpiry(key string) (v Value, ttl time.Duration, ok bool) {
+	v, info, result := lru.lookupCounted(key)
+	if result != Hit {
+		return nil, 0, false
+	}
+	if !info.Expires.IsZero() {
+		if ttl = time.Until(info.Expires); ttl <= 0 {
+			// It expired just after being read; don't report it as never expiring
+			ttl = time.Nanosecond
+		}
+	}
+	return v, ttl, true
+}
+
+// Touch sets the entry for key to expire ttl from now without changing
+// its value, and moves it to the front. A ttl of zero or less means the
+// entry never expires. Touch reports whether there was such an entry.
+func (lru *LRUCache) Touch(key string, ttl time.Duration) bool {
+	lru.lock()
+	defer lru.unlock()
+
+	element := lru.table[key]
+	if element == nil || lru.closed {
+		return false
+	}
+	e := element.Value.(*entry)
+	if e.expired(time.Now()) {
+		lru.removeElement(element)
+		return false
+	}
+	e.expires = expiryFor(ttl)
+	lru.viewSet(e)
+	lru.markModified()
+	lru.moveToFront(element)
+	return true
+}
+
+// TTL returns the remaining lifetime of the entry for key without
+// affecting the LRU order. ttl is zero for entries that never expire
+// and ok is false if there is no such entry.
+func (lru *LRUCache) TTL(key string) (ttl time.Duration, ok bool) {
+	lru.lock()
+	defer lru.unlock()
+
+	element := lru.table[key]
+	if element == nil {
+		return 0, false
+	}
+	e := element.Value.(*entry)
+	now := time.Now()
+	if e.expired(now) {
+		return 0, false
 	}
+	if e.expires.IsZero() {
+		return 0, true
+	}
+	return e.expires.Sub(now), true
 }
 
 // SetIfAbsent creates a new cache entry only if it doesn't exist.
+// With a backing store, a new entry is written through to the store.
 func (lru *LRUCache) SetIfAbsent(key string, value Value) {
-	lru.mu.Lock()
-	defer lru.mu.Unlock()
+	lru.lock()
+	exists := lru.table[key] != nil
+	closed := lru.closed
+	lru.unlock()
+	if exists || closed {
+		return
+	}
 
-	if element := lru.table[key]; element == nil {
-		lru.addNew(key, value)
+	if !lru.writeThrough(key, value) {
+		return
+	}
+	value = lru.copyValue(value)
+
+	lru.lock()
+	defer lru.unlock()
+
+	if element := lru.table[key]; element == nil && !lru.closed {
+		lru.addNew(key, value, time.Time{}, nil)
 	}
 }
 
-// Delete deletes the cache entry corresponding to the key
+// Delete deletes the cache entry corresponding to the key.
+// With a backing store, the key is deleted from the store as well.
 func (lru *LRUCache) Delete(key string) bool {
-	lru.mu.Lock()
-	defer lru.mu.Unlock()
+	if lru.isClosed() {
+		return false
+	}
+	if lru.store != nil {
+		if err := lru.store.Delete(key); err != nil {
+			lru.storeError("delete", key, err)
+		}
+	}
+
+	lru.lock()
+	defer lru.unlock()
 
 	element := lru.table[key]
 	if element == nil {
 		return false
 	}
 
-	lru.list.Remove(element)
-	delete(lru.table, key)
-	lru.size -= uint64(element.Value.(*entry).size)
+	lru.removeElement(element)
 	return true
 }
 
-// Clear clears the cache
+// Clear clears the cache. The backing store, if any, is left untouched.
 func (lru *LRUCache) Clear() {
-	lru.mu.Lock()
-	defer lru.mu.Unlock()
+	lru.lock()
+	defer lru.unlock()
 
+	if lru.closed {
+		return
+	}
 	lru.list.Init()
 	lru.table = make(map[string]*list.Element)
+	lru.tags = make(map[string]map[string]struct{})
 	lru.size = 0
+	lru.dropView()
+	lru.markModified()
 }
 
 // SetCapacity sets the cache capacity
 func (lru *LRUCache) SetCapacity(capacity uint64) {
-	lru.mu.Lock()
-	defer lru.mu.Unlock()
+	lru.lock()
+	defer lru.unlock()
 
 	lru.capacity = capacity
 	lru.checkCapacity()
@@ -122,8 +356,8 @@ func (lru *LRUCache) SetCapacity(capacity uint64) {
 
 // Stats returns some information about the cache
 func (lru *LRUCache) Stats() (length, size, capacity uint64, oldest time.Time) {
-	lru.mu.Lock()
-	defer lru.mu.Unlock()
+	lru.lock()
+	defer lru.unlock()
 
 	if lastElem := lru.list.Back(); lastElem != nil {
 		oldest = lastElem.Value.(*entry).timeAccessed
@@ -146,63 +380,80 @@ func (lru *LRUCache) StatsJSON() string {
 
 // Keys returns all keys in the cache
 func (lru *LRUCache) Keys() []string {
-	lru.mu.Lock()
-	defer lru.mu.Unlock()
+	lru.lock()
+	defer lru.unlock()
 
+	now := time.Now()
 	keys := make([]string, 0, lru.list.Len())
 	for element := lru.list.Front(); element != nil; element = element.Next() {
-		keys = append(keys, element.Value.(*entry).key)
+		if v := element.Value.(*entry); !v.expired(now) {
+			keys = append(keys, v.key)
+		}
 	}
 	return keys
 }
 
 // Items returns all items in the cache
 func (lru *LRUCache) Items() []Item {
-	lru.mu.Lock()
-	defer lru.mu.Unlock()
+	lru.lock()
+	defer lru.unlock()
 
+	now := time.Now()
 	items := make([]Item, 0, lru.list.Len())
 	for element := lru.list.Front(); element != nil; element = element.Next() {
-		v := element.Value.(*entry)
-		items = append(items, Item{Key: v.key, Value: v.value})
+		if v := element.Value.(*entry); !v.expired(now) {
+			items = append(items, Item{Key: v.key, Value: lru.copyValue(v.value), Expires: v.expires, Tags: v.tags})
+		}
 	}
 	return items
 }
 
-// SaveItems saves the cache items by transmitting to an io.Writer
+// SaveItems saves the cache items by transmitting to an io.Writer.
+// The values are gob-encoded, so their types must have been registered
+// with RegisterValue.
 func (lru *LRUCache) SaveItems(w io.Writer) error {
 	items := lru.Items()
 	encoder := gob.NewEncoder(w)
 	return encoder.Encode(items)
 }
 
-// SaveItemsToFile saves the cache items in a file
+// SaveItemsToFile saves the cache items in a file.
+// The snapshot is written to a temporary file and renamed over path,
+// so a crash mid-write never leaves a truncated snapshot behind.
 func (lru *LRUCache) SaveItemsToFile(path string) error {
-	if writer, err := os.OpenFile(
-		path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644); err != nil {
-		return err
-	} else {
-		defer writer.Close()
-		return lru.SaveItems(writer)
-	}
+	return lru.SaveItemsToFileRotated(path, 0)
 }
 
-// LoadItems loads cache items from io.Reader
+// LoadItems loads cache items from io.Reader, keeping the order in which
+// they were last used, ahead of the entries already in the cache.
+// If the snapshot can't be decoded the cache is left unchanged and the
+// error wraps ErrSnapshotCorrupt.
 func (lru *LRUCache) LoadItems(r io.Reader) error {
 	items := make([]Item, 0)
 	decoder := gob.NewDecoder(r)
 	if err := decoder.Decode(&items); err != nil {
-		return err
+		return fmt.Errorf("%w: %w", ErrSnapshotCorrupt, err)
 	}
 
-	lru.mu.Lock()
-	defer lru.mu.Unlock()
+	lru.lock()
+	defer lru.unlock()
 
-	for _, item := range items {
+	if lru.closed {
+		return ErrCacheClosed
+	}
+	now := time.Now()
+	// Items are saved most recently used first, so they are added from the
+	// back to keep that order, and to evict the least recently used ones if
+	// they don't all fit
+	for i := len(items) - 1; i >= 0; i-- {
+		item := items[i]
+		if !item.Expires.IsZero() && !now.Before(item.Expires) {
+			continue
+		}
 		if element := lru.table[item.Key]; element != nil {
-			lru.updateInplace(element, item.Value)
+			lru.updateInplace(element, item.Value, item.Expires, item.Tags)
 		} else {
-			lru.addNew(item.Key, item.Value)
+			lru.addNew(item.Key, item.Value, item.Expires, item.Tags)
 		}
 	}
 
@@ -219,39 +470,126 @@ func (lru *LRUCache) LoadItemsFromFile(path string) error {
 	}
 }
 
-func (lru *LRUCache) updateInplace(element *list.Element, value Value) {
+func (lru *LRUCache) updateInplace(element *list.Element, value Value, expires time.Time, tags []string) {
 	valueSize := value.Size()
 	sizeDiff := valueSize - element.Value.(*entry).size
 
+	lru.untag(element.Value.(*entry))
+	element.Value.(*entry).tags = tags
+	lru.tag(element.Value.(*entry))
+
 	element.Value.(*entry).value = value
 	element.Value.(*entry).size = valueSize
+	element.Value.(*entry).expires = expires
+	element.Value.(*entry).timeSet = time.Now()
+	element.Value.(*entry).writes++
+	lru.queueSet(element.Value.(*entry))
+	lru.viewSet(element.Value.(*entry))
 
 	lru.size += uint64(sizeDiff)
+	lru.markModified()
 	lru.moveToFront(element)
 	lru.checkCapacity()
 }
 
+// lock takes the cache lock; unlock releases it
+func (lru *LRUCache) lock() {
+	lru.mu.Lock()
+}
+
+// markModified records a change to the cache contents
+func (lru *LRUCache) markModified() {
+	lru.mutations++
+}
+
+func (lru *LRUCache) mutationCount() uint64 {
+	lru.lock()
+	defer lru.unlock()
+
+	return lru.mutations
+}
+
 func (lru *LRUCache) moveToFront(element *list.Element) {
 	lru.list.MoveToFront(element)
+	lru.promotions++
+	element.Value.(*entry).promoted = lru.promotions
 	element.Value.(*entry).timeAccessed = time.Now()
 }
 
-func (lru *LRUCache) addNew(key string, value Value) {
-	newEntry := &entry{key, value, value.Size(), time.Now()}
+// promotionWindow sets how near the front an entry must be for Get to
+// leave it there: within the first 1/promotionWindow of the list
+const promotionWindow = 4
+
+// nearFront reports whether e is within the front 1/promotionWindow of the
+// list. Only entries promoted after e can be ahead of it, so it is if there
+// have been few enough promotions since its own. Not moving such entries on
+// every hit saves Get most of its work under the lock on hot keys, and they
+// are still far from being evicted. The list is short enough to keep in
+// exact LRU order until it has promotionWindow entries.
+func (lru *LRUCache) nearFront(e *entry) bool {
+	return lru.promotions-e.promoted < uint64(lru.list.Len()/promotionWindow)
+}
+
+func (lru *LRUCache) addNew(key string, value Value, expires time.Time, tags []string) {
+	now := time.Now()
+	newEntry := &entry{
+		key:          key,
+		value:        value,
+		size:         value.Size(),
+		timeAccessed: now,
+		timeSet:      now,
+		expires:      expires,
+		tags:         tags,
+	}
 	element := lru.list.PushFront(newEntry)
+	lru.promotions++
+	newEntry.promoted = lru.promotions
+	lru.tag(newEntry)
+	lru.queueSet(newEntry)
+	lru.viewSet(newEntry)
 
 	lru.table[key] = element
 	lru.size += uint64(newEntry.size)
+	lru.markModified()
 	lru.checkCapacity()
 }
 
+func (lru *LRUCache) removeElement(element *list.Element) {
+	delValue := element.Value.(*entry)
+
+	lru.list.Remove(element)
+	delete(lru.table, delValue.key)
+	lru.untag(delValue)
+	lru.viewDelete(delValue.key)
+	lru.size -= uint64(delValue.size)
+	lru.markModified()
+}
+
 func (lru *LRUCache) checkCapacity() {
-	for lru.size > lru.capacity {
-		delElem := lru.list.Back()
-		delValue := delElem.Value.(*entry)
+	if lru.size <= uint64(float64(lru.capacity)*lru.highWater) {
+		return
+	}
+	low := uint64(float64(lru.capacity) * lru.lowWater)
+	for lru.size > low {
+		element := lru.list.Back()
+		lru.removeElement(element)
+		lru.evictions++
+		lru.queueEvict(element.Value.(*entry))
+	}
+}
+
+// tooLarge reports whether value can't fit in the cache even when empty
+func (lru *LRUCache) tooLarge(value Value) bool {
+	lru.lock()
+	defer lru.unlock()
+
+	return uint64(value.Size()) > lru.capacity
+}
 
-		lru.list.Remove(delElem)
-		delete(lru.table, delValue.key)
-		lru.size -= uint64(delValue.size)
+// expiryFor returns the expiry time for an entry set now with the given ttl
+func expiryFor(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
 	}
+	return time.Now().Add(ttl)
 }
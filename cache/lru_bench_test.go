@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Run with several GOMAXPROCS to see how the lock behaves under contention:
+//
+//	go test -run '^$' -bench . -cpu 1,4,8 ./cache
+
+const (
+	benchKeys     = 10000
+	benchCapacity = 5000
+)
+
+type benchValue int
+
+func (v benchValue) Size() int {
+	return 1
+}
+
+// benchmarkWorkload runs Gets and Sets from parallel goroutines on
+// random keys, readPercent of them Gets
+func benchmarkWorkload(b *testing.B, readPercent int) {
+	keys := make([]string, benchKeys)
+	for i := range keys {
+		keys[i] = "key-" + strconv.Itoa(i)
+	}
+	lru := NewLRUCache(benchCapacity)
+	for i, key := range keys {
+		lru.Set(key, benchValue(i))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for pb.Next() {
+			key := keys[r.Intn(len(keys))]
+			if r.Intn(100) < readPercent {
+				lru.Get(key)
+			} else {
+				lru.Set(key, benchValue(0))
+			}
+		}
+	})
+}
+
+func BenchmarkReadHeavy(b *testing.B) {
+	benchmarkWorkload(b, 90)
+}
+
+func BenchmarkMixed(b *testing.B) {
+	benchmarkWorkload(b, 50)
+}
+
+func BenchmarkWriteHeavy(b *testing.B) {
+	benchmarkWorkload(b, 10)
+}
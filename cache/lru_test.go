@@ -0,0 +1,288 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestGetPromotesOnlyFarFromFront(t *testing.T) {
+	lru := NewLRUCache(8)
+	for i := 0; i < 8; i++ {
+		lru.Set("k"+strconv.Itoa(i), testValue("v"))
+	}
+
+	// k7 and k6 are in the front quarter and stay where they are
+	lru.Get("k6")
+	if keys := lru.Keys(); keys[0] != "k7" || keys[1] != "k6" {
+		t.Errorf("getting an entry near the front moved it: %v", keys)
+	}
+
+	// k0 is at the back, so it is moved to the front and not evicted next
+	lru.Get("k0")
+	if keys := lru.Keys(); keys[0] != "k0" {
+		t.Errorf("getting the last entry didn't move it to the front: %v", keys)
+	}
+	lru.Set("k8", testValue("v"))
+	if _, ok := lru.Get("k0"); !ok {
+		t.Error("the entry just read was evicted")
+	}
+	if _, ok := lru.Get("k1"); ok {
+		t.Error("the least recently used entry wasn't evicted")
+	}
+	if err := lru.CheckConsistency(false); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetKeepsSmallCachesInOrder(t *testing.T) {
+	lru := NewLRUCache(3)
+	lru.Set("a", testValue("1"))
+	lru.Set("b", testValue("1"))
+	lru.Set("c", testValue("1"))
+	lru.Get("b")
+	if keys := lru.Keys(); !slices.Equal(keys, []string{"b", "c", "a"}) {
+		t.Errorf("keys %v, want exact LRU order [b c a]", keys)
+	}
+}
+
+// checkConsistent fails the test if the cache's table, list and sizes disagree
+func checkConsistent(t *testing.T, lru *LRUCache) {
+	t.Helper()
+	if err := lru.CheckConsistency(false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetAndUpdate(t *testing.T) {
+	lru := NewLRUCache(100)
+	lru.Set("a", testValue("1"))
+	lru.Set("b", testValue("22"))
+	checkConsistent(t, lru)
+
+	lru.Set("a", testValue("4444"))
+	checkConsistent(t, lru)
+	if v, ok := lru.Get("a"); !ok || v != testValue("4444") {
+		t.Errorf("a = %v, %v after updating it", v, ok)
+	}
+	if keys := lru.Keys(); !slices.Equal(keys, []string{"a", "b"}) {
+		t.Errorf("keys %v, want the updated entry first, [a b]", keys)
+	}
+	if length, size, _, _ := lru.Stats(); length != 2 || size != 6 {
+		t.Errorf("%d entries of size %d, want 2 of size 6", length, size)
+	}
+
+	lru.SetIfAbsent("b", testValue("x"))
+	lru.SetIfAbsent("c", testValue("333"))
+	checkConsistent(t, lru)
+	if v, _ := lru.Get("b"); v != testValue("22") {
+		t.Errorf("SetIfAbsent replaced b with %v", v)
+	}
+	if v, _ := lru.Get("c"); v != testValue("333") {
+		t.Errorf("SetIfAbsent didn't set c: %v", v)
+	}
+
+	if !lru.Delete("a") || lru.Delete("a") {
+		t.Error("Delete didn't report deleting a exactly once")
+	}
+	checkConsistent(t, lru)
+	if length, size, _, _ := lru.Stats(); length != 2 || size != 5 {
+		t.Errorf("%d entries of size %d after deleting, want 2 of size 5", length, size)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	lru := NewLRUCache(10)
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		lru.Set(key, testValue("11"))
+	}
+	checkConsistent(t, lru)
+
+	lru.Get("a")
+	lru.Set("f", testValue("11"))
+	checkConsistent(t, lru)
+	if _, ok := lru.Get("b"); ok {
+		t.Error("the least recently used entry wasn't evicted")
+	}
+	if _, ok := lru.Get("a"); !ok {
+		t.Error("an entry read since it was set was evicted before older ones")
+	}
+
+	// Growing an entry evicts others to make room
+	lru.Set("f", testValue("1111111"))
+	checkConsistent(t, lru)
+	if length, size, capacity, _ := lru.Stats(); size > capacity || length != 2 {
+		t.Errorf("%d entries of size %d in a cache of %d after growing one, want 2 fitting", length, size, capacity)
+	}
+
+	lru.SetCapacity(4)
+	checkConsistent(t, lru)
+	if _, size, _, _ := lru.Stats(); size > 4 {
+		t.Errorf("size %d after shrinking the capacity to 4", size)
+	}
+	if m := lru.Metrics(); m.Evictions == 0 {
+		t.Error("no evictions counted")
+	}
+}
+
+func TestTTL(t *testing.T) {
+	lru := NewLRUCache(100)
+	lru.SetWithTTL("short", testValue("1"), 20*time.Millisecond)
+	lru.SetWithTTL("long", testValue("2"), time.Hour)
+	lru.Set("forever", testValue("3"))
+	checkConsistent(t, lru)
+
+	if ttl, ok := lru.TTL("long"); !ok || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("TTL of long is %s, %v", ttl, ok)
+	}
+	if ttl, ok := lru.TTL("forever"); !ok || ttl != 0 {
+		t.Errorf("TTL of an entry without one is %s, %v", ttl, ok)
+	}
+	if !lru.Touch("long", 2*time.Hour) {
+		t.Error("Touch didn't find long")
+	}
+	if ttl, _ := lru.TTL("long"); ttl <= time.Hour {
+		t.Errorf("Touch didn't extend the TTL: %s", ttl)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := lru.Get("short"); ok {
+		t.Error("an expired entry was returned")
+	}
+	checkConsistent(t, lru)
+	if keys := lru.Keys(); slices.Contains(keys, "short") {
+		t.Errorf("the expired entry is still listed: %v", keys)
+	}
+	if _, ok := lru.Get("forever"); !ok {
+		t.Error("an entry without a TTL expired")
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	lru := NewLRUCache(100)
+	namespace := func(name string) *Namespace {
+		t.Helper()
+		ns, err := lru.Namespace(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ns
+	}
+	weather, geo := namespace("weather"), namespace("geo")
+	if namespace("weather") != weather {
+		t.Error("asking for a namespace again made a new one")
+	}
+	if _, err := lru.Namespace("weather:gb"); !errors.Is(err, ErrInvalidNamespace) {
+		t.Errorf("a namespace name with the separator: %v, want ErrInvalidNamespace", err)
+	}
+	weather.Set("London", testValue("1"))
+	weather.Set("Paris", testValue("2"))
+	geo.Set("London", testValue("GB"))
+	lru.Set("London", testValue("top"))
+	checkConsistent(t, lru)
+
+	if v, _ := weather.Get("London"); v != testValue("1") {
+		t.Errorf("weather London = %v", v)
+	}
+	if v, _ := geo.Get("London"); v != testValue("GB") {
+		t.Errorf("geo London = %v", v)
+	}
+	keys := weather.Keys()
+	slices.Sort(keys)
+	if !slices.Equal(keys, []string{"London", "Paris"}) {
+		t.Errorf("weather keys %v", keys)
+	}
+	if stats := weather.Stats(); stats.Length != 2 || stats.Size != 2 {
+		t.Errorf("weather stats %+v", stats)
+	}
+
+	weather.Clear()
+	checkConsistent(t, lru)
+	if keys := weather.Keys(); len(keys) != 0 {
+		t.Errorf("weather still has %v after Clear", keys)
+	}
+	if _, ok := geo.Get("London"); !ok {
+		t.Error("clearing one namespace cleared another")
+	}
+	if _, ok := lru.Get("London"); !ok {
+		t.Error("clearing a namespace cleared a key outside it")
+	}
+}
+
+func TestTags(t *testing.T) {
+	lru := NewLRUCache(100)
+	lru.SetWithTags("a", testValue("1"), 0, "eu", "gb")
+	lru.SetWithTags("b", testValue("1"), 0, "eu")
+	lru.Set("c", testValue("1"))
+	checkConsistent(t, lru)
+
+	// Setting an entry again replaces its tags
+	lru.SetWithTags("a", testValue("1"), 0, "gb")
+	if n := lru.InvalidateTag("eu"); n != 1 {
+		t.Errorf("InvalidateTag dropped %d entries, want only b", n)
+	}
+	checkConsistent(t, lru)
+	if keys := lru.Keys(); !slices.Equal(keys, []string{"a", "c"}) {
+		t.Errorf("keys %v after invalidating eu, want [a c]", keys)
+	}
+}
+
+func TestLoadItems(t *testing.T) {
+	lru := NewLRUCache(100)
+	lru.Set("a", testValue("1"))
+	lru.SetWithTTL("b", testValue("22"), time.Hour)
+	lru.SetWithTags("c", testValue("333"), 0, "t")
+	lru.SetWithTTL("expiring", testValue("4"), 20*time.Millisecond)
+	var snapshot bytes.Buffer
+	if err := lru.SaveItems(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	restored := NewLRUCache(100)
+	restored.Set("a", testValue("old"))
+	restored.Set("d", testValue("kept"))
+	if err := restored.LoadItems(bytes.NewReader(snapshot.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	checkConsistent(t, restored)
+	if keys, want := restored.Keys(), []string{"c", "b", "a", "d"}; !slices.Equal(keys, want) {
+		t.Errorf("keys are %v after loading, want %v in the order they were used", keys, want)
+	}
+	for key, want := range map[string]testValue{"a": "1", "b": "22", "c": "333", "d": "kept"} {
+		if v, ok := restored.Get(key); !ok || v != want {
+			t.Errorf("%s = %v, %v after loading, want %q", key, v, ok, want)
+		}
+	}
+	if _, ok := restored.Get("expiring"); ok {
+		t.Error("an entry that expired since the snapshot was loaded")
+	}
+	if ttl, _ := restored.TTL("b"); ttl <= 59*time.Minute {
+		t.Errorf("the TTL of b wasn't kept: %s", ttl)
+	}
+	if tags := restored.Tags("c"); !slices.Equal(tags, []string{"t"}) {
+		t.Errorf("the tags of c weren't kept: %v", tags)
+	}
+
+	// A smaller cache keeps the most recently used entries
+	small := NewLRUCache(5)
+	if err := small.LoadItems(bytes.NewReader(snapshot.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	checkConsistent(t, small)
+	if keys, want := small.Keys(), []string{"c", "b"}; !slices.Equal(keys, want) {
+		t.Errorf("keys are %v after loading into a smaller cache, want %v", keys, want)
+	}
+
+	before := restored.Keys()
+	if err := restored.LoadItems(bytes.NewReader([]byte("not a snapshot"))); !errors.Is(err, ErrSnapshotCorrupt) {
+		t.Errorf("loading garbage: %v, want ErrSnapshotCorrupt", err)
+	}
+	checkConsistent(t, restored)
+	if !slices.Equal(restored.Keys(), before) {
+		t.Error("a corrupt snapshot changed the cache")
+	}
+}
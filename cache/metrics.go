@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"expvar"
+	"sync/atomic"
+)
+
+// Metrics gives counters and gauges for monitoring a cache
+type Metrics struct {
+	Length   uint64
+	Size     uint64
+	Capacity uint64
+
+	// Hits and Misses count the results of Get and Lookup; a key cached
+	// with SetNegative counts as a miss
+	Hits   uint64
+	Misses uint64
+
+	// Evictions counts entries dropped to stay within capacity
+	Evictions uint64
+}
+
+// HitRatio returns the share of lookups that were hits, 0 if there were none
+func (m Metrics) HitRatio() float64 {
+	if total := m.Hits + m.Misses; total > 0 {
+		return float64(m.Hits) / float64(total)
+	}
+	return 0
+}
+
+// Metrics returns the current metrics of the cache
+func (lru *LRUCache) Metrics() Metrics {
+	lru.lock()
+	defer lru.unlock()
+
+	return Metrics{
+		Length:    uint64(lru.list.Len()),
+		Size:      lru.size,
+		Capacity:  lru.capacity,
+		Hits:      atomic.LoadUint64(&lru.hits),
+		Misses:    atomic.LoadUint64(&lru.misses),
+		Evictions: lru.evictions,
+	}
+}
+
+// PublishExpvar publishes the cache metrics as the expvar variable name,
+// a map with the fields of Metrics and its hit ratio:
+//
+//	"cache": {"length": 10, "size": 10, "capacity": 1000, "hits": 7,
+//	          "misses": 3, "hit_ratio": 0.7, "evictions": 0}
+//
+// Like expvar.Publish, it panics if name is already in use.
+func (lru *LRUCache) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		m := lru.Metrics()
+		return map[string]interface{}{
+			"length":    m.Length,
+			"size":      m.Size,
+			"capacity":  m.Capacity,
+			"hits":      m.Hits,
+			"misses":    m.Misses,
+			"hit_ratio": m.HitRatio(),
+			"evictions": m.Evictions,
+		}
+	}))
+}
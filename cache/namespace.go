@@ -0,0 +1,205 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// namespaceSeparator separates a namespace prefix from the keys in it
+const namespaceSeparator = ":"
+
+// Namespace is a view of an LRUCache in which every key is prefixed,
+// so several subsystems can share one cache without key collisions.
+// Each namespace keeps its own hit and miss counts and can be cleared
+// on its own. Capacity and eviction are still shared by the whole cache.
+type Namespace struct {
+	lru    *LRUCache
+	prefix string
+
+	hits   uint64
+	misses uint64
+}
+
+// NamespaceStats gives information about the entries of a namespace
+type NamespaceStats struct {
+	Length uint64
+	Size   uint64
+	Hits   uint64
+	Misses uint64
+}
+
+// Namespace returns the namespace with the given name. Keys in it are
+// stored in the cache as "<name>:<key>". Calls with the same name return
+// the same Namespace, so statistics are shared by all its users.
+//
+// The name can't contain ":", and the error wraps ErrInvalidNamespace if it
+// does, as the keys of "a" could otherwise collide with those of "a:b", and
+// clearing "a" would clear "a:b" too.
+func (lru *LRUCache) Namespace(name string) (*Namespace, error) {
+	if strings.Contains(name, namespaceSeparator) {
+		return nil, fmt.Errorf("%w: %q contains %q", ErrInvalidNamespace, name, namespaceSeparator)
+	}
+
+	lru.lock()
+	defer lru.unlock()
+
+	if lru.namespaces == nil {
+		lru.namespaces = make(map[string]*Namespace)
+	}
+	ns := lru.namespaces[name]
+	if ns == nil {
+		ns = &Namespace{lru: lru, prefix: name + namespaceSeparator}
+		lru.namespaces[name] = ns
+	}
+	return ns, nil
+}
+
+// Get returns the value in the namespace corresponding to the given key
+func (ns *Namespace) Get(key string) (v Value, ok bool) {
+	v, ok = ns.lru.Get(ns.prefix + key)
+	if ok {
+		atomic.AddUint64(&ns.hits, 1)
+	} else {
+		atomic.AddUint64(&ns.misses, 1)
+	}
+	return v, ok
+}
+
+// Lookup is like Get, but tells a cached miss apart from an unknown key,
+// see LRUCache.Lookup
+func (ns *Namespace) Lookup(key string) (v Value, result LookupResult) {
+	v, result = ns.lru.Lookup(ns.prefix + key)
+	if result == Hit {
+		atomic.AddUint64(&ns.hits, 1)
+	} else {
+		atomic.AddUint64(&ns.misses, 1)
+	}
+	return v, result
+}
+
+// GetWithExpiry returns the value for key in the namespace and its remaining
+// lifetime, see LRUCache.GetWithExpiry
+func (ns *Namespace) GetWithExpiry(key string) (v Value, ttl time.Duration, ok bool) {
+	v, ttl, ok = ns.lru.GetWithExpiry(ns.prefix + key)
+	if ok {
+		atomic.AddUint64(&ns.hits, 1)
+	} else {
+		atomic.AddUint64(&ns.misses, 1)
+	}
+	return v, ttl, ok
+}
+
+// Touch extends the lifetime of the entry for key in the namespace,
+// see LRUCache.Touch
+func (ns *Namespace) Touch(key string, ttl time.Duration) bool {
+	return ns.lru.Touch(ns.prefix+key, ttl)
+}
+
+// SetNegative caches the absence of a value for key in the namespace,
+// see LRUCache.SetNegative
+func (ns *Namespace) SetNegative(key string, reason error) {
+	ns.lru.SetNegative(ns.prefix+key, reason)
+}
+
+// Set sets the value for key in the namespace, see LRUCache.Set
+func (ns *Namespace) Set(key string, value Value) {
+	ns.lru.Set(ns.prefix+key, value)
+}
+
+// SetWithTTL sets the value for key in the namespace, see LRUCache.SetWithTTL
+func (ns *Namespace) SetWithTTL(key string, value Value, ttl time.Duration) {
+	ns.lru.SetWithTTL(ns.prefix+key, value, ttl)
+}
+
+// SetWithTags sets the value for key in the namespace, see LRUCache.SetWithTags
+func (ns *Namespace) SetWithTags(key string, value Value, ttl time.Duration, tags ...string) {
+	ns.lru.SetWithTags(ns.prefix+key, value, ttl, tags...)
+}
+
+// SetIfAbsent sets the value for key in the namespace only if it doesn't exist
+func (ns *Namespace) SetIfAbsent(key string, value Value) {
+	ns.lru.SetIfAbsent(ns.prefix+key, value)
+}
+
+// Delete deletes the entry for key in the namespace
+func (ns *Namespace) Delete(key string) bool {
+	return ns.lru.Delete(ns.prefix + key)
+}
+
+// RegisterRefresher refreshes entries in the namespace with keys matching
+// pattern, see LRUCache.RegisterRefresher. pattern and the keys fn is
+// called with don't include the prefix.
+func (ns *Namespace) RegisterRefresher(pattern string, fn Refresher) error {
+	prefix := ns.prefix
+	for _, meta := range []string{`\`, "*", "?", "["} {
+		prefix = strings.ReplaceAll(prefix, meta, `\`+meta)
+	}
+	return ns.lru.RegisterRefresher(prefix+pattern, func(key string) (Value, time.Duration, error) {
+		return fn(strings.TrimPrefix(key, ns.prefix))
+	})
+}
+
+// Warm loads keys into the namespace, see LRUCache.Warm. loader is called
+// with the keys without the prefix.
+func (ns *Namespace) Warm(ctx context.Context, keys []string, loader func(key string) (Value, error), parallelism int) (int, error) {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = ns.prefix + key
+	}
+	return ns.lru.Warm(ctx, prefixed, func(key string) (Value, error) {
+		return loader(strings.TrimPrefix(key, ns.prefix))
+	}, parallelism)
+}
+
+// Keys returns the keys in the namespace, without the prefix
+func (ns *Namespace) Keys() []string {
+	var keys []string
+	for _, key := range ns.lru.Keys() {
+		if strings.HasPrefix(key, ns.prefix) {
+			keys = append(keys, strings.TrimPrefix(key, ns.prefix))
+		}
+	}
+	return keys
+}
+
+// Clear deletes all entries in the namespace.
+// The backing store, if any, is left untouched.
+func (ns *Namespace) Clear() {
+	lru := ns.lru
+	lru.lock()
+	defer lru.unlock()
+
+	if lru.closed {
+		return
+	}
+	for key, element := range lru.table {
+		if strings.HasPrefix(key, ns.prefix) {
+			lru.removeElement(element)
+		}
+	}
+}
+
+// Stats returns information about the namespace
+func (ns *Namespace) Stats() NamespaceStats {
+	stats := NamespaceStats{
+		Hits:   atomic.LoadUint64(&ns.hits),
+		Misses: atomic.LoadUint64(&ns.misses),
+	}
+
+	lru := ns.lru
+	lru.lock()
+	defer lru.unlock()
+
+	now := time.Now()
+	for key, element := range lru.table {
+		e := element.Value.(*entry)
+		if strings.HasPrefix(key, ns.prefix) && !e.expired(now) {
+			stats.Length++
+			stats.Size += uint64(e.size)
+		}
+	}
+	return stats
+}
@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// defaultNegativeTTL is how long SetNegative caches a miss unless
+// configured otherwise with WithNegativeTTL
+const defaultNegativeTTL = time.Minute
+
+// Negative is the value cached for a key known to have no value,
+// such as a lookup that failed upstream.
+// It counts as 1 towards the cache capacity.
+type Negative struct {
+	// Reason describes why there is no value
+	Reason string
+}
+
+// Size implements Value
+func (n Negative) Size() int {
+	return 1
+}
+
+func (n Negative) Error() string {
+	return n.Reason
+}
+
+func init() {
+	RegisterValue(Negative{})
+}
+
+// LookupResult tells a cached miss apart from a key never seen
+type LookupResult int
+
+const (
+	// Miss means there is no entry for the key
+	Miss LookupResult = iota
+	// Hit means there is a value for the key
+	Hit
+	// NegativeHit means the key is cached as having no value
+	NegativeHit
+)
+
+// SetNegative caches the absence of a value for key, for the negative TTL
+// set with WithNegativeTTL. reason is kept with the entry and may be nil.
+// Until the entry expires Get reports a miss for the key without reading
+// through to the backing store, and Lookup reports a NegativeHit.
+func (lru *LRUCache) SetNegative(key string, reason error) {
+	n := Negative{}
+	if reason != nil {
+		n.Reason = reason.Error()
+	}
+
+	lru.lock()
+	defer lru.unlock()
+
+	if lru.closed {
+		return
+	}
+	expires := expiryFor(lru.negativeTTL)
+	if element := lru.table[key]; element != nil {
+		lru.updateInplace(element, n, expires, nil)
+	} else {
+		lru.addNew(key, n, expires, nil)
+	}
+}
+
+// Lookup is like Get, but tells a cached miss apart from an unknown key.
+// For a NegativeHit the returned value is the Negative cached for the key.
+func (lru *LRUCache) Lookup(key string) (v Value, result LookupResult) {
+	v, _, result = lru.lookupCounted(key)
+	return v, result
+}
+
+// lookupCounted is lookup, counting the result and calling the hooks
+func (lru *LRUCache) lookupCounted(key string) (v Value, info EntryInfo, result LookupResult) {
+	v, info, result = lru.lookup(key)
+	if result == Hit {
+		atomic.AddUint64(&lru.hits, 1)
+		if lru.hooks.OnHit != nil {
+			lru.hooks.OnHit(info)
+		}
+	} else {
+		atomic.AddUint64(&lru.misses, 1)
+		if lru.hooks.OnMiss != nil {
+			lru.hooks.OnMiss(key)
+		}
+	}
+	return v, info, result
+}
+
+func (lru *LRUCache) lookup(key string) (v Value, info EntryInfo, result LookupResult) {
+	v, info, ok := lru.get(key)
+	if !ok {
+		if lru.store == nil || lru.isClosed() {
+			return nil, info, Miss
+		}
+		if v, info, ok = lru.readThrough(key); !ok {
+			return nil, info, Miss
+		}
+	}
+	if _, negative := v.(Negative); negative {
+		return v, info, NegativeHit
+	}
+	return v, info, Hit
+}
@@ -0,0 +1,79 @@
+package cache
+
+import "time"
+
+// Option configures an LRUCache
+type Option func(*LRUCache)
+
+// WithCopyOnRead makes the cache hand out defensive copies of values
+// implementing Cloner: values are copied when they are set and whenever
+// they are read, so neither the caller nor other readers can change the
+// cached copy. Values in a FrozenView are copied whenever they are read from it.
+// Values not implementing Cloner are shared as usual.
+func WithCopyOnRead() Option {
+	return func(lru *LRUCache) {
+		lru.copyOnRead = true
+	}
+}
+
+// WithNegativeTTL sets how long SetNegative caches misses
+func WithNegativeTTL(ttl time.Duration) Option {
+	return func(lru *LRUCache) {
+		lru.negativeTTL = ttl
+	}
+}
+
+// WithStore makes the cache read through to store on misses
+// and write through to it on Set, SetIfAbsent and Delete
+func WithStore(store Store) Option {
+	return func(lru *LRUCache) {
+		lru.store = store
+	}
+}
+
+// WithStoreErrorHandler sets a function to be called with the errors returned
+// by the backing store. op is one of "get", "set" or "delete", or "refresh"
+// for errors returned by a Refresher.
+// Without a handler, store errors are ignored: failed reads count as misses
+// and failed writes leave the cache unchanged.
+func WithStoreErrorHandler(fn func(op, key string, err error)) Option {
+	return func(lru *LRUCache) {
+		lru.storeErrorFn = fn
+	}
+}
+
+// WithRefreshWorkers sets how many refreshes registered with
+// RegisterRefresher may run at once
+func WithRefreshWorkers(n int) Option {
+	return func(lru *LRUCache) {
+		if n > 0 {
+			lru.refreshWorkers = n
+		}
+	}
+}
+
+// WithLoadLimits limits how many loaders GetOrLoad runs at once: at most
+// global in total and perKey for any one key. Zero means no limit.
+func WithLoadLimits(global, perKey int) Option {
+	return func(lru *LRUCache) {
+		lru.loads.global = nil
+		if global > 0 {
+			lru.loads.global = make(chan struct{}, global)
+		}
+		lru.loads.perKey = perKey
+	}
+}
+
+// WithEvictionWatermarks makes the cache evict in batches: once the size
+// goes over high times the capacity, entries are evicted until it is down
+// to low times the capacity. For example 1 and 0.9 evict down to 90% when
+// the cache is full, so the next inserts don't each evict an entry.
+// Both are fractions with 0 < low <= high <= 1; other values are ignored.
+// By default both are 1, evicting just enough to stay within capacity.
+func WithEvictionWatermarks(high, low float64) Option {
+	return func(lru *LRUCache) {
+		if 0 < low && low <= high && high <= 1 {
+			lru.highWater, lru.lowWater = high, low
+		}
+	}
+}
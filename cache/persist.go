@@ -0,0 +1,150 @@
+package cache
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// PersistOptions configures when a Persister snapshots the cache
+type PersistOptions struct {
+	// Interval is the time between snapshots. Zero disables periodic snapshots.
+	Interval time.Duration
+
+	// Mutations triggers a snapshot once this many changes have been made
+	// since the last one. Zero disables mutation-triggered snapshots.
+	Mutations uint64
+
+	// Keep is the number of previous snapshots to keep next to the current one
+	Keep int
+}
+
+// Persister periodically snapshots a cache to a file
+type Persister struct {
+	lru  *LRUCache
+	path string
+	opts PersistOptions
+
+	mu        sync.Mutex
+	lastSaved uint64
+	// suspended stops snapshots being taken, see Suspend
+	suspended bool
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// persistCheckInterval is how often the Persister checks the mutation count
+const persistCheckInterval = time.Second
+
+// NewPersister restores the cache from the snapshot at path, if there is one,
+// and starts snapshotting it in the background according to opts.
+// Closing the cache stops the Persister.
+func NewPersister(lru *LRUCache, path string, opts PersistOptions) (*Persister, error) {
+	if err := lru.LoadItemsFromFile(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	p := &Persister{
+		lru:       lru,
+		path:      path,
+		opts:      opts,
+		lastSaved: lru.mutationCount(),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	lru.lock()
+	lru.persister = p
+	lru.unlock()
+
+	go p.run()
+	return p, nil
+}
+
+// Save snapshots the cache now if it changed since the last snapshot,
+// unless snapshots are suspended
+func (p *Persister) Save() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.suspended {
+		return nil
+	}
+	return p.save()
+}
+
+// Suspend takes a last snapshot and then stops taking any, even by Save or
+// when the cache is closed, until Resume. It is for handing the snapshot
+// file over to another process, which this one mustn't overwrite.
+// If the last snapshot fails, snapshots aren't suspended.
+func (p *Persister) Suspend() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.save(); err != nil {
+		return err
+	}
+	p.suspended = true
+	return nil
+}
+
+// Resume takes snapshots again after Suspend
+func (p *Persister) Resume() {
+	p.mu.Lock()
+	p.suspended = false
+	p.mu.Unlock()
+}
+
+// save snapshots the cache if it changed. p.mu must be held.
+func (p *Persister) save() error {
+	mutations := p.lru.mutationCount()
+	if mutations == p.lastSaved {
+		return nil
+	}
+	if err := p.lru.SaveItemsToFileRotated(p.path, p.opts.Keep); err != nil {
+		return err
+	}
+	p.lastSaved = mutations
+	return nil
+}
+
+// Stop stops the background snapshots and takes a final snapshot.
+// It is safe to call more than once.
+func (p *Persister) Stop() error {
+	p.stopOnce.Do(func() { close(p.stop) })
+	<-p.done
+	return p.Save()
+}
+
+func (p *Persister) run() {
+	defer close(p.done)
+
+	check := persistCheckInterval
+	if p.opts.Interval > 0 && p.opts.Interval < check {
+		check = p.opts.Interval
+	}
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+
+	lastRun := time.Now()
+	for {
+		select {
+		case <-p.stop:
+			return
+
+		case now := <-ticker.C:
+			due := p.opts.Interval > 0 && now.Sub(lastRun) >= p.opts.Interval
+			if !due && p.opts.Mutations > 0 {
+				p.mu.Lock()
+				due = p.lru.mutationCount()-p.lastSaved >= p.opts.Mutations
+				p.mu.Unlock()
+			}
+			if due {
+				// A failed snapshot is retried on the next trigger
+				p.Save()
+				lastRun = now
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+//go:build prometheus
+
+package cache
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Collector is a prometheus.Collector for the metrics of a cache.
+// It is only built with the prometheus build tag, so the package doesn't
+// depend on the Prometheus client otherwise.
+type Collector struct {
+	lru *LRUCache
+
+	length    *prometheus.Desc
+	size      *prometheus.Desc
+	capacity  *prometheus.Desc
+	hits      *prometheus.Desc
+	misses    *prometheus.Desc
+	hitRatio  *prometheus.Desc
+	evictions *prometheus.Desc
+}
+
+// NewCollector returns a Collector for lru. Metric names start with
+// namespace, such as "weather_cache_hits_total" for "weather".
+// constLabels are added to every metric, and may be nil.
+func NewCollector(lru *LRUCache, namespace string, constLabels prometheus.Labels) *Collector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "cache", name), help, nil, constLabels)
+	}
+	return &Collector{
+		lru:       lru,
+		length:    desc("entries", "Number of entries in the cache."),
+		size:      desc("size", "Total size of the entries in the cache."),
+		capacity:  desc("capacity", "Capacity of the cache."),
+		hits:      desc("hits_total", "Lookups that found a value."),
+		misses:    desc("misses_total", "Lookups that found no value."),
+		hitRatio:  desc("hit_ratio", "Share of lookups that found a value."),
+		evictions: desc("evictions_total", "Entries evicted to stay within capacity."),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.length
+	ch <- c.size
+	ch <- c.capacity
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.hitRatio
+	ch <- c.evictions
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	m := c.lru.Metrics()
+	ch <- prometheus.MustNewConstMetric(c.length, prometheus.GaugeValue, float64(m.Length))
+	ch <- prometheus.MustNewConstMetric(c.size, prometheus.GaugeValue, float64(m.Size))
+	ch <- prometheus.MustNewConstMetric(c.capacity, prometheus.GaugeValue, float64(m.Capacity))
+	ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(m.Hits))
+	ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(m.Misses))
+	ch <- prometheus.MustNewConstMetric(c.hitRatio, prometheus.GaugeValue, m.HitRatio())
+	ch <- prometheus.MustNewConstMetric(c.evictions, prometheus.CounterValue, float64(m.Evictions))
+}
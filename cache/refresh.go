@@ -0,0 +1,220 @@
+package cache
+
+import (
+	"container/list"
+	"path"
+	"sync"
+	"time"
+)
+
+// defaultRefreshWorkers is how many refreshes run at once unless
+// configured otherwise with WithRefreshWorkers
+const defaultRefreshWorkers = 4
+
+// refreshQueueLength is how many refreshes may wait per worker; reads
+// that would queue more don't trigger a refresh
+const refreshQueueLength = 16
+
+// An entry read when less than refreshAhead of its TTL is left is refreshed
+const refreshAhead = 0.2
+
+// Refresher returns a fresh value for key and the TTL to cache it with
+type Refresher func(key string) (Value, time.Duration, error)
+
+type refresherRule struct {
+	pattern string
+	fn      Refresher
+}
+
+// refresher runs the refreshes of a cache on a bounded pool of workers
+type refresher struct {
+	mu      sync.Mutex
+	rules   []refresherRule
+	pending map[string]struct{}
+	stopped bool
+
+	jobs chan string
+	stop chan struct{}
+}
+
+// RegisterRefresher refreshes entries with keys matching pattern, as in
+// path.Match, in the background when they are read with less than a fifth
+// of their TTL left, so that frequently read entries never expire.
+// The refreshed value replaces the old one, keeping its tags, unless the
+// entry has been deleted or set meanwhile. Errors from fn are reported to the
+// store error handler with op "refresh"; the old value then expires as
+// usual. Entries without a TTL are never refreshed.
+//
+// When several patterns match a key the first registered is used.
+// The first call starts the workers; StopRefresh stops them, after which
+// RegisterRefresher returns ErrRefreshStopped.
+func (lru *LRUCache) RegisterRefresher(pattern string, fn Refresher) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+
+	lru.lock()
+	if lru.closed {
+		lru.unlock()
+		return ErrCacheClosed
+	}
+	if lru.refresher == nil {
+		lru.refresher = &refresher{
+			pending: make(map[string]struct{}),
+			jobs:    make(chan string, lru.refreshWorkers*refreshQueueLength),
+			stop:    make(chan struct{}),
+		}
+		for i := 0; i < lru.refreshWorkers; i++ {
+			go lru.refreshWorker()
+		}
+	}
+	r := lru.refresher
+	lru.unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped {
+		return ErrRefreshStopped
+	}
+	r.rules = append(r.rules, refresherRule{pattern: pattern, fn: fn})
+	return nil
+}
+
+// StopRefresh stops the background refresh workers. Refreshes already
+// running are finished, queued ones are dropped.
+func (lru *LRUCache) StopRefresh() {
+	lru.lock()
+	r := lru.refresher
+	if r == nil {
+		// Nothing to stop, but refreshers can't be registered afterwards
+		lru.refresher = &refresher{stopped: true}
+	}
+	lru.unlock()
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.stopped {
+		r.stopped = true
+		close(r.stop)
+	}
+}
+
+// needsRefresh reports whether e should be refreshed when read now
+func (e *entry) needsRefresh(now time.Time) bool {
+	if e.expires.IsZero() {
+		return false
+	}
+	ttl := e.expires.Sub(e.timeSet)
+	return e.expires.Sub(now) < time.Duration(float64(ttl)*refreshAhead)
+}
+
+// queueRefresh queues a refresh of key if it has a refresher and isn't
+// already queued. It is called with the cache lock held.
+func (lru *LRUCache) queueRefresh(key string) {
+	r := lru.refresher
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped || r.ruleFor(key) == nil {
+		return
+	}
+	if _, ok := r.pending[key]; ok {
+		return
+	}
+	select {
+	case r.jobs <- key:
+		r.pending[key] = struct{}{}
+	default:
+	}
+}
+
+// ruleFor returns the first rule matching key, or nil
+func (r *refresher) ruleFor(key string) *refresherRule {
+	for i := range r.rules {
+		if ok, _ := path.Match(r.rules[i].pattern, key); ok {
+			return &r.rules[i]
+		}
+	}
+	return nil
+}
+
+func (lru *LRUCache) refreshWorker() {
+	r := lru.refresher
+	for {
+		select {
+		case <-r.stop:
+			return
+		case key := <-r.jobs:
+			lru.refresh(key)
+
+			r.mu.Lock()
+			delete(r.pending, key)
+			r.mu.Unlock()
+		}
+	}
+}
+
+// refresh loads a fresh value for key and writes it to the store and the
+// cache. The store is written without holding the lock, like in Set, and
+// nothing is written if the entry was deleted or set since the load began.
+func (lru *LRUCache) refresh(key string) {
+	r := lru.refresher
+	r.mu.Lock()
+	rule := r.ruleFor(key)
+	r.mu.Unlock()
+
+	element, writes, ok := lru.refreshing(key)
+	if !ok {
+		return
+	}
+	value, ttl, err := rule.fn(key)
+	if err != nil {
+		lru.storeError("refresh", key, err)
+		return
+	}
+
+	if !lru.unchanged(key, element, writes) || !lru.writeThrough(key, value) {
+		return
+	}
+	value = lru.copyValue(value)
+
+	lru.lock()
+	defer lru.unlock()
+
+	if lru.closed || !lru.unchangedLocked(key, element, writes) {
+		return
+	}
+	lru.updateInplace(element, value, expiryFor(ttl), element.Value.(*entry).tags)
+}
+
+// refreshing returns the element of key and how often it has been written,
+// for unchanged to check after loading
+func (lru *LRUCache) refreshing(key string) (*list.Element, uint64, bool) {
+	lru.lock()
+	defer lru.unlock()
+
+	element := lru.table[key]
+	if element == nil || lru.closed {
+		return nil, 0, false
+	}
+	return element, element.Value.(*entry).writes, true
+}
+
+// unchanged reports whether key is still cached in element, not written
+// since it had been written writes times
+func (lru *LRUCache) unchanged(key string, element *list.Element, writes uint64) bool {
+	lru.lock()
+	defer lru.unlock()
+
+	return !lru.closed && lru.unchangedLocked(key, element, writes)
+}
+
+// unchangedLocked is unchanged with the lock held
+func (lru *LRUCache) unchangedLocked(key string, element *list.Element, writes uint64) bool {
+	return lru.table[key] == element && element.Value.(*entry).writes == writes
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/muthubro/ready-set-go/cache"
+)
+
+// relativeExpiryLimit is memcached's cut-off between relative expiry times
+// in seconds and absolute Unix timestamps
+const relativeExpiryLimit = 60 * 60 * 24 * 30
+
+// maxLineLength is memcached's limit on the length of a command line
+const maxLineLength = 2048
+
+// Memcached serves an LRUCache over the memcached text protocol.
+// It supports the get, set, delete, stats and quit commands.
+type Memcached struct {
+	lru *cache.LRUCache
+	ln  listener
+
+	getHits   uint64
+	getMisses uint64
+	cmdGet    uint64
+	cmdSet    uint64
+}
+
+// NewMemcached creates a memcached protocol server backed by lru
+func NewMemcached(lru *cache.LRUCache) *Memcached {
+	return &Memcached{lru: lru}
+}
+
+// ListenAndServe listens on the TCP address addr and serves clients
+func (m *Memcached) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return m.Serve(l)
+}
+
+// Serve serves clients connecting to l. It always returns a non-nil error.
+func (m *Memcached) Serve(l net.Listener) error {
+	return m.ln.serve(l, m.handle)
+}
+
+// Close stops the server and closes all client connections
+func (m *Memcached) Close() error {
+	return m.ln.close()
+}
+
+func (m *Memcached) handle(r *bufio.Reader, w *bufio.Writer) {
+	for {
+		line, err := readLine(r, maxLineLength)
+		if err == errLineTooLong {
+			m.reply(w, "CLIENT_ERROR line too long")
+			w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			m.reply(w, "ERROR")
+			continue
+		}
+
+		switch fields[0] {
+		case "get":
+			m.get(w, fields[1:])
+
+		case "set":
+			if err := m.set(r, w, fields[1:]); err != nil {
+				return
+			}
+
+		case "delete":
+			m.delete(w, fields[1:])
+
+		case "stats":
+			m.stats(w)
+
+		case "quit":
+			w.Flush()
+			return
+
+		default:
+			m.reply(w, "ERROR")
+		}
+
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (m *Memcached) reply(w *bufio.Writer, line string) {
+	w.WriteString(line)
+	w.WriteString("\r\n")
+}
+
+func (m *Memcached) get(w *bufio.Writer, keys []string) {
+	if len(keys) == 0 {
+		m.reply(w, "ERROR")
+		return
+	}
+
+	for _, key := range keys {
+		atomic.AddUint64(&m.cmdGet, 1)
+		v, ok := m.lru.Get(key)
+		if !ok {
+			atomic.AddUint64(&m.getMisses, 1)
+			continue
+		}
+		value, ok := v.(wireValue)
+		if !ok {
+			// Entries set by Go code can't be represented on the wire
+			atomic.AddUint64(&m.getMisses, 1)
+			continue
+		}
+
+		atomic.AddUint64(&m.getHits, 1)
+		fmt.Fprintf(w, "VALUE %s %d %d\r\n", key, value.Flags, len(value.Data))
+		w.Write(value.Data)
+		w.WriteString("\r\n")
+	}
+	m.reply(w, "END")
+}
+
+// set handles "set <key> <flags> <exptime> <bytes> [noreply]".
+// It only returns an error when the connection should be dropped.
+func (m *Memcached) set(r *bufio.Reader, w *bufio.Writer, args []string) error {
+	if len(args) != 4 && len(args) != 5 {
+		m.reply(w, "ERROR")
+		return nil
+	}
+	noreply := len(args) == 5 && args[4] == "noreply"
+
+	key := args[0]
+	flags, err1 := strconv.ParseUint(args[1], 10, 32)
+	exptime, err2 := strconv.ParseInt(args[2], 10, 64)
+	size, err3 := strconv.Atoi(args[3])
+	if err1 != nil || err2 != nil || err3 != nil || size < 0 {
+		m.reply(w, "CLIENT_ERROR bad command line format")
+		return nil
+	}
+	if size > maxValueSize {
+		// The data block can't be trusted to be skipped, so hang up
+		m.reply(w, "SERVER_ERROR object too large for cache")
+		w.Flush()
+		return fmt.Errorf("value of %d bytes is too large", size)
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		m.reply(w, "CLIENT_ERROR bad data chunk")
+		return nil
+	}
+
+	atomic.AddUint64(&m.cmdSet, 1)
+	value := wireValue{Flags: uint32(flags), Data: data[:size]}
+	if ttl := expiryTTL(exptime); ttl < 0 {
+		m.lru.Delete(key)
+	} else {
+		m.lru.SetWithTTL(key, value, ttl)
+	}
+
+	if !noreply {
+		m.reply(w, "STORED")
+	}
+	return nil
+}
+
+// expiryTTL converts a memcached exptime into a TTL.
+// Zero means no expiry, a negative TTL means the item is already expired.
+func expiryTTL(exptime int64) time.Duration {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime < 0:
+		return -1
+	case exptime <= relativeExpiryLimit:
+		return time.Duration(exptime) * time.Second
+	default:
+		ttl := time.Until(time.Unix(exptime, 0))
+		if ttl <= 0 {
+			return -1
+		}
+		return ttl
+	}
+}
+
+// delete handles "delete <key> [noreply]"
+func (m *Memcached) delete(w *bufio.Writer, args []string) {
+	if len(args) != 1 && len(args) != 2 {
+		m.reply(w, "ERROR")
+		return
+	}
+	noreply := len(args) == 2 && args[1] == "noreply"
+
+	deleted := m.lru.Delete(args[0])
+	if noreply {
+		return
+	}
+	if deleted {
+		m.reply(w, "DELETED")
+	} else {
+		m.reply(w, "NOT_FOUND")
+	}
+}
+
+func (m *Memcached) stats(w *bufio.Writer) {
+	length, size, capacity, _ := m.lru.Stats()
+
+	stat := func(name string, value interface{}) {
+		fmt.Fprintf(w, "STAT %s %v\r\n", name, value)
+	}
+	stat("pid", os.Getpid())
+	stat("uptime", int64(m.ln.uptime().Seconds()))
+	stat("time", time.Now().Unix())
+	stat("curr_items", length)
+	stat("bytes", size)
+	stat("limit_maxbytes", capacity)
+	stat("cmd_get", atomic.LoadUint64(&m.cmdGet))
+	stat("cmd_set", atomic.LoadUint64(&m.cmdSet))
+	stat("get_hits", atomic.LoadUint64(&m.getHits))
+	stat("get_misses", atomic.LoadUint64(&m.getMisses))
+	m.reply(w, "END")
+}
@@ -0,0 +1,312 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/muthubro/ready-set-go/cache"
+)
+
+// maxArgs bounds the number of arguments in a RESP command
+const maxArgs = 1024
+
+// maxCommandSize bounds the arguments of a RESP command together, so a
+// command of many large arguments can't buffer maxArgs times maxValueSize.
+// It leaves room for a SET of the largest value.
+const maxCommandSize = maxValueSize + maxInlineLength
+
+// maxInlineLength bounds the length of a line, including inline
+// commands, like Redis does
+const maxInlineLength = 64 << 10
+
+var (
+	errProtocol        = errors.New("protocol error")
+	errCommandTooLarge = errors.New("command too large")
+)
+
+// RESP serves an LRUCache over the Redis serialization protocol, so Redis
+// clients and tools can talk to it. It supports GET, SET (with EX or PX),
+// DEL, TTL, INFO, PING and QUIT.
+type RESP struct {
+	lru *cache.LRUCache
+	ln  listener
+
+	commands uint64
+	hits     uint64
+	misses   uint64
+}
+
+// NewRESP creates a RESP server backed by lru
+func NewRESP(lru *cache.LRUCache) *RESP {
+	return &RESP{lru: lru}
+}
+
+// ListenAndServe listens on the TCP address addr and serves clients
+func (s *RESP) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serves clients connecting to l. It always returns a non-nil error.
+func (s *RESP) Serve(l net.Listener) error {
+	return s.ln.serve(l, s.handle)
+}
+
+// Close stops the server and closes all client connections
+func (s *RESP) Close() error {
+	return s.ln.close()
+}
+
+func (s *RESP) handle(r *bufio.Reader, w *bufio.Writer) {
+	for {
+		args, err := readCommand(r)
+		if err == errLineTooLong {
+			writeError(w, "ERR Protocol error: too big inline request")
+			w.Flush()
+			return
+		}
+		if err == errProtocol {
+			writeError(w, "ERR Protocol error")
+			w.Flush()
+			return
+		}
+		if err == errCommandTooLarge {
+			writeError(w, "ERR Protocol error: command too large")
+			w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		atomic.AddUint64(&s.commands, 1)
+		if strings.ToUpper(args[0]) == "QUIT" {
+			writeSimple(w, "OK")
+			w.Flush()
+			return
+		}
+		s.dispatch(w, args)
+
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *RESP) dispatch(w *bufio.Writer, args []string) {
+	switch cmd := strings.ToUpper(args[0]); cmd {
+	case "GET":
+		if len(args) != 2 {
+			writeArityError(w, cmd)
+			return
+		}
+		s.get(w, args[1])
+
+	case "SET":
+		if len(args) < 3 {
+			writeArityError(w, cmd)
+			return
+		}
+		s.set(w, args[1], args[2], args[3:])
+
+	case "DEL":
+		if len(args) < 2 {
+			writeArityError(w, cmd)
+			return
+		}
+		deleted := 0
+		for _, key := range args[1:] {
+			if s.lru.Delete(key) {
+				deleted++
+			}
+		}
+		writeInt(w, int64(deleted))
+
+	case "TTL":
+		if len(args) != 2 {
+			writeArityError(w, cmd)
+			return
+		}
+		s.ttl(w, args[1])
+
+	case "INFO":
+		s.info(w)
+
+	case "PING":
+		if len(args) > 1 {
+			writeBulk(w, []byte(args[1]))
+		} else {
+			writeSimple(w, "PONG")
+		}
+
+	default:
+		// Quoted, as a bulk string command may hold CRLF and inject replies
+		writeError(w, fmt.Sprintf("ERR unknown command %q", args[0]))
+	}
+}
+
+func (s *RESP) get(w *bufio.Writer, key string) {
+	v, ok := s.lru.Get(key)
+	value, isWire := v.(wireValue)
+	if !ok || !isWire {
+		atomic.AddUint64(&s.misses, 1)
+		writeNull(w)
+		return
+	}
+	atomic.AddUint64(&s.hits, 1)
+	writeBulk(w, value.Data)
+}
+
+// set handles SET key value [EX seconds | PX milliseconds]
+func (s *RESP) set(w *bufio.Writer, key, value string, options []string) {
+	var ttl time.Duration
+	for i := 0; i < len(options); i++ {
+		option := strings.ToUpper(options[i])
+		if (option != "EX" && option != "PX") || i+1 == len(options) || ttl != 0 {
+			writeError(w, "ERR syntax error")
+			return
+		}
+		i++
+		unit := time.Millisecond
+		if option == "EX" {
+			unit = time.Second
+		}
+		// Longer times overflow a time.Duration, and would never expire
+		n, err := strconv.ParseInt(options[i], 10, 64)
+		if err != nil || n <= 0 || n > math.MaxInt64/int64(unit) {
+			writeError(w, "ERR invalid expire time in 'set' command")
+			return
+		}
+		ttl = time.Duration(n) * unit
+	}
+
+	if len(value) > maxValueSize {
+		writeError(w, "ERR value is too large")
+		return
+	}
+	s.lru.SetWithTTL(key, wireValue{Data: []byte(value)}, ttl)
+	writeSimple(w, "OK")
+}
+
+// ttl replies -2 for missing keys, -1 for keys without expiry and
+// the remaining lifetime in seconds otherwise
+func (s *RESP) ttl(w *bufio.Writer, key string) {
+	ttl, ok := s.lru.TTL(key)
+	switch {
+	case !ok:
+		writeInt(w, -2)
+	case ttl == 0:
+		writeInt(w, -1)
+	default:
+		writeInt(w, int64((ttl+time.Second-1)/time.Second))
+	}
+}
+
+func (s *RESP) info(w *bufio.Writer) {
+	length, size, capacity, _ := s.lru.Stats()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Server\r\n")
+	fmt.Fprintf(&b, "process_id:%d\r\n", os.Getpid())
+	fmt.Fprintf(&b, "uptime_in_seconds:%d\r\n", int64(s.ln.uptime().Seconds()))
+	fmt.Fprintf(&b, "\r\n# Memory\r\n")
+	fmt.Fprintf(&b, "used_memory:%d\r\n", size)
+	fmt.Fprintf(&b, "maxmemory:%d\r\n", capacity)
+	fmt.Fprintf(&b, "maxmemory_policy:allkeys-lru\r\n")
+	fmt.Fprintf(&b, "\r\n# Stats\r\n")
+	fmt.Fprintf(&b, "total_commands_processed:%d\r\n", atomic.LoadUint64(&s.commands))
+	fmt.Fprintf(&b, "keyspace_hits:%d\r\n", atomic.LoadUint64(&s.hits))
+	fmt.Fprintf(&b, "keyspace_misses:%d\r\n", atomic.LoadUint64(&s.misses))
+	fmt.Fprintf(&b, "\r\n# Keyspace\r\n")
+	fmt.Fprintf(&b, "db0:keys=%d\r\n", length)
+	writeBulk(w, []byte(b.String()))
+}
+
+// readCommand reads a command sent either as an array of bulk strings
+// or as an inline command
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r, maxInlineLength)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > maxArgs {
+		return nil, errProtocol
+	}
+	args := make([]string, 0, n)
+	remaining := maxCommandSize
+	for i := 0; i < n; i++ {
+		line, err := readLine(r, maxInlineLength)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxValueSize {
+			return nil, errProtocol
+		}
+		if size > remaining {
+			return nil, errCommandTooLarge
+		}
+		remaining -= size
+
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if data[size] != '\r' || data[size+1] != '\n' {
+			return nil, errProtocol
+		}
+		args = append(args, string(data[:size]))
+	}
+	return args, nil
+}
+
+func writeSimple(w *bufio.Writer, s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func writeError(w *bufio.Writer, msg string) {
+	w.WriteString("-" + msg + "\r\n")
+}
+
+func writeArityError(w *bufio.Writer, cmd string) {
+	writeError(w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+}
+
+func writeInt(w *bufio.Writer, n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func writeBulk(w *bufio.Writer, data []byte) {
+	w.WriteString("$" + strconv.Itoa(len(data)) + "\r\n")
+	w.Write(data)
+	w.WriteString("\r\n")
+}
+
+func writeNull(w *bufio.Writer) {
+	w.WriteString("$-1\r\n")
+}
@@ -0,0 +1,163 @@
+// Package server exposes an LRUCache over network protocols,
+// so that processes not written in Go can share the same in-memory cache.
+package server
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/muthubro/ready-set-go/cache"
+)
+
+// maxValueSize is the largest value a client may store
+const maxValueSize = 1 << 20
+
+// errLineTooLong is returned by readLine for a line longer than allowed.
+// The rest of the line is still unread, so the connection can't go on.
+var errLineTooLong = errors.New("line too long")
+
+// readLine reads a line of at most max bytes, not counting the line
+// ending, which is trimmed. Unlike bufio.Reader.ReadString, it doesn't
+// buffer however much a client sends without a newline.
+func readLine(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > max+2 {
+			return "", errLineTooLong
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// wireValue is the cache value stored by network clients.
+// All protocols store the same type, so they can read each other's entries.
+type wireValue struct {
+	// Flags is opaque client data, only used by memcached
+	Flags uint32
+	Data  []byte
+}
+
+func (v wireValue) Size() int {
+	return len(v.Data)
+}
+
+func init() {
+	cache.RegisterValue(wireValue{})
+}
+
+// ErrServerClosed is returned by Serve after Close is called
+var ErrServerClosed = errors.New("server: closed")
+
+// listener keeps track of the listeners and connections of a server
+// so that they can all be closed together
+type listener struct {
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	closed    bool
+	wg        sync.WaitGroup
+
+	started time.Time
+}
+
+// serve accepts connections on l and handles each one in its own goroutine
+func (ln *listener) serve(l net.Listener, handle func(r *bufio.Reader, w *bufio.Writer)) error {
+	ln.mu.Lock()
+	if ln.closed {
+		ln.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	if ln.listeners == nil {
+		ln.listeners = make(map[net.Listener]bool)
+		ln.conns = make(map[net.Conn]bool)
+		ln.started = time.Now()
+	}
+	ln.listeners[l] = true
+	ln.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			ln.mu.Lock()
+			closed := ln.closed
+			delete(ln.listeners, l)
+			ln.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		ln.mu.Lock()
+		if ln.closed {
+			ln.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		ln.conns[conn] = true
+		ln.wg.Add(1)
+		ln.mu.Unlock()
+
+		go func() {
+			defer ln.wg.Done()
+			defer func() {
+				ln.mu.Lock()
+				delete(ln.conns, conn)
+				ln.mu.Unlock()
+				conn.Close()
+			}()
+
+			// A bug handling one client's input must not take the
+			// process down with it
+			defer func() {
+				if err := recover(); err != nil {
+					log.Printf("server: %s: panic handling connection: %v\n%s", conn.RemoteAddr(), err, debug.Stack())
+				}
+			}()
+
+			handle(bufio.NewReader(conn), bufio.NewWriter(conn))
+		}()
+	}
+}
+
+// close stops all listeners and closes all connections
+func (ln *listener) close() error {
+	ln.mu.Lock()
+	ln.closed = true
+	for l := range ln.listeners {
+		l.Close()
+	}
+	for conn := range ln.conns {
+		conn.Close()
+	}
+	ln.mu.Unlock()
+
+	ln.wg.Wait()
+	return nil
+}
+
+// uptime returns the time since the server started serving
+func (ln *listener) uptime() time.Duration {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+
+	if ln.started.IsZero() {
+		return 0
+	}
+	return time.Since(ln.started)
+}
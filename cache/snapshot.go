@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// SaveItemsToFileRotated saves the cache items in a file like SaveItemsToFile,
+// keeping up to keep previous snapshots as path.1 (newest) to path.<keep> (oldest)
+func (lru *LRUCache) SaveItemsToFileRotated(path string, keep int) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+base+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if err := lru.SaveItems(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := rotateSnapshots(path, keep); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// rotateSnapshots shifts path.1 .. path.<keep-1> up by one and moves
+// the current snapshot at path to path.1, dropping the oldest one
+func rotateSnapshots(path string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	for i := keep - 1; i >= 1; i-- {
+		err := os.Rename(rotatedName(path, i), rotatedName(path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(path, rotatedName(path, 1))
+}
+
+func rotatedName(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// syncDir flushes the directory entry so a completed rename survives a crash.
+// Not every platform supports syncing directories, so failures are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
@@ -0,0 +1,73 @@
+package cache
+
+import "time"
+
+// Store is a slower backing storage (disk, SQL, Redis...) behind the cache
+type Store interface {
+	// Get returns the value stored for key. ok is false if there is none.
+	Get(key string) (v Value, ok bool, err error)
+
+	// Set stores the value for key
+	Set(key string, value Value) error
+
+	// Delete removes key from the store. Deleting a missing key is not an error.
+	Delete(key string) error
+}
+
+// readThrough loads a missing key from the store and caches it.
+// It is called without holding the lock, so a concurrent Set wins over the
+// value read from the store.
+// info.Tags is only filled in if there is an OnHit hook.
+func (lru *LRUCache) readThrough(key string) (v Value, info EntryInfo, ok bool) {
+	v, ok, err := lru.store.Get(key)
+	if err != nil {
+		lru.storeError("get", key, err)
+		return nil, info, false
+	}
+	if !ok {
+		return nil, info, false
+	}
+
+	lru.lock()
+	defer lru.unlock()
+
+	if lru.closed {
+		return nil, info, false
+	}
+	element := lru.table[key]
+	if element != nil {
+		lru.moveToFront(element)
+	} else {
+		lru.addNew(key, v, time.Time{}, nil)
+		element = lru.table[key]
+	}
+	if element == nil {
+		// Evicted straight away, the value is bigger than the capacity
+		return lru.copyValue(v), info, true
+	}
+	e := element.Value.(*entry)
+	info = EntryInfo{Key: key, Size: e.size, Expires: e.expires}
+	if lru.hooks.OnHit != nil {
+		info = e.info()
+	}
+	return lru.copyValue(e.value), info, true
+}
+
+// writeThrough writes the value to the store, if there is one.
+// It reports whether the cache should be updated.
+func (lru *LRUCache) writeThrough(key string, value Value) bool {
+	if lru.store == nil {
+		return true
+	}
+	if err := lru.store.Set(key, value); err != nil {
+		lru.storeError("set", key, err)
+		return false
+	}
+	return true
+}
+
+func (lru *LRUCache) storeError(op, key string, err error) {
+	if lru.storeErrorFn != nil {
+		lru.storeErrorFn(op, key, err)
+	}
+}
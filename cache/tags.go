@@ -0,0 +1,57 @@
+package cache
+
+// InvalidateTag deletes all entries tagged with tag and returns how many
+// there were. The backing store, if any, is left untouched.
+func (lru *LRUCache) InvalidateTag(tag string) int {
+	lru.lock()
+	defer lru.unlock()
+
+	if lru.closed {
+		return 0
+	}
+	keys := lru.tags[tag]
+	n := 0
+	for key := range keys {
+		if element := lru.table[key]; element != nil {
+			lru.removeElement(element)
+			n++
+		}
+	}
+	delete(lru.tags, tag)
+	return n
+}
+
+// Tags returns the tags of the entry for key
+func (lru *LRUCache) Tags(key string) []string {
+	lru.lock()
+	defer lru.unlock()
+
+	element := lru.table[key]
+	if element == nil {
+		return nil
+	}
+	return append([]string(nil), element.Value.(*entry).tags...)
+}
+
+// tag adds the entry to the index of each of its tags
+func (lru *LRUCache) tag(e *entry) {
+	for _, t := range e.tags {
+		keys := lru.tags[t]
+		if keys == nil {
+			keys = make(map[string]struct{})
+			lru.tags[t] = keys
+		}
+		keys[e.key] = struct{}{}
+	}
+}
+
+// untag removes the entry from the index of each of its tags
+func (lru *LRUCache) untag(e *entry) {
+	for _, t := range e.tags {
+		keys := lru.tags[t]
+		delete(keys, e.key)
+		if len(keys) == 0 {
+			delete(lru.tags, t)
+		}
+	}
+}
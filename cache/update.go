@@ -0,0 +1,62 @@
+package cache
+
+import "time"
+
+// Update atomically replaces the value for key with the result of fn.
+// fn is called with the current value, if any, while the cache lock is held,
+// so it must be quick and must not call back into the cache.
+// If fn returns false the entry is deleted instead. An updated entry keeps
+// its TTL and tags; a new one has neither.
+// Update returns the value left in the cache and whether there is one.
+//
+// Missing keys are not read through from the backing store, but a new value
+// is written through to it (while the lock is held) before the cache is
+// changed, and the cache is left unchanged if that fails.
+func (lru *LRUCache) Update(key string, fn func(old Value, exists bool) (Value, bool)) (Value, bool) {
+	lru.lock()
+	defer lru.unlock()
+
+	if lru.closed {
+		return nil, false
+	}
+	element := lru.table[key]
+	if element != nil && element.Value.(*entry).expired(time.Now()) {
+		lru.removeElement(element)
+		element = nil
+	}
+
+	var old Value
+	if element != nil {
+		old = lru.copyValue(element.Value.(*entry).value)
+	}
+	value, keep := fn(old, element != nil)
+
+	if !keep {
+		if element != nil {
+			if lru.store != nil {
+				if err := lru.store.Delete(key); err != nil {
+					lru.storeError("delete", key, err)
+				}
+			}
+			lru.removeElement(element)
+		}
+		return nil, false
+	}
+
+	if !lru.writeThrough(key, value) {
+		return old, element != nil
+	}
+	value = lru.copyValue(value)
+	if element != nil {
+		e := element.Value.(*entry)
+		lru.updateInplace(element, value, e.expires, e.tags)
+	} else {
+		lru.addNew(key, value, time.Time{}, nil)
+	}
+
+	// The new value may be too large to stay in the cache
+	if lru.table[key] == nil {
+		return nil, false
+	}
+	return lru.copyValue(value), true
+}
@@ -0,0 +1,55 @@
+package cache
+
+import "encoding/gob"
+
+// RegisterValue registers the concrete type of v with encoding/gob, so
+// snapshots holding values of that type can be saved and loaded.
+// Call it once for each Value type, typically from an init function.
+// The built-in Values below are already registered.
+func RegisterValue(v Value) {
+	gob.Register(v)
+}
+
+// Bytes is a Value holding a byte slice. Its size is its length.
+type Bytes []byte
+
+// Size implements Value
+func (b Bytes) Size() int {
+	return len(b)
+}
+
+// Clone implements Cloner, so copy-on-read caches don't share the slice
+func (b Bytes) Clone() Value {
+	return append(Bytes(nil), b...)
+}
+
+// String is a Value holding a string. Its size is its length in bytes.
+type String string
+
+// Size implements Value
+func (s String) Size() int {
+	return len(s)
+}
+
+// Int64 is a Value holding an integer. Its size is 8.
+type Int64 int64
+
+// Size implements Value
+func (i Int64) Size() int {
+	return 8
+}
+
+// Float64 is a Value holding a floating-point number. Its size is 8.
+type Float64 float64
+
+// Size implements Value
+func (f Float64) Size() int {
+	return 8
+}
+
+func init() {
+	RegisterValue(Bytes(nil))
+	RegisterValue(String(""))
+	RegisterValue(Int64(0))
+	RegisterValue(Float64(0))
+}
@@ -0,0 +1,184 @@
+package cache
+
+import (
+	"maps"
+	"time"
+)
+
+// FrozenView is an immutable view of the cache entries.
+// It can be read from any number of goroutines without taking the cache lock.
+//
+// Views are copy-on-write. Every caller gets the same view until the cache
+// is next written. The first write after that copies the view's map, but not
+// the values, and updates the copy. Later writes update the copy in place
+// until it is handed out in turn. Reads don't invalidate views.
+type FrozenView struct {
+	items map[string]viewEntry
+	// order is nil once a write has been applied, until FrozenView puts
+	// the keys back in LRU order
+	order []string
+	size  uint64
+
+	// validUntil is when the first entry in the view expires
+	validUntil time.Time
+
+	copyValue func(Value) Value
+}
+
+// viewEntry is an entry as the view holds it
+type viewEntry struct {
+	value   Value
+	size    int
+	expires time.Time
+}
+
+// FrozenView returns an immutable view of the current cache entries.
+//
+// The first call builds the view, which takes time proportional to the size
+// of the cache. Until the cache is written, later calls return the same
+// view at no cost. The cache then keeps the view up to date on every write.
+// The first write after a view was returned copies its map once. A call
+// after writes walks the keys to put them back in order.
+//
+// The keys are in LRU order as of when the view was returned. Reads through
+// the view, or through the cache since then, don't change it.
+func (lru *LRUCache) FrozenView() *FrozenView {
+	lru.lock()
+	defer lru.unlock()
+
+	now := time.Now()
+	switch view := lru.view; {
+	case view == nil:
+		lru.view = lru.buildView(now)
+	case view.order == nil || !view.validUntil.IsZero() && !now.Before(view.validUntil):
+		lru.orderView(lru.writableView(), now)
+	}
+	lru.viewShared = true
+	return lru.view
+}
+
+// buildView copies the entries of the cache into a new view
+func (lru *LRUCache) buildView(now time.Time) *FrozenView {
+	view := &FrozenView{
+		items:     make(map[string]viewEntry, len(lru.table)),
+		order:     make([]string, 0, lru.list.Len()),
+		copyValue: lru.copyValue,
+	}
+	for element := lru.list.Front(); element != nil; element = element.Next() {
+		e := element.Value.(*entry)
+		if e.expired(now) {
+			continue
+		}
+		view.items[e.key] = viewEntry{value: e.value, size: e.size, expires: e.expires}
+		view.size += uint64(e.size)
+		view.order = append(view.order, e.key)
+		view.expiresAt(e.expires)
+	}
+	return view
+}
+
+// orderView puts the keys of view in the cache's LRU order, dropping the
+// entries that have expired
+func (lru *LRUCache) orderView(view *FrozenView, now time.Time) {
+	view.order = make([]string, 0, len(view.items))
+	view.validUntil = time.Time{}
+	for element := lru.list.Front(); element != nil; element = element.Next() {
+		e := element.Value.(*entry)
+		if e.expired(now) {
+			if old, ok := view.items[e.key]; ok {
+				delete(view.items, e.key)
+				view.size -= uint64(old.size)
+			}
+			continue
+		}
+		view.order = append(view.order, e.key)
+		view.expiresAt(e.expires)
+	}
+}
+
+// writableView returns the view the cache keeps, copying it first if callers
+// have been given it
+func (lru *LRUCache) writableView() *FrozenView {
+	if lru.viewShared {
+		view := *lru.view
+		view.items = maps.Clone(lru.view.items)
+		lru.view, lru.viewShared = &view, false
+	}
+	return lru.view
+}
+
+// viewSet applies a new or changed entry to the view, if there is one
+func (lru *LRUCache) viewSet(e *entry) {
+	if lru.view == nil {
+		return
+	}
+	view := lru.writableView()
+	if old, ok := view.items[e.key]; ok {
+		view.size -= uint64(old.size)
+	}
+	view.items[e.key] = viewEntry{value: e.value, size: e.size, expires: e.expires}
+	view.size += uint64(e.size)
+	view.expiresAt(e.expires)
+	view.order = nil
+}
+
+// viewDelete applies the removal of an entry to the view, if there is one
+func (lru *LRUCache) viewDelete(key string) {
+	if lru.view == nil {
+		return
+	}
+	if _, ok := lru.view.items[key]; !ok {
+		return
+	}
+	view := lru.writableView()
+	view.size -= uint64(view.items[key].size)
+	delete(view.items, key)
+	view.order = nil
+}
+
+// dropView discards the view, so the next FrozenView builds a new one
+func (lru *LRUCache) dropView() {
+	lru.view, lru.viewShared = nil, false
+}
+
+// expiresAt moves validUntil earlier if an entry expires before it
+func (view *FrozenView) expiresAt(expires time.Time) {
+	if !expires.IsZero() && (view.validUntil.IsZero() || expires.Before(view.validUntil)) {
+		view.validUntil = expires
+	}
+}
+
+// Get returns the value in the view corresponding to the given key
+func (view *FrozenView) Get(key string) (v Value, ok bool) {
+	e, ok := view.items[key]
+	if !ok {
+		return nil, false
+	}
+	return view.copyValue(e.value), true
+}
+
+// Len returns the number of entries in the view
+func (view *FrozenView) Len() int {
+	return len(view.order)
+}
+
+// Size returns the total size of the entries in the view
+func (view *FrozenView) Size() uint64 {
+	return view.size
+}
+
+// Keys returns the keys in the view, most recently used first.
+// The returned slice must not be modified.
+func (view *FrozenView) Keys() []string {
+	return view.order
+}
+
+// Range calls fn for each entry in the view, most recently used first,
+// until fn returns false
+func (view *FrozenView) Range(fn func(key string, value Value) bool) {
+	for _, key := range view.order {
+		if !fn(key, view.copyValue(view.items[key].value)) {
+			return
+		}
+	}
+}
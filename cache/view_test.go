@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// testValue is a cache value as big as its text
+type testValue string
+
+func (v testValue) Size() int {
+	return len(v)
+}
+
+func init() {
+	// Snapshots are gob-encoded
+	RegisterValue(testValue(""))
+}
+
+// cloneValue is a mutable value, copied by WithCopyOnRead
+type cloneValue struct {
+	n *int
+}
+
+func (v cloneValue) Size() int {
+	return 1
+}
+
+func (v cloneValue) Clone() Value {
+	n := *v.n
+	return cloneValue{&n}
+}
+
+func TestFrozenViewSharedUntilWritten(t *testing.T) {
+	lru := NewLRUCache(100)
+	lru.Set("a", testValue("1"))
+	lru.Set("b", testValue("22"))
+
+	view := lru.FrozenView()
+	if again := lru.FrozenView(); again != view {
+		t.Error("a second view before any write is a new one")
+	}
+	lru.Get("a")
+	if again := lru.FrozenView(); again != view {
+		t.Error("reading the cache invalidated the view")
+	}
+	if keys := view.Keys(); !slices.Equal(keys, []string{"b", "a"}) {
+		t.Errorf("view keys %v, want the order when it was taken, [b a]", keys)
+	}
+
+	lru.Set("c", testValue("333"))
+	lru.Delete("b")
+	if !slices.Equal(view.Keys(), []string{"b", "a"}) || view.Len() != 2 || view.Size() != 3 {
+		t.Errorf("writes changed the old view: keys %v, size %d", view.Keys(), view.Size())
+	}
+	if _, ok := view.Get("c"); ok {
+		t.Error("the old view has an entry set after it was taken")
+	}
+
+	next := lru.FrozenView()
+	if next == view {
+		t.Fatal("the view wasn't replaced after writes")
+	}
+	if keys := next.Keys(); !slices.Equal(keys, []string{"c", "a"}) {
+		t.Errorf("new view keys %v, want [c a]", keys)
+	}
+	if next.Size() != 4 {
+		t.Errorf("new view size %d, want 4", next.Size())
+	}
+	if v, ok := next.Get("c"); !ok || v != testValue("333") {
+		t.Errorf("new view has c = %v, %v", v, ok)
+	}
+	if _, ok := next.Get("b"); ok {
+		t.Error("the new view has the deleted entry")
+	}
+}
+
+func TestFrozenViewCopiesOnce(t *testing.T) {
+	lru := NewLRUCache(100)
+	lru.Set("a", testValue("1"))
+	view := lru.FrozenView()
+
+	lru.Set("b", testValue("2"))
+	copied := lru.view
+	if copied == view {
+		t.Fatal("the first write changed the view callers hold")
+	}
+	lru.Set("c", testValue("3"))
+	if lru.view != copied {
+		t.Error("a second write copied the view again")
+	}
+	if got := lru.FrozenView(); got != copied || got.Len() != 3 {
+		t.Errorf("the next view isn't the copy the writes updated, or has %d entries", got.Len())
+	}
+}
+
+func TestFrozenViewExpiry(t *testing.T) {
+	lru := NewLRUCache(100)
+	lru.SetWithTTL("short", testValue("1"), 20*time.Millisecond)
+	lru.Set("long", testValue("2"))
+
+	if view := lru.FrozenView(); view.Len() != 2 {
+		t.Fatalf("view has %d entries, want 2", view.Len())
+	}
+	time.Sleep(30 * time.Millisecond)
+	view := lru.FrozenView()
+	if !slices.Equal(view.Keys(), []string{"long"}) || view.Size() != 1 {
+		t.Errorf("after expiry the view has %v of size %d, want only long", view.Keys(), view.Size())
+	}
+	if _, ok := view.Get("short"); ok {
+		t.Error("the view still has the expired entry")
+	}
+	if again := lru.FrozenView(); again != view {
+		t.Error("the view was rebuilt with nothing left to expire")
+	}
+}
+
+func TestFrozenViewClearAndEviction(t *testing.T) {
+	lru := NewLRUCache(2)
+	lru.Set("a", testValue("1"))
+	lru.Set("b", testValue("2"))
+	lru.FrozenView()
+	lru.Set("c", testValue("3"))
+	if view := lru.FrozenView(); !slices.Equal(view.Keys(), []string{"c", "b"}) {
+		t.Errorf("view after eviction has %v, want [c b]", view.Keys())
+	}
+
+	lru.Clear()
+	if view := lru.FrozenView(); view.Len() != 0 || view.Size() != 0 {
+		t.Errorf("view after Clear has %d entries of size %d", view.Len(), view.Size())
+	}
+}
+
+func TestFrozenViewCopyOnRead(t *testing.T) {
+	lru := NewLRUCache(100, WithCopyOnRead())
+	n := 1
+	lru.Set("a", cloneValue{&n})
+
+	view := lru.FrozenView()
+	v, _ := view.Get("a")
+	*v.(cloneValue).n = 2
+	view.Range(func(key string, value Value) bool {
+		if got := *value.(cloneValue).n; got != 1 {
+			t.Errorf("changing a value read from the view changed the view: %d", got)
+		}
+		return true
+	})
+}
@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Warm loads keys into the cache with loader, running up to parallelism
+// loaders at once, so a cache can be filled before it serves traffic.
+// Keys already cached are skipped. Warming stops once the next value
+// wouldn't fit in the remaining capacity, so it never evicts anything;
+// list the most wanted keys first.
+//
+// Warm returns how many keys it loaded and the loader errors, each
+// wrapped with ErrLoaderFailed, or ctx.Err() if ctx was done first.
+func (lru *LRUCache) Warm(ctx context.Context, keys []string, loader func(key string) (Value, error), parallelism int) (int, error) {
+	if lru.isClosed() {
+		return 0, ErrCacheClosed
+	}
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	var (
+		mu     sync.Mutex
+		loaded int
+		full   bool
+		errs   []error
+	)
+	todo := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range todo {
+				v, err := loader(key)
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%w: %q: %w", ErrLoaderFailed, key, err))
+				} else if lru.addIfFits(key, v) {
+					loaded++
+				} else {
+					full = true
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var ctxErr error
+feed:
+	for _, key := range keys {
+		mu.Lock()
+		stop := full
+		mu.Unlock()
+		if stop {
+			break
+		}
+		if lru.contains(key) {
+			continue
+		}
+		select {
+		case todo <- key:
+		case <-ctx.Done():
+			ctxErr = ctx.Err()
+			break feed
+		}
+	}
+	close(todo)
+	wg.Wait()
+
+	if ctxErr != nil {
+		return loaded, ctxErr
+	}
+	return loaded, errors.Join(errs...)
+}
+
+// contains reports whether there is an unexpired entry for key,
+// without affecting the LRU order or the hit counts
+func (lru *LRUCache) contains(key string) bool {
+	_, ok := lru.TTL(key)
+	return ok
+}
+
+// addIfFits adds a new entry for key if there isn't one and it fits in the
+// remaining capacity. It reports false only if the value doesn't fit.
+func (lru *LRUCache) addIfFits(key string, value Value) bool {
+	if lru.isClosed() {
+		return true
+	}
+	if !lru.writeThrough(key, value) {
+		return true
+	}
+	value = lru.copyValue(value)
+
+	lru.lock()
+	defer lru.unlock()
+
+	if lru.closed || lru.table[key] != nil {
+		return true
+	}
+	if lru.size+uint64(value.Size()) > lru.capacity {
+		return false
+	}
+	lru.addNew(key, value, time.Time{}, nil)
+	return true
+}
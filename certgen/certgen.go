@@ -0,0 +1,441 @@
+// Package certgen generates keys and X.509 certificates: TLS server and
+// client certificates and CAs, S/MIME and code signing certificates, either
+// self-signed or signed by a CA. The genCrt command is its command line
+// interface, and servers can use it to make their own TLS material.
+package certgen
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Certificate profiles
+const (
+	ProfileServer   = "server"
+	ProfileSMIME    = "smime"
+	ProfileCodeSign = "codesign"
+	ProfileSPIFFE   = "spiffe"
+)
+
+// Usages of server profile certificates
+const (
+	UsageServer = "server"
+	UsageClient = "client"
+	UsageBoth   = "both"
+)
+
+// DefaultValidFor is how long certificates are valid for when neither
+// NotAfter nor ValidFor is given
+const DefaultValidFor = 365 * 24 * time.Hour
+
+// Options describe a certificate. The zero value is a self-signed TLS
+// server certificate for no names, with a new RSA key.
+type Options struct {
+	// Profile is the kind of certificate, ProfileServer if empty
+	Profile string
+	// Hosts are the names a server profile certificate is for, see ParseHosts
+	Hosts []string
+	// Usage is what a server profile certificate authenticates, UsageServer if empty
+	Usage string
+	// IsCA makes a server profile certificate a CA
+	IsCA bool
+	// PermittedDNSDomains and PermittedIPRanges limit what a CA can issue
+	// certificates for, so it is harmless for other names if it leaks.
+	// A domain permits itself and its subdomains.
+	PermittedDNSDomains []string
+	PermittedIPRanges   []*net.IPNet
+	// MaxPathLen and MaxPathLenZero limit how many CAs may follow a CA in a
+	// chain, as in x509.Certificate: unlimited if both are zero
+	MaxPathLen     int
+	MaxPathLenZero bool
+	// Emails are the addresses an S/MIME certificate is for
+	Emails []string
+	// SPIFFEID is the identity of a SPIFFE profile certificate, see
+	// ParseSPIFFEID. An ID with a path is a workload's X.509-SVID and
+	// one without is a CA signing SVIDs for the trust domain; IsCA is
+	// ignored.
+	SPIFFEID string
+
+	// Subject is the certificate subject. If it has no common name, client
+	// certificates are named by the first host and S/MIME certificates by
+	// the first email address.
+	Subject pkix.Name
+
+	// NotBefore is when the certificate becomes valid, Backdate before now
+	// if zero. NotAfter is when it expires, ValidFor (or DefaultValidFor)
+	// after now if zero.
+	NotBefore time.Time
+	NotAfter  time.Time
+	ValidFor  time.Duration
+	Backdate  time.Duration
+
+	// Key is the key to certify. If it is nil a new one is generated, on
+	// the ECDSACurve or as an RSA key of RSABits if the curve is empty.
+	Key        crypto.Signer
+	ECDSACurve string
+	RSABits    int
+
+	// OCSPServer and CRLDistributionPoints are URLs where clients can
+	// check whether the certificate has been revoked
+	OCSPServer            []string
+	CRLDistributionPoints []string
+
+	// Parent and ParentKey are the CA signing the certificate. It is
+	// self-signed if they are nil.
+	Parent    *x509.Certificate
+	ParentKey crypto.Signer
+
+	// Rand is the source of the key and serial number, crypto/rand.Reader
+	// if nil. With any other reader Generate signs deterministically, so
+	// the same bytes make the same certificate, see InsecureRand.
+	Rand io.Reader
+	// Now is the clock the validity period is relative to, time.Now if nil
+	Now func() time.Time
+}
+
+// Bundle is a generated certificate and its key
+type Bundle struct {
+	Certificate *x509.Certificate
+	Key         crypto.Signer
+	// CertPEM and KeyPEM are the certificate and the key in KeyFormatPKCS1
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+// Generate creates a key, unless opts has one, and a certificate for it
+func Generate(opts Options) (*Bundle, error) {
+	key := opts.Key
+	if key == nil {
+		var err error
+		if key, err = GenerateKeyFrom(opts.Rand, opts.ECDSACurve, opts.RSABits); err != nil {
+			return nil, err
+		}
+	}
+	template, err := Template(opts, key.Public())
+	if err != nil {
+		return nil, err
+	}
+	signer, parentKey := key, opts.ParentKey
+	if opts.Rand != nil && opts.Rand != rand.Reader {
+		signer = Deterministic(key)
+		if parentKey != nil {
+			parentKey = Deterministic(parentKey)
+		}
+	}
+	cert, err := Issue(template, key.Public(), opts.Parent, parentKey, signer)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := EncodeKeyPEM(key, KeyFormatPKCS1, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Bundle{
+		Certificate: cert,
+		Key:         key,
+		CertPEM:     CertificatePEM(cert),
+		KeyPEM:      keyPEM,
+	}, nil
+}
+
+// Template returns the certificate opts describe, for a key pub, ready to
+// be adjusted further and passed to Issue
+func Template(opts Options, pub crypto.PublicKey) (*x509.Certificate, error) {
+	serialNumber, err := NewSerialNumberFrom(opts.Rand)
+	if err != nil {
+		return nil, err
+	}
+
+	notBefore, notAfter := opts.NotBefore, opts.NotAfter
+	now := time.Now()
+	if opts.Now != nil {
+		now = opts.Now()
+	}
+	if notBefore.IsZero() {
+		if opts.Backdate < 0 {
+			return nil, errors.New("certgen: negative backdate")
+		}
+		notBefore = now.Add(-opts.Backdate)
+	}
+	if notAfter.IsZero() {
+		validFor := opts.ValidFor
+		if validFor == 0 {
+			validFor = DefaultValidFor
+		}
+		if opts.NotBefore.IsZero() {
+			notAfter = now.Add(validFor)
+		} else {
+			notAfter = notBefore.Add(validFor)
+		}
+	}
+	if !notAfter.After(notBefore) {
+		return nil, fmt.Errorf("certgen: certificate would expire at %s, before it is valid from %s", notAfter.UTC().Format(time.RFC3339), notBefore.UTC().Format(time.RFC3339))
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               opts.Subject,
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		OCSPServer:            opts.OCSPServer,
+		CRLDistributionPoints: opts.CRLDistributionPoints,
+	}
+	_, isRSA := pub.(*rsa.PublicKey)
+
+	switch opts.Profile {
+	case "", ProfileServer:
+		sans, err := ParseHosts(opts.Hosts)
+		if err != nil {
+			return nil, err
+		}
+		template.DNSNames, template.IPAddresses = sans.DNSNames, sans.IPAddresses
+		template.EmailAddresses, template.URIs = sans.EmailAddresses, sans.URIs
+
+		usage := opts.Usage
+		if usage == "" {
+			usage = UsageServer
+		}
+		template.ExtKeyUsage, template.KeyUsage, err = TLSKeyUsage(usage, pub)
+		if err != nil {
+			return nil, err
+		}
+		if usage != UsageServer && template.Subject.CommonName == "" && len(opts.Hosts) > 0 {
+			// Servers usually identify clients by their common name
+			template.Subject.CommonName = opts.Hosts[0]
+		}
+
+		if opts.IsCA {
+			template.IsCA = true
+			template.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+			template.MaxPathLen, template.MaxPathLenZero = opts.MaxPathLen, opts.MaxPathLenZero
+			if len(opts.PermittedDNSDomains) > 0 || len(opts.PermittedIPRanges) > 0 {
+				// RFC 5280 requires name constraints to be critical
+				template.PermittedDNSDomainsCritical = true
+				template.PermittedDNSDomains = opts.PermittedDNSDomains
+				template.PermittedIPRanges = opts.PermittedIPRanges
+			}
+		} else if len(opts.PermittedDNSDomains) > 0 || len(opts.PermittedIPRanges) > 0 {
+			return nil, errors.New("certgen: name constraints are only for CAs")
+		} else if opts.MaxPathLen != 0 || opts.MaxPathLenZero {
+			return nil, errors.New("certgen: path length constraints are only for CAs")
+		}
+
+	case ProfileSMIME:
+		// S/MIME certificates are end-entity certificates named by their
+		// email addresses, used to sign and encrypt mail
+		if len(opts.Emails) == 0 {
+			return nil, errors.New("certgen: S/MIME certificates need an email address")
+		}
+		template.EmailAddresses = opts.Emails
+		if template.Subject.CommonName == "" {
+			template.Subject.CommonName = opts.Emails[0]
+		}
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection}
+		if isRSA {
+			template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+		} else {
+			template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement
+		}
+
+	case ProfileSPIFFE:
+		// X.509-SVIDs have exactly one URI SAN, the SPIFFE ID, and may have
+		// DNS names and IPs too
+		id, err := ParseSPIFFEID(opts.SPIFFEID)
+		if err != nil {
+			return nil, err
+		}
+		sans, err := ParseHosts(opts.Hosts)
+		if err != nil {
+			return nil, err
+		}
+		if len(sans.URIs) > 0 || len(sans.EmailAddresses) > 0 {
+			return nil, errors.New("certgen: SPIFFE certificates can only have DNS names and IPs besides the SPIFFE ID")
+		}
+		template.URIs = []*url.URL{id}
+		template.DNSNames, template.IPAddresses = sans.DNSNames, sans.IPAddresses
+		if id.Path == "" {
+			template.IsCA = true
+			template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+		} else {
+			template.ExtKeyUsage, template.KeyUsage, _ = TLSKeyUsage(UsageBoth, pub)
+		}
+
+	case ProfileCodeSign:
+		// Code signing certificates only ever sign, and must not be CAs
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+
+	default:
+		return nil, fmt.Errorf("certgen: unrecognized profile %q", opts.Profile)
+	}
+	return template, nil
+}
+
+// Issue signs template for the key pub with parent and parentKey, or
+// self-signs it with key if parent is nil
+func Issue(template *x509.Certificate, pub crypto.PublicKey, parent *x509.Certificate, parentKey, key crypto.Signer) (*x509.Certificate, error) {
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, parentKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// CertificatePEM encodes cert as PEM
+func CertificatePEM(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+// RequestPEM returns a PEM PKCS#10 certificate signing request for key,
+// for the subject and names of template
+func RequestPEM(template *x509.Certificate, key crypto.Signer) ([]byte, error) {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:        template.Subject,
+		DNSNames:       template.DNSNames,
+		IPAddresses:    template.IPAddresses,
+		EmailAddresses: template.EmailAddresses,
+		URIs:           template.URIs,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// SubjectAltNames are the names a certificate is for, by type
+type SubjectAltNames struct {
+	DNSNames       []string
+	IPAddresses    []net.IP
+	EmailAddresses []string
+	URIs           []*url.URL
+}
+
+// ParseHosts sorts hostnames, IPs, email addresses and URIs by type.
+// Anything with a scheme is a URI and anything else with an @ an email
+// address.
+func ParseHosts(hosts []string) (SubjectAltNames, error) {
+	var sans SubjectAltNames
+	for _, h := range hosts {
+		switch {
+		case net.ParseIP(h) != nil:
+			sans.IPAddresses = append(sans.IPAddresses, net.ParseIP(h))
+
+		case strings.Contains(h, "://"):
+			u, err := url.Parse(h)
+			if err != nil {
+				return sans, err
+			}
+			sans.URIs = append(sans.URIs, u)
+
+		case strings.Contains(h, "@"):
+			addr, err := mail.ParseAddress(h)
+			if err != nil || addr.Address != h {
+				return sans, fmt.Errorf("invalid email address %q", h)
+			}
+			sans.EmailAddresses = append(sans.EmailAddresses, h)
+
+		default:
+			sans.DNSNames = append(sans.DNSNames, h)
+		}
+	}
+	return sans, nil
+}
+
+// ParseSPIFFEID parses and checks a SPIFFE ID, spiffe://<trust domain>
+// followed by a path for workloads, as the SPIFFE ID specification says
+func ParseSPIFFEID(id string) (*url.URL, error) {
+	u, err := url.Parse(id)
+	if err != nil {
+		return nil, fmt.Errorf("certgen: invalid SPIFFE ID %q: %s", id, err)
+	}
+	invalid := func(reason string) error {
+		return fmt.Errorf("certgen: invalid SPIFFE ID %q: %s", id, reason)
+	}
+	switch {
+	case u.Scheme != "spiffe":
+		return nil, invalid("the scheme must be spiffe")
+	case u.Host == "":
+		return nil, invalid("no trust domain")
+	case u.User != nil || u.Port() != "":
+		return nil, invalid("the trust domain can't have a user or port")
+	case u.RawQuery != "" || u.ForceQuery || u.Fragment != "" || u.RawFragment != "":
+		return nil, invalid("no query or fragment is allowed")
+	case u.RawPath != "":
+		return nil, invalid("the path can't be percent-encoded")
+	}
+	for _, c := range u.Host {
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return nil, invalid("the trust domain must be lowercase letters, digits, dots, dashes and underscores")
+		}
+	}
+	if u.Path != "" {
+		for _, segment := range strings.Split(strings.TrimPrefix(u.Path, "/"), "/") {
+			if segment == "" || segment == "." || segment == ".." {
+				return nil, invalid("path segments can't be empty, . or ..")
+			}
+			for _, c := range segment {
+				if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '-' || c == '_') {
+					return nil, invalid("path segments must be letters, digits, dots, dashes and underscores")
+				}
+			}
+		}
+	}
+	return u, nil
+}
+
+// TLSKeyUsage returns the key usages of a TLS certificate for usage and a
+// key of type pub. Only RSA keys are used to encrypt session keys; clients
+// only ever sign.
+func TLSKeyUsage(usage string, pub crypto.PublicKey) ([]x509.ExtKeyUsage, x509.KeyUsage, error) {
+	_, isRSA := pub.(*rsa.PublicKey)
+	switch usage {
+	case UsageServer:
+		if isRSA {
+			return []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment, nil
+		}
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, x509.KeyUsageDigitalSignature, nil
+
+	case UsageClient:
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, x509.KeyUsageDigitalSignature, nil
+
+	case UsageBoth:
+		ext := []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		if isRSA {
+			return ext, x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment, nil
+		}
+		return ext, x509.KeyUsageDigitalSignature, nil
+	}
+	return nil, 0, fmt.Errorf("unrecognized usage %q", usage)
+}
+
+// NewSerialNumber returns a random 128 bit certificate serial number
+func NewSerialNumber() (*big.Int, error) {
+	return NewSerialNumberFrom(rand.Reader)
+}
+
+// NewSerialNumberFrom is NewSerialNumber reading from random, or
+// crypto/rand.Reader if it is nil
+func NewSerialNumberFrom(random io.Reader) (*big.Int, error) {
+	if random == nil {
+		random = rand.Reader
+	}
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	return rand.Int(random, serialNumberLimit)
+}
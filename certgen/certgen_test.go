@@ -0,0 +1,336 @@
+package certgen
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testNow is the clock of every test, so validity periods are exact
+var testNow = time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+func testClock() time.Time {
+	return testNow
+}
+
+func testECDSAKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestTemplate(t *testing.T) {
+	ecKey, rsaKey := testECDSAKey(t).Public(), testRSAKey(t).Public()
+	_, permitted, _ := net.ParseCIDR("10.0.0.0/8")
+
+	tests := []struct {
+		name  string
+		opts  Options
+		pub   crypto.PublicKey
+		check func(t *testing.T, c *x509.Certificate)
+	}{
+		{
+			name: "server names by type",
+			opts: Options{Hosts: []string{"example.com", "10.1.2.3", "ops@example.com", "https://example.com/x"}},
+			pub:  ecKey,
+			check: func(t *testing.T, c *x509.Certificate) {
+				if !slices.Equal(c.DNSNames, []string{"example.com"}) {
+					t.Errorf("DNSNames = %v", c.DNSNames)
+				}
+				if len(c.IPAddresses) != 1 || !c.IPAddresses[0].Equal(net.ParseIP("10.1.2.3")) {
+					t.Errorf("IPAddresses = %v", c.IPAddresses)
+				}
+				if !slices.Equal(c.EmailAddresses, []string{"ops@example.com"}) {
+					t.Errorf("EmailAddresses = %v", c.EmailAddresses)
+				}
+				if len(c.URIs) != 1 || c.URIs[0].String() != "https://example.com/x" {
+					t.Errorf("URIs = %v", c.URIs)
+				}
+				wantUsage(t, c, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, x509.KeyUsageDigitalSignature)
+				if c.IsCA || c.Subject.CommonName != "" {
+					t.Errorf("IsCA = %v, CommonName = %q, want a leaf with no common name", c.IsCA, c.Subject.CommonName)
+				}
+			},
+		},
+		{
+			name: "RSA server encrypts session keys",
+			opts: Options{Hosts: []string{"example.com"}},
+			pub:  rsaKey,
+			check: func(t *testing.T, c *x509.Certificate) {
+				wantUsage(t, c, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment)
+			},
+		},
+		{
+			name: "client named by first host",
+			opts: Options{Hosts: []string{"alice", "bob"}, Usage: UsageClient},
+			pub:  rsaKey,
+			check: func(t *testing.T, c *x509.Certificate) {
+				wantUsage(t, c, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, x509.KeyUsageDigitalSignature)
+				if c.Subject.CommonName != "alice" {
+					t.Errorf("CommonName = %q, want alice", c.Subject.CommonName)
+				}
+			},
+		},
+		{
+			name: "client keeps given common name",
+			opts: Options{Hosts: []string{"alice"}, Usage: UsageBoth, Subject: pkix.Name{CommonName: "carol"}},
+			pub:  ecKey,
+			check: func(t *testing.T, c *x509.Certificate) {
+				wantUsage(t, c, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}, x509.KeyUsageDigitalSignature)
+				if c.Subject.CommonName != "carol" {
+					t.Errorf("CommonName = %q, want carol", c.Subject.CommonName)
+				}
+			},
+		},
+		{
+			name: "CA with name constraints",
+			opts: Options{
+				IsCA:                true,
+				PermittedDNSDomains: []string{"example.com"},
+				PermittedIPRanges:   []*net.IPNet{permitted},
+			},
+			pub: ecKey,
+			check: func(t *testing.T, c *x509.Certificate) {
+				if !c.IsCA || !c.BasicConstraintsValid {
+					t.Errorf("IsCA = %v, BasicConstraintsValid = %v", c.IsCA, c.BasicConstraintsValid)
+				}
+				if c.KeyUsage&(x509.KeyUsageCertSign|x509.KeyUsageCRLSign) != x509.KeyUsageCertSign|x509.KeyUsageCRLSign {
+					t.Errorf("KeyUsage = %b, want cert and CRL signing", c.KeyUsage)
+				}
+				if !c.PermittedDNSDomainsCritical || !slices.Equal(c.PermittedDNSDomains, []string{"example.com"}) {
+					t.Errorf("PermittedDNSDomains = %v, critical %v", c.PermittedDNSDomains, c.PermittedDNSDomainsCritical)
+				}
+				if len(c.PermittedIPRanges) != 1 || c.PermittedIPRanges[0].String() != "10.0.0.0/8" {
+					t.Errorf("PermittedIPRanges = %v", c.PermittedIPRanges)
+				}
+			},
+		},
+		{
+			name: "CA without name constraints",
+			opts: Options{IsCA: true},
+			pub:  ecKey,
+			check: func(t *testing.T, c *x509.Certificate) {
+				if !c.IsCA || c.PermittedDNSDomainsCritical {
+					t.Errorf("IsCA = %v, PermittedDNSDomainsCritical = %v", c.IsCA, c.PermittedDNSDomainsCritical)
+				}
+				if c.MaxPathLen != 0 || c.MaxPathLenZero {
+					t.Errorf("MaxPathLen = %d, MaxPathLenZero = %v, want unlimited", c.MaxPathLen, c.MaxPathLenZero)
+				}
+			},
+		},
+		{
+			name: "intermediate CA",
+			opts: Options{IsCA: true, MaxPathLenZero: true},
+			pub:  ecKey,
+			check: func(t *testing.T, c *x509.Certificate) {
+				if c.MaxPathLen != 0 || !c.MaxPathLenZero {
+					t.Errorf("MaxPathLen = %d, MaxPathLenZero = %v, want only leaves below", c.MaxPathLen, c.MaxPathLenZero)
+				}
+			},
+		},
+		{
+			name: "S/MIME named by first email",
+			opts: Options{Profile: ProfileSMIME, Emails: []string{"a@example.com", "b@example.com"}},
+			pub:  ecKey,
+			check: func(t *testing.T, c *x509.Certificate) {
+				wantUsage(t, c, []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection}, x509.KeyUsageDigitalSignature|x509.KeyUsageKeyAgreement)
+				if c.Subject.CommonName != "a@example.com" || len(c.EmailAddresses) != 2 {
+					t.Errorf("CommonName = %q, EmailAddresses = %v", c.Subject.CommonName, c.EmailAddresses)
+				}
+			},
+		},
+		{
+			name: "RSA S/MIME encrypts",
+			opts: Options{Profile: ProfileSMIME, Emails: []string{"a@example.com"}},
+			pub:  rsaKey,
+			check: func(t *testing.T, c *x509.Certificate) {
+				wantUsage(t, c, []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection}, x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment)
+			},
+		},
+		{
+			name: "SPIFFE workload",
+			opts: Options{Profile: ProfileSPIFFE, SPIFFEID: "spiffe://example.org/ns/prod/sa/web", Hosts: []string{"web.example.org"}, IsCA: true},
+			pub:  ecKey,
+			check: func(t *testing.T, c *x509.Certificate) {
+				if len(c.URIs) != 1 || c.URIs[0].String() != "spiffe://example.org/ns/prod/sa/web" {
+					t.Errorf("URIs = %v, want only the SPIFFE ID", c.URIs)
+				}
+				if !slices.Equal(c.DNSNames, []string{"web.example.org"}) {
+					t.Errorf("DNSNames = %v", c.DNSNames)
+				}
+				if c.IsCA {
+					t.Error("workload SVID is a CA")
+				}
+				wantUsage(t, c, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}, x509.KeyUsageDigitalSignature)
+			},
+		},
+		{
+			name: "SPIFFE trust domain CA",
+			opts: Options{Profile: ProfileSPIFFE, SPIFFEID: "spiffe://example.org"},
+			pub:  ecKey,
+			check: func(t *testing.T, c *x509.Certificate) {
+				if !c.IsCA {
+					t.Error("trust domain certificate is not a CA")
+				}
+				if c.KeyUsage&x509.KeyUsageCertSign == 0 {
+					t.Errorf("KeyUsage = %b, want cert signing", c.KeyUsage)
+				}
+			},
+		},
+		{
+			name: "code signing",
+			opts: Options{Profile: ProfileCodeSign, Subject: pkix.Name{CommonName: "Example Inc"}},
+			pub:  rsaKey,
+			check: func(t *testing.T, c *x509.Certificate) {
+				wantUsage(t, c, []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}, x509.KeyUsageDigitalSignature)
+				if c.IsCA {
+					t.Error("code signing certificate is a CA")
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Now = testClock
+			c, err := Template(tt.opts, tt.pub)
+			if err != nil {
+				t.Fatalf("Template: %s", err)
+			}
+			tt.check(t, c)
+		})
+	}
+}
+
+func wantUsage(t *testing.T, c *x509.Certificate, ext []x509.ExtKeyUsage, usage x509.KeyUsage) {
+	t.Helper()
+	if !slices.Equal(c.ExtKeyUsage, ext) {
+		t.Errorf("ExtKeyUsage = %v, want %v", c.ExtKeyUsage, ext)
+	}
+	if c.KeyUsage != usage {
+		t.Errorf("KeyUsage = %b, want %b", c.KeyUsage, usage)
+	}
+}
+
+func TestTemplateValidity(t *testing.T) {
+	start := time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name                string
+		opts                Options
+		notBefore, notAfter time.Time
+	}{
+		{"default", Options{}, testNow, testNow.Add(DefaultValidFor)},
+		{"backdated", Options{Backdate: time.Hour, ValidFor: 24 * time.Hour}, testNow.Add(-time.Hour), testNow.Add(24 * time.Hour)},
+		{"from start", Options{NotBefore: start, ValidFor: 24 * time.Hour}, start, start.Add(24 * time.Hour)},
+		{"until end", Options{NotAfter: start.AddDate(5, 0, 0), Backdate: time.Minute}, testNow.Add(-time.Minute), start.AddDate(5, 0, 0)},
+		{"start and end", Options{NotBefore: start, NotAfter: start.AddDate(1, 0, 0)}, start, start.AddDate(1, 0, 0)},
+	}
+	pub := testECDSAKey(t).Public()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Now = testClock
+			c, err := Template(tt.opts, pub)
+			if err != nil {
+				t.Fatalf("Template: %s", err)
+			}
+			if !c.NotBefore.Equal(tt.notBefore) || !c.NotAfter.Equal(tt.notAfter) {
+				t.Errorf("valid from %s to %s, want %s to %s", c.NotBefore, c.NotAfter, tt.notBefore, tt.notAfter)
+			}
+		})
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	_, permitted, _ := net.ParseCIDR("10.0.0.0/8")
+	tests := []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{"negative backdate", Options{Backdate: -time.Hour}, "negative backdate"},
+		{"expires before valid", Options{NotBefore: testNow, NotAfter: testNow.Add(-time.Hour)}, "before it is valid"},
+		{"expires when valid", Options{NotBefore: testNow, NotAfter: testNow}, "before it is valid"},
+		{"unknown profile", Options{Profile: "email"}, "unrecognized profile"},
+		{"unknown usage", Options{Usage: "peer"}, "unrecognized usage"},
+		{"bad email host", Options{Hosts: []string{"Ops <ops@example.com>"}}, "invalid email address"},
+		{"leaf DNS constraint", Options{PermittedDNSDomains: []string{"example.com"}}, "only for CAs"},
+		{"leaf IP constraint", Options{PermittedIPRanges: []*net.IPNet{permitted}}, "only for CAs"},
+		{"leaf path length", Options{MaxPathLenZero: true}, "only for CAs"},
+		{"S/MIME without email", Options{Profile: ProfileSMIME}, "need an email address"},
+		{"SPIFFE without ID", Options{Profile: ProfileSPIFFE}, "invalid SPIFFE ID"},
+		{"SPIFFE with URI host", Options{Profile: ProfileSPIFFE, SPIFFEID: "spiffe://example.org/web", Hosts: []string{"https://example.org"}}, "only have DNS names and IPs"},
+		{"SPIFFE with email host", Options{Profile: ProfileSPIFFE, SPIFFEID: "spiffe://example.org/web", Hosts: []string{"a@example.org"}}, "only have DNS names and IPs"},
+	}
+	pub := testECDSAKey(t).Public()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Now = testClock
+			_, err := Template(tt.opts, pub)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Template error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSPIFFEID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string // part of the error, or empty if id is valid
+	}{
+		{"spiffe://example.org", ""},
+		{"spiffe://example.org/ns/prod/sa/web", ""},
+		{"spiffe://my-domain_1.example/Web.v2/a-b_c", ""},
+		{"", "the scheme must be spiffe"},
+		{"https://example.org/web", "the scheme must be spiffe"},
+		{"SPIFFE://example.org", ""}, // url.Parse lowercases the scheme
+		{"spiffe:///web", "no trust domain"},
+		{"spiffe://user@example.org/web", "user or port"},
+		{"spiffe://example.org:8443/web", "user or port"},
+		{"spiffe://example.org/web?x=1", "no query or fragment"},
+		{"spiffe://example.org/web?", "no query or fragment"},
+		{"spiffe://example.org/web#frag", "no query or fragment"},
+		{"spiffe://example.org/a%2Fb", "percent-encoded"},
+		{"spiffe://Example.org/web", "the trust domain must be lowercase"},
+		{"spiffe://exa$mple.org", "the trust domain must be lowercase"},
+		{"spiffe://example.org/", "path segments can't be empty"},
+		{"spiffe://example.org/a//b", "path segments can't be empty"},
+		{"spiffe://example.org/a/./b", "path segments can't be empty"},
+		{"spiffe://example.org/a/../b", "path segments can't be empty"},
+		{"spiffe://example.org/a+b", "path segments must be letters"},
+		{"spiffe://example.org/a b", "can't be percent-encoded"}, // url.Parse keeps the raw path
+		{"spiffe://example.org/a:b", "path segments must be letters"},
+	}
+	for _, tt := range tests {
+		u, err := ParseSPIFFEID(tt.id)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("ParseSPIFFEID(%q): %s", tt.id, err)
+		case tt.want == "" && u.Host != "example.org" && u.Host != "my-domain_1.example":
+			t.Errorf("ParseSPIFFEID(%q) trust domain = %q", tt.id, u.Host)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("ParseSPIFFEID(%q) error = %v, want one containing %q", tt.id, err, tt.want)
+		}
+	}
+}
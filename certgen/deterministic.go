@@ -0,0 +1,157 @@
+package certgen
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/big"
+	mathrand "math/rand/v2"
+)
+
+// Reproducible certificates are for test fixtures. crypto/rand ignores
+// other readers when generating keys and ECDSA signatures, so with a
+// reader other than crypto/rand.Reader keys are derived from its bytes
+// here, and Deterministic makes signatures depend on nothing but the key
+// and message. The same bytes and Options then make the same certificate
+// with a given Go version.
+
+// InsecureRand returns a stream of bytes derived from seed alone, to use as
+// Options.Rand. Anyone who knows the seed can recreate the keys made from
+// it, so they must never protect anything.
+func InsecureRand(seed string) io.Reader {
+	return mathrand.NewChaCha8(sha256.Sum256([]byte(seed)))
+}
+
+// GenerateKeyFrom is GenerateKey reading its randomness from random. Keys
+// from readers other than crypto/rand.Reader are only as secret as the
+// reader's bytes.
+func GenerateKeyFrom(random io.Reader, curve string, rsaBits int) (crypto.Signer, error) {
+	if random == nil || random == rand.Reader {
+		return GenerateKey(curve, rsaBits)
+	}
+	switch curve {
+	case "":
+		if rsaBits == 0 {
+			rsaBits = DefaultRSABits
+		}
+		return deriveRSAKey(random, rsaBits)
+
+	case "P224":
+		return deriveECDSAKey(random, elliptic.P224())
+
+	case "P256":
+		return deriveECDSAKey(random, elliptic.P256())
+
+	case "P384":
+		return deriveECDSAKey(random, elliptic.P384())
+
+	case "P521":
+		return deriveECDSAKey(random, elliptic.P521())
+
+	default:
+		return nil, ErrUnknownCurve
+	}
+}
+
+// deriveECDSAKey reads scalars from random until one is a valid private key
+func deriveECDSAKey(random io.Reader, curve elliptic.Curve) (*ecdsa.PrivateKey, error) {
+	bitSize := curve.Params().BitSize
+	buf := make([]byte, (bitSize+7)/8)
+	for i := 0; i < 100; i++ {
+		if _, err := io.ReadFull(random, buf); err != nil {
+			return nil, err
+		}
+		// P521 scalars don't fill their bytes
+		buf[0] &= 0xff >> (8*len(buf) - bitSize)
+		if key, err := ecdsa.ParseRawPrivateKey(curve, buf); err == nil {
+			return key, nil
+		}
+	}
+	return nil, errors.New("certgen: no valid ECDSA key in the random stream")
+}
+
+// deriveRSAKey makes an RSA key of bits from primes read from random
+func deriveRSAKey(random io.Reader, bits int) (*rsa.PrivateKey, error) {
+	if bits < 1024 {
+		return nil, errors.New("certgen: RSA keys must be at least 1024 bits")
+	}
+	e := big.NewInt(65537)
+	one := big.NewInt(1)
+	for {
+		p, err := derivePrime(random, bits/2)
+		if err != nil {
+			return nil, err
+		}
+		q, err := derivePrime(random, bits-bits/2)
+		if err != nil {
+			return nil, err
+		}
+		if p.Cmp(q) == 0 {
+			continue
+		}
+		phi := new(big.Int).Mul(new(big.Int).Sub(p, one), new(big.Int).Sub(q, one))
+		d := new(big.Int).ModInverse(e, phi)
+		if d == nil {
+			continue
+		}
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: new(big.Int).Mul(p, q), E: int(e.Int64())},
+			D:         d,
+			Primes:    []*big.Int{p, q},
+		}
+		key.Precompute()
+		if err := key.Validate(); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+}
+
+// derivePrime reads odd numbers of bits with the top two bits set, so the
+// product of two is twice as long, until one is prime
+func derivePrime(random io.Reader, bits int) (*big.Int, error) {
+	buf := make([]byte, (bits+7)/8)
+	top := uint(bits % 8)
+	if top == 0 {
+		top = 8
+	}
+	for {
+		if _, err := io.ReadFull(random, buf); err != nil {
+			return nil, err
+		}
+		buf[0] &= uint8(int(1<<top) - 1)
+		if top >= 2 {
+			buf[0] |= 3 << (top - 2)
+		} else {
+			buf[0] |= 1
+			buf[1] |= 0x80
+		}
+		buf[len(buf)-1] |= 1
+		if p := new(big.Int).SetBytes(buf); p.ProbablyPrime(20) {
+			return p, nil
+		}
+	}
+}
+
+// Deterministic wraps key so its signatures depend only on the key and
+// what is signed: ECDSA signatures are made as RFC 6979 says, and RSA
+// PKCS #1 v1.5 and Ed25519 signatures are deterministic anyway
+func Deterministic(key crypto.Signer) crypto.Signer {
+	return deterministicSigner{key}
+}
+
+type deterministicSigner struct {
+	crypto.Signer
+}
+
+func (s deterministicSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, ok := s.Signer.(*ecdsa.PrivateKey); ok {
+		return s.Signer.Sign(nil, digest, opts)
+	}
+	return s.Signer.Sign(rand.Reader, digest, opts)
+}
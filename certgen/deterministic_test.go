@@ -0,0 +1,108 @@
+package certgen
+
+import (
+	"bytes"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+)
+
+func TestGenerateKeyFromSeed(t *testing.T) {
+	for _, curve := range []string{"", "P224", "P256", "P384", "P521"} {
+		t.Run("curve "+curve, func(t *testing.T) {
+			a, err := GenerateKeyFrom(InsecureRand("fixture"), curve, 1024)
+			if err != nil {
+				t.Fatalf("GenerateKeyFrom: %s", err)
+			}
+			b, err := GenerateKeyFrom(InsecureRand("fixture"), curve, 1024)
+			if err != nil {
+				t.Fatalf("GenerateKeyFrom: %s", err)
+			}
+			if !a.(equaler).Equal(b) {
+				t.Error("the same seed made different keys")
+			}
+			c, err := GenerateKeyFrom(InsecureRand("other"), curve, 1024)
+			if err != nil {
+				t.Fatalf("GenerateKeyFrom: %s", err)
+			}
+			if a.(equaler).Equal(c) {
+				t.Error("different seeds made the same key")
+			}
+		})
+	}
+	if _, err := GenerateKeyFrom(InsecureRand("fixture"), "P192", 0); err != ErrUnknownCurve {
+		t.Errorf("GenerateKeyFrom P192: %v, want ErrUnknownCurve", err)
+	}
+}
+
+func TestGenerateSeeded(t *testing.T) {
+	for _, curve := range []string{"", "P256"} {
+		t.Run("curve "+curve, func(t *testing.T) {
+			generate := func(seed string) *Bundle {
+				t.Helper()
+				ca, err := Generate(Options{
+					IsCA:       true,
+					Subject:    pkix.Name{CommonName: "Fixture CA"},
+					ECDSACurve: curve,
+					RSABits:    1024,
+					Rand:       InsecureRand(seed + " CA"),
+					Now:        testClock,
+				})
+				if err != nil {
+					t.Fatalf("Generate CA: %s", err)
+				}
+				leaf, err := Generate(Options{
+					Hosts:      []string{"example.com", "127.0.0.1"},
+					ECDSACurve: curve,
+					RSABits:    1024,
+					ValidFor:   24 * time.Hour,
+					Parent:     ca.Certificate,
+					ParentKey:  ca.Key,
+					Rand:       InsecureRand(seed),
+					Now:        testClock,
+				})
+				if err != nil {
+					t.Fatalf("Generate: %s", err)
+				}
+				if err := leaf.Certificate.CheckSignatureFrom(ca.Certificate); err != nil {
+					t.Fatalf("leaf isn't signed by the CA: %s", err)
+				}
+				return leaf
+			}
+
+			a, b := generate("fixture"), generate("fixture")
+			if !bytes.Equal(a.CertPEM, b.CertPEM) {
+				t.Error("the same seed made different certificates")
+			}
+			if !bytes.Equal(a.KeyPEM, b.KeyPEM) {
+				t.Error("the same seed made different keys")
+			}
+			if !a.Certificate.NotBefore.Equal(testNow) {
+				t.Errorf("NotBefore = %s, want the injected clock's %s", a.Certificate.NotBefore, testNow)
+			}
+
+			c := generate("other")
+			if bytes.Equal(a.CertPEM, c.CertPEM) || bytes.Equal(a.KeyPEM, c.KeyPEM) {
+				t.Error("different seeds made the same certificate or key")
+			}
+			if a.Certificate.SerialNumber.Cmp(c.Certificate.SerialNumber) == 0 {
+				t.Error("different seeds made the same serial number")
+			}
+		})
+	}
+}
+
+func TestGenerateUnseeded(t *testing.T) {
+	opts := Options{Hosts: []string{"example.com"}, ECDSACurve: "P256", Now: testClock}
+	a, err := Generate(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Generate(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(a.KeyPEM, b.KeyPEM) || a.Certificate.SerialNumber.Cmp(b.Certificate.SerialNumber) == 0 {
+		t.Error("two certificates without a seed share a key or serial number")
+	}
+}
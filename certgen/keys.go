@@ -0,0 +1,148 @@
+package certgen
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// Private key PEM formats
+const (
+	// KeyFormatPKCS1 is the traditional format of each key type: PKCS#1
+	// for RSA, SEC 1 for ECDSA and PKCS#8 for Ed25519, which has no other
+	KeyFormatPKCS1 = "pkcs1"
+	KeyFormatPKCS8 = "pkcs8"
+)
+
+// DefaultRSABits is the size of RSA keys generated when none is given
+const DefaultRSABits = 2048
+
+var (
+	ErrUnknownCurve = errors.New("certgen: unrecognized elliptic curve")
+	// ErrPassphraseRequired is returned for encrypted keys parsed without a passphrase
+	ErrPassphraseRequired = errors.New("certgen: key is encrypted")
+)
+
+// GenerateKey generates an ECDSA key on curve, one of P224, P256, P384
+// and P521, or an RSA key of rsaBits if curve is empty
+func GenerateKey(curve string, rsaBits int) (crypto.Signer, error) {
+	switch curve {
+	case "":
+		if rsaBits == 0 {
+			rsaBits = DefaultRSABits
+		}
+		return rsa.GenerateKey(rand.Reader, rsaBits)
+
+	case "P224":
+		return ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+
+	case "P256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	case "P384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+
+	case "P521":
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+
+	default:
+		return nil, ErrUnknownCurve
+	}
+}
+
+// signer checks that a parsed key is of a supported type
+func signer(priv interface{}) (crypto.Signer, error) {
+	switch key := priv.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("certgen: unsupported key type %T", priv)
+}
+
+// EncodeKeyPEM encodes priv as PEM in format, encrypted with passphrase
+// unless it is empty. Encrypted keys are always PKCS#8.
+func EncodeKeyPEM(priv crypto.Signer, format string, passphrase []byte) ([]byte, error) {
+	if len(passphrase) > 0 {
+		if format != KeyFormatPKCS8 {
+			return nil, errors.New("certgen: encrypted keys are always PKCS#8")
+		}
+		der, err := encryptPKCS8PrivateKey(priv, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}), nil
+	}
+
+	switch format {
+	case KeyFormatPKCS1:
+		switch key := priv.(type) {
+		case *rsa.PrivateKey:
+			return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), nil
+
+		case *ecdsa.PrivateKey:
+			der, err := x509.MarshalECPrivateKey(key)
+			if err != nil {
+				return nil, err
+			}
+			return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+		}
+		fallthrough
+
+	case KeyFormatPKCS8:
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+	return nil, fmt.Errorf("certgen: unrecognized key format %q", format)
+}
+
+// ParsePrivateKeyPEM parses a PKCS#1, SEC 1 or PKCS#8 PEM encoded private
+// key. Encrypted PKCS#8 keys are decrypted with passphrase.
+func ParsePrivateKeyPEM(data, passphrase []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if _, ok := block.Headers["DEK-Info"]; ok {
+		return nil, errors.New("encrypted PEM keys are not supported")
+	}
+
+	var priv interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		priv, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+
+	case "EC PRIVATE KEY":
+		priv, err = x509.ParseECPrivateKey(block.Bytes)
+
+	case "PRIVATE KEY":
+		priv, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+
+	case "ENCRYPTED PRIVATE KEY":
+		if len(passphrase) == 0 {
+			return nil, ErrPassphraseRequired
+		}
+		return decryptPKCS8PrivateKey(block.Bytes, passphrase)
+
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return signer(priv)
+}
@@ -0,0 +1,132 @@
+package certgen
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// testKeys are one key of each supported type
+func testKeys(t *testing.T) map[string]crypto.Signer {
+	t.Helper()
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]crypto.Signer{
+		"rsa":     testRSAKey(t),
+		"ecdsa":   testECDSAKey(t),
+		"ed25519": edKey,
+	}
+}
+
+type equaler interface {
+	Equal(crypto.PrivateKey) bool
+}
+
+func TestKeyPEMRoundTrip(t *testing.T) {
+	blockTypes := map[string]map[string]string{
+		KeyFormatPKCS1: {"rsa": "RSA PRIVATE KEY", "ecdsa": "EC PRIVATE KEY", "ed25519": "PRIVATE KEY"},
+		KeyFormatPKCS8: {"rsa": "PRIVATE KEY", "ecdsa": "PRIVATE KEY", "ed25519": "PRIVATE KEY"},
+	}
+	for name, key := range testKeys(t) {
+		for format, types := range blockTypes {
+			t.Run(name+"/"+format, func(t *testing.T) {
+				data, err := EncodeKeyPEM(key, format, nil)
+				if err != nil {
+					t.Fatalf("EncodeKeyPEM: %s", err)
+				}
+				if block, _ := pem.Decode(data); block == nil || block.Type != types[name] {
+					t.Errorf("PEM block %v, want %q", block, types[name])
+				}
+				parsed, err := ParsePrivateKeyPEM(data, nil)
+				if err != nil {
+					t.Fatalf("ParsePrivateKeyPEM: %s", err)
+				}
+				if !key.(equaler).Equal(parsed) {
+					t.Error("parsed key differs from the encoded one")
+				}
+			})
+		}
+	}
+}
+
+func TestEncryptedPKCS8RoundTrip(t *testing.T) {
+	passphrase := []byte("correct horse battery staple")
+	for name, key := range testKeys(t) {
+		t.Run(name, func(t *testing.T) {
+			data, err := EncodeKeyPEM(key, KeyFormatPKCS8, passphrase)
+			if err != nil {
+				t.Fatalf("EncodeKeyPEM: %s", err)
+			}
+			if block, _ := pem.Decode(data); block == nil || block.Type != "ENCRYPTED PRIVATE KEY" {
+				t.Fatalf("PEM block %v, want an encrypted private key", block)
+			}
+
+			parsed, err := ParsePrivateKeyPEM(data, passphrase)
+			if err != nil {
+				t.Fatalf("ParsePrivateKeyPEM: %s", err)
+			}
+			if !key.(equaler).Equal(parsed) {
+				t.Error("decrypted key differs from the encrypted one")
+			}
+			if _, err := ParsePrivateKeyPEM(data, nil); !errors.Is(err, ErrPassphraseRequired) {
+				t.Errorf("parsing without a passphrase: %v, want ErrPassphraseRequired", err)
+			}
+			if _, err := ParsePrivateKeyPEM(data, []byte("wrong")); err == nil {
+				t.Error("parsed with the wrong passphrase")
+			}
+		})
+	}
+}
+
+func TestEncryptedKeyNeedsPKCS8(t *testing.T) {
+	if _, err := EncodeKeyPEM(testECDSAKey(t), KeyFormatPKCS1, []byte("secret")); err == nil {
+		t.Error("encrypted a PKCS#1 key")
+	}
+}
+
+// TestEncryptedPKCS8OpenSSL checks OpenSSL reads the keys we encrypt, and
+// that we read the keys it does
+func TestEncryptedPKCS8OpenSSL(t *testing.T) {
+	openssl, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Skip("openssl is not installed")
+	}
+	dir := t.TempDir()
+	key := testECDSAKey(t)
+	data, err := EncodeKeyPEM(key, KeyFormatPKCS8, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ours := filepath.Join(dir, "ours.key")
+	if err := os.WriteFile(ours, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(openssl, "pkey", "-in", ours, "-passin", "pass:secret").CombinedOutput()
+	if err != nil {
+		t.Fatalf("openssl can't read our key: %s\n%s", err, out)
+	}
+	if parsed, err := ParsePrivateKeyPEM(out, nil); err != nil || !key.Equal(parsed) {
+		t.Errorf("openssl decrypted a different key: %v", err)
+	}
+
+	theirs := filepath.Join(dir, "theirs.key")
+	out, err = exec.Command(openssl, "pkcs8", "-topk8", "-v2", "aes-128-cbc", "-in", ours, "-passin", "pass:secret", "-out", theirs, "-passout", "pass:other").CombinedOutput()
+	if err != nil {
+		t.Fatalf("openssl pkcs8: %s\n%s", err, out)
+	}
+	data, err = os.ReadFile(theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed, err := ParsePrivateKeyPEM(data, []byte("other")); err != nil || !key.Equal(parsed) {
+		t.Errorf("reading the key openssl encrypted: %v", err)
+	}
+}
@@ -0,0 +1,381 @@
+package certgen
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"unicode/utf16"
+)
+
+// PKCS#12 (RFC 7292) encoding, using the widely supported
+// pbeWithSHAAnd3-KeyTripleDES-CBC scheme for both the key and the
+// certificates and an HMAC-SHA1 integrity MAC, as Windows and Java expect.
+
+var (
+	oidDataContentType               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEncryptedDataContentType      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+	oidPBEWithSHAAnd3KeyTripleDESCBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidPKCS8ShroudedKeyBag           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag                       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidCertTypeX509Certificate       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName                  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID                    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidSHA1                          = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+)
+
+const pkcs12Iterations = 2048
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type encryptedData struct {
+	Version              int
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"tag:0,optional"`
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue     `asn1:"tag:0,explicit"`
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+// EncodePKCS12 returns a PKCS#12 bundle holding the private key, its
+// certificate and any CA certificates, protected with password, for Java
+// keystores and Windows
+func EncodePKCS12(priv crypto.Signer, cert *x509.Certificate, caCerts []*x509.Certificate, friendlyName, password string) ([]byte, error) {
+	encodedPassword, err := bmpString(password)
+	if err != nil {
+		return nil, err
+	}
+
+	localKeyID := sha1.Sum(cert.Raw)
+	attributes, err := bagAttributes(localKeyID[:], friendlyName)
+	if err != nil {
+		return nil, err
+	}
+
+	certBags := make([]safeBag, 0, 1+len(caCerts))
+	bag, err := makeCertBag(cert.Raw, attributes)
+	if err != nil {
+		return nil, err
+	}
+	certBags = append(certBags, bag)
+	for _, caCert := range caCerts {
+		bag, err := makeCertBag(caCert.Raw, nil)
+		if err != nil {
+			return nil, err
+		}
+		certBags = append(certBags, bag)
+	}
+
+	keyBag, err := makeShroudedKeyBag(priv, encodedPassword, attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	certContent, err := makeEncryptedContentInfo(certBags, encodedPassword)
+	if err != nil {
+		return nil, err
+	}
+	keyContent, err := makeDataContentInfo([]safeBag{keyBag})
+	if err != nil {
+		return nil, err
+	}
+
+	authenticatedSafe, err := asn1.Marshal([]contentInfo{certContent, keyContent})
+	if err != nil {
+		return nil, err
+	}
+
+	macSalt := make([]byte, 8)
+	if _, err := rand.Read(macSalt); err != nil {
+		return nil, err
+	}
+	macKey := pkcs12KDF(encodedPassword, macSalt, pkcs12Iterations, 3, sha1.Size)
+	mac := hmac.New(sha1.New, macKey)
+	mac.Write(authenticatedSafe)
+
+	pfx := pfxPdu{
+		Version: 3,
+		MacData: macData{
+			Mac: digestInfo{
+				Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+				Digest:    mac.Sum(nil),
+			},
+			MacSalt:    macSalt,
+			Iterations: pkcs12Iterations,
+		},
+	}
+	pfx.AuthSafe.ContentType = oidDataContentType
+	if pfx.AuthSafe.Content, err = explicitOctetString(authenticatedSafe); err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pfx)
+}
+
+func bagAttributes(localKeyID []byte, friendlyName string) ([]pkcs12Attribute, error) {
+	var attributes []pkcs12Attribute
+
+	if friendlyName != "" {
+		name, err := bmpString(friendlyName)
+		if err != nil {
+			return nil, err
+		}
+		// Drop the terminating NUL the password encoding adds
+		name = name[:len(name)-2]
+		value, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagBMPString, Bytes: name})
+		if err != nil {
+			return nil, err
+		}
+		attributes = append(attributes, pkcs12Attribute{ID: oidFriendlyName, Value: asn1.RawValue{FullBytes: setOf(value)}})
+	}
+
+	value, err := asn1.Marshal(localKeyID)
+	if err != nil {
+		return nil, err
+	}
+	attributes = append(attributes, pkcs12Attribute{ID: oidLocalKeyID, Value: asn1.RawValue{FullBytes: setOf(value)}})
+	return attributes, nil
+}
+
+func makeCertBag(der []byte, attributes []pkcs12Attribute) (safeBag, error) {
+	value, err := asn1.Marshal(certBag{ID: oidCertTypeX509Certificate, Data: der})
+	if err != nil {
+		return safeBag{}, err
+	}
+	return safeBag{
+		ID:         oidCertBag,
+		Value:      asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: value},
+		Attributes: attributes,
+	}, nil
+}
+
+func makeShroudedKeyBag(priv interface{}, password []byte, attributes []pkcs12Attribute) (safeBag, error) {
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return safeBag{}, err
+	}
+
+	algorithm, encrypted, err := pbeEncrypt(pkcs8, password)
+	if err != nil {
+		return safeBag{}, err
+	}
+	value, err := asn1.Marshal(encryptedPrivateKeyInfo{Algorithm: algorithm, EncryptedData: encrypted})
+	if err != nil {
+		return safeBag{}, err
+	}
+	return safeBag{
+		ID:         oidPKCS8ShroudedKeyBag,
+		Value:      asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: value},
+		Attributes: attributes,
+	}, nil
+}
+
+func makeDataContentInfo(bags []safeBag) (ci contentInfo, err error) {
+	data, err := asn1.Marshal(bags)
+	if err != nil {
+		return ci, err
+	}
+	ci.ContentType = oidDataContentType
+	ci.Content, err = explicitOctetString(data)
+	return ci, err
+}
+
+func makeEncryptedContentInfo(bags []safeBag, password []byte) (ci contentInfo, err error) {
+	data, err := asn1.Marshal(bags)
+	if err != nil {
+		return ci, err
+	}
+
+	algorithm, encrypted, err := pbeEncrypt(data, password)
+	if err != nil {
+		return ci, err
+	}
+	content, err := asn1.Marshal(encryptedData{
+		Version: 0,
+		EncryptedContentInfo: encryptedContentInfo{
+			ContentType:                oidDataContentType,
+			ContentEncryptionAlgorithm: algorithm,
+			EncryptedContent:           encrypted,
+		},
+	})
+	if err != nil {
+		return ci, err
+	}
+
+	ci.ContentType = oidEncryptedDataContentType
+	ci.Content = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: content}
+	return ci, nil
+}
+
+// pbeEncrypt encrypts data with pbeWithSHAAnd3-KeyTripleDES-CBC
+func pbeEncrypt(data, password []byte) (pkix.AlgorithmIdentifier, []byte, error) {
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return pkix.AlgorithmIdentifier{}, nil, err
+	}
+	params, err := asn1.Marshal(pbeParams{Salt: salt, Iterations: pkcs12Iterations})
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, nil, err
+	}
+
+	key := pkcs12KDF(password, salt, pkcs12Iterations, 1, 24)
+	iv := pkcs12KDF(password, salt, pkcs12Iterations, 2, des.BlockSize)
+	block, err := des.NewTripleDESCipher(key)
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, nil, err
+	}
+
+	padded := pkcs7Pad(data, block.BlockSize())
+	encrypted := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, padded)
+
+	algorithm := pkix.AlgorithmIdentifier{
+		Algorithm:  oidPBEWithSHAAnd3KeyTripleDESCBC,
+		Parameters: asn1.RawValue{FullBytes: params},
+	}
+	return algorithm, encrypted, nil
+}
+
+// pkcs12KDF derives size bytes of key material for the given purpose
+// (1: key, 2: IV, 3: MAC key) as specified in RFC 7292, appendix B.2
+func pkcs12KDF(password, salt []byte, iterations int, id byte, size int) []byte {
+	const u = sha1.Size
+	const v = 64
+
+	d := bytes.Repeat([]byte{id}, v)
+	s := fillBlocks(salt, v)
+	p := fillBlocks(password, v)
+	i := append(s, p...)
+
+	one := big.NewInt(1)
+	var out []byte
+	for len(out) < size {
+		h := sha1.New()
+		h.Write(d)
+		h.Write(i)
+		a := h.Sum(nil)
+		for r := 1; r < iterations; r++ {
+			sum := sha1.Sum(a)
+			a = sum[:]
+		}
+		out = append(out, a...)
+
+		// I_j = (I_j + B + 1) mod 2^(8v) for every v-byte block of I
+		b := new(big.Int).SetBytes(fillBlocks(a[:u], v)[:v])
+		b.Add(b, one)
+		for j := 0; j < len(i); j += v {
+			block := new(big.Int).SetBytes(i[j : j+v])
+			block.Add(block, b)
+			sum := block.Bytes()
+			if len(sum) > v {
+				sum = sum[len(sum)-v:]
+			}
+			copy(i[j:j+v], make([]byte, v-len(sum)))
+			copy(i[j+v-len(sum):j+v], sum)
+		}
+	}
+	return out[:size]
+}
+
+// fillBlocks repeats data to fill a whole number of v-byte blocks
+func fillBlocks(data []byte, v int) []byte {
+	if len(data) == 0 {
+		return nil
+	}
+	n := v * ((len(data) + v - 1) / v)
+	out := make([]byte, n)
+	for i := range out {
+		out[i] = data[i%len(data)]
+	}
+	return out
+}
+
+// bmpString encodes s as a NUL-terminated big-endian UTF-16 string,
+// the password format PKCS#12 expects
+func bmpString(s string) ([]byte, error) {
+	out := make([]byte, 0, 2*len(s)+2)
+	for _, r := range s {
+		if r > 0xFFFF {
+			return nil, errors.New("pkcs12: character outside the Basic Multilingual Plane")
+		}
+		if utf16.IsSurrogate(r) {
+			return nil, errors.New("pkcs12: invalid character in string")
+		}
+		out = append(out, byte(r>>8), byte(r))
+	}
+	return append(out, 0, 0), nil
+}
+
+func pkcs7Pad(data []byte, blockSize int) []byte {
+	n := blockSize - len(data)%blockSize
+	return append(append([]byte{}, data...), bytes.Repeat([]byte{byte(n)}, n)...)
+}
+
+func explicitOctetString(data []byte) (asn1.RawValue, error) {
+	octets, err := asn1.Marshal(data)
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: octets}, nil
+}
+
+// setOf wraps a DER encoded value in a SET
+func setOf(der []byte) []byte {
+	set, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: der})
+	return set
+}
@@ -0,0 +1,265 @@
+package certgen
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testPKCS12 is what decodePKCS12 found in a bundle
+type testPKCS12 struct {
+	key          crypto.PrivateKey
+	keyID        []byte
+	certs        []*x509.Certificate
+	certKeyIDs   [][]byte
+	friendlyName string
+}
+
+// decodePKCS12 undoes EncodePKCS12, checking the MAC, so the bundle is
+// tested without depending on another implementation
+func decodePKCS12(t *testing.T, der []byte, password string) (*testPKCS12, error) {
+	t.Helper()
+	encodedPassword, err := bmpString(password)
+	if err != nil {
+		return nil, err
+	}
+
+	var pfx pfxPdu
+	if rest, err := asn1.Unmarshal(der, &pfx); err != nil || len(rest) > 0 {
+		return nil, errors.Join(errors.New("not one PFX"), err)
+	}
+	if pfx.Version != 3 || !pfx.AuthSafe.ContentType.Equal(oidDataContentType) {
+		return nil, errors.New("unexpected PFX version or content type")
+	}
+	var authenticatedSafe []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authenticatedSafe); err != nil {
+		return nil, err
+	}
+
+	macKey := pkcs12KDF(encodedPassword, pfx.MacData.MacSalt, pfx.MacData.Iterations, 3, sha1.Size)
+	mac := hmac.New(sha1.New, macKey)
+	mac.Write(authenticatedSafe)
+	if !hmac.Equal(mac.Sum(nil), pfx.MacData.Mac.Digest) {
+		return nil, errors.New("MAC mismatch")
+	}
+
+	var contents []contentInfo
+	if _, err := asn1.Unmarshal(authenticatedSafe, &contents); err != nil {
+		return nil, err
+	}
+	var p12 testPKCS12
+	for _, ci := range contents {
+		var data []byte
+		switch {
+		case ci.ContentType.Equal(oidDataContentType):
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &data); err != nil {
+				return nil, err
+			}
+		case ci.ContentType.Equal(oidEncryptedDataContentType):
+			var encrypted encryptedData
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &encrypted); err != nil {
+				return nil, err
+			}
+			info := encrypted.EncryptedContentInfo
+			if data, err = pbeDecrypt(info.ContentEncryptionAlgorithm.Algorithm, info.ContentEncryptionAlgorithm.Parameters.FullBytes, info.EncryptedContent, encodedPassword); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errors.New("unexpected content type " + ci.ContentType.String())
+		}
+
+		var bags []safeBag
+		if _, err := asn1.Unmarshal(data, &bags); err != nil {
+			return nil, err
+		}
+		for _, bag := range bags {
+			keyID, name := bagAttributeValues(t, bag.Attributes)
+			switch {
+			case bag.ID.Equal(oidCertBag):
+				var cb certBag
+				if _, err := asn1.Unmarshal(bag.Value.Bytes, &cb); err != nil {
+					return nil, err
+				}
+				cert, err := x509.ParseCertificate(cb.Data)
+				if err != nil {
+					return nil, err
+				}
+				p12.certs = append(p12.certs, cert)
+				p12.certKeyIDs = append(p12.certKeyIDs, keyID)
+
+			case bag.ID.Equal(oidPKCS8ShroudedKeyBag):
+				var info encryptedPrivateKeyInfo
+				if _, err := asn1.Unmarshal(bag.Value.Bytes, &info); err != nil {
+					return nil, err
+				}
+				plain, err := pbeDecrypt(info.Algorithm.Algorithm, info.Algorithm.Parameters.FullBytes, info.EncryptedData, encodedPassword)
+				if err != nil {
+					return nil, err
+				}
+				if p12.key, err = x509.ParsePKCS8PrivateKey(plain); err != nil {
+					return nil, err
+				}
+				p12.keyID, p12.friendlyName = keyID, name
+
+			default:
+				return nil, errors.New("unexpected bag " + bag.ID.String())
+			}
+		}
+	}
+	return &p12, nil
+}
+
+// pbeDecrypt undoes pbeEncrypt
+func pbeDecrypt(algorithm asn1.ObjectIdentifier, params, data, password []byte) ([]byte, error) {
+	if !algorithm.Equal(oidPBEWithSHAAnd3KeyTripleDESCBC) {
+		return nil, errors.New("unexpected encryption " + algorithm.String())
+	}
+	var pbe pbeParams
+	if _, err := asn1.Unmarshal(params, &pbe); err != nil {
+		return nil, err
+	}
+	block, err := des.NewTripleDESCipher(pkcs12KDF(password, pbe.Salt, pbe.Iterations, 1, 24))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errors.New("ciphertext is not whole blocks")
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, pkcs12KDF(password, pbe.Salt, pbe.Iterations, 2, des.BlockSize)).CryptBlocks(plain, data)
+	n := int(plain[len(plain)-1])
+	if n == 0 || n > block.BlockSize() || !bytes.Equal(plain[len(plain)-n:], bytes.Repeat([]byte{byte(n)}, n)) {
+		return nil, errors.New("bad padding")
+	}
+	return plain[:len(plain)-n], nil
+}
+
+// bagAttributeValues returns the local key ID and friendly name of a bag
+func bagAttributeValues(t *testing.T, attributes []pkcs12Attribute) (keyID []byte, name string) {
+	t.Helper()
+	for _, attribute := range attributes {
+		var values []asn1.RawValue
+		if _, err := asn1.UnmarshalWithParams(attribute.Value.FullBytes, &values, "set"); err != nil || len(values) != 1 {
+			t.Fatalf("attribute %s is not a set of one value: %v", attribute.ID, err)
+		}
+		switch {
+		case attribute.ID.Equal(oidLocalKeyID):
+			if _, err := asn1.Unmarshal(values[0].FullBytes, &keyID); err != nil {
+				t.Fatal(err)
+			}
+		case attribute.ID.Equal(oidFriendlyName):
+			if values[0].Tag != asn1.TagBMPString {
+				t.Fatalf("friendly name has tag %d, want a BMPString", values[0].Tag)
+			}
+			var runes []rune
+			for i := 0; i+1 < len(values[0].Bytes); i += 2 {
+				runes = append(runes, rune(values[0].Bytes[i])<<8|rune(values[0].Bytes[i+1]))
+			}
+			name = string(runes)
+		}
+	}
+	return keyID, name
+}
+
+// testChain is a CA and a leaf certificate it signed
+func testChain(t *testing.T) (leaf *Bundle, ca *Bundle) {
+	t.Helper()
+	ca, err := Generate(Options{IsCA: true, ECDSACurve: "P256", Now: testClock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err = Generate(Options{
+		Hosts:      []string{"example.com"},
+		ECDSACurve: "P256",
+		Parent:     ca.Certificate,
+		ParentKey:  ca.Key,
+		Now:        testClock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf, ca
+}
+
+func TestEncodePKCS12(t *testing.T) {
+	leaf, ca := testChain(t)
+	der, err := EncodePKCS12(leaf.Key, leaf.Certificate, []*x509.Certificate{ca.Certificate}, "web server", "pässword")
+	if err != nil {
+		t.Fatalf("EncodePKCS12: %s", err)
+	}
+
+	p12, err := decodePKCS12(t, der, "pässword")
+	if err != nil {
+		t.Fatalf("decoding: %s", err)
+	}
+	if !leaf.Key.(equaler).Equal(p12.key) {
+		t.Error("bundled key differs")
+	}
+	if len(p12.certs) != 2 || !p12.certs[0].Equal(leaf.Certificate) || !p12.certs[1].Equal(ca.Certificate) {
+		t.Fatalf("bundled %d certificates, want the leaf then the CA", len(p12.certs))
+	}
+	if p12.friendlyName != "web server" {
+		t.Errorf("friendly name %q, want %q", p12.friendlyName, "web server")
+	}
+	// The key and its certificate are paired by local key ID; the CA isn't
+	if len(p12.keyID) == 0 || !bytes.Equal(p12.keyID, p12.certKeyIDs[0]) || p12.certKeyIDs[1] != nil {
+		t.Errorf("local key IDs: key %x, certificates %x", p12.keyID, p12.certKeyIDs)
+	}
+
+	if _, err := decodePKCS12(t, der, "password"); err == nil {
+		t.Error("decoded with the wrong password")
+	}
+}
+
+func TestEncodePKCS12Password(t *testing.T) {
+	leaf, _ := testChain(t)
+	if _, err := EncodePKCS12(leaf.Key, leaf.Certificate, nil, "", "emoji 🔑"); err == nil {
+		t.Error("encoded a password outside the Basic Multilingual Plane")
+	}
+	der, err := EncodePKCS12(leaf.Key, leaf.Certificate, nil, "", "")
+	if err != nil {
+		t.Fatalf("EncodePKCS12 with no password: %s", err)
+	}
+	if p12, err := decodePKCS12(t, der, ""); err != nil || p12.friendlyName != "" || len(p12.certs) != 1 {
+		t.Errorf("decoding a bundle with no password or name: %v", err)
+	}
+}
+
+// TestEncodePKCS12OpenSSL checks OpenSSL reads our bundles, as the Java
+// and Windows stores they are for are harder to run in a test
+func TestEncodePKCS12OpenSSL(t *testing.T) {
+	openssl, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Skip("openssl is not installed")
+	}
+	leaf, ca := testChain(t)
+	der, err := EncodePKCS12(leaf.Key, leaf.Certificate, []*x509.Certificate{ca.Certificate}, "web", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "bundle.p12")
+	if err := os.WriteFile(path, der, 0600); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(openssl, "pkcs12", "-in", path, "-passin", "pass:secret", "-nodes").CombinedOutput()
+	if err != nil {
+		t.Fatalf("openssl can't read the bundle: %s\n%s", err, out)
+	}
+	if n := strings.Count(string(out), "BEGIN CERTIFICATE"); n != 2 {
+		t.Errorf("openssl found %d certificates, want 2", n)
+	}
+	if !strings.Contains(string(out), "friendlyName: web") {
+		t.Errorf("openssl didn't find the friendly name:\n%s", out)
+	}
+}
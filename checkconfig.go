@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/muthubro/ready-set-go/config"
+)
+
+// serverConfig is the typed form of the server's flags
+func serverConfig() config.Server {
+	var server config.Server
+	if err := config.Decode(flag.CommandLine, &server); err != nil {
+		// Every flag named by config.Server is defined in main
+		panic(err)
+	}
+	return server
+}
+
+// checkConfig reports every setting that is invalid, alone or with the
+// others, so they can all be fixed at once
+func checkConfig() error {
+	var errs []error
+	problem := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	server := serverConfig()
+	if err := server.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if server.Cache.URL != "" {
+		if _, err := newRedisCache(server.Cache.URL, "", 0); err != nil {
+			problem("--cache-url: %s", err)
+		}
+	}
+	durations := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"probe-interval", *probeInterval},
+		{"probe-max-latency", *probeMaxLatency},
+	}
+	for _, d := range durations {
+		if d.d <= 0 {
+			problem("--%s must be positive, not %s", d.name, d.d)
+		}
+	}
+
+	if _, err := parseQuotas(*providerQuotas); err != nil {
+		problem("--provider-quotas: %s", err)
+	}
+
+	if *adminTLSDir != "" && len(config.SplitList(*adminHosts)) == 0 {
+		problem("--admin-mtls needs --admin-hosts for the listener's certificate")
+	}
+	if *tlsHosts == "" {
+		if *acmeDirectory != "" {
+			problem("--acme-directory needs --tls-hosts to get certificates for")
+		}
+	} else if *adminTLSDir != "" && server.AdminAddr == server.TLSAddr {
+		problem("--admin-addr and --tls-addr are both %s", server.TLSAddr)
+	}
+	if *acmeEmail != "" && *acmeDirectory == "" {
+		problem("--acme-email is only used with --acme-directory")
+	}
+	return errors.Join(errs...)
+}
+
+// loopbackURL is the URL of the HTTP listener on addr over loopback
+func loopbackURL(addr string) string {
+	_, port, _ := net.SplitHostPort(addr)
+	return "http://" + net.JoinHostPort("127.0.0.1", port)
+}
@@ -0,0 +1,290 @@
+// Package config sets up the weather server and genCrt from a config file
+// and the environment as well as their command line flags. Every setting is
+// a flag, and is taken from the first of:
+//
+//  1. the command line
+//  2. the environment variable named after the flag, with a prefix for the
+//     program: WEATHER_CACHE_CAPACITY for the server's --cache-capacity
+//  3. the config file, named by the flag FileFlag
+//  4. the default of the flag
+//
+// The config file is a JSON object of settings by flag name. Lists can be
+// given as arrays, and strings can refer to environment variables as ${VAR},
+// or as ${VAR:-default} for default when VAR is unset or empty, so secrets
+// can be kept out of the file. $$ is a literal $.
+//
+//	{
+//	  "cache-capacity": 5000,
+//	  "warm-cities": ["London", "Paris"],
+//	  "openweathermap-api-key": "${OWM_API_KEY}"
+//	}
+//
+// Once loaded, Decode fills the typed sections Server and GenCrt from the
+// flags, and their Validate methods report every invalid setting.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FileFlag is the flag naming the config file. It can be set on the command
+// line and in the environment, but not in the file itself.
+const FileFlag = "config"
+
+// Load sets the flags of fs that weren't given on the command line from the
+// environment, and then those still unset from the config file, if fs has a
+// FileFlag that names one. It must be called after fs.Parse. Flags set by
+// Load count as set for fs.Visit.
+//
+// Aliases are older environment variables still read for a flag when its
+// own isn't set.
+//
+// Every invalid setting is reported, not just the first.
+func Load(fs *flag.FlagSet, envPrefix string, aliases ...Alias) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] {
+			return
+		}
+		name := EnvName(envPrefix, f.Name)
+		value, ok := os.LookupEnv(name)
+		for _, alias := range aliases {
+			if !ok && alias.Flag == f.Name {
+				name = alias.Env
+				value, ok = os.LookupEnv(name)
+			}
+		}
+		if ok {
+			if err := setFlag(fs, f.Name, value); err != nil {
+				errs = append(errs, fmt.Errorf("$%s: %s", name, err))
+			}
+			set[f.Name] = true
+		}
+	})
+
+	if file := fs.Lookup(FileFlag); file != nil && file.Value.String() != "" {
+		errs = append(errs, loadFile(fs, file.Value.String(), set)...)
+	}
+	return errors.Join(errs...)
+}
+
+// Alias is another environment variable setting a flag, kept from before
+// the flag had one of its own
+type Alias struct {
+	Flag, Env string
+}
+
+// EnvName is the environment variable for the flag name of a program
+func EnvName(prefix, name string) string {
+	return prefix + "_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadFile sets the flags of fs not in set from the config file at path
+func loadFile(fs *flag.FlagSet, path string, set map[string]bool) []error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return []error{err}
+	}
+	var settings map[string]json.RawMessage
+	if err := json.Unmarshal(data, &settings); err != nil {
+		var syntax *json.SyntaxError
+		if errors.As(err, &syntax) {
+			line, col := position(data, syntax.Offset)
+			return []error{fmt.Errorf("%s:%d:%d: %s", path, line, col, err)}
+		}
+		return []error{fmt.Errorf("%s: %s", path, err)}
+	}
+
+	// Sorted, so errors are reported in the same order every time
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		f := fs.Lookup(name)
+		switch {
+		case f == nil:
+			if suggestion := closest(fs, name); suggestion != "" {
+				errs = append(errs, fmt.Errorf("%s: unknown setting %q, did you mean %q?", path, name, suggestion))
+			} else {
+				errs = append(errs, fmt.Errorf("%s: unknown setting %q", path, name))
+			}
+			continue
+		case name == FileFlag:
+			errs = append(errs, fmt.Errorf("%s: %s can't be set in the config file", path, FileFlag))
+			continue
+		case set[name]:
+			continue
+		}
+
+		value, err := flagValue(settings[name])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: %s", path, name, err))
+			continue
+		}
+		if err := setFlag(fs, name, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: %s", path, name, err))
+		}
+	}
+	return errs
+}
+
+// setFlag sets a flag, explaining what durations look like if it is one
+func setFlag(fs *flag.FlagSet, name, value string) error {
+	err := fs.Set(name, value)
+	if err == nil {
+		return nil
+	}
+	if getter, ok := fs.Lookup(name).Value.(flag.Getter); ok {
+		if _, ok := getter.Get().(time.Duration); ok {
+			return fmt.Errorf("invalid value %q: want a duration such as 90s, 5m or 1h30m", value)
+		}
+	}
+	return fmt.Errorf("invalid value %q: %s", value, err)
+}
+
+// flagValue converts a JSON setting to the text of a flag value. Strings
+// are expanded, and lists joined with commas.
+func flagValue(raw json.RawMessage) (string, error) {
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	// Numbers are kept as written, so 1e3 isn't turned into an int flag's 1000
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		return "", err
+	}
+
+	switch v := v.(type) {
+	case string:
+		return Expand(v)
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		if v {
+			return "true", nil
+		}
+		return "false", nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			switch item := item.(type) {
+			case string:
+				expanded, err := Expand(item)
+				if err != nil {
+					return "", err
+				}
+				items[i] = expanded
+			case json.Number:
+				items[i] = item.String()
+			default:
+				return "", errors.New("lists may only hold strings and numbers")
+			}
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", errors.New("want a string, number, boolean or list")
+	}
+}
+
+// Expand replaces ${VAR} and ${VAR:-default} in s with the values of
+// environment variables, and $$ with $. Other $ are left alone. It is an
+// error for VAR to be unset without a default, so typos don't silently
+// become empty settings.
+func Expand(s string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '$')
+		if i < 0 || i == len(s)-1 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		b.WriteString(s[:i])
+		s = s[i:]
+
+		switch s[1] {
+		case '$':
+			b.WriteByte('$')
+			s = s[2:]
+
+		case '{':
+			end := strings.IndexByte(s, '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated %q", s)
+			}
+			name, fallback, hasFallback := strings.Cut(s[2:end], ":-")
+			if name == "" {
+				return "", fmt.Errorf("no variable name in %q", s[:end+1])
+			}
+			value, ok := os.LookupEnv(name)
+			switch {
+			case hasFallback && value == "":
+				value = fallback
+			case !ok:
+				return "", fmt.Errorf("${%s} is not set; use ${%s:-default} to make it optional", name, name)
+			}
+			b.WriteString(value)
+			s = s[end+1:]
+
+		default:
+			b.WriteByte('$')
+			s = s[1:]
+		}
+	}
+}
+
+// position is the line and column of an offset into data
+func position(data []byte, offset int64) (line, col int) {
+	offset = min(offset, int64(len(data)))
+	line = 1 + bytes.Count(data[:offset], []byte("\n"))
+	col = int(offset) - bytes.LastIndexByte(data[:offset], '\n')
+	return line, col
+}
+
+// closest returns the flag of fs most like name, if one is close enough to
+// be a likely typo
+func closest(fs *flag.FlagSet, name string) string {
+	best, bestDistance := "", len(name)/3+1
+	fs.VisitAll(func(f *flag.Flag) {
+		if d := editDistance(name, f.Name); d < bestDistance {
+			best, bestDistance = f.Name, d
+		}
+	})
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,300 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unsetenv unsets an environment variable for the rest of the test
+func unsetenv(t *testing.T, name string) {
+	t.Helper()
+	t.Setenv(name, "")
+	os.Unsetenv(name)
+}
+
+func TestExpand(t *testing.T) {
+	t.Setenv("CONFIG_TEST_SET", "secret")
+	t.Setenv("CONFIG_TEST_EMPTY", "")
+	unsetenv(t, "CONFIG_TEST_UNSET")
+
+	tests := []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{"${CONFIG_TEST_SET}", "secret"},
+		{"key=${CONFIG_TEST_SET}!", "key=secret!"},
+		{"${CONFIG_TEST_SET:-default}", "secret"},
+		{"${CONFIG_TEST_UNSET:-default}", "default"},
+		{"${CONFIG_TEST_EMPTY:-default}", "default"},
+		{"${CONFIG_TEST_EMPTY}", ""},
+		{"${CONFIG_TEST_UNSET:-}", ""},
+		{"$${CONFIG_TEST_SET}", "${CONFIG_TEST_SET}"},
+		{"$$$$", "$$"},
+		{"cost: $5", "cost: $5"},
+		{"trailing $", "trailing $"},
+		{"$CONFIG_TEST_SET", "$CONFIG_TEST_SET"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := Expand(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Expand(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+
+	failures := []struct {
+		in, want string
+	}{
+		{"${CONFIG_TEST_UNSET}", "${CONFIG_TEST_UNSET} is not set"},
+		{"${CONFIG_TEST_SET", "unterminated"},
+		{"${}", "no variable name"},
+		{"${:-default}", "no variable name"},
+	}
+	for _, tt := range failures {
+		t.Run(tt.in, func(t *testing.T) {
+			_, err := Expand(tt.in)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Expand(%q) returned %v, want an error containing %q", tt.in, err, tt.want)
+			}
+		})
+	}
+}
+
+// testFlags is a flag set like a program's, with a config file flag
+func testFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String(FileFlag, "", "")
+	fs.String("addr", ":8080", "")
+	fs.Uint64("cache-capacity", 1000, "")
+	fs.Duration("cache-fresh-for", 10*time.Minute, "")
+	fs.String("warm-cities", "", "")
+	fs.String("client-secret", "", "")
+	fs.Bool("verbose", false, "")
+	return fs
+}
+
+// writeConfig writes a config file and returns its path
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeConfig(t, `{
+		"addr": ":1",
+		"cache-capacity": 3,
+		"cache-fresh-for": "3m",
+		"warm-cities": ["London", "${CONFIG_TEST_CITY}"],
+		"verbose": true
+	}`)
+	t.Setenv("CONFIG_TEST_CITY", "Paris")
+	t.Setenv("TEST_CONFIG", file)
+	t.Setenv("TEST_ADDR", ":2")
+	t.Setenv("TEST_CACHE_CAPACITY", "2")
+	unsetenv(t, "TEST_CACHE_FRESH_FOR")
+	unsetenv(t, "TEST_WARM_CITIES")
+	unsetenv(t, "TEST_VERBOSE")
+	unsetenv(t, "TEST_CLIENT_SECRET")
+
+	fs := testFlags()
+	if err := fs.Parse([]string{"--addr", ":3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Load(fs, "TEST"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"addr":            ":3",   // the command line over the rest
+		"cache-capacity":  "2",    // the environment over the file
+		"cache-fresh-for": "3m0s", // the file over the default
+		"warm-cities":     "London,Paris",
+		"verbose":         "true",
+		"client-secret":   "", // the default
+	}
+	for name, value := range want {
+		if got := fs.Lookup(name).Value.String(); got != value {
+			t.Errorf("--%s = %q, want %q", name, got, value)
+		}
+	}
+
+	var set []string
+	fs.Visit(func(f *flag.Flag) {
+		set = append(set, f.Name)
+	})
+	if want := []string{"addr", "cache-capacity", "cache-fresh-for", FileFlag, "verbose", "warm-cities"}; !slices.Equal(set, want) {
+		t.Errorf("flags set are %v, want %v", set, want)
+	}
+}
+
+func TestLoadAlias(t *testing.T) {
+	t.Setenv("OLD_SECRET", "old")
+	unsetenv(t, "TEST_CLIENT_SECRET")
+
+	fs := testFlags()
+	if err := Load(fs, "TEST", Alias{Flag: "client-secret", Env: "OLD_SECRET"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := fs.Lookup("client-secret").Value.String(); got != "old" {
+		t.Errorf("--client-secret = %q from the alias, want %q", got, "old")
+	}
+
+	// The flag's own variable is read first
+	t.Setenv("TEST_CLIENT_SECRET", "new")
+	fs = testFlags()
+	if err := Load(fs, "TEST", Alias{Flag: "client-secret", Env: "OLD_SECRET"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := fs.Lookup("client-secret").Value.String(); got != "new" {
+		t.Errorf("--client-secret = %q, want %q over the alias", got, "new")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	unsetenv(t, "TEST_CONFIG")
+	unsetenv(t, "CONFIG_TEST_UNSET")
+
+	tests := []struct {
+		name, file string
+		env        map[string]string
+		want       []string
+	}{
+		{
+			name: "typo",
+			file: `{"cache-capacty": 5}`,
+			want: []string{`unknown setting "cache-capacty", did you mean "cache-capacity"?`},
+		},
+		{
+			name: "unknown",
+			file: `{"colour": "blue"}`,
+			want: []string{`unknown setting "colour"`},
+		},
+		{
+			name: "config in the file",
+			file: `{"config": "other.json"}`,
+			want: []string{"config can't be set in the config file"},
+		},
+		{
+			name: "syntax",
+			file: "{\n  \"addr\": ,\n}",
+			want: []string{"config.json:2:"},
+		},
+		{
+			name: "duration",
+			file: `{"cache-fresh-for": "10"}`,
+			want: []string{`cache-fresh-for: invalid value "10": want a duration such as 90s`},
+		},
+		{
+			name: "unset variable",
+			file: `{"client-secret": "${CONFIG_TEST_UNSET}"}`,
+			want: []string{"client-secret: ${CONFIG_TEST_UNSET} is not set"},
+		},
+		{
+			name: "object",
+			file: `{"warm-cities": {"London": true}}`,
+			want: []string{"warm-cities: want a string, number, boolean or list"},
+		},
+		{
+			name: "every error",
+			file: `{"cache-capacty": 5, "cache-capacity": "lots"}`,
+			env:  map[string]string{"TEST_VERBOSE": "maybe"},
+			want: []string{
+				`$TEST_VERBOSE: invalid value "maybe"`,
+				`cache-capacity: invalid value "lots"`,
+				`did you mean "cache-capacity"?`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unsetenv(t, "TEST_VERBOSE")
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			fs := testFlags()
+			if err := fs.Parse([]string{"--config", writeConfig(t, tt.file)}); err != nil {
+				t.Fatal(err)
+			}
+			err := Load(fs, "TEST")
+			if err == nil {
+				t.Fatal("Load succeeded")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Load returned %q, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestClosest(t *testing.T) {
+	fs := testFlags()
+	tests := []struct {
+		name, want string
+	}{
+		{"adr", "addr"},
+		{"cache_capacity", "cache-capacity"},
+		{"cache-freshfor", "cache-fresh-for"},
+		{"cache-fresh", ""},
+		{"warm-city", "warm-cities"},
+		{"port", ""},
+		{"capacity", ""},
+	}
+	for _, tt := range tests {
+		if got := closest(fs, tt.name); got != tt.want {
+			t.Errorf("closest(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"addr", "", 4},
+		{"", "addr", 4},
+		{"addr", "addr", 0},
+		{"adr", "addr", 1},
+		{"addr", "adr", 1},
+		{"kitten", "sitting", 3},
+		{"cache_capacity", "cache-capacity", 1},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{" , ,", nil},
+		{"London", []string{"London"}},
+		{"London, Paris ,,Rome", []string{"London", "Paris", "Rome"}},
+	}
+	for _, tt := range tests {
+		if got := SplitList(tt.in); !slices.Equal(got, tt.want) {
+			t.Errorf("SplitList(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Server is the weather server's listener, cache and sign in settings.
+// Its other settings, such as the providers and the TLS hosts, are still
+// read from their flags.
+type Server struct {
+	Addr         string `flag:"addr"`
+	AdminAddr    string `flag:"admin-addr"`
+	TLSAddr      string `flag:"tls-addr"`
+	ACMEHTTPAddr string `flag:"acme-http-addr"`
+
+	Cache Cache
+	OIDC  OIDC
+}
+
+// Cache is the weather server's cache settings
+type Cache struct {
+	Capacity      uint64        `flag:"cache-capacity"`
+	Snapshot      string        `flag:"cache-snapshot"`
+	SnapshotEvery time.Duration `flag:"cache-snapshot-every"`
+	SnapshotAfter uint64        `flag:"cache-snapshot-after"`
+	FreshFor      time.Duration `flag:"cache-fresh-for"`
+	StaleFor      time.Duration `flag:"cache-stale-for"`
+	NegativeTTL   time.Duration `flag:"cache-negative-ttl"`
+	URL           string        `flag:"cache-url"`
+}
+
+// OIDC is the OpenID Connect sign in settings of the weather server. Sign
+// in is off unless Issuer is set.
+type OIDC struct {
+	Issuer         string   `flag:"oidc-issuer"`
+	ClientID       string   `flag:"oidc-client-id"`
+	ClientSecret   string   `flag:"oidc-client-secret"`
+	RedirectURL    string   `flag:"oidc-redirect-url"`
+	GroupsClaim    string   `flag:"oidc-groups-claim"`
+	AdminGroups    []string `flag:"oidc-admin-groups"`
+	OperatorGroups []string `flag:"oidc-operator-groups"`
+}
+
+// Validate reports every server setting that is invalid
+func (s Server) Validate() error {
+	var errs []error
+	addrs := []struct {
+		name, addr string
+	}{
+		{"addr", s.Addr},
+		{"admin-addr", s.AdminAddr},
+		{"tls-addr", s.TLSAddr},
+		{"acme-http-addr", s.ACMEHTTPAddr},
+	}
+	for _, a := range addrs {
+		if _, _, err := net.SplitHostPort(a.addr); err != nil {
+			errs = append(errs, fmt.Errorf("--%s: %s", a.name, err))
+		}
+	}
+	return errors.Join(append(errs, s.Cache.Validate(), s.OIDC.Validate())...)
+}
+
+// Validate reports every cache setting that is invalid
+func (c Cache) Validate() error {
+	var errs []error
+	if c.Capacity == 0 {
+		errs = append(errs, errors.New("--cache-capacity must be positive"))
+	}
+	if c.Snapshot == "" {
+		errs = append(errs, errors.New("--cache-snapshot must name a file"))
+	}
+	if c.StaleFor < 0 {
+		errs = append(errs, fmt.Errorf("--cache-stale-for must not be negative, not %s", c.StaleFor))
+	}
+	// 0 turns the periodic snapshots off
+	if c.SnapshotEvery < 0 {
+		errs = append(errs, fmt.Errorf("--cache-snapshot-every must not be negative, not %s", c.SnapshotEvery))
+	}
+	durations := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"cache-fresh-for", c.FreshFor},
+		{"cache-negative-ttl", c.NegativeTTL},
+	}
+	for _, d := range durations {
+		if d.d <= 0 {
+			errs = append(errs, fmt.Errorf("--%s must be positive, not %s", d.name, d.d))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate reports every sign in setting that is invalid
+func (o OIDC) Validate() error {
+	if o.Issuer == "" {
+		return nil
+	}
+	var errs []error
+	if o.ClientID == "" {
+		errs = append(errs, errors.New("--oidc-issuer needs --oidc-client-id"))
+	}
+	if o.ClientSecret == "" {
+		errs = append(errs, errors.New("--oidc-issuer needs --oidc-client-secret"))
+	}
+	return errors.Join(errs...)
+}
+
+// GenCrt is genCrt's key, validity and CA settings. The profile is applied
+// to the flags before they are decoded.
+type GenCrt struct {
+	Hosts      []string      `flag:"host"`
+	Profile    string        `flag:"profile"`
+	Usage      string        `flag:"usage"`
+	Countries  []string      `flag:"country"`
+	ValidFor   time.Duration `flag:"duration"`
+	Backdate   time.Duration `flag:"backdate"`
+	IsCA       bool          `flag:"ca"`
+	CACert     string        `flag:"ca-cert"`
+	CAKey      string        `flag:"ca-key"`
+	RSABits    int           `flag:"rsa-bits"`
+	ECDSACurve string        `flag:"ecdsa-curve"`
+	KeyFormat  string        `flag:"key-format"`
+
+	TicketKeys     string        `flag:"ticket-keys"`
+	TicketKeyCount int           `flag:"ticket-key-count"`
+	TicketEvery    time.Duration `flag:"rotate-ticket-keys"`
+}
+
+// Validate reports every genCrt setting that is invalid. The checks
+// particular to a profile are left to genCrt.
+func (g GenCrt) Validate() error {
+	var errs []error
+	if g.ValidFor <= 0 {
+		errs = append(errs, fmt.Errorf("--duration must be positive, not %s", g.ValidFor))
+	}
+	if g.Backdate < 0 {
+		errs = append(errs, fmt.Errorf("--backdate must not be negative, not %s", g.Backdate))
+	}
+	for _, c := range g.Countries {
+		if len(c) != 2 {
+			errs = append(errs, fmt.Errorf("--country must be two letter codes, got %q", c))
+		}
+	}
+	if (g.CACert == "") != (g.CAKey == "") {
+		errs = append(errs, errors.New("--ca-cert and --ca-key must be given together"))
+	}
+	if g.KeyFormat != "pkcs1" && g.KeyFormat != "pkcs8" {
+		errs = append(errs, fmt.Errorf("--key-format must be pkcs1 or pkcs8, not %q", g.KeyFormat))
+	}
+	if g.TicketEvery > 0 && g.TicketKeys == "" {
+		errs = append(errs, errors.New("--rotate-ticket-keys requires --ticket-keys"))
+	}
+	if g.TicketKeyCount < 1 {
+		errs = append(errs, errors.New("--ticket-key-count must be at least 1"))
+	}
+	return errors.Join(errs...)
+}
+
+// Decode sets the fields of the struct v points to from the flags of fs
+// named by their flag tags, recursing into untagged struct fields. Lists
+// are split from comma-separated flags. Call it after Load, so v holds the
+// settings from every source.
+func Decode(fs *flag.FlagSet, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config: Decode needs a pointer to a struct, not %T", v)
+	}
+	return decode(fs, rv.Elem())
+}
+
+// decode sets the fields of the struct rv from the flags of fs
+func decode(fs *flag.FlagSet, rv reflect.Value) error {
+	var errs []error
+	for i := 0; i < rv.NumField(); i++ {
+		field, value := rv.Type().Field(i), rv.Field(i)
+		name, ok := field.Tag.Lookup("flag")
+		if !ok {
+			if field.Type.Kind() == reflect.Struct {
+				errs = append(errs, decode(fs, value))
+			}
+			continue
+		}
+
+		f := fs.Lookup(name)
+		if f == nil {
+			errs = append(errs, fmt.Errorf("config: %s: no flag %q", field.Name, name))
+			continue
+		}
+		getter, ok := f.Value.(flag.Getter)
+		if !ok {
+			errs = append(errs, fmt.Errorf("config: %s: flag %q has no value to get", field.Name, name))
+			continue
+		}
+		flagValue := reflect.ValueOf(getter.Get())
+		switch {
+		case field.Type == reflect.TypeOf([]string(nil)) && flagValue.Kind() == reflect.String:
+			value.Set(reflect.ValueOf(SplitList(flagValue.String())))
+		case flagValue.Type().AssignableTo(field.Type):
+			value.Set(flagValue)
+		default:
+			errs = append(errs, fmt.Errorf("config: %s is %s, but flag %q is %s", field.Name, field.Type, name, flagValue.Type()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SplitList splits a comma-separated flag value, dropping empty items
+func SplitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
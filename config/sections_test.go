@@ -0,0 +1,197 @@
+package config
+
+import (
+	"flag"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecode(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("addr", ":8080", "")
+	fs.Uint64("capacity", 1000, "")
+	fs.Duration("fresh-for", time.Minute, "")
+	fs.String("groups", "", "")
+	fs.Bool("verbose", false, "")
+	if err := fs.Parse([]string{"--capacity=5", "--groups", "ops, admins,", "--verbose"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var settings struct {
+		Addr   string `flag:"addr"`
+		Nested struct {
+			Capacity uint64        `flag:"capacity"`
+			FreshFor time.Duration `flag:"fresh-for"`
+		}
+		Groups  []string `flag:"groups"`
+		Verbose bool     `flag:"verbose"`
+		Ignored int
+	}
+	if err := Decode(fs, &settings); err != nil {
+		t.Fatal(err)
+	}
+	if settings.Addr != ":8080" || settings.Nested.Capacity != 5 || settings.Nested.FreshFor != time.Minute || !settings.Verbose {
+		t.Errorf("Decode set %+v", settings)
+	}
+	if want := []string{"ops", "admins"}; !slices.Equal(settings.Groups, want) {
+		t.Errorf("Groups = %q, want %q", settings.Groups, want)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("addr", ":8080", "")
+	fs.Duration("fresh-for", time.Minute, "")
+
+	var settings struct {
+		Addr     int    `flag:"addr"`
+		FreshFor string `flag:"fresh-for"`
+		Missing  string `flag:"missing"`
+	}
+	err := Decode(fs, &settings)
+	if err == nil {
+		t.Fatal("Decode succeeded")
+	}
+	for _, want := range []string{
+		`Addr is int, but flag "addr" is string`,
+		`FreshFor is string, but flag "fresh-for" is time.Duration`,
+		`Missing: no flag "missing"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Decode returned %q, want it to contain %q", err, want)
+		}
+	}
+
+	if err := Decode(fs, settings); err == nil {
+		t.Error("Decode succeeded without a pointer")
+	}
+}
+
+// validServer is a Server that passes Validate, for tests to break
+func validServer() Server {
+	return Server{
+		Addr:         ":8080",
+		AdminAddr:    ":8443",
+		TLSAddr:      ":443",
+		ACMEHTTPAddr: ":80",
+		Cache: Cache{
+			Capacity:      1000,
+			Snapshot:      "weather.cache",
+			SnapshotEvery: 5 * time.Minute,
+			FreshFor:      10 * time.Minute,
+			StaleFor:      time.Hour,
+			NegativeTTL:   time.Minute,
+		},
+	}
+}
+
+func TestServerValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(s *Server)
+		want   []string
+	}{
+		{"valid", func(s *Server) {}, nil},
+		{"no stale temperatures", func(s *Server) { s.Cache.StaleFor = 0 }, nil},
+		{"no periodic snapshots", func(s *Server) { s.Cache.SnapshotEvery = 0 }, nil},
+		{
+			"address",
+			func(s *Server) { s.TLSAddr = "443" },
+			[]string{"--tls-addr"},
+		},
+		{
+			"cache",
+			func(s *Server) {
+				s.Cache.Capacity = 0
+				s.Cache.Snapshot = ""
+				s.Cache.SnapshotEvery = -time.Second
+				s.Cache.FreshFor = 0
+				s.Cache.StaleFor = -time.Second
+				s.Cache.NegativeTTL = 0
+			},
+			[]string{
+				"--cache-capacity must be positive",
+				"--cache-snapshot must name a file",
+				"--cache-snapshot-every must not be negative",
+				"--cache-fresh-for must be positive",
+				"--cache-stale-for must not be negative",
+				"--cache-negative-ttl must be positive",
+			},
+		},
+		{
+			"sign in",
+			func(s *Server) { s.OIDC.Issuer = "https://id.example.com" },
+			[]string{"--oidc-issuer needs --oidc-client-id", "--oidc-issuer needs --oidc-client-secret"},
+		},
+		{
+			"sign in off",
+			func(s *Server) { s.OIDC.ClientID = "weather" },
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := validServer()
+			tt.change(&s)
+			checkErrors(t, s.Validate(), tt.want)
+		})
+	}
+}
+
+func TestGenCrtValidate(t *testing.T) {
+	valid := GenCrt{ValidFor: time.Hour, KeyFormat: "pkcs1", TicketKeyCount: 1}
+	tests := []struct {
+		name   string
+		change func(g *GenCrt)
+		want   []string
+	}{
+		{"valid", func(g *GenCrt) {}, nil},
+		{"countries", func(g *GenCrt) { g.Countries = []string{"GB", "GBR"} }, []string{`two letter codes, got "GBR"`}},
+		{"ca key", func(g *GenCrt) { g.CACert = "ca.pem" }, []string{"--ca-cert and --ca-key must be given together"}},
+		{"ticket keys", func(g *GenCrt) { g.TicketEvery = time.Hour }, []string{"--rotate-ticket-keys requires --ticket-keys"}},
+		{
+			"every error",
+			func(g *GenCrt) {
+				g.ValidFor = 0
+				g.Backdate = -time.Hour
+				g.KeyFormat = "der"
+				g.TicketKeyCount = 0
+			},
+			[]string{
+				"--duration must be positive",
+				"--backdate must not be negative",
+				`--key-format must be pkcs1 or pkcs8, not "der"`,
+				"--ticket-key-count must be at least 1",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := valid
+			tt.change(&g)
+			checkErrors(t, g.Validate(), tt.want)
+		})
+	}
+}
+
+// checkErrors checks that err reports every problem in want, or that it is
+// nil if want is
+func checkErrors(t *testing.T, err error, want []string) {
+	t.Helper()
+	if len(want) == 0 {
+		if err != nil {
+			t.Errorf("Validate returned %q", err)
+		}
+		return
+	}
+	if err == nil {
+		t.Fatalf("Validate succeeded, want %q", want)
+	}
+	for _, w := range want {
+		if !strings.Contains(err.Error(), w) {
+			t.Errorf("Validate returned %q, want it to contain %q", err, w)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/muthubro/ready-set-go/providertest"
+)
+
+// providerFactories build each built-in provider against a base URL,
+// for the conformance checks
+var providerFactories = map[string]func(baseURL string) weatherProvider{
+	"openweathermap": func(baseURL string) weatherProvider {
+		return openWeatherMap{baseURL: baseURL}
+	},
+	"weatherunderground": func(baseURL string) weatherProvider {
+		return weatherUnderground{apiKey: *wuAPIKey, baseURL: baseURL}
+	},
+}
+
+// checkProviders runs the providertest checks against every built-in
+// provider, with the fixtures recorded in dir/<name>.json.
+// It returns the exit status: 0 if all passed, 1 otherwise.
+func checkProviders(dir string) int {
+	names := make([]string, 0, len(providerFactories))
+	for name := range providerFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	status := 0
+	for _, name := range names {
+		fixtures, err := providertest.LoadFixtures(filepath.Join(dir, name+".json"))
+		if err == nil {
+			newProvider := providerFactories[name]
+			err = providertest.Check(func(baseURL string) providertest.Provider {
+				return providertest.ProviderFunc(newProvider(baseURL).temperature)
+			}, fixtures)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "FAIL %s:\n%s\n", name, err)
+			status = 1
+			continue
+		}
+		fmt.Printf("ok   %s\n", name)
+	}
+	return status
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/muthubro/ready-set-go/providertest"
+)
+
+// TestProviderConformance runs the providertest checks that --check-providers
+// runs against every built-in provider, with the fixtures in testdata
+func TestProviderConformance(t *testing.T) {
+	for name, newProvider := range providerFactories {
+		t.Run(name, func(t *testing.T) {
+			fixtures, err := providertest.LoadFixtures(filepath.Join("testdata", "providers", name+".json"))
+			if err != nil {
+				t.Fatalf("every built-in provider needs fixtures: %s", err)
+			}
+			err = providertest.Check(func(baseURL string) providertest.Provider {
+				return providertest.ProviderFunc(newProvider(baseURL).temperature)
+			}, fixtures)
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
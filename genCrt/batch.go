@@ -0,0 +1,180 @@
+package main
+
+// A batch manifest lists certificates to generate in one run, one per line,
+// for example the nodes of a test cluster. A line is either an output
+// directory followed by comma-separated hosts:
+//
+//	node1 node1.cluster.local,10.0.0.1
+//
+// or a JSON object, which can also set the usage and common name:
+//
+//	{"dir": "node2", "hosts": ["node2.cluster.local"], "usage": "both", "cn": "node2"}
+//
+// Blank lines and lines starting with # are ignored. Every other flag of
+// gen, such as --ca-cert, applies to every entry.
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/muthubro/ready-set-go/certgen"
+)
+
+// batchEntry is a certificate to generate in a batch
+type batchEntry struct {
+	Dir   string   `json:"dir"`
+	Hosts []string `json:"hosts"`
+	Usage string   `json:"usage"`
+	CN    string   `json:"cn"`
+}
+
+// readBatch reads a batch manifest
+func readBatch(path string) ([]batchEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []batchEntry
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var entry batchEntry
+		if strings.HasPrefix(line, "{") {
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+			}
+		} else {
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("%s:%d: want a directory and comma-separated hosts", path, n)
+			}
+			entry.Dir, entry.Hosts = fields[0], strings.Split(fields[1], ",")
+		}
+		if entry.Dir == "" || len(entry.Hosts) == 0 {
+			return nil, fmt.Errorf("%s:%d: an entry needs a directory and hosts", path, n)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// runBatch generates a key and certificate for every entry of a batch
+// manifest, reporting how each went. It carries on past failed entries
+// and only fails on the manifest and the CA.
+func runBatch(path string, keyPass []byte, random io.Reader) int {
+	entries, err := readBatch(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read batch: %s\n", err)
+		return 1
+	}
+	var parent *x509.Certificate
+	var signer crypto.Signer
+	if *caCert != "" {
+		parent, signer, err = loadCA(*caCert, *caKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load CA: %s\n", err)
+			return 1
+		}
+	}
+
+	failed := 0
+	for _, entry := range entries {
+		cert, err := generateBatchEntry(entry, parent, signer, keyPass, random)
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %s\n", entry.Dir, err)
+			continue
+		}
+		fmt.Printf("ok   %s: %s, serial %s, valid until %s\n", entry.Dir,
+			strings.Join(entry.Hosts, ","), cert.SerialNumber.Text(16), cert.NotAfter.UTC().Format("2006-01-02"))
+	}
+	fmt.Printf("%d of %d certificates generated\n", len(entries)-failed, len(entries))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// generateBatchEntry writes a key and certificate for a batch entry into its
+// directory, named like --cert-out and --key-out
+func generateBatchEntry(entry batchEntry, parent *x509.Certificate, signer crypto.Signer, keyPass []byte, random io.Reader) (*x509.Certificate, error) {
+	certPath := filepath.Join(entry.Dir, filepath.Base(*certOut))
+	keyPath := filepath.Join(entry.Dir, filepath.Base(*keyOut))
+	if !*force {
+		for _, path := range []string{certPath, keyPath} {
+			if _, err := os.Stat(path); err == nil {
+				return nil, fmt.Errorf("%s already exists, use --force to overwrite it", path)
+			}
+		}
+	}
+
+	notBefore, notAfter, appliedBackdate := flagValidity(nil)
+	opts := certgen.Options{
+		Profile:               *profile,
+		Hosts:                 entry.Hosts,
+		Usage:                 *usage,
+		IsCA:                  issueCA(),
+		Subject:               flagSubject(),
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		ECDSACurve:            *ecdsaCurve,
+		RSABits:               *rsaBits,
+		Parent:                parent,
+		ParentKey:             signer,
+		OCSPServer:            subjectList(*ocspURL),
+		CRLDistributionPoints: subjectList(*crlURL),
+		Rand:                  random,
+	}
+	if entry.Usage != "" {
+		opts.Usage = entry.Usage
+	}
+	if entry.CN != "" {
+		opts.Subject.CommonName = entry.CN
+	}
+	bundle, err := certgen.Generate(opts)
+	if errors.Is(err, certgen.ErrUnknownCurve) {
+		return nil, fmt.Errorf("unrecognized elliptic curve %q", *ecdsaCurve)
+	}
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := certgen.EncodeKeyPEM(bundle.Key, *keyFormat, keyPass)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(entry.Dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(certPath, bundle.CertPEM, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	if *indexFile != "" {
+		if err := addToIndex(*indexFile, bundle.Certificate); err != nil {
+			return nil, fmt.Errorf("failed to add the certificate to %s: %s", *indexFile, err)
+		}
+	}
+	if *auditLog != "" {
+		record := newIssuanceRecord(bundle.Certificate, *profile, appliedBackdate, certPath, keyPath)
+		if err := record.appendTo(*auditLog); err != nil {
+			return nil, fmt.Errorf("failed to write audit log %s: %s", *auditLog, err)
+		}
+	}
+	return bundle.Certificate, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/x509/pkix"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/muthubro/ready-set-go/certgen"
+)
+
+// runChain issues a root CA, an intermediate CA signed by the root and a
+// leaf signed by the intermediate into a directory:
+//
+//	root.crt, root.key                  the trust anchor clients are given
+//	intermediate.crt, intermediate.key
+//	leaf.crt, leaf.key                  what the server uses
+//	chain.crt                           leaf.crt then intermediate.crt, what the server sends
+func runChain(args []string) int {
+	fs := flag.NewFlagSet("chain", flag.ExitOnError)
+	hosts := fs.String("host", "localhost", "Comma-separated hostnames, IPs, email addresses and URIs for the leaf")
+	curve := fs.String("ecdsa-curve", "P256", "ECDSA curve to use to generate the keys. Empty for RSA")
+	bits := fs.Int("rsa-bits", 2048, "Size of RSA keys to generate. Ignored if -ecdsa-curve is set")
+	usage := fs.String("usage", "server", "What the leaf authenticates. Valid values are server, client, both")
+	validFor := fs.Duration("duration", 365*24*time.Hour, "Duration that the leaf is valid for. The CAs are valid for ten times as long")
+	back := fs.Duration("backdate", 5*time.Minute, "How far before now to set NotBefore")
+	overwrite := fs.Bool("force", false, "Overwrite existing files in the directory")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: genCrt chain [flags] <dir>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	dir := fs.Arg(0)
+	// Checked before any file is written, like the usage
+	if _, err := certgen.ParseHosts(strings.Split(*hosts, ",")); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -host: %s\n", err)
+		return 2
+	}
+	if _, _, err := certgen.TLSKeyUsage(*usage, nil); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	write := writeNewFile
+	if *overwrite {
+		write = os.WriteFile
+	}
+	now := time.Now()
+	subject := func(cn string) pkix.Name {
+		return pkix.Name{Organization: []string{"Ubifly Technologies Pvt Ltd"}, CommonName: cn}
+	}
+
+	// issue generates a key and a certificate for it, signed by opts.Parent
+	// or self-signed, and writes both as name.crt and name.key. The CAs have
+	// the usage of the leaf too, as verifiers want every certificate in the
+	// chain to allow it.
+	issue := func(name string, opts certgen.Options) (*certgen.Bundle, error) {
+		opts.Usage, opts.ECDSACurve, opts.RSABits = *usage, *curve, *bits
+		opts.Backdate, opts.Now = *back, func() time.Time { return now }
+		bundle, err := certgen.Generate(opts)
+		if err != nil {
+			return nil, err
+		}
+		if err := write(filepath.Join(dir, name+".crt"), bundle.CertPEM, 0644); err != nil {
+			return nil, err
+		}
+		if err := write(filepath.Join(dir, name+".key"), bundle.KeyPEM, 0600); err != nil {
+			return nil, err
+		}
+		return bundle, nil
+	}
+
+	root, err := issue("root", certgen.Options{
+		Subject:    subject("genCrt Test Root CA"),
+		ValidFor:   10 * *validFor,
+		IsCA:       true,
+		MaxPathLen: 1,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to issue the root CA: %s\n", err)
+		return 1
+	}
+
+	intermediate, err := issue("intermediate", certgen.Options{
+		Subject:        subject("genCrt Test Intermediate CA"),
+		ValidFor:       10 * *validFor,
+		IsCA:           true,
+		MaxPathLenZero: true,
+		Parent:         root.Certificate,
+		ParentKey:      root.Key,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to issue the intermediate CA: %s\n", err)
+		return 1
+	}
+
+	leaf, err := issue("leaf", certgen.Options{
+		Hosts:     strings.Split(*hosts, ","),
+		Subject:   subject(strings.Split(*hosts, ",")[0]),
+		ValidFor:  *validFor,
+		Parent:    intermediate.Certificate,
+		ParentKey: intermediate.Key,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to issue the leaf: %s\n", err)
+		return 1
+	}
+
+	chain := append(leaf.CertPEM, intermediate.CertPEM...)
+	if err := write(filepath.Join(dir, "chain.crt"), chain, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write the chain: %s\n", err)
+		return 1
+	}
+
+	fmt.Printf("Wrote root, intermediate and leaf certificates and chain.crt to %s\n", dir)
+	return 0
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// runConnect connects to a TLS server and checks the chain it presents,
+// like verify does for files. Verification is done after the handshake so
+// the chain is shown even when it is invalid.
+func runConnect(args []string) int {
+	fs := flag.NewFlagSet("connect", flag.ExitOnError)
+	caCertPath := fs.String("ca-cert", "", "CA certificate the server must chain to. Defaults to the system roots")
+	serverName := fs.String("servername", "", "Hostname to send as SNI and verify the certificate for. Defaults to the host of <host:port>")
+	timeout := fs.Duration("timeout", 10*time.Second, "How long to wait for the connection and handshake")
+	warn := fs.Duration("warn", 30*24*time.Hour, "Fail if the server certificate expires within this long")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: genCrt connect [flags] <host:port>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	addr := fs.Arg(0)
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid address %q: %s\n", addr, err)
+		return 2
+	}
+	if *serverName == "" {
+		*serverName = host
+	}
+
+	var roots *x509.CertPool
+	if *caCertPath != "" {
+		roots = x509.NewCertPool()
+		if err := addCertificates(roots, *caCertPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: *timeout},
+		Config: &tls.Config{
+			ServerName: *serverName,
+			// The chain is verified below, to report on it whatever it is
+			InsecureSkipVerify: true,
+		},
+	}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect to %s: %s\n", addr, err)
+		return 1
+	}
+	defer conn.Close()
+	state := conn.(*tls.Conn).ConnectionState()
+
+	fmt.Printf("%s: %s, %s", addr, tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	if state.NegotiatedProtocol != "" {
+		fmt.Printf(", ALPN %s", state.NegotiatedProtocol)
+	}
+	fmt.Println()
+
+	now := time.Now()
+	peers := state.PeerCertificates
+	for i, cert := range peers {
+		fmt.Printf("  %d: %s\n     issuer:  %s\n     expires: %s (%s)\n", i, cert.Subject, cert.Issuer,
+			cert.NotAfter.UTC().Format(time.RFC3339), expiresIn(cert, now))
+	}
+	if len(peers) == 0 {
+		fmt.Fprintln(os.Stderr, "The server sent no certificates")
+		return 1
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range peers[1:] {
+		intermediates.AddCert(cert)
+	}
+	leaf := peers[0]
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		DNSName:       *serverName,
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+	})
+	if err != nil {
+		fmt.Printf("FAIL %s\n", err)
+		return 1
+	}
+
+	var names []string
+	for _, c := range chains[0] {
+		names = append(names, c.Subject.String())
+	}
+	fmt.Printf("OK   valid for %s\n  chain: %s\n", *serverName, strings.Join(names, " <- "))
+	if left := leaf.NotAfter.Sub(now); left < *warn {
+		fmt.Printf("WARN the certificate expires in %s, within %s\n", formatDays(left), formatDays(*warn))
+		return 1
+	}
+	return 0
+}
+
+// expiresIn says how long until a certificate expires, or that it has
+func expiresIn(cert *x509.Certificate, now time.Time) string {
+	if now.After(cert.NotAfter) {
+		return "expired " + formatDays(now.Sub(cert.NotAfter)) + " ago"
+	}
+	return "in " + formatDays(cert.NotAfter.Sub(now))
+}
+
+// formatDays formats a duration in days and hours, which suit certificate lifetimes
+func formatDays(d time.Duration) string {
+	days, hours := int(d/(24*time.Hour)), int(d%(24*time.Hour)/time.Hour)
+	if days == 0 {
+		return d.Round(time.Second).String()
+	}
+	return fmt.Sprintf("%dd%dh", days, hours)
+}
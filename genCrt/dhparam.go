@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"math/big"
+)
+
+// dhGenerator is the generator written to DH parameter files, as openssl
+// dhparam uses by default
+const dhGenerator = 2
+
+// dhParameters is the PKCS #3 DHParameter structure
+type dhParameters struct {
+	P *big.Int
+	G int
+}
+
+// smallPrimes are used to rule out most candidates before the
+// expensive primality tests
+var smallPrimes = []uint64{
+	3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41, 43, 47, 53, 59, 61, 67, 71,
+	73, 79, 83, 89, 97, 101, 103, 107, 109, 113, 127, 131, 137, 139, 149, 151,
+	157, 163, 167, 173, 179, 181, 191, 193, 197, 199, 211, 223, 227, 229, 233,
+	239, 241, 251, 257, 263, 269, 271, 277, 281, 283, 293, 307, 311, 313, 317,
+}
+
+// generateSafePrime returns a prime p of the given size such that
+// (p-1)/2 is prime too. This takes a while: seconds for 1024 bits,
+// minutes for 2048.
+func generateSafePrime(bits int) (*big.Int, error) {
+	if bits < 512 {
+		return nil, errors.New("DH parameters must be at least 512 bits")
+	}
+
+	one := big.NewInt(1)
+	mod := new(big.Int)
+	for {
+		q, err := rand.Prime(rand.Reader, bits-1)
+		if err != nil {
+			return nil, err
+		}
+		// With p = 23 mod 24, which holds when q = 11 mod 12, 2 is a
+		// quadratic residue and so generates the subgroup of prime order q
+		if mod.Mod(q, big.NewInt(12)).Int64() != 11 {
+			continue
+		}
+		p := new(big.Int).Lsh(q, 1)
+		p.Add(p, one)
+
+		composite := false
+		for _, sp := range smallPrimes {
+			if mod.Mod(p, new(big.Int).SetUint64(sp)).Sign() == 0 {
+				composite = true
+				break
+			}
+		}
+		if !composite && p.ProbablyPrime(20) {
+			return p, nil
+		}
+	}
+}
+
+// writeDHParams generates DH parameters and writes them to path as a
+// "DH PARAMETERS" PEM block, the format of openssl dhparam. Like the other
+// outputs, an existing file is only replaced with --force.
+func writeDHParams(path string, bits int) error {
+	p, err := generateSafePrime(bits)
+	if err != nil {
+		return err
+	}
+	der, err := asn1.Marshal(dhParameters{P: p, G: dhGenerator})
+	if err != nil {
+		return err
+	}
+	return writeOutput(path, pem.EncodeToMemory(&pem.Block{Type: "DH PARAMETERS", Bytes: der}), 0644)
+}
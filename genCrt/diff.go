@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// certField is a named, comparable view of part of a certificate
+type certField struct {
+	name string
+	// security is set for fields whose change affects what the certificate
+	// can be used for or who it can be trusted for
+	security bool
+	values   func(cert *x509.Certificate) []string
+}
+
+var diffFields = []certField{
+	{"Subject", true, func(c *x509.Certificate) []string { return []string{c.Subject.String()} }},
+	{"Issuer", true, func(c *x509.Certificate) []string { return []string{c.Issuer.String()} }},
+	{"SerialNumber", false, func(c *x509.Certificate) []string { return []string{c.SerialNumber.Text(16)} }},
+	{"NotBefore", false, func(c *x509.Certificate) []string { return []string{c.NotBefore.UTC().Format(time.RFC3339)} }},
+	{"NotAfter", false, func(c *x509.Certificate) []string { return []string{c.NotAfter.UTC().Format(time.RFC3339)} }},
+	{"DNSNames", true, func(c *x509.Certificate) []string { return c.DNSNames }},
+	{"IPAddresses", true, func(c *x509.Certificate) []string {
+		ips := make([]string, 0, len(c.IPAddresses))
+		for _, ip := range c.IPAddresses {
+			ips = append(ips, ip.String())
+		}
+		return ips
+	}},
+	{"EmailAddresses", true, func(c *x509.Certificate) []string { return c.EmailAddresses }},
+	{"URIs", true, func(c *x509.Certificate) []string {
+		uris := make([]string, 0, len(c.URIs))
+		for _, uri := range c.URIs {
+			uris = append(uris, uri.String())
+		}
+		return uris
+	}},
+	{"PublicKey", true, func(c *x509.Certificate) []string {
+		sum := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+		return []string{fmt.Sprintf("%s sha256:%s", c.PublicKeyAlgorithm, hex.EncodeToString(sum[:]))}
+	}},
+	{"SignatureAlgorithm", true, func(c *x509.Certificate) []string { return []string{c.SignatureAlgorithm.String()} }},
+	{"IsCA", true, func(c *x509.Certificate) []string { return []string{fmt.Sprint(c.IsCA)} }},
+	{"MaxPathLen", true, func(c *x509.Certificate) []string {
+		if !c.IsCA || (c.MaxPathLen <= 0 && !c.MaxPathLenZero) {
+			return nil
+		}
+		return []string{fmt.Sprint(c.MaxPathLen)}
+	}},
+	{"KeyUsage", true, func(c *x509.Certificate) []string { return keyUsageNames(c.KeyUsage) }},
+	{"ExtKeyUsage", true, func(c *x509.Certificate) []string { return extKeyUsageNames(c.ExtKeyUsage) }},
+	{"Extensions", true, func(c *x509.Certificate) []string {
+		exts := make([]string, 0, len(c.Extensions))
+		for _, ext := range c.Extensions {
+			name := ext.Id.String()
+			if ext.Critical {
+				name += " (critical)"
+			}
+			exts = append(exts, name)
+		}
+		return exts
+	}},
+}
+
+var keyUsages = []struct {
+	usage x509.KeyUsage
+	name  string
+}{
+	{x509.KeyUsageDigitalSignature, "DigitalSignature"},
+	{x509.KeyUsageContentCommitment, "ContentCommitment"},
+	{x509.KeyUsageKeyEncipherment, "KeyEncipherment"},
+	{x509.KeyUsageDataEncipherment, "DataEncipherment"},
+	{x509.KeyUsageKeyAgreement, "KeyAgreement"},
+	{x509.KeyUsageCertSign, "CertSign"},
+	{x509.KeyUsageCRLSign, "CRLSign"},
+	{x509.KeyUsageEncipherOnly, "EncipherOnly"},
+	{x509.KeyUsageDecipherOnly, "DecipherOnly"},
+}
+
+func keyUsageNames(usage x509.KeyUsage) []string {
+	var names []string
+	for _, u := range keyUsages {
+		if usage&u.usage != 0 {
+			names = append(names, u.name)
+		}
+	}
+	return names
+}
+
+var extKeyUsageNameMap = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:             "Any",
+	x509.ExtKeyUsageServerAuth:      "ServerAuth",
+	x509.ExtKeyUsageClientAuth:      "ClientAuth",
+	x509.ExtKeyUsageCodeSigning:     "CodeSigning",
+	x509.ExtKeyUsageEmailProtection: "EmailProtection",
+	x509.ExtKeyUsageTimeStamping:    "TimeStamping",
+	x509.ExtKeyUsageOCSPSigning:     "OCSPSigning",
+}
+
+func extKeyUsageNames(usages []x509.ExtKeyUsage) []string {
+	names := make([]string, 0, len(usages))
+	for _, u := range usages {
+		if name, ok := extKeyUsageNameMap[u]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, fmt.Sprintf("ExtKeyUsage(%d)", u))
+		}
+	}
+	return names
+}
+
+// readCertificate reads the first PEM certificate in a file
+func readCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM certificate found", path)
+		}
+		if block.Type == "CERTIFICATE" {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", path, err)
+			}
+			return cert, nil
+		}
+	}
+}
+
+// runDiff prints the fields that differ between two certificates.
+// It returns 1 if a security-relevant field changed, 2 on errors and 0 otherwise.
+func runDiff(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: genCrt diff <old.pem> <new.pem>")
+		return 2
+	}
+
+	oldCert, err := readCertificate(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read certificate: %s\n", err)
+		return 2
+	}
+	newCert, err := readCertificate(args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read certificate: %s\n", err)
+		return 2
+	}
+
+	changed, security := false, false
+	for _, field := range diffFields {
+		oldValues, newValues := field.values(oldCert), field.values(newCert)
+		removed, added := diffSets(oldValues, newValues)
+		if len(removed) == 0 && len(added) == 0 {
+			continue
+		}
+
+		marker := "~"
+		if field.security {
+			marker = "!"
+			security = true
+		}
+		changed = true
+
+		if len(oldValues) <= 1 && len(newValues) <= 1 {
+			fmt.Printf("%s %s: %s -> %s\n", marker, field.name, single(oldValues), single(newValues))
+			continue
+		}
+		fmt.Printf("%s %s:\n", marker, field.name)
+		for _, v := range removed {
+			fmt.Printf("    - %s\n", v)
+		}
+		for _, v := range added {
+			fmt.Printf("    + %s\n", v)
+		}
+	}
+
+	if !changed {
+		fmt.Println("Certificates are equivalent")
+	}
+	if security {
+		return 1
+	}
+	return 0
+}
+
+// diffSets returns the values only in a and the values only in b, sorted
+func diffSets(a, b []string) (removed, added []string) {
+	inA := make(map[string]bool, len(a))
+	for _, v := range a {
+		inA[v] = true
+	}
+	inB := make(map[string]bool, len(b))
+	for _, v := range b {
+		inB[v] = true
+		if !inA[v] {
+			added = append(added, v)
+		}
+	}
+	for _, v := range a {
+		if !inB[v] {
+			removed = append(removed, v)
+		}
+	}
+	sort.Strings(removed)
+	sort.Strings(added)
+	return removed, added
+}
+
+func single(values []string) string {
+	if len(values) == 0 {
+		return "(none)"
+	}
+	return strings.Join(values, ", ")
+}
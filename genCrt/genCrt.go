@@ -1,165 +1,719 @@
 package main
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
-	"crypto/rsa"
+	"bytes"
+	"crypto"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
-	"math/big"
 	"net"
 	"os"
 	"strings"
 	"time"
+
+	"github.com/muthubro/ready-set-go/certgen"
+	"github.com/muthubro/ready-set-go/config"
 )
 
-/**
- * TODO: Get validFor duration
- */
+// dateLayout is the format of --start-date and --end-date
+const dateLayout = "Jan 2 15:04:05 2006"
+
+// envPrefix starts the names of the environment variables setting flags
+const envPrefix = "GENCRT"
+
 var (
-	host       = flag.String("host", "localhost", "Comma-seperated hostnames and IPs to generate a certificate for")
-	validFrom  = flag.String("start-date", "", "Creation date formatted as Jan 1 15:04:05 2020")
-	validFor   = flag.Duration("duration", 365*24*time.Hour, "Duration that certificate is valid for")
-	isCA       = flag.Bool("ca", true, "whether this cert should be its own Certificate Authority")
-	rsaBits    = flag.Int("rsa-bits", 2048, "Size of RSA key to generate. Ignored if --ecdsa-curve is set")
-	ecdsaCurve = flag.String("ecdsa-curve", "P224", "ECDSA curve to use to generate a key. Valid values are P224, P256, P384, P521")
+	configFile  = flag.String(config.FileFlag, "", "JSON config file of flag settings by name; see package config. Flags can also be given in the environment, as "+envPrefix+"_ECDSA_CURVE for --ecdsa-curve")
+	host        = flag.String("host", "localhost", "Comma-separated hostnames, IPs, email addresses and URIs such as spiffe://example.org/web to generate a certificate for")
+	validFrom   = flag.String("start-date", "", "Creation date formatted as Jan 1 15:04:05 2020")
+	validFor    = flag.Duration("duration", 365*24*time.Hour, "Duration that certificate is valid for. Can't be used with --end-date")
+	validTo     = flag.String("end-date", "", "Expiry date formatted as Jan 1 15:04:05 2020, instead of --duration")
+	isCA        = flag.Bool("ca", true, "whether this cert should be its own Certificate Authority. Certs signed with --ca-cert or --sign-csr are only CAs when given explicitly")
+	rsaBits     = flag.Int("rsa-bits", 2048, "Size of RSA key to generate. Ignored if --ecdsa-curve is set")
+	ecdsaCurve  = flag.String("ecdsa-curve", "P224", "ECDSA curve to use to generate a key. Valid values are P224, P256, P384, P521")
+	profile     = flag.String("profile", "server", "Certificate profile. Valid values are server, smime, codesign, spiffe and the profiles in --profiles")
+	profileFile = flag.String("profiles", "", "JSON file of named certificate profiles. Defaults to $GENCRT_PROFILES")
+	usage       = flag.String("usage", "server", "What a server profile certificate authenticates. Valid values are server, client, both. Client certificates are named by the first --host")
+	commonName  = flag.String("cn", "", "Subject common name. Defaults to the first --host for client certificates and the first --email for S/MIME")
+	orgs        = flag.String("org", "", "Comma-separated organizations to add to the subject")
+	orgUnits    = flag.String("ou", "", "Comma-separated subject organizational units")
+	country     = flag.String("country", "", "Comma-separated two letter subject country codes")
+	locality    = flag.String("locality", "", "Comma-separated subject localities, such as cities")
+	province    = flag.String("province", "", "Comma-separated subject provinces or states")
+	email       = flag.String("email", "", "Comma-separated email addresses to generate an S/MIME certificate for")
+	spiffeID    = flag.String("spiffe-id", "", "SPIFFE ID of a spiffe profile certificate, such as spiffe://example.org/ns/prod/sa/web for a workload or spiffe://example.org for the CA signing its SVIDs")
+	caCert      = flag.String("ca-cert", "", "CA certificate to sign with instead of self-signing. Requires --ca-key")
+	caKey       = flag.String("ca-key", "", "Private key of the CA given by --ca-cert")
+	permitDNS   = flag.String("permitted-dns", "", "Comma-separated domains a --ca certificate may only issue certificates for, with their subdomains")
+	permitIP    = flag.String("permitted-ip", "", "Comma-separated IP ranges in CIDR notation a --ca certificate may only issue certificates for")
+	indexFile   = flag.String("index", "", "Record the issued certificate in this CA index, for genCrt revoke, crl and ocsp")
+	ocspURL     = flag.String("ocsp-url", "", "Comma-separated OCSP responder URLs to put in the certificate")
+	crlURL      = flag.String("crl-url", "", "Comma-separated CRL distribution point URLs to put in the certificate")
+	p12Out      = flag.String("p12", "", "Also write the key and certificate chain as a PKCS#12 bundle to this file")
+	p12Pass     = flag.String("p12-password", "", "Password protecting the PKCS#12 bundle, or env:NAME or file:PATH to read it from")
+	tsaURL      = flag.String("timestamp-url", "", "RFC 3161 timestamping authority to use when signing with a codesign certificate")
+	tsaConfig   = flag.String("timestamp-config", "", "Write a code signing configuration using --timestamp-url to this file")
+	certOut     = flag.String("cert-out", "tls.cert", "File to write the certificate to")
+	keyOut      = flag.String("key-out", "tls.key", "File to write the private key to")
+	toStdout    = flag.Bool("stdout", false, "Write the certificate, its CA and the private key to stdout as one PEM bundle instead of to files")
+	force       = flag.Bool("force", false, "Overwrite existing output files")
+	csrOut      = flag.String("csr", "", "Write a certificate signing request for the key to this file instead of a certificate, for an external CA")
+	csrIn       = flag.String("sign-csr", "", "Issue the certificate for the PKCS#10 request in this file instead of for a new key. Requires --ca-cert")
+	passphrase  = flag.String("passphrase", "", "Encrypt the private key with this passphrase. Use env:NAME or file:PATH to read it from an environment variable or file instead")
+	keyFormat   = flag.String("key-format", "pkcs1", "Private key format. Valid values are pkcs1, which is PKCS#1 for RSA and SEC 1 for ECDSA keys, and pkcs8. Encrypted keys are always pkcs8")
+	renew       = flag.String("renew", "", "Issue a fresh certificate with the subject, names and usages of this one, with a validity period as long unless --duration is given. Give its key as --key-in to keep that too")
+	batchFile   = flag.String("batch", "", "Generate a key and certificate for every entry of this manifest, each into its own directory, instead of for --host")
+	seed        = flag.String("seed", "", "INSECURE, for test fixtures only: derive the key, serial number and signature from this seed, so the same flags always make the same certificate. Anyone with the seed has the key. Requires --start-date")
+	keyIn       = flag.String("key-in", "", "Use the PEM private key in this file instead of generating one. --rsa-bits and --ecdsa-curve are ignored")
+	backdate    = flag.Duration("backdate", 5*time.Minute, "How far before now to set NotBefore, to tolerate clients with skewed clocks. Ignored if --start-date is set")
+	jsonOut     = flag.Bool("json", false, "Print a JSON description of the issued certificate to stdout")
+	auditLog    = flag.String("audit-log", "", "Append a JSON record of the issued certificate to this file")
+	dhParams    = flag.String("dhparam", "", "Also generate Diffie-Hellman parameters into this file")
+	dhBits      = flag.Int("dhparam-bits", 2048, "Size of the Diffie-Hellman prime. Generating 2048 bits takes minutes")
+	ticketKeys  = flag.String("ticket-keys", "", "Also add a TLS session ticket key to this file, one base64 key per line, newest first, as HAProxy's tls-ticket-keys takes")
+	ticketKeep  = flag.Int("ticket-key-count", 3, "Number of session ticket keys to keep in --ticket-keys")
+	ticketEvery = flag.Duration("rotate-ticket-keys", 0, "Keep running and add a new session ticket key this often. Requires --ticket-keys")
 )
 
-func publicKey(priv interface{}) interface{} {
-	switch key := priv.(type) {
-	case *rsa.PrivateKey:
-		return &key.PublicKey
+// writeOutput writes an output file, refusing to replace an existing one
+// unless --force is given
+func writeOutput(path string, data []byte, perm os.FileMode) error {
+	if *force {
+		return os.WriteFile(path, data, perm)
+	}
+	return writeNewFile(path, data, perm)
+}
+
+// subjectList splits a comma-separated subject flag, dropping empty items
+func subjectList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
 
-	case *ecdsa.PrivateKey:
-		return &key.PublicKey
+// flagSet reports whether the named flag was given on the command line, in
+// the environment, in the config file or by the profile
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
 
-	default:
-		return nil
+// issueCA reports whether to issue a CA certificate. Self-signed
+// certificates are CAs unless --ca=false is given, but certificates signed
+// by a CA given with --ca-cert, such as for a CSR, only when --ca is given.
+func issueCA() bool {
+	if *caCert != "" || *csrIn != "" {
+		return flagSet("ca") && *isCA
 	}
+	return *isCA
 }
 
-func pemBlockForKey(priv interface{}) *pem.Block {
-	switch key := priv.(type) {
-	case *rsa.PrivateKey:
-		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+// passphraseEnv holds the passphrase of encrypted keys genCrt reads
+const passphraseEnv = "GENCRT_KEY_PASSPHRASE"
 
-	case *ecdsa.PrivateKey:
-		bytes, err := x509.MarshalECPrivateKey(key)
+// readPassphrase resolves a passphrase flag: env:NAME reads it from an
+// environment variable and file:PATH from the first line of a file, so it
+// needn't be on the command line. Anything else is the passphrase itself.
+func readPassphrase(spec string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(spec, "env:"):
+		name := strings.TrimPrefix(spec, "env:")
+		pass := os.Getenv(name)
+		if pass == "" {
+			return nil, fmt.Errorf("$%s is empty", name)
+		}
+		return []byte(pass), nil
+
+	case strings.HasPrefix(spec, "file:"):
+		data, err := os.ReadFile(strings.TrimPrefix(spec, "file:"))
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Unable to marshal ECDSA private key: %v", err)
-			os.Exit(2)
+			return nil, err
+		}
+		pass, _, _ := strings.Cut(string(data), "\n")
+		if pass = strings.TrimSuffix(pass, "\r"); pass == "" {
+			return nil, fmt.Errorf("%s: empty passphrase", strings.TrimPrefix(spec, "file:"))
 		}
-		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: bytes}
+		return []byte(pass), nil
+	}
+	return []byte(spec), nil
+}
 
-	default:
-		return nil
+// loadPrivateKey reads a PEM encoded private key of a supported type from
+// a file. Encrypted keys are decrypted with the passphrase in $GENCRT_KEY_PASSPHRASE.
+func loadPrivateKey(path string) (crypto.Signer, error) {
+	keyPEM, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := certgen.ParsePrivateKeyPEM(keyPEM, []byte(os.Getenv(passphraseEnv)))
+	if errors.Is(err, certgen.ErrPassphraseRequired) {
+		return nil, fmt.Errorf("key is encrypted, set $%s to its passphrase", passphraseEnv)
 	}
+	return priv, err
 }
 
-func main() {
-	flag.Parse()
+// loadCA reads the CA certificate and private key used to sign certificates
+func loadCA(certPath, keyPath string) (*x509.Certificate, crypto.Signer, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, nil, fmt.Errorf("%s: no PEM certificate found", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", certPath, err)
+	}
 
-	if len(*host) == 0 {
-		log.Fatalf("Missing required --host parameter")
+	key, err := loadPrivateKey(keyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", keyPath, err)
 	}
+	return cert, key, nil
+}
 
-	var priv interface{}
-	var err error
-	switch *ecdsaCurve {
-	case "":
-		priv, err = rsa.GenerateKey(rand.Reader, *rsaBits)
+// subcommands run with their arguments and return the exit status
+var subcommands = map[string]func(args []string) int{
+	"gen":     runGen,
+	"request": runRequest,
+	"sign":    runSign,
+	"accept":  runAccept,
+	"chain":   runChain,
+	"inspect": runInspect,
+	"verify":  runVerify,
+	"diff":    runDiff,
+	"revoke":  runRevoke,
+	"crl":     runCRL,
+	"ocsp":    runOCSP,
+	"connect": runConnect,
+}
+
+func printUsage() {
+	fmt.Fprint(os.Stderr, `Usage:
+  genCrt [gen] [flags]              generate a key and certificate
+  genCrt request [flags] <name>     generate a key and CSR for an offline CA
+  genCrt sign [flags] <name>.csr    sign a CSR with a CA
+  genCrt accept [flags] <name>      check a signed certificate matches its key
+  genCrt chain [flags] <dir>        generate a root CA, intermediate CA and leaf for testing
+  genCrt inspect <cert>...          print what certificates are for
+  genCrt verify [flags] <cert>      check a certificate chains to a CA and names a host
+  genCrt diff <old> <new>           compare two certificates
+  genCrt connect <host:port>        check the chain a TLS server presents
+  genCrt revoke [flags] <cert>...   mark certificates revoked in a CA index
+  genCrt crl [flags]                write a CRL of the revoked certificates in a CA index
+  genCrt ocsp [flags]               run an OCSP responder for a CA index
+
+Run genCrt <command> -h for the flags of a command. The flags of gen are:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = printUsage
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(run(os.Args[2:]))
+		}
+	}
+	// Without a command genCrt generates, as it always has
+	os.Exit(runGen(os.Args[1:]))
+}
 
-	case "P224":
-		priv, err = ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+// runGen generates a key and certificate as the flags say. It exits on
+// failure rather than returning 1.
+func runGen(args []string) int {
+	flag.CommandLine.Parse(args)
+	if flag.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", flag.Arg(0))
+		printUsage()
+		return 2
+	}
+	// The command line, environment and config file take precedence over the profile
+	if err := config.Load(flag.CommandLine, envPrefix); err != nil {
+		log.Fatalf("Failed to load config:\n%s", err)
+	}
+
+	profileName := *profile
+	if err := applyProfile(); err != nil {
+		log.Fatalf("Failed to apply profile: %s", err)
+	}
+	var settings config.GenCrt
+	if err := config.Decode(flag.CommandLine, &settings); err != nil {
+		log.Fatalf("Failed to load config:\n%s", err)
+	}
+	if err := settings.Validate(); err != nil {
+		log.Fatalf("Invalid config:\n%s", err)
+	}
+	switch *profile {
+	case "server":
+		if len(*host) == 0 {
+			log.Fatalf("Missing required --host parameter")
+		}
+		if _, _, err := certgen.TLSKeyUsage(*usage, nil); err != nil {
+			fmt.Fprintf(os.Stderr, "Unrecognized usage: %q", *usage)
+			os.Exit(1)
+		}
 
-	case "P256":
-		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "smime":
+		if len(*email) == 0 && *renew == "" {
+			log.Fatalf("Missing required --email parameter for the smime profile")
+		}
 
-	case "P384":
-		priv, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "spiffe":
+		id, err := certgen.ParseSPIFFEID(*spiffeID)
+		if *spiffeID == "" {
+			log.Fatalf("Missing required --spiffe-id parameter for the spiffe profile")
+		}
+		if err != nil {
+			log.Fatalf("Invalid --spiffe-id: %s", err)
+		}
+		if id.Path != "" && flagSet("ca") && *isCA {
+			log.Fatalf("Workload SVIDs can't be CAs, give --spiffe-id without a path for the trust domain CA")
+		}
 
-	case "P521":
-		priv, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case "codesign":
+		if *tsaConfig != "" && *tsaURL == "" {
+			log.Fatalf("--timestamp-config requires --timestamp-url")
+		}
 
 	default:
-		fmt.Fprintf(os.Stderr, "Unrecognized elliptic curve: %q", *ecdsaCurve)
+		fmt.Fprintf(os.Stderr, "Unrecognized profile: %q", *profile)
 		os.Exit(1)
 	}
+
+	permittedIPs, err := parseIPRanges(subjectList(*permitIP))
 	if err != nil {
-		log.Fatalf("Failed to generate private key: %s", err)
+		log.Fatalf("Invalid --permitted-ip: %s", err)
+	}
+	if (*permitDNS != "" || *permitIP != "") && !issueCA() {
+		log.Fatalf("--permitted-dns and --permitted-ip require --ca")
 	}
 
-	var notBefore time.Time
-	if len(*validFrom) == 0 {
-		notBefore = time.Now()
-	} else {
-		notBefore, err = time.Parse("Jan 2 15:04:05 2006", *validFrom)
+	if *toStdout && (*jsonOut || *tsaConfig != "") {
+		log.Fatalf("--stdout can't be used with --json or --timestamp-config")
+	}
+	if *batchFile != "" && (*csrOut != "" || *csrIn != "" || *renew != "" || *keyIn != "" || *toStdout || *p12Out != "" || *tsaConfig != "" || *jsonOut) {
+		log.Fatalf("--batch can't be used with --csr, --sign-csr, --renew, --key-in, --stdout, --p12, --timestamp-config or --json")
+	}
+	if *batchFile != "" && *profile != "server" {
+		log.Fatalf("--batch only supports the server profile")
+	}
+	if !*force && *batchFile == "" {
+		outputs := []string{*p12Out}
+		if !*toStdout {
+			outputs = append(outputs, *certOut)
+			if *csrIn == "" {
+				outputs = append(outputs, *keyOut)
+			}
+		}
+		if *csrOut != "" {
+			outputs = []string{*csrOut, *keyOut}
+		} else {
+			// Checked now, rather than after the parameters take minutes to generate
+			outputs = append(outputs, *dhParams)
+		}
+		if *profile == "codesign" {
+			outputs = append(outputs, *tsaConfig)
+		}
+		for _, path := range outputs {
+			if _, err := os.Stat(path); path != "" && err == nil {
+				log.Fatalf("%s already exists, use --force to overwrite it", path)
+			}
+		}
+	}
+	if *csrOut != "" && (*caCert != "" || *csrIn != "") {
+		log.Fatalf("--csr can't be used with --ca-cert or --sign-csr")
+	}
+	if *csrIn != "" {
+		if *caCert == "" {
+			log.Fatalf("--sign-csr requires --ca-cert")
+		}
+		if *keyIn != "" || *p12Out != "" || *tsaConfig != "" {
+			log.Fatalf("--sign-csr can't be used with --key-in, --p12 or --timestamp-config, the key stays with the requester")
+		}
+	}
+
+	if *passphrase != "" {
+		if flagSet("key-format") && *keyFormat != "pkcs8" {
+			log.Fatalf("--passphrase requires --key-format pkcs8")
+		}
+		*keyFormat = "pkcs8"
+	}
+
+	var keyPass []byte
+	if *passphrase != "" {
+		if *csrIn != "" {
+			log.Fatalf("--passphrase can't be used with --sign-csr, no key is written")
+		}
+		var err error
+		keyPass, err = readPassphrase(*passphrase)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to parse creation date: %s", err)
-			os.Exit(1)
+			log.Fatalf("Failed to read passphrase: %s", err)
+		}
+	}
+
+	// random is nil unless the key and certificate are derived from --seed
+	var random io.Reader
+	if *seed != "" {
+		if *validFrom == "" {
+			log.Fatalf("--seed requires --start-date, so the validity period is reproducible too")
+		}
+		if *passphrase != "" || *p12Out != "" {
+			log.Fatalf("--seed can't be used with --passphrase or --p12, their encryption isn't reproducible")
 		}
+		log.Printf("WARNING: --seed makes the key predictable, only use it for test fixtures")
+		random = certgen.InsecureRand(*seed)
 	}
 
-	notAfter := notBefore.Add(*validFor)
+	if *batchFile != "" {
+		return runBatch(*batchFile, keyPass, random)
+	}
 
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
-	if err != nil {
-		log.Fatalf("Failed to generate serial number: %s", err)
+	// priv is nil when signing a request, only its public key is known
+	var priv crypto.Signer
+	var pub crypto.PublicKey
+	var request *x509.CertificateRequest
+	if *csrIn != "" {
+		request, err = readCertificateRequest(*csrIn)
+		if err != nil {
+			log.Fatalf("Failed to read certificate request: %s", err)
+		}
+		pub = request.PublicKey
+	} else if *keyIn != "" {
+		priv, err = loadPrivateKey(*keyIn)
+		if err != nil {
+			log.Fatalf("Failed to read private key from %s: %s", *keyIn, err)
+		}
+	} else {
+		priv, err = certgen.GenerateKeyFrom(random, *ecdsaCurve, *rsaBits)
+		if errors.Is(err, certgen.ErrUnknownCurve) {
+			fmt.Fprintf(os.Stderr, "Unrecognized elliptic curve: %q", *ecdsaCurve)
+			os.Exit(1)
+		}
+		if err != nil {
+			log.Fatalf("Failed to generate private key: %s", err)
+		}
+	}
+	if priv != nil {
+		pub = priv.Public()
+	}
+
+	var renewing *x509.Certificate
+	var selfSigned bool
+	if *renew != "" {
+		if *csrIn != "" {
+			log.Fatalf("--renew can't be used with --sign-csr")
+		}
+		renewing, err = readCertificate(*renew)
+		if err != nil {
+			log.Fatalf("Failed to read certificate to renew: %s", err)
+		}
+		selfSigned = bytes.Equal(renewing.RawIssuer, renewing.RawSubject) && renewing.CheckSignature(renewing.SignatureAlgorithm, renewing.RawTBSCertificate, renewing.Signature) == nil
+		if !selfSigned && *caCert == "" {
+			log.Fatalf("%s was issued by %s, give that CA as --ca-cert and --ca-key", *renew, renewing.Issuer)
+		}
 	}
 
-	template := x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			Organization: []string{"Ubifly Technologies Pvt Ltd"},
-		},
+	notBefore, notAfter, appliedBackdate := flagValidity(renewing)
+	opts := certgen.Options{
+		Profile:               *profile,
+		Hosts:                 strings.Split(*host, ","),
+		Usage:                 *usage,
+		SPIFFEID:              *spiffeID,
+		IsCA:                  issueCA(),
+		Subject:               flagSubject(),
+		PermittedDNSDomains:   subjectList(*permitDNS),
+		PermittedIPRanges:     permittedIPs,
 		NotBefore:             notBefore,
 		NotAfter:              notAfter,
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
+		OCSPServer:            subjectList(*ocspURL),
+		CRLDistributionPoints: subjectList(*crlURL),
+		Rand:                  random,
+	}
+	if *profile == "spiffe" && !flagSet("host") {
+		// SVIDs are named by their SPIFFE ID, not the default --host
+		opts.Hosts = nil
+	}
+	if *email != "" {
+		opts.Emails = strings.Split(*email, ",")
+	} else if renewing != nil {
+		opts.Emails = renewing.EmailAddresses
+	}
+	var template *x509.Certificate
+	if request != nil {
+		template, err = requestTemplate(opts, request)
+	} else {
+		template, err = certgen.Template(opts, pub)
+	}
+	if err != nil {
+		log.Fatalf("Invalid certificate: %s", err)
+	}
+	if request != nil {
+		describeRequest(os.Stderr, request, template, *usage)
 	}
 
-	hosts := strings.Split(*host, ",")
-	for _, h := range hosts {
-		if ip := net.ParseIP(h); ip != nil {
-			template.IPAddresses = append(template.IPAddresses, ip)
-		} else {
-			template.DNSNames = append(template.DNSNames, h)
+	if renewing != nil {
+		// Everything but the key and validity comes from the old certificate
+		template.Subject = renewing.Subject
+		template.DNSNames, template.IPAddresses = renewing.DNSNames, renewing.IPAddresses
+		template.EmailAddresses, template.URIs = renewing.EmailAddresses, renewing.URIs
+		template.KeyUsage, template.ExtKeyUsage = renewing.KeyUsage, renewing.ExtKeyUsage
+		template.IsCA, template.MaxPathLen, template.MaxPathLenZero = renewing.IsCA, renewing.MaxPathLen, renewing.MaxPathLenZero
+		template.PermittedDNSDomainsCritical = renewing.PermittedDNSDomainsCritical
+		template.PermittedDNSDomains, template.PermittedIPRanges = renewing.PermittedDNSDomains, renewing.PermittedIPRanges
+	}
+
+	if *csrOut != "" {
+		csrPEM, err := certgen.RequestPEM(template, signingKey(priv, random))
+		if err != nil {
+			log.Fatalf("Failed to create certificate request: %s", err)
+		}
+		if err := writeOutput(*csrOut, csrPEM, 0644); err != nil {
+			log.Fatalf("Failed to write %s: %s", *csrOut, err)
+		}
+		log.Printf("Wrote %s\n", *csrOut)
+		keyPEM, err := certgen.EncodeKeyPEM(priv, *keyFormat, keyPass)
+		if err != nil {
+			log.Fatalf("Failed to encode private key: %s", err)
 		}
+		if err := writeOutput(*keyOut, keyPEM, 0600); err != nil {
+			log.Fatalf("Failed to write %s: %s", *keyOut, err)
+		}
+		log.Printf("Wrote %s\n", *keyOut)
+		return 0
 	}
 
-	if *isCA {
-		template.IsCA = true
-		template.KeyUsage |= x509.KeyUsageCertSign
+	var parent *x509.Certificate
+	var signer crypto.Signer
+	var chain []*x509.Certificate
+	if *caCert != "" {
+		parent, signer, err = loadCA(*caCert, *caKey)
+		if err != nil {
+			log.Fatalf("Failed to load CA: %s", err)
+		}
+		// Renewing with another CA would move the certificate to an issuer
+		// its clients may not trust
+		if renewing != nil && !selfSigned {
+			if err := renewing.CheckSignatureFrom(parent); err != nil {
+				log.Fatalf("%s wasn't issued by --ca-cert %s: %s", *renew, *caCert, err)
+			}
+		}
+		chain = append(chain, parent)
 	}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, publicKey(priv), priv)
+	cert, err := certgen.Issue(template, pub, parent, signingKey(signer, random), signingKey(priv, random))
 	if err != nil {
 		log.Fatalf("Failed to create certificate: %s", err)
 	}
 
-	certOut, err := os.Create("tls.cert")
-	if err != nil {
-		log.Fatalf("Failed to open cert.pem for writing: %s", err)
+	certPEM := certgen.CertificatePEM(cert)
+	var keyPEM []byte
+	if priv != nil {
+		keyPEM, err = certgen.EncodeKeyPEM(priv, *keyFormat, keyPass)
+		if err != nil {
+			log.Fatalf("Failed to encode private key: %s", err)
+		}
+	}
+	certPath, keyPath := *certOut, *keyOut
+	if priv == nil {
+		keyPath = ""
+	}
+
+	if *toStdout {
+		// The bundle is the certificate, then its CA, then the key
+		bundle := append([]byte(nil), certPEM...)
+		for _, c := range chain {
+			bundle = append(bundle, certgen.CertificatePEM(c)...)
+		}
+		bundle = append(bundle, keyPEM...)
+		if _, err := os.Stdout.Write(bundle); err != nil {
+			log.Fatalf("Failed to write to stdout: %s", err)
+		}
+		certPath, keyPath = "", ""
+	} else {
+		if err := writeOutput(certPath, certPEM, 0644); err != nil {
+			log.Fatalf("Failed to write %s: %s", certPath, err)
+		}
+		log.Printf("Wrote %s\n", certPath)
+
+		if keyPEM != nil {
+			if err := writeOutput(keyPath, keyPEM, 0600); err != nil {
+				log.Fatalf("Failed to write %s: %s", keyPath, err)
+			}
+			log.Printf("Wrote %s\n", keyPath)
+		}
 	}
 
-	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
-	certOut.Close()
-	log.Print("Wrote cert.pem\n")
+	if *p12Out != "" {
+		password := *p12Pass
+		if password != "" {
+			pass, err := readPassphrase(password)
+			if err != nil {
+				log.Fatalf("Failed to read PKCS#12 password: %s", err)
+			}
+			password = string(pass)
+		}
+		p12, err := certgen.EncodePKCS12(priv, cert, chain, template.Subject.CommonName, password)
+		if err != nil {
+			log.Fatalf("Failed to encode PKCS#12 bundle: %s", err)
+		}
+		if err := writeOutput(*p12Out, p12, 0600); err != nil {
+			log.Fatalf("Failed to write %s: %s", *p12Out, err)
+		}
+		log.Printf("Wrote %s\n", *p12Out)
+	}
 
-	keyOut, err := os.OpenFile("tls.key", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		log.Print("Failed to open key.pem for writing:", err)
-		return
+	if *profile == "codesign" && *tsaConfig != "" {
+		if err := writeTimestampConfig(*tsaConfig, certPath, keyPath, *tsaURL); err != nil {
+			log.Fatalf("Failed to write %s: %s", *tsaConfig, err)
+		}
+		log.Printf("Wrote %s\n", *tsaConfig)
+	}
+
+	if *indexFile != "" {
+		if err := addToIndex(*indexFile, cert); err != nil {
+			log.Fatalf("Failed to add the certificate to %s: %s", *indexFile, err)
+		}
+	}
+
+	if *jsonOut || *auditLog != "" {
+		record := newIssuanceRecord(cert, profileName, appliedBackdate, certPath, keyPath)
+		if *jsonOut {
+			if err := record.print(os.Stdout); err != nil {
+				log.Fatalf("Failed to write JSON output: %s", err)
+			}
+		}
+		if *auditLog != "" {
+			if err := record.appendTo(*auditLog); err != nil {
+				log.Fatalf("Failed to write audit log %s: %s", *auditLog, err)
+			}
+		}
+	}
+
+	if *dhParams != "" {
+		log.Printf("Generating %d bit DH parameters, this may take a while\n", *dhBits)
+		if err := writeDHParams(*dhParams, *dhBits); err != nil {
+			log.Fatalf("Failed to write %s: %s", *dhParams, err)
+		}
+		log.Printf("Wrote %s\n", *dhParams)
 	}
 
-	pem.Encode(keyOut, pemBlockForKey(priv))
-	keyOut.Close()
-	log.Print("Wrote key.pem\n")
+	if *ticketKeys != "" {
+		if err := rotateTicketKeys(*ticketKeys, *ticketKeep); err != nil {
+			log.Fatalf("Failed to write %s: %s", *ticketKeys, err)
+		}
+		log.Printf("Wrote %s\n", *ticketKeys)
+		if *ticketEvery > 0 {
+			watchTicketKeys(*ticketKeys, *ticketKeep, *ticketEvery)
+		}
+	}
+	return 0
+}
+
+// flagValidity returns the validity period the flags give and how much of
+// it is backdating. The period starts now or at --start-date. When starting
+// now, NotBefore is moved back by --backdate without shortening the period.
+// A renewed certificate keeps the length of the old one.
+func flagValidity(renewing *x509.Certificate) (notBefore, notAfter time.Time, appliedBackdate time.Duration) {
+	var err error
+	if len(*validFrom) == 0 {
+		if *backdate < 0 {
+			log.Fatalf("--backdate must not be negative")
+		}
+		now := time.Now()
+		appliedBackdate = *backdate
+		notBefore = now.Add(-appliedBackdate)
+		notAfter = now.Add(*validFor)
+	} else {
+		notBefore, err = time.Parse(dateLayout, *validFrom)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to parse creation date: %s", err)
+			os.Exit(1)
+		}
+		notAfter = notBefore.Add(*validFor)
+	}
+	switch {
+	case *validTo != "":
+		if flagSet("duration") {
+			log.Fatalf("--end-date and --duration can't be used together")
+		}
+		notAfter, err = time.Parse(dateLayout, *validTo)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to parse expiry date: %s", err)
+			os.Exit(1)
+		}
+	case renewing != nil && !flagSet("duration"):
+		notAfter = notBefore.Add(renewing.NotAfter.Sub(renewing.NotBefore))
+	}
+	return notBefore, notAfter, appliedBackdate
+}
+
+// parseIPRanges parses CIDR ranges. A bare IP is a range of just that address.
+func parseIPRanges(ranges []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, r := range ranges {
+		if ip := net.ParseIP(r); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// signingKey makes key sign deterministically when deriving from --seed
+func signingKey(key crypto.Signer, random io.Reader) crypto.Signer {
+	if key == nil || random == nil {
+		return key
+	}
+	return certgen.Deterministic(key)
+}
+
+// flagSubject returns the certificate subject the flags give
+func flagSubject() pkix.Name {
+	return pkix.Name{
+		CommonName:         *commonName,
+		Organization:       append([]string{"Ubifly Technologies Pvt Ltd"}, subjectList(*orgs)...),
+		OrganizationalUnit: subjectList(*orgUnits),
+		Country:            subjectList(strings.ToUpper(*country)),
+		Locality:           subjectList(*locality),
+		Province:           subjectList(*province),
+	}
+}
+
+// writeTimestampConfig writes the settings needed to sign and timestamp
+// binaries with the generated code signing certificate
+func writeTimestampConfig(path, certPath, keyPath, url string) error {
+	config := fmt.Sprintf(`# Code signing configuration generated by genCrt
+certificate = %s
+key = %s
+timestamp_url = %s
+timestamp_hash = sha256
+
+# osslsigncode sign -certs %s -key %s -ts %s -h sha256 -in <file> -out <signed file>
+`, certPath, keyPath, url, certPath, keyPath, url)
+	return writeOutput(path, []byte(config), 0644)
 }
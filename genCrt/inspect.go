@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// runInspect prints the fields of each certificate that say what it is
+// for, the same fields diff compares
+func runInspect(args []string) int {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: genCrt inspect <cert>...")
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	status := 0
+	for i, path := range fs.Args() {
+		cert, err := readCertificate(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("%s:\n", path)
+		for _, f := range diffFields {
+			if values := f.values(cert); len(values) > 0 {
+				fmt.Printf("  %-19s %s\n", f.name+":", strings.Join(values, ", "))
+			}
+		}
+		switch now := time.Now(); {
+		case now.Before(cert.NotBefore):
+			fmt.Printf("  %-19s not valid for another %s\n", "Status:", cert.NotBefore.Sub(now).Round(time.Second))
+		case now.After(cert.NotAfter):
+			fmt.Printf("  %-19s expired %s ago\n", "Status:", now.Sub(cert.NotAfter).Round(time.Second))
+		default:
+			fmt.Printf("  %-19s valid for another %s\n", "Status:", cert.NotAfter.Sub(now).Round(time.Second))
+		}
+	}
+	return status
+}
+
+// runVerify checks that a certificate chains to a CA, is valid now and,
+// if asked, is for a host and usage
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	caCertPath := fs.String("ca-cert", "", "CA certificate the certificate must chain to")
+	intermediates := fs.String("intermediates", "", "File of PEM intermediate CA certificates, if any")
+	hostname := fs.String("host", "", "Hostname or IP the certificate must be valid for")
+	usage := fs.String("usage", "", "Usage the certificate must allow: server, client or any. Defaults to server")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: genCrt verify -ca-cert <cert> [flags] <cert>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || *caCertPath == "" {
+		fs.Usage()
+		return 2
+	}
+
+	var keyUsages []x509.ExtKeyUsage
+	switch *usage {
+	case "", "server":
+		keyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	case "client":
+		keyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	case "any":
+		keyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageAny}
+	default:
+		fmt.Fprintf(os.Stderr, "Unrecognized usage: %q\n", *usage)
+		return 2
+	}
+
+	cert, err := readCertificate(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	roots := x509.NewCertPool()
+	if err := addCertificates(roots, *caCertPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	pool := x509.NewCertPool()
+	if *intermediates != "" {
+		if err := addCertificates(pool, *intermediates); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	chains, err := cert.Verify(x509.VerifyOptions{
+		DNSName:       *hostname,
+		Roots:         roots,
+		Intermediates: pool,
+		KeyUsages:     keyUsages,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", fs.Arg(0), err)
+		return 1
+	}
+
+	var names []string
+	for _, c := range chains[0] {
+		names = append(names, c.Subject.String())
+	}
+	fmt.Printf("%s: OK\n  chain: %s\n", fs.Arg(0), strings.Join(names, " <- "))
+	return 0
+}
+
+// addCertificates adds the PEM certificates in a file to pool
+func addCertificates(pool *x509.CertPool, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("%s: no PEM certificates found", path)
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// The OCSP messages of RFC 6960, as much of them as a responder needs
+
+// OCSP response statuses
+const (
+	ocspSuccessful       = 0
+	ocspMalformedRequest = 1
+	ocspInternalError    = 2
+)
+
+var (
+	oidOCSPBasic = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	oidOCSPNonce = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 2}
+
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidEd25519         = asn1.ObjectIdentifier{1, 3, 101, 112}
+)
+
+type ocspCertID struct {
+	HashAlgorithm  pkix.AlgorithmIdentifier
+	IssuerNameHash []byte
+	IssuerKeyHash  []byte
+	SerialNumber   *big.Int
+}
+
+type ocspRequest struct {
+	TBSRequest struct {
+		Version           int           `asn1:"explicit,tag:0,default:0,optional"`
+		RequestorName     asn1.RawValue `asn1:"explicit,tag:1,optional"`
+		RequestList       []struct{ CertID ocspCertID }
+		RequestExtensions []pkix.Extension `asn1:"explicit,tag:2,optional"`
+	}
+}
+
+type ocspResponse struct {
+	Status        asn1.Enumerated
+	ResponseBytes struct {
+		ResponseType asn1.ObjectIdentifier
+		Response     []byte
+	} `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+}
+
+type ocspResponseData struct {
+	ResponderID        asn1.RawValue
+	ProducedAt         time.Time `asn1:"generalized"`
+	Responses          []ocspSingleResponse
+	ResponseExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+// ocspSingleResponse has one of Good, Revoked and Unknown set
+type ocspSingleResponse struct {
+	CertID     ocspCertID
+	Good       asn1.Flag       `asn1:"tag:0,optional"`
+	Revoked    ocspRevokedInfo `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag       `asn1:"tag:2,optional"`
+	ThisUpdate time.Time       `asn1:"generalized"`
+	NextUpdate time.Time       `asn1:"generalized,explicit,tag:0,optional"`
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+// ocspResponder answers OCSP requests for the certificates of a CA from
+// its index. The index is read for every request, so revocations take
+// effect without restarting it.
+type ocspResponder struct {
+	indexPath string
+	key       crypto.Signer
+	validity  time.Duration
+
+	// nameHash and keyHash identify the CA in requests, by hash algorithm
+	nameHash map[string][]byte
+	keyHash  map[string][]byte
+}
+
+func newOCSPResponder(indexPath string, ca *x509.Certificate, key crypto.Signer, validity time.Duration) (*ocspResponder, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(ca.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, err
+	}
+	responder := &ocspResponder{
+		indexPath: indexPath,
+		key:       key,
+		validity:  validity,
+		nameHash:  make(map[string][]byte),
+		keyHash:   make(map[string][]byte),
+	}
+	for oid, h := range map[string]func() hash.Hash{oidSHA1.String(): sha1.New, oidSHA256.String(): sha256.New} {
+		name, key := h(), h()
+		name.Write(ca.RawSubject)
+		key.Write(spki.PublicKey.RightAlign())
+		responder.nameHash[oid], responder.keyHash[oid] = name.Sum(nil), key.Sum(nil)
+	}
+	return responder, nil
+}
+
+func (o *ocspResponder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var der []byte
+	var err error
+	switch r.Method {
+	case http.MethodPost:
+		der, err = io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	case http.MethodGet:
+		// GET requests are the base64 DER request as the path
+		var path string
+		if path, err = url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/")); err == nil {
+			der, err = base64.StdEncoding.DecodeString(path)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var resp []byte
+	if err != nil {
+		resp = ocspStatus(ocspMalformedRequest)
+	} else {
+		resp = o.respond(der)
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(resp)
+}
+
+// ocspStatus is an unsuccessful response, which has nothing but the status
+func ocspStatus(status int) []byte {
+	der, _ := asn1.Marshal(struct{ Status asn1.Enumerated }{asn1.Enumerated(status)})
+	return der
+}
+
+// respond returns the DER response to a DER request
+func (o *ocspResponder) respond(der []byte) []byte {
+	var req ocspRequest
+	if rest, err := asn1.Unmarshal(der, &req); err != nil || len(rest) > 0 || len(req.TBSRequest.RequestList) == 0 {
+		return ocspStatus(ocspMalformedRequest)
+	}
+	index, err := readIndex(o.indexPath)
+	if err != nil {
+		log.Printf("Failed to read index: %s", err)
+		return ocspStatus(ocspInternalError)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	data := ocspResponseData{ProducedAt: now}
+	for _, single := range req.TBSRequest.RequestList {
+		id := single.CertID
+		response := ocspSingleResponse{CertID: id, ThisUpdate: now, NextUpdate: now.Add(o.validity)}
+		entry := index.lookup(id.SerialNumber)
+		var status string
+		switch {
+		case !o.issued(id) || entry == nil:
+			status, response.Unknown = "unknown", true
+		case entry.RevokedAt != nil:
+			status = "revoked"
+			response.Revoked = ocspRevokedInfo{
+				RevocationTime: entry.RevokedAt.UTC(),
+				Reason:         asn1.Enumerated(revocationReasons[entry.Reason]),
+			}
+		default:
+			status, response.Good = "good", true
+		}
+		log.Printf("OCSP %s: %s", id.SerialNumber.Text(16), status)
+		data.Responses = append(data.Responses, response)
+	}
+	for _, ext := range req.TBSRequest.RequestExtensions {
+		if ext.Id.Equal(oidOCSPNonce) {
+			data.ResponseExtensions = append(data.ResponseExtensions, ext)
+		}
+	}
+
+	resp, err := o.sign(data)
+	if err != nil {
+		log.Printf("Failed to sign OCSP response: %s", err)
+		return ocspStatus(ocspInternalError)
+	}
+	return resp
+}
+
+// issued reports whether a request is for a certificate of this CA
+func (o *ocspResponder) issued(id ocspCertID) bool {
+	alg := id.HashAlgorithm.Algorithm.String()
+	return o.nameHash[alg] != nil &&
+		bytes.Equal(o.nameHash[alg], id.IssuerNameHash) && bytes.Equal(o.keyHash[alg], id.IssuerKeyHash)
+}
+
+// sign signs response data with the CA key, identifying the responder by
+// the hash of that key
+func (o *ocspResponder) sign(data ocspResponseData) ([]byte, error) {
+	keyID, err := asn1.Marshal(o.keyHash[oidSHA1.String()])
+	if err != nil {
+		return nil, err
+	}
+	data.ResponderID = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: keyID}
+	tbs, err := asn1.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var alg pkix.AlgorithmIdentifier
+	var signature []byte
+	digest := sha256.Sum256(tbs)
+	switch o.key.Public().(type) {
+	case *rsa.PublicKey:
+		alg = pkix.AlgorithmIdentifier{Algorithm: oidSHA256WithRSA, Parameters: asn1.NullRawValue}
+		signature, err = o.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case *ecdsa.PublicKey:
+		alg = pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+		signature, err = o.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case ed25519.PublicKey:
+		alg = pkix.AlgorithmIdentifier{Algorithm: oidEd25519}
+		signature, err = o.key.Sign(rand.Reader, tbs, crypto.Hash(0))
+	default:
+		return nil, errors.New("unsupported CA key type")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	basic, err := asn1.Marshal(ocspBasicResponse{
+		TBSResponseData:    asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: alg,
+		Signature:          asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var resp ocspResponse
+	resp.Status = ocspSuccessful
+	resp.ResponseBytes.ResponseType = oidOCSPBasic
+	resp.ResponseBytes.Response = basic
+	return asn1.Marshal(resp)
+}
+
+func runOCSP(args []string) int {
+	fs := flag.NewFlagSet("ocsp", flag.ExitOnError)
+	indexPath := fs.String("index", "", "CA index file")
+	caCertPath := fs.String("ca-cert", "", "CA certificate the index is for")
+	caKeyPath := fs.String("ca-key", "", "Private key of the CA, to sign responses with")
+	addr := fs.String("addr", "localhost:8889", "Address to listen on")
+	validity := fs.Duration("validity", time.Hour, "How long clients may cache responses for")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: genCrt ocsp -index <file> -ca-cert <cert> -ca-key <key> [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 || *indexPath == "" || *caCertPath == "" || *caKeyPath == "" {
+		fs.Usage()
+		return 2
+	}
+
+	ca, caPriv, err := loadCA(*caCertPath, *caKeyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load CA: %s\n", err)
+		return 1
+	}
+	responder, err := newOCSPResponder(*indexPath, ca, caPriv, *validity)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read CA public key: %s\n", err)
+		return 1
+	}
+	log.Printf("OCSP responder for %s listening on %s\n", ca.Subject, *addr)
+	if err := http.ListenAndServe(*addr, responder); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/muthubro/ready-set-go/certgen"
+)
+
+// testCA is a CA with an index, and files of a revoked and a good
+// certificate it issued
+type testCA struct {
+	dir                   string
+	certPath, keyPath     string
+	indexPath             string
+	cert                  *x509.Certificate
+	revoked, good         *x509.Certificate
+	revokedPath, goodPath string
+}
+
+// newTestCA makes a CA, issues two certificates recorded in its index and
+// revokes one of them with revoke
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	dir := t.TempDir()
+	ca, err := certgen.Generate(certgen.Options{
+		IsCA:       true,
+		Subject:    pkix.Name{CommonName: "Test CA"},
+		ECDSACurve: "P256",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testCA{
+		dir:       dir,
+		certPath:  filepath.Join(dir, "ca.cert"),
+		keyPath:   filepath.Join(dir, "ca.key"),
+		indexPath: filepath.Join(dir, "ca.index"),
+		cert:      ca.Certificate,
+	}
+	writeTestFile(t, c.certPath, ca.CertPEM)
+	writeTestFile(t, c.keyPath, ca.KeyPEM)
+
+	issue := func(host string) (*x509.Certificate, string) {
+		leaf, err := certgen.Generate(certgen.Options{
+			Hosts:      []string{host},
+			ECDSACurve: "P256",
+			Parent:     ca.Certificate,
+			ParentKey:  ca.Key,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, host+".cert")
+		writeTestFile(t, path, leaf.CertPEM)
+		if err := addToIndex(c.indexPath, leaf.Certificate); err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Certificate, path
+	}
+	c.revoked, c.revokedPath = issue("revoked.example.com")
+	c.good, c.goodPath = issue("good.example.com")
+
+	if status := runRevoke([]string{"-index", c.indexPath, "-reason", "keyCompromise", c.revokedPath}); status != 0 {
+		t.Fatalf("revoke exited with %d", status)
+	}
+	return c
+}
+
+func writeTestFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestOCSPOpenSSL asks the responder for the status of each certificate
+// with openssl ocsp, which also verifies the responses are signed by the CA
+func TestOCSPOpenSSL(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl isn't installed")
+	}
+	ca := newTestCA(t)
+	key, err := loadPrivateKey(ca.keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, err := newOCSPResponder(ca.indexPath, ca.cert, key, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(responder)
+	defer server.Close()
+
+	// Another CA's certificate with the serial of the good one
+	other, err := certgen.Generate(certgen.Options{IsCA: true, Subject: pkix.Name{CommonName: "Other CA"}, ECDSACurve: "P256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPath := filepath.Join(ca.dir, "other.cert")
+	writeTestFile(t, otherPath, other.CertPEM)
+
+	tests := []struct {
+		name, issuer, cert string
+		want               []string
+	}{
+		{"revoked", ca.certPath, ca.revokedPath, []string{"revoked.example.com.cert: revoked", "Reason: keyCompromise"}},
+		{"good", ca.certPath, ca.goodPath, []string{"good.example.com.cert: good"}},
+		{"other CA", otherPath, ca.goodPath, []string{"good.example.com.cert: unknown"}},
+	}
+	// The responses are signed with the CA's key, so openssl finds the
+	// signer in -issuer, except when asking about the other CA
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := []string{"ocsp", "-issuer", tt.issuer, "-cert", tt.cert, "-url", server.URL, "-CAfile", ca.certPath}
+			if tt.issuer != ca.certPath {
+				args = append(args, "-VAfile", ca.certPath)
+			}
+			out, err := exec.Command("openssl", args...).CombinedOutput()
+			if err != nil {
+				t.Fatalf("openssl ocsp: %s\n%s", err, out)
+			}
+			for _, want := range append(tt.want, "Response verify OK") {
+				if !strings.Contains(string(out), want) {
+					t.Errorf("openssl ocsp printed:\n%s\nwant %q", out, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCRL(t *testing.T) {
+	ca := newTestCA(t)
+	out := filepath.Join(ca.dir, "ca.crl")
+	args := []string{"-index", ca.indexPath, "-ca-cert", ca.certPath, "-ca-key", ca.keyPath, "-out", out}
+	for number := int64(1); number <= 2; number++ {
+		if number > 1 {
+			args = append(args, "-force")
+		}
+		if status := runCRL(args); status != 0 {
+			t.Fatalf("crl exited with %d", status)
+		}
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "X509 CRL" {
+			t.Fatalf("%s isn't a PEM CRL", out)
+		}
+		list, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := list.CheckSignatureFrom(ca.cert); err != nil {
+			t.Errorf("the CRL isn't signed by the CA: %s", err)
+		}
+		if list.Number.Int64() != number {
+			t.Errorf("CRL number %s, want %d", list.Number, number)
+		}
+		if len(list.RevokedCertificateEntries) != 1 {
+			t.Fatalf("the CRL lists %d certificates, want the revoked one", len(list.RevokedCertificateEntries))
+		}
+		entry := list.RevokedCertificateEntries[0]
+		if entry.SerialNumber.Cmp(ca.revoked.SerialNumber) != 0 || entry.ReasonCode != revocationReasons["keyCompromise"] {
+			t.Errorf("the CRL lists %s for reason %d, want %s for keyCompromise", entry.SerialNumber.Text(16), entry.ReasonCode, ca.revoked.SerialNumber.Text(16))
+		}
+	}
+
+	// Without -force the last CRL is kept, and so is its number
+	if status := runCRL(args[:len(args)-1]); status != 1 {
+		t.Errorf("crl exited with %d over an existing CRL, want 1", status)
+	}
+	index, err := readIndex(ca.indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.CRLNumber != 2 {
+		t.Errorf("the index has CRL number %d, want 2", index.CRLNumber)
+	}
+}
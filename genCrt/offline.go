@@ -0,0 +1,300 @@
+package main
+
+// Offline issuance keeps the CA key on a machine that is never networked.
+// Files are named after the certificate, <name>:
+//
+//  1. genCrt request -host example.com <name>           (online machine)
+//     writes <name>.key, which never leaves the machine, and <name>.csr
+//  2. copy <name>.csr to the CA machine
+//  3. genCrt sign -ca-cert ca.cert -ca-key ca.key <name>.csr   (CA machine)
+//     shows what is being certified and writes <name>.crt
+//  4. copy <name>.crt back
+//  5. genCrt accept -ca-cert ca.cert <name>              (online machine)
+//     checks <name>.crt is for <name>.key and issued by the CA
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/muthubro/ready-set-go/certgen"
+)
+
+// writeNewFile writes data to path, failing if the file already exists
+func writeNewFile(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func runRequest(args []string) int {
+	fs := flag.NewFlagSet("request", flag.ExitOnError)
+	hosts := fs.String("host", "", "Comma-separated hostnames, IPs, email addresses and URIs to request a certificate for")
+	curve := fs.String("ecdsa-curve", "P256", "ECDSA curve to use to generate a key. Empty for RSA")
+	bits := fs.Int("rsa-bits", 2048, "Size of RSA key to generate. Ignored if -ecdsa-curve is set")
+	passSpec := fs.String("passphrase", "", "Encrypt the private key with this passphrase, or env:NAME or file:PATH")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: genCrt request -host <hosts> [flags] <name>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || *hosts == "" {
+		fs.Usage()
+		return 2
+	}
+	name := fs.Arg(0)
+
+	var keyPass []byte
+	if *passSpec != "" {
+		var err error
+		if keyPass, err = readPassphrase(*passSpec); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read passphrase: %s\n", err)
+			return 1
+		}
+	}
+
+	priv, err := certgen.GenerateKey(*curve, *bits)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate private key: %s\n", err)
+		return 1
+	}
+	sans, err := certgen.ParseHosts(strings.Split(*hosts, ","))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -host: %s\n", err)
+		return 2
+	}
+	csrPEM, err := certgen.RequestPEM(&x509.Certificate{
+		Subject:        pkix.Name{CommonName: strings.Split(*hosts, ",")[0]},
+		DNSNames:       sans.DNSNames,
+		IPAddresses:    sans.IPAddresses,
+		EmailAddresses: sans.EmailAddresses,
+		URIs:           sans.URIs,
+	}, priv)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create certificate request: %s\n", err)
+		return 1
+	}
+
+	format := certgen.KeyFormatPKCS1
+	if keyPass != nil {
+		format = certgen.KeyFormatPKCS8
+	}
+	keyPEM, err := certgen.EncodeKeyPEM(priv, format, keyPass)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to encode private key: %s\n", err)
+		return 1
+	}
+	if err := writeNewFile(name+".key", keyPEM, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write private key: %s\n", err)
+		return 1
+	}
+	if err := writeNewFile(name+".csr", csrPEM, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write certificate request: %s\n", err)
+		return 1
+	}
+	fmt.Printf("Wrote %s.key and %s.csr\nTake %s.csr to the CA and run: genCrt sign -ca-cert <ca cert> -ca-key <ca key> %s.csr\n", name, name, name, name)
+	return 0
+}
+
+// readCertificateRequest reads a PEM certificate request and checks its signature
+func readCertificateRequest(path string) (*x509.CertificateRequest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("%s: no PEM certificate request found", path)
+	}
+	request, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if err := request.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return request, nil
+}
+
+// requestTemplate returns the certificate to issue for request, for both
+// genCrt sign and --sign-csr. opts decide what the certificate may be used
+// for and for how long; the request names the subject and, if it has any,
+// the names it is for.
+func requestTemplate(opts certgen.Options, request *x509.CertificateRequest) (*x509.Certificate, error) {
+	template, err := certgen.Template(opts, request.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	template.Subject = request.Subject
+	if len(request.DNSNames) > 0 || len(request.IPAddresses) > 0 || len(request.URIs) > 0 {
+		template.DNSNames, template.IPAddresses = request.DNSNames, request.IPAddresses
+		template.URIs = request.URIs
+	}
+	if len(request.EmailAddresses) > 0 {
+		template.EmailAddresses = request.EmailAddresses
+	}
+	return template, nil
+}
+
+// describeRequest shows what signing request is going to certify, so it
+// can be checked before the certificate is handed out
+func describeRequest(w io.Writer, request *x509.CertificateRequest, template *x509.Certificate, usage string) {
+	fmt.Fprintf(w, "Subject:     %s\n", template.Subject)
+	fmt.Fprintf(w, "DNS names:   %s\n", strings.Join(template.DNSNames, ", "))
+	fmt.Fprintf(w, "IPs:         %v\n", template.IPAddresses)
+	fmt.Fprintf(w, "Emails:      %s\n", strings.Join(template.EmailAddresses, ", "))
+	fmt.Fprintf(w, "URIs:        %v\n", template.URIs)
+	fmt.Fprintf(w, "Public key:  %s sha256:%s\n", request.PublicKeyAlgorithm, publicKeyFingerprint(request.RawSubjectPublicKeyInfo))
+	fmt.Fprintf(w, "Usage:       %s\n", usage)
+	fmt.Fprintf(w, "CA:          %t\n", template.IsCA)
+	fmt.Fprintf(w, "Valid until: %s\n", template.NotAfter.UTC().Format(time.RFC3339))
+}
+
+// publicKeyFingerprint is the SHA-256 of the DER public key, for checking
+// by eye that a request and a certificate belong together
+func publicKeyFingerprint(rawSubjectPublicKeyInfo []byte) string {
+	sum := sha256.Sum256(rawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+func runSign(args []string) int {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	caCertPath := fs.String("ca-cert", "", "CA certificate to sign with")
+	caKeyPath := fs.String("ca-key", "", "Private key of the CA")
+	duration := fs.Duration("duration", 365*24*time.Hour, "Duration that certificate is valid for")
+	back := fs.Duration("backdate", 5*time.Minute, "How far before now to set NotBefore")
+	usage := fs.String("usage", "server", "What the certificate authenticates. Valid values are server, client, both")
+	indexPath := fs.String("index", "", "Record the certificate in this CA index, for genCrt revoke, crl and ocsp")
+	ocspURL := fs.String("ocsp-url", "", "Comma-separated OCSP responder URLs to put in the certificate")
+	crlURL := fs.String("crl-url", "", "Comma-separated CRL distribution point URLs to put in the certificate")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: genCrt sign -ca-cert <cert> -ca-key <key> [flags] <name>.csr")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || *caCertPath == "" || *caKeyPath == "" {
+		fs.Usage()
+		return 2
+	}
+	csrPath := fs.Arg(0)
+	name := strings.TrimSuffix(csrPath, ".csr")
+	if _, _, err := certgen.TLSKeyUsage(*usage, nil); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	request, err := readCertificateRequest(csrPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read certificate request: %s\n", err)
+		return 1
+	}
+	ca, caPriv, err := loadCA(*caCertPath, *caKeyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load CA: %s\n", err)
+		return 1
+	}
+	template, err := requestTemplate(certgen.Options{
+		Usage:                 *usage,
+		ValidFor:              *duration,
+		Backdate:              *back,
+		OCSPServer:            subjectList(*ocspURL),
+		CRLDistributionPoints: subjectList(*crlURL),
+	}, request)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid certificate: %s\n", err)
+		return 1
+	}
+	describeRequest(os.Stdout, request, template, *usage)
+
+	cert, err := certgen.Issue(template, request.PublicKey, ca, caPriv, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create certificate: %s\n", err)
+		return 1
+	}
+	if err := writeNewFile(name+".crt", certgen.CertificatePEM(cert), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write certificate: %s\n", err)
+		return 1
+	}
+	if *indexPath != "" {
+		if err := addToIndex(*indexPath, cert); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to add the certificate to %s: %s\n", *indexPath, err)
+			return 1
+		}
+	}
+	fmt.Printf("Wrote %s.crt\nTake it back and run: genCrt accept -ca-cert <ca cert> %s\n", name, name)
+	return 0
+}
+
+func runAccept(args []string) int {
+	fs := flag.NewFlagSet("accept", flag.ExitOnError)
+	caCertPath := fs.String("ca-cert", "", "CA certificate the certificate must be issued by")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: genCrt accept [-ca-cert <cert>] <name>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	name := fs.Arg(0)
+
+	cert, err := readCertificate(name + ".crt")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read certificate: %s\n", err)
+		return 1
+	}
+	priv, err := loadPrivateKey(name + ".key")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read private key: %s\n", err)
+		return 1
+	}
+	pub, err := x509.MarshalPKIXPublicKey(priv.Public())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to encode public key: %s\n", err)
+		return 1
+	}
+	if !bytes.Equal(pub, cert.RawSubjectPublicKeyInfo) {
+		fmt.Fprintf(os.Stderr, "%s.crt is not for the key in %s.key\n", name, name)
+		return 1
+	}
+
+	if *caCertPath != "" {
+		ca, err := readCertificate(*caCertPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read CA certificate: %s\n", err)
+			return 1
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(ca)
+		_, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+		if err != nil {
+			var invalid x509.CertificateInvalidError
+			if errors.As(err, &invalid) && invalid.Reason == x509.Expired {
+				fmt.Fprintf(os.Stderr, "%s.crt has expired or is not yet valid\n", name)
+				return 1
+			}
+			fmt.Fprintf(os.Stderr, "%s.crt is not issued by %s: %s\n", name, *caCertPath, err)
+			return 1
+		}
+	}
+
+	fmt.Printf("%s.crt matches %s.key, valid until %s\n", name, name, cert.NotAfter.UTC().Format(time.RFC3339))
+	return 0
+}
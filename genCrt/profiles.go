@@ -0,0 +1,162 @@
+package main
+
+// A profiles file names certificate templates so a team can generate
+// consistent certificates with just --profile. It is a JSON object of
+// profiles by name, for example:
+//
+//	{
+//	  "internal-web": {
+//	    "kind": "server",
+//	    "usage": "both",
+//	    "ca": false,
+//	    "ecdsa_curve": "P256",
+//	    "hosts": ["web.internal", "10.0.0.10"],
+//	    "subject": {"ou": ["Platform"], "country": ["IN"]},
+//	    "duration": "2160h"
+//	  }
+//	}
+//
+// kind is the built-in profile it is based on, server if empty. Flags given
+// on the command line take precedence over the profile.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// builtinProfiles are the profiles genCrt knows without a profiles file
+var builtinProfiles = []string{"server", "smime", "codesign", "spiffe"}
+
+// profileSubject is the subject of a profile. Its organizations are added
+// to the default one.
+type profileSubject struct {
+	CN       string   `json:"cn"`
+	Org      []string `json:"org"`
+	OU       []string `json:"ou"`
+	Country  []string `json:"country"`
+	Locality []string `json:"locality"`
+	Province []string `json:"province"`
+}
+
+// certProfile is a named template in a profiles file. Unset fields leave
+// the flag defaults alone.
+type certProfile struct {
+	Kind       string         `json:"kind"`
+	Usage      string         `json:"usage"`
+	CA         *bool          `json:"ca"`
+	PermitDNS  []string       `json:"permitted_dns"`
+	PermitIP   []string       `json:"permitted_ip"`
+	ECDSACurve *string        `json:"ecdsa_curve"`
+	RSABits    int            `json:"rsa_bits"`
+	KeyFormat  string         `json:"key_format"`
+	Hosts      []string       `json:"hosts"`
+	Emails     []string       `json:"emails"`
+	SPIFFEID   string         `json:"spiffe_id"`
+	Subject    profileSubject `json:"subject"`
+	Duration   string         `json:"duration"`
+	Backdate   string         `json:"backdate"`
+	OCSPURLs   []string       `json:"ocsp_urls"`
+	CRLURLs    []string       `json:"crl_urls"`
+}
+
+// flags returns the values the profile gives flags, by flag name
+func (p *certProfile) flags() map[string]string {
+	values := make(map[string]string)
+	set := func(name, value string) {
+		if value != "" {
+			values[name] = value
+		}
+	}
+	set("usage", p.Usage)
+	if p.CA != nil {
+		values["ca"] = strconv.FormatBool(*p.CA)
+	}
+	set("permitted-dns", strings.Join(p.PermitDNS, ","))
+	set("permitted-ip", strings.Join(p.PermitIP, ","))
+	if p.ECDSACurve != nil {
+		// An empty curve selects RSA
+		values["ecdsa-curve"] = *p.ECDSACurve
+	}
+	if p.RSABits != 0 {
+		values["rsa-bits"] = strconv.Itoa(p.RSABits)
+	}
+	set("key-format", p.KeyFormat)
+	set("host", strings.Join(p.Hosts, ","))
+	set("email", strings.Join(p.Emails, ","))
+	set("spiffe-id", p.SPIFFEID)
+	set("cn", p.Subject.CN)
+	set("org", strings.Join(p.Subject.Org, ","))
+	set("ou", strings.Join(p.Subject.OU, ","))
+	set("country", strings.Join(p.Subject.Country, ","))
+	set("locality", strings.Join(p.Subject.Locality, ","))
+	set("province", strings.Join(p.Subject.Province, ","))
+	set("duration", p.Duration)
+	set("backdate", p.Backdate)
+	set("ocsp-url", strings.Join(p.OCSPURLs, ","))
+	set("crl-url", strings.Join(p.CRLURLs, ","))
+	return values
+}
+
+// readProfiles reads a profiles file and checks every profile in it
+func readProfiles(path string) (map[string]*certProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var profiles map[string]*certProfile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	for name, p := range profiles {
+		if p.Kind == "" {
+			p.Kind = "server"
+		}
+		if !isBuiltinProfile(p.Kind) {
+			return nil, fmt.Errorf("%s: profile %q: unrecognized kind %q", path, name, p.Kind)
+		}
+	}
+	return profiles, nil
+}
+
+func isBuiltinProfile(name string) bool {
+	for _, builtin := range builtinProfiles {
+		if name == builtin {
+			return true
+		}
+	}
+	return false
+}
+
+// applyProfile looks --profile up in the profiles file, if there is one,
+// and sets the flags it gives that weren't given on the command line.
+// --profile is then the kind of the profile. Names not in the file are
+// left to be the built-in profiles.
+func applyProfile() error {
+	path := *profileFile
+	if path == "" {
+		return nil
+	}
+	profiles, err := readProfiles(path)
+	if err != nil {
+		return err
+	}
+	p, ok := profiles[*profile]
+	if !ok {
+		return nil
+	}
+	for name, value := range p.flags() {
+		// --end-date on the command line replaces the profile duration
+		if flagSet(name) || name == "duration" && flagSet("end-date") {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("%s: profile %q: %s: %s", path, *profile, name, err)
+		}
+	}
+	*profile = p.Kind
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+)
+
+// issuanceRecord describes an issued certificate for --json and --audit-log
+type issuanceRecord struct {
+	IssuedAt       time.Time `json:"issued_at"`
+	Profile        string    `json:"profile"`
+	SerialNumber   string    `json:"serial_number"`
+	Subject        string    `json:"subject"`
+	Issuer         string    `json:"issuer"`
+	NotBefore      time.Time `json:"not_before"`
+	NotAfter       time.Time `json:"not_after"`
+	Backdate       string    `json:"backdate"`
+	IsCA           bool      `json:"is_ca"`
+	DNSNames       []string  `json:"dns_names,omitempty"`
+	IPAddresses    []string  `json:"ip_addresses,omitempty"`
+	EmailAddresses []string  `json:"email_addresses,omitempty"`
+	URIs           []string  `json:"uris,omitempty"`
+	CertFile       string    `json:"cert_file,omitempty"`
+	KeyFile        string    `json:"key_file,omitempty"`
+}
+
+func newIssuanceRecord(cert *x509.Certificate, profile string, backdate time.Duration, certFile, keyFile string) *issuanceRecord {
+	record := &issuanceRecord{
+		IssuedAt:       time.Now().UTC(),
+		Profile:        profile,
+		SerialNumber:   cert.SerialNumber.Text(16),
+		Subject:        cert.Subject.String(),
+		Issuer:         cert.Issuer.String(),
+		NotBefore:      cert.NotBefore.UTC(),
+		NotAfter:       cert.NotAfter.UTC(),
+		Backdate:       backdate.String(),
+		IsCA:           cert.IsCA,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+	}
+	for _, ip := range cert.IPAddresses {
+		record.IPAddresses = append(record.IPAddresses, ip.String())
+	}
+	for _, u := range cert.URIs {
+		record.URIs = append(record.URIs, u.String())
+	}
+	return record
+}
+
+// print writes the record as indented JSON
+func (r *issuanceRecord) print(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// appendTo appends the record to a JSON lines audit log
+func (r *issuanceRecord) appendTo(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
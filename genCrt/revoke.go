@@ -0,0 +1,260 @@
+package main
+
+// Revocation is tracked in a CA index, a JSON file listing the serials a CA
+// has issued and which of them are revoked. gen and sign add the
+// certificates they issue to it with --index, revoke marks them revoked,
+// and crl and ocsp publish their status to clients:
+//
+//	genCrt -ca-cert ca.cert -ca-key ca.key -index ca.index -ocsp-url http://localhost:8889 ...
+//	genCrt revoke -index ca.index -reason keyCompromise tls.cert
+//	genCrt crl -index ca.index -ca-cert ca.cert -ca-key ca.key -out ca.crl -force
+//	genCrt ocsp -index ca.index -ca-cert ca.cert -ca-key ca.key
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// indexEntry is a certificate issued by a CA
+type indexEntry struct {
+	SerialNumber string     `json:"serial_number"`
+	Subject      string     `json:"subject"`
+	NotAfter     time.Time  `json:"not_after"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	Reason       string     `json:"reason,omitempty"`
+}
+
+// caIndex is the contents of an index file
+type caIndex struct {
+	// CRLNumber is the number of the last CRL generated from the index
+	CRLNumber    int64        `json:"crl_number"`
+	Certificates []indexEntry `json:"certificates"`
+}
+
+// revocationReasons are the CRL reason codes revoke accepts, from RFC 5280
+var revocationReasons = map[string]int{
+	"unspecified":          0,
+	"keyCompromise":        1,
+	"caCompromise":         2,
+	"affiliationChanged":   3,
+	"superseded":           4,
+	"cessationOfOperation": 5,
+	"certificateHold":      6,
+	"privilegeWithdrawn":   9,
+}
+
+// readIndex reads an index file. A missing file is an empty index.
+func readIndex(path string) (*caIndex, error) {
+	index := &caIndex{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return index, nil
+}
+
+// write replaces the index file, through a temporary file so a responder
+// reading it never sees half of it
+func (index *caIndex) write(path string) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// lookup returns the entry for a serial number, or nil
+func (index *caIndex) lookup(serial *big.Int) *indexEntry {
+	hex := serial.Text(16)
+	for i := range index.Certificates {
+		if strings.EqualFold(index.Certificates[i].SerialNumber, hex) {
+			return &index.Certificates[i]
+		}
+	}
+	return nil
+}
+
+// addToIndex records an issued certificate in the index file at path
+func addToIndex(path string, cert *x509.Certificate) error {
+	index, err := readIndex(path)
+	if err != nil {
+		return err
+	}
+	if index.lookup(cert.SerialNumber) == nil {
+		index.Certificates = append(index.Certificates, indexEntry{
+			SerialNumber: cert.SerialNumber.Text(16),
+			Subject:      cert.Subject.String(),
+			NotAfter:     cert.NotAfter.UTC(),
+		})
+	}
+	return index.write(path)
+}
+
+// parseSerial reads a certificate file or, if there is none, a hexadecimal serial number
+func parseSerial(arg string) (*big.Int, error) {
+	if _, err := os.Stat(arg); err == nil {
+		cert, err := readCertificate(arg)
+		if err != nil {
+			return nil, err
+		}
+		return cert.SerialNumber, nil
+	}
+	serial, ok := new(big.Int).SetString(strings.ReplaceAll(arg, ":", ""), 16)
+	if !ok {
+		return nil, fmt.Errorf("%q is neither a certificate file nor a hexadecimal serial number", arg)
+	}
+	return serial, nil
+}
+
+func runRevoke(args []string) int {
+	fs := flag.NewFlagSet("revoke", flag.ExitOnError)
+	indexPath := fs.String("index", "", "CA index file")
+	reason := fs.String("reason", "unspecified", "Why the certificate is revoked. Valid values are unspecified, keyCompromise, caCompromise, affiliationChanged, superseded, cessationOfOperation, certificateHold, privilegeWithdrawn")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: genCrt revoke -index <file> [-reason <reason>] <cert or serial>...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 || *indexPath == "" {
+		fs.Usage()
+		return 2
+	}
+	if _, ok := revocationReasons[*reason]; !ok {
+		fmt.Fprintf(os.Stderr, "Unrecognized reason: %q\n", *reason)
+		return 2
+	}
+
+	index, err := readIndex(*indexPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read index: %s\n", err)
+		return 1
+	}
+	now := time.Now().UTC()
+	for _, arg := range fs.Args() {
+		serial, err := parseSerial(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		entry := index.lookup(serial)
+		if entry == nil {
+			// Certificates issued without --index can still be revoked
+			index.Certificates = append(index.Certificates, indexEntry{SerialNumber: serial.Text(16)})
+			entry = &index.Certificates[len(index.Certificates)-1]
+		}
+		if entry.RevokedAt != nil {
+			fmt.Printf("%s was already revoked at %s\n", entry.SerialNumber, entry.RevokedAt.Format(time.RFC3339))
+			continue
+		}
+		entry.RevokedAt, entry.Reason = &now, *reason
+		fmt.Printf("Revoked %s (%s)\n", entry.SerialNumber, *reason)
+	}
+	if err := index.write(*indexPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write index: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func runCRL(args []string) int {
+	fs := flag.NewFlagSet("crl", flag.ExitOnError)
+	indexPath := fs.String("index", "", "CA index file")
+	caCertPath := fs.String("ca-cert", "", "CA certificate the index is for")
+	caKeyPath := fs.String("ca-key", "", "Private key of the CA, to sign the CRL with")
+	nextUpdate := fs.Duration("next-update", 7*24*time.Hour, "How long until clients should fetch a new CRL")
+	out := fs.String("out", "crl.pem", "File to write the PEM CRL to")
+	overwrite := fs.Bool("force", false, "Replace -out if it exists, as when publishing a new CRL over the last one")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: genCrt crl -index <file> -ca-cert <cert> -ca-key <key> [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 || *indexPath == "" || *caCertPath == "" || *caKeyPath == "" {
+		fs.Usage()
+		return 2
+	}
+
+	index, err := readIndex(*indexPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read index: %s\n", err)
+		return 1
+	}
+	ca, caPriv, err := loadCA(*caCertPath, *caKeyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load CA: %s\n", err)
+		return 1
+	}
+
+	now := time.Now()
+	list := &x509.RevocationList{
+		Number:     big.NewInt(index.CRLNumber + 1),
+		ThisUpdate: now,
+		NextUpdate: now.Add(*nextUpdate),
+	}
+	for _, entry := range index.Certificates {
+		if entry.RevokedAt == nil {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(entry.SerialNumber, 16)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "%s: invalid serial number %q\n", *indexPath, entry.SerialNumber)
+			return 1
+		}
+		list.RevokedCertificateEntries = append(list.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: *entry.RevokedAt,
+			ReasonCode:     revocationReasons[entry.Reason],
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, list, ca, caPriv)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create CRL: %s\n", err)
+		return 1
+	}
+	write := writeNewFile
+	if *overwrite {
+		write = os.WriteFile
+	}
+	if err := write(*out, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write %s: %s\n", *out, err)
+		return 1
+	}
+
+	index.CRLNumber++
+	if err := index.write(*indexPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write index: %s\n", err)
+		return 1
+	}
+	fmt.Printf("Wrote CRL %d with %d revoked certificates to %s, next update %s\n",
+		index.CRLNumber, len(list.RevokedCertificateEntries), *out, list.NextUpdate.UTC().Format(time.RFC3339))
+	return 0
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ticketKeySize is the size of a session ticket key: a 16 byte key name,
+// a 32 byte HMAC secret and a 32 byte AES key. The key file, one base64
+// key per line, is the format of HAProxy's tls-ticket-keys. nginx's
+// ssl_session_ticket_key takes a single raw key per file instead, so it
+// can't read it.
+const ticketKeySize = 80
+
+// readTicketKeys returns the keys in a ticket key file, newest first.
+// A missing file has no keys.
+func readTicketKeys(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys [][]byte
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(key) != ticketKeySize {
+			return nil, fmt.Errorf("%s:%d: not a base64 %d byte key", path, n, ticketKeySize)
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// rotateTicketKeys adds a new key at the top of the ticket key file at
+// path and drops the oldest ones, keeping count keys. Servers encrypt new
+// tickets with the first key and accept tickets from any of them.
+// The file is replaced atomically, so servers never read half of it.
+func rotateTicketKeys(path string, count int) error {
+	keys, err := readTicketKeys(path)
+	if err != nil {
+		return err
+	}
+
+	key := make([]byte, ticketKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	keys = append([][]byte{key}, keys...)
+	if len(keys) > count {
+		keys = keys[:count]
+	}
+
+	var b strings.Builder
+	b.WriteString("# TLS session ticket keys generated by genCrt, newest first\n")
+	for _, key := range keys {
+		b.WriteString(base64.StdEncoding.EncodeToString(key))
+		b.WriteByte('\n')
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// watchTicketKeys rotates the ticket keys at path every interval, forever
+func watchTicketKeys(path string, count int, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := rotateTicketKeys(path, count); err != nil {
+			log.Printf("Failed to rotate session ticket keys in %s: %s", path, err)
+			continue
+		}
+		log.Printf("Rotated session ticket keys in %s\n", path)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/muthubro/ready-set-go/certgen"
+)
+
+const (
+	// certRenewBefore is how long before a certificate expires it is replaced
+	certRenewBefore = 30 * 24 * time.Hour
+	// certRetryAfter is how long to wait after failing to get a certificate
+	certRetryAfter = time.Hour
+)
+
+// certManager keeps the certificate of the HTTPS listener for its hosts.
+// With an ACME client the certificate comes from the CA and is renewed
+// before it expires; until the first one is issued, and without a client,
+// a self-signed one like genCrt makes is served instead. Certificates and
+// the account key are kept in dir, so restarts don't ask the CA again.
+type certManager struct {
+	hosts []string
+	dir   string
+	acme  *acmeClient
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	// obtained is whether cert came from the CA rather than being self-signed
+	obtained bool
+}
+
+// newCertManager loads the certificate for hosts from dir, or makes a
+// self-signed one. If acmeDirectory isn't empty, certificates are ordered
+// from that CA for an account with the contact email.
+func newCertManager(hosts []string, dir, acmeDirectory, email string) (*certManager, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	m := &certManager{hosts: hosts, dir: dir}
+
+	if acmeDirectory != "" {
+		key, err := m.accountKey()
+		if err != nil {
+			return nil, fmt.Errorf("ACME account key: %s", err)
+		}
+		m.acme = newACMEClient(acmeDirectory, email, key)
+		if cert, err := m.load("acme"); err == nil && cert != nil {
+			m.cert, m.obtained = cert, true
+			return m, nil
+		} else if err != nil {
+			log.Printf("ACME: ignoring the stored certificate: %s", err)
+		}
+	}
+
+	cert, err := m.load("self-signed")
+	if err != nil {
+		log.Printf("HTTPS: ignoring the stored self-signed certificate: %s", err)
+	}
+	if cert == nil {
+		if cert, err = m.selfSign(); err != nil {
+			return nil, err
+		}
+	}
+	m.cert = cert
+	return m, nil
+}
+
+// GetCertificate is the tls.Config callback returning the current certificate
+func (m *certManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.cert, nil
+}
+
+// run replaces the certificate whenever it is due for renewal, forever.
+// A self-signed certificate is replaced straight away when there is an
+// ACME client. The current certificate is kept if getting a new one fails.
+func (m *certManager) run() {
+	for {
+		m.mu.RLock()
+		due := m.cert.Leaf.NotAfter.Add(-certRenewBefore)
+		if m.acme != nil && !m.obtained {
+			due = time.Now()
+		}
+		m.mu.RUnlock()
+		time.Sleep(time.Until(due))
+
+		var cert *tls.Certificate
+		var err error
+		if m.acme != nil {
+			cert, err = m.order()
+		} else {
+			cert, err = m.selfSign()
+		}
+		if err != nil {
+			log.Printf("HTTPS: failed to renew the certificate for %v, retrying in %s: %s", m.hosts, certRetryAfter, err)
+			time.Sleep(certRetryAfter)
+			continue
+		}
+		m.mu.Lock()
+		m.cert, m.obtained = cert, m.acme != nil
+		m.mu.Unlock()
+	}
+}
+
+// order gets a certificate with a new key from the ACME CA and stores it
+func (m *certManager) order() (*tls.Certificate, error) {
+	key, err := certgen.GenerateKey(serverKeyCurve, 0)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("ACME: ordering a certificate for %v", m.hosts)
+	chain, err := m.acme.obtain(m.hosts, key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, err
+	}
+	var certPEM []byte
+	for _, der := range chain {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		certPEM = append(certPEM, certgen.CertificatePEM(c)...)
+	}
+	keyPEM, err := certgen.EncodeKeyPEM(key, certgen.KeyFormatPKCS1, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.store("acme", certPEM, keyPEM); err != nil {
+		return nil, err
+	}
+	log.Printf("ACME: got a certificate for %v from %s, valid until %s", m.hosts, leaf.Issuer, leaf.NotAfter.UTC().Format(time.RFC3339))
+	return &tls.Certificate{Certificate: chain, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// selfSign makes a self-signed certificate for the hosts and stores it
+func (m *certManager) selfSign() (*tls.Certificate, error) {
+	bundle, err := certgen.Generate(certgen.Options{
+		Hosts: m.hosts,
+		// Self-signed, the subject is the issuer too and clients want it named
+		Subject:    pkix.Name{CommonName: m.hosts[0]},
+		ECDSACurve: serverKeyCurve,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := m.store("self-signed", bundle.CertPEM, bundle.KeyPEM); err != nil {
+		return nil, err
+	}
+	log.Printf("HTTPS: generated a self-signed certificate for %v, valid until %s", m.hosts, bundle.Certificate.NotAfter.UTC().Format(time.RFC3339))
+	return &tls.Certificate{
+		Certificate: [][]byte{bundle.Certificate.Raw},
+		PrivateKey:  bundle.Key,
+		Leaf:        bundle.Certificate,
+	}, nil
+}
+
+// load reads the certificate name from dir. It returns nil if there is
+// none, or if it isn't for every host or has expired.
+func (m *certManager) load(name string) (*tls.Certificate, error) {
+	certPath, keyPath := m.paths(name)
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Leaf is only filled in by tls.LoadX509KeyPair since Go 1.23, and not
+	// with GODEBUG=x509keypairleaf=0
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	for _, h := range m.hosts {
+		if cert.Leaf.VerifyHostname(h) != nil {
+			return nil, nil
+		}
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return nil, nil
+	}
+	return &cert, nil
+}
+
+// store writes a certificate chain and its key as name.pem and name-key.pem in dir
+func (m *certManager) store(name string, certPEM, keyPEM []byte) error {
+	certPath, keyPath := m.paths(name)
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, certPEM, 0644)
+}
+
+func (m *certManager) paths(name string) (certPath, keyPath string) {
+	return filepath.Join(m.dir, name+".pem"), filepath.Join(m.dir, name+"-key.pem")
+}
+
+// accountKey reads the ACME account key from dir, or generates and stores one
+func (m *certManager) accountKey() (*ecdsa.PrivateKey, error) {
+	path := filepath.Join(m.dir, "acme-account-key.pem")
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		key, err := certgen.GenerateKey(serverKeyCurve, 0)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM, err := certgen.EncodeKeyPEM(key, certgen.KeyFormatPKCS1, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, keyPEM, 0600); err != nil {
+			return nil, err
+		}
+		return key.(*ecdsa.PrivateKey), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := certgen.ParsePrivateKeyPEM(data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok || ecKey.Curve.Params().Name != "P-256" {
+		return nil, fmt.Errorf("%s: account keys must be ECDSA P-256 keys", path)
+	}
+	return ecKey, nil
+}
@@ -3,114 +3,586 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	_ "expvar"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
+
+	"github.com/muthubro/ready-set-go/cache"
+	"github.com/muthubro/ready-set-go/config"
+)
+
+// envPrefix starts the names of the environment variables setting flags
+const envPrefix = "WEATHER"
+
+var (
+	configFile       = flag.String(config.FileFlag, "", "JSON config file of settings by flag name; see package config. Settings can also be given in the environment, as "+envPrefix+"_CACHE_CAPACITY for --cache-capacity")
+	listenAddr       = flag.String("addr", ":8080", "Address to serve HTTP on")
+	owmAPIKey        = flag.String("openweathermap-api-key", "ea199eb3a8d6d30f838275b1c7b58042", "API key of OpenWeatherMap")
+	wuAPIKey         = flag.String("weatherunderground-api-key", "991e0d84bd9e404a9e0d84bd9ef04a0d", "API key of Weather Underground")
+	cacheCapacity    = flag.Uint64("cache-capacity", 1000, "How many entries the cache holds")
+	cacheSnapshot    = flag.String("cache-snapshot", "weather.cache", "File the cache is saved to and restored from")
+	cacheFreshFor    = flag.Duration("cache-fresh-for", 10*time.Minute, "How long a cached temperature is served before it is fetched again")
+	cacheSnapEvery   = flag.Duration("cache-snapshot-every", 5*time.Minute, "How often to save the cache, or 0 to only save it after --cache-snapshot-after changes")
+	cacheSnapAfter   = flag.Uint64("cache-snapshot-after", 100, "Save the cache after this many changes, even if it isn't time yet")
+	cacheNegTTL      = flag.Duration("cache-negative-ttl", time.Minute, "How long a failed lookup is remembered, so the providers aren't asked again")
+	cacheStaleFor    = flag.Duration("cache-stale-for", time.Hour, "How long past --cache-fresh-for a temperature may still be served to /v2 clients, flagged stale, while the providers fail. 0 to never")
+	cacheURL         = flag.String("cache-url", "", "redis://[[user]:password@]host[:port][/db] of a Redis server to keep temperatures in instead of in process, shared by every instance. rediss:// connects over TLS")
+	oidcIssuer       = flag.String("oidc-issuer", "", "OpenID Connect issuer URL. Enables sign in for the admin UI")
+	oidcClientID     = flag.String("oidc-client-id", "", "OpenID Connect client ID")
+	oidcClientSecret = flag.String("oidc-client-secret", "", "OpenID Connect client secret. Best given in the environment, as "+envPrefix+"_OIDC_CLIENT_SECRET or $OIDC_CLIENT_SECRET")
+	oidcRedirectURL  = flag.String("oidc-redirect-url", "http://localhost:8080/auth/callback", "URL of /auth/callback registered with the provider")
+	oidcGroupsClaim  = flag.String("oidc-groups-claim", "groups", "ID token claim listing the user's groups")
+	oidcAdminGroups  = flag.String("oidc-admin-groups", "", "Comma-separated groups whose members are admins")
+	oidcOperGroups   = flag.String("oidc-operator-groups", "", "Comma-separated groups whose members are operators. Other users are viewers")
+	rbacPolicyFile   = flag.String("rbac-policy", "", "JSON file mapping API keys and client certificates to admin roles")
+	adminLoopback    = flag.Bool("admin-allow-loopback", false, "Let requests from loopback addresses use the admin endpoints while no API keys, client certificates or OpenID Connect are configured. Behind a reverse proxy on the same host, that is every request")
+	routingFile      = flag.String("routing-rules", "", "JSON file choosing providers by the country of the city. Without it all providers are asked")
+	probeCity        = flag.String("probe-city", "", "City to request through the server itself to check it works. Disabled if empty")
+	probeInterval    = flag.Duration("probe-interval", time.Minute, "How often to probe")
+	probeMaxLatency  = flag.Duration("probe-max-latency", 5*time.Second, "Probes slower than this count as failures")
+	warmCities       = flag.String("warm-cities", "", "Comma-separated cities to fetch into the cache at startup, most popular first")
+	sandboxMode      = flag.Bool("sandbox", false, "Answer /weather requests with API keys starting with "+sandboxKeyPrefix+" from canned data, see sandbox.go")
+	adminTLSDir      = flag.String("admin-mtls", "", "Directory of a CA and certificates, generated on first start, to serve /admin/ with mutual TLS on --admin-addr instead of on --addr")
+	adminAddr        = flag.String("admin-addr", ":8443", "Address of the mutual TLS admin listener")
+	adminHosts       = flag.String("admin-hosts", "localhost,127.0.0.1,::1", "Comma-separated hostnames and IPs of the admin listener's certificate")
+	tlsHosts         = flag.String("tls-hosts", "", "Comma-separated hostnames to also serve HTTPS for on --tls-addr, with certificates from --acme-directory or, without it, self-signed ones")
+	tlsAddr          = flag.String("tls-addr", ":443", "Address of the HTTPS listener")
+	tlsDir           = flag.String("tls-dir", "tls", "Directory keeping the HTTPS certificates and ACME account key across restarts")
+	acmeDirectory    = flag.String("acme-directory", "", "ACME directory URL to get publicly trusted certificates from, such as "+letsEncryptDirectory)
+	acmeEmail        = flag.String("acme-email", "", "Contact email of the ACME account, for expiry notices")
+	acmeHTTPAddr     = flag.String("acme-http-addr", ":80", "Address answering the CA's http-01 challenges, which must be port 80 of the hostnames, and redirecting other requests to HTTPS")
+	providerQuotas   = flag.String("provider-quotas", "", "Comma-separated provider=calls daily limits, such as openweathermap=1000 for its free tier. Providers without one are unlimited")
+	cityQuota        = flag.Uint64("city-quota", 0, "Daily limit of calls to each provider for any one city, or 0 for none. Cities beyond the first 10000 of the day only count against --provider-quotas")
+	quotaFile        = flag.String("quota-file", "quota.json", "File today's calls to each provider are saved to and restored from, or empty to start counting afresh on every restart")
+	checkAndExit     = flag.Bool("check", false, "Check the configuration, that every provider answers and that the TLS certificates load and haven't expired, without serving, and exit non-zero if anything is wrong")
+	checkProvidersIn = flag.String("check-providers", "", "Run the provider conformance checks with the fixtures in this directory, such as testdata/providers, and exit")
 )
 
-var weatherUndergroundAPIKey = "991e0d84bd9e404a9e0d84bd9ef04a0d"
+const (
+	cacheWarmTimeout  = time.Minute
+	cacheWarmParallel = 4
+)
+
+// cachedTemperature is the cache value for a city's temperature.
+// Each entry counts as 1 towards the cache capacity.
+type cachedTemperature struct {
+	Kelvin  float64
+	Fetched time.Time
+	// Providers were asked for the temperature
+	Providers []string
+	// Readings are what each provider answered
+	Readings []providerReading
+	// Failed is when fetching a newer temperature last failed, and Reason
+	// why, while this one is kept to be served stale
+	Failed time.Time
+	Reason string
+}
 
+// providerReading is the temperature one provider returned, in kelvin
+type providerReading struct {
+	Provider string
+	Kelvin   float64
+}
+
+func (t cachedTemperature) Size() int {
+	return 1
+}
+
+// weatherProvider returns the temperature in a city, in kelvin.
+// It gives up when ctx is done, returning an error wrapping ctx.Err().
+// New providers should pass the checks in package providertest.
 type weatherProvider interface {
-	temperature(city string) (float64, error)
+	temperature(ctx context.Context, city string) (float64, error)
 }
 type multiWeatherProvider []weatherProvider
 
-type openWeatherMap struct{}
+// openWeatherMap and weatherUnderground use the public API at baseURL,
+// or their usual endpoint if it is empty
+type openWeatherMap struct {
+	baseURL string
+}
 type weatherUnderground struct {
-	apiKey string
+	apiKey  string
+	baseURL string
 }
 
-func (w openWeatherMap) temperature(city string) (float64, error) {
-	resp, err := http.Get("http://api.openweathermap.org/data/2.5/weather?APPID=ea199eb3a8d6d30f838275b1c7b58042&q=" + city)
-	if err != nil {
-		return 0, err
+func (w openWeatherMap) temperature(ctx context.Context, city string) (float64, error) {
+	base := w.baseURL
+	if base == "" {
+		base = "http://api.openweathermap.org"
 	}
 
-	defer resp.Body.Close()
-
 	var data struct {
-		Main struct {
-			Kelvin float64 `json:"temp"`
+		Main *struct {
+			Kelvin *float64 `json:"temp"`
 		} `json:"main"`
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-		return 0, err
+	if err := getJSON(ctx, base+"/data/2.5/weather?APPID="+*owmAPIKey+"&q="+url.QueryEscape(city), &data); err != nil {
+		return 0, fmt.Errorf("openWeatherMap: %s: %w", city, err)
+	}
+	if data.Main == nil || data.Main.Kelvin == nil {
+		return 0, fmt.Errorf("openWeatherMap: %s: %w: main.temp", city, errMissingField)
+	}
+	kelvin := *data.Main.Kelvin
+	if err := checkKelvin(kelvin); err != nil {
+		return 0, fmt.Errorf("openWeatherMap: %s: %w", city, err)
 	}
 
-	log.Printf("openWeatherMap: %s: %.2f", city, data.Main.Kelvin)
-	return data.Main.Kelvin, nil
+	log.Printf("openWeatherMap: %s: %.2f", city, kelvin)
+	return kelvin, nil
 }
 
-func (w weatherUnderground) temperature(city string) (float64, error) {
-	resp, err := http.Get("http://api.wunderground.com/api/" + w.apiKey + "/conditions/q/" + city + ".json")
-	if err != nil {
-		return 0, err
+func (w weatherUnderground) temperature(ctx context.Context, city string) (float64, error) {
+	base := w.baseURL
+	if base == "" {
+		base = "http://api.wunderground.com"
 	}
 
-	defer resp.Body.Close()
-
 	var data struct {
-		Observation struct {
-			Celsius float64 `json:"temp_c"`
+		Observation *struct {
+			Celsius *float64 `json:"temp_c"`
 		} `json:"current_observation"`
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-		return 0, err
+	if err := getJSON(ctx, base+"/api/"+w.apiKey+"/conditions/q/"+url.PathEscape(city)+".json", &data); err != nil {
+		return 0, fmt.Errorf("weatherUnderground: %s: %w", city, err)
+	}
+	if data.Observation == nil || data.Observation.Celsius == nil {
+		return 0, fmt.Errorf("weatherUnderground: %s: %w: current_observation.temp_c", city, errMissingField)
+	}
+	kelvin := *data.Observation.Celsius + 273.15
+	if err := checkKelvin(kelvin); err != nil {
+		return 0, fmt.Errorf("weatherUnderground: %s: %w", city, err)
 	}
 
-	kelvin := data.Observation.Celsius + 273.15
 	log.Printf("weatherUnderground: %s: %.2f", city, kelvin)
 	return kelvin, nil
 }
 
-func (w multiWeatherProvider) temperature(city string) (float64, error) {
+// The temperatures providers may return, in kelvin. Anything outside is a
+// broken response, such as one in the wrong unit, and is rejected rather
+// than skewing the average: the coldest and hottest ever measured on Earth
+// are 184K and 330K.
+const (
+	minKelvin = 150
+	maxKelvin = 400
+)
+
+var (
+	// errMissingField means a provider's response lacks the temperature
+	errMissingField = errors.New("response has no field")
+	// errImplausible means a provider returned a temperature that can't be right
+	errImplausible = errors.New("implausible temperature")
+)
+
+// checkKelvin returns an error wrapping errImplausible unless kelvin is
+// between minKelvin and maxKelvin
+func checkKelvin(kelvin float64) error {
+	if kelvin < minKelvin || kelvin > maxKelvin {
+		return fmt.Errorf("%w %.2fK, want %dK to %dK", errImplausible, kelvin, minKelvin, maxKelvin)
+	}
+	return nil
+}
+
+// getJSON decodes the JSON response to a GET of url into v.
+// Any status but 200 OK is an error.
+func getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// temperature averages the providers, leaving out those without quota
+// left today. It fails if any other provider fails, or if none has quota.
+func (w multiWeatherProvider) temperature(ctx context.Context, city string) (float64, error) {
 	sum := 0.0
+	n := 0
+	var exhausted error
 
 	for _, provider := range w {
-		k, err := provider.temperature(city)
+		k, err := provider.temperature(ctx, city)
+		if errors.Is(err, errQuotaExhausted) {
+			exhausted = err
+			continue
+		}
 		if err != nil {
 			return 0, err
 		}
 
 		sum += k
+		n++
 	}
 
-	return sum / float64(len(w)), nil
+	if n == 0 && exhausted != nil {
+		return 0, exhausted
+	}
+	return sum / float64(n), nil
+}
+
+// metricsExporters are called with the cache to publish its metrics
+// beyond expvar, such as for Prometheus when built with that tag
+var metricsExporters []func(c *cache.LRUCache)
+
+// warmCache fetches the temperature in cities into the cache
+func warmCache(temps weatherCache, provider weatherProvider, cities []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), cacheWarmTimeout)
+	defer cancel()
+
+	begin := time.Now()
+	n, err := warm(ctx, temps, cities, func(city string) (cache.Value, error) {
+		ctx, calls := withProviderCalls(ctx)
+		kelvin, err := provider.temperature(ctx, city)
+		if err != nil {
+			return nil, err
+		}
+		return cachedTemperature{Kelvin: kelvin, Fetched: time.Now(), Providers: calls.list(), Readings: calls.answers()}, nil
+	}, cacheWarmParallel)
+	if err != nil {
+		log.Printf("Cache warming: %s", err)
+	}
+	log.Printf("Cache warming: fetched %d of %d cities in %s", n, len(cities), time.Since(begin))
 }
 
 func hello(w http.ResponseWriter, r *http.Request) {
+	// Versioned paths only exist where registered, so /v3/weather/London
+	// and /v1/nothing don't get the greeting
+	_, prefix, err := pathAPIVersion(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if prefix != "" {
+		http.NotFound(w, r)
+		return
+	}
 	w.Write([]byte("hello!"))
 }
 
 func main() {
+	flag.Parse()
+	// $OIDC_CLIENT_SECRET was read before the secret had a flag
+	loadErr := config.Load(flag.CommandLine, envPrefix, config.Alias{Flag: "oidc-client-secret", Env: "OIDC_CLIENT_SECRET"})
+	if *checkAndExit {
+		os.Exit(selfCheck(loadErr))
+	}
+	if loadErr != nil {
+		log.Fatalf("Failed to load config:\n%s", loadErr)
+	}
+	if err := checkConfig(); err != nil {
+		log.Fatalf("Invalid config:\n%s", err)
+	}
+	settings := serverConfig()
+
+	if *checkProvidersIn != "" {
+		os.Exit(checkProviders(*checkProvidersIn))
+	}
+	sockets, err := newListeners()
+	if err != nil {
+		log.Fatalf("Failed to take over from the previous process: %s", err)
+	}
+
+	cache.RegisterValue(cachedTemperature{})
+	cache.RegisterValue(cachedCountry{})
+	shared := cache.NewLRUCache(settings.Cache.Capacity, cache.WithNegativeTTL(settings.Cache.NegativeTTL))
+	temperatures, err := shared.Namespace("weather")
+	if err != nil {
+		log.Fatalf("Failed to set up the cache: %s", err)
+	}
+	var temps weatherCache = temperatures
+	if settings.Cache.URL != "" {
+		// checkConfig has parsed the URL already
+		redis, _ := newRedisCache(settings.Cache.URL, "weather:", settings.Cache.NegativeTTL)
+		log.Printf("Keeping temperatures in Redis at %s", redis.addr)
+		temps = redis
+	}
+	shared.PublishExpvar("cache")
+	for _, register := range metricsExporters {
+		register(shared)
+	}
+
+	// checkConfig has parsed the quotas already
+	limits, _ := parseQuotas(*providerQuotas)
+	names := make([]string, 0, len(providerFactories))
+	for name := range providerFactories {
+		names = append(names, name)
+	}
+	quotas, err := newUpstreamQuotas(*quotaFile, names, limits, *cityQuota)
+	if err != nil {
+		log.Fatalf("Failed to restore quota counts: %s", err)
+	}
+	quotas.start(quotaSaveInterval)
+
+	upstream := newUpstreamSavings()
+	providers := make(map[string]weatherProvider)
+	for name, newProvider := range providerFactories {
+		counted := countedProvider{name: name, provider: newProvider(""), savings: upstream}
+		providers[name] = quotaProvider{name: name, provider: counted, quotas: quotas}
+	}
 	mw := multiWeatherProvider{
-		openWeatherMap{},
-		weatherUnderground{apiKey: weatherUndergroundAPIKey},
+		providers["openweathermap"],
+		providers["weatherunderground"],
+	}
+
+	var provider weatherProvider = mw
+	if *routingFile != "" {
+		rules, routes, err := loadRoutingRules(*routingFile, providers)
+		if err != nil {
+			log.Fatalf("Failed to load routing rules: %s", err)
+		}
+		geocodes, err := shared.Namespace("geocode")
+		if err != nil {
+			log.Fatalf("Failed to set up the cache: %s", err)
+		}
+		provider = routedWeatherProvider{
+			geocoder: cachingGeocoder{
+				geocoder: openWeatherMapGeocoder{apiKey: *owmAPIKey},
+				cache:    geocodes,
+			},
+			rules:    rules,
+			routes:   routes,
+			fallback: mw,
+		}
+	}
+	persistOpts := cache.PersistOptions{
+		Interval:  settings.Cache.SnapshotEvery,
+		Mutations: settings.Cache.SnapshotAfter,
+	}
+	persister, err := cache.NewPersister(shared, settings.Cache.Snapshot, persistOpts)
+	if errors.Is(err, cache.ErrSnapshotCorrupt) {
+		// Keep the bad snapshot for inspection and start with an empty cache
+		log.Printf("Ignoring cache snapshot: %s", err)
+		if err = os.Rename(settings.Cache.Snapshot, settings.Cache.Snapshot+".corrupt"); err == nil {
+			persister, err = cache.NewPersister(shared, settings.Cache.Snapshot, persistOpts)
+		}
+	}
+	if err != nil {
+		log.Fatalf("Failed to restore cache: %s", err)
 	}
 
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+		for s := range sig {
+			if s == syscall.SIGHUP {
+				// Hand over to a new process, see restart.go. From here on
+				// the cache snapshot and the quota counts are the new
+				// process's to save, unless it fails to start.
+				if err := persister.Suspend(); err != nil {
+					log.Printf("Not restarting, failed to save cache: %s", err)
+					continue
+				}
+				if err := quotas.suspend(); err != nil {
+					persister.Resume()
+					log.Printf("Not restarting, failed to save quota counts: %s", err)
+					continue
+				}
+				if err := sockets.restart(); err != nil {
+					persister.Resume()
+					quotas.resume()
+					log.Printf("Failed to restart, carrying on: %s", err)
+					continue
+				}
+				log.Print("Handed over to the new process, finishing requests in flight")
+				sockets.shutdown()
+				os.Exit(0)
+			}
+			if err := shared.Close(); err != nil {
+				log.Printf("Failed to save cache: %s", err)
+			}
+			if err := quotas.close(); err != nil {
+				log.Printf("Failed to save quota counts: %s", err)
+			}
+			os.Exit(0)
+		}
+	}()
+
 	http.HandleFunc("/", hello)
 
-	http.HandleFunc("/weather/", func(w http.ResponseWriter, r *http.Request) {
+	var auth *oidcAuth
+	if oidc := settings.OIDC; oidc.Issuer != "" {
+		auth, err = newOIDCAuth(oidcConfig{
+			Issuer:         oidc.Issuer,
+			ClientID:       oidc.ClientID,
+			ClientSecret:   oidc.ClientSecret,
+			RedirectURL:    oidc.RedirectURL,
+			GroupsClaim:    oidc.GroupsClaim,
+			AdminGroups:    oidc.AdminGroups,
+			OperatorGroups: oidc.OperatorGroups,
+		})
+		if err != nil {
+			log.Fatalf("Failed to set up OpenID Connect: %s", err)
+		}
+		auth.register(http.DefaultServeMux)
+	}
+
+	authz := newAuthorizer(auth)
+	authz.allowLoopback = *adminLoopback
+	if *rbacPolicyFile != "" {
+		if err := authz.loadPolicy(*rbacPolicyFile); err != nil {
+			log.Fatalf("Failed to load RBAC policy: %s", err)
+		}
+	}
+
+	// With mutual TLS the admin endpoints are only served on its listener
+	adminMux := http.DefaultServeMux
+	var adminTLS *tls.Config
+	if *adminTLSDir != "" {
+		adminTLS, err = provisionAdminTLS(*adminTLSDir, config.SplitList(*adminHosts))
+		if err != nil {
+			log.Fatalf("Failed to provision admin TLS: %s", err)
+		}
+		authz.trustClientCert(adminClientName, roleAdmin)
+		adminMux = http.NewServeMux()
+	}
+
+	admin := http.StripPrefix("/admin/cache", cache.NewAdminHandler(shared))
+	adminMux.Handle("/admin/cache/", authz.protect(admin, cacheAdminRole))
+	state := &stateHandler{cache: shared, authz: authz, quotas: quotas, policyFile: *rbacPolicyFile}
+	adminMux.Handle("/admin/state/", authz.protect(http.StripPrefix("/admin/state", state), stateAdminRole))
+	adminMux.Handle("/admin/quota/", authz.protect(http.StripPrefix("/admin/quota", quotas), quotaAdminRole))
+
+	var fetches fetchGroup
+	var weather http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		begin := time.Now()
 		city := strings.SplitN(r.URL.Path, "/", 3)[2]
 
-		temp, err := mw.temperature(city)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		report := weatherReport{City: city}
+		v, result := temps.Lookup(city)
+		last, hit := v.(cachedTemperature)
+		// The last temperature may be kept, and served to clients of
+		// versions that flag it as stale, while no newer one can be fetched
+		keep := hit && time.Since(last.Fetched) < settings.Cache.FreshFor+settings.Cache.StaleFor
+		serveStale := keep && apiVersion(r) >= apiV2
+		switch {
+		case result == cache.NegativeHit:
+			// The lookup failed recently; don't ask the providers again yet
+			upstream.avoided(nil, savedByNegativeCache)
+			http.Error(w, v.(cache.Negative).Reason, http.StatusInternalServerError)
 			return
+
+		case hit && time.Since(last.Fetched) < settings.Cache.FreshFor:
+			report.cachedTemperature, report.Cached = last, true
+			upstream.avoided(last.Providers, savedByCache)
+
+		case hit && time.Since(last.Failed) < settings.Cache.NegativeTTL:
+			// Likewise, while the last temperature is kept
+			upstream.avoided(nil, savedByNegativeCache)
+			if !serveStale {
+				http.Error(w, last.Reason, http.StatusInternalServerError)
+				return
+			}
+			report.cachedTemperature, report.Cached, report.Stale = last, true, true
+
+		default:
+			value, shared, err := fetches.do(r.Context(), city, func(ctx context.Context) (cachedTemperature, error) {
+				ctx, calls := withProviderCalls(ctx)
+				temp, err := provider.temperature(ctx, city)
+				if err != nil {
+					// Don't remember failures caused by the client going away
+					if ctx.Err() == nil && keep {
+						failed := last
+						failed.Failed, failed.Reason = time.Now(), err.Error()
+						temps.SetWithTTL(city, failed, 0)
+					} else if ctx.Err() == nil {
+						temps.SetNegative(city, err)
+					}
+					return cachedTemperature{Providers: calls.list()}, err
+				}
+				value := cachedTemperature{Kelvin: temp, Fetched: time.Now(), Providers: calls.list(), Readings: calls.answers()}
+				temps.SetWithTTL(city, value, 0)
+				return value, nil
+			})
+			if shared {
+				upstream.avoided(value.Providers, savedByCoalescing)
+			}
+			switch {
+			case err == nil:
+				report.cachedTemperature = value
+			case serveStale:
+				report.cachedTemperature, report.Cached, report.Stale = last, true, true
+				report.Reason = err.Error()
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 		}
 
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"city": city,
-			"temp": temp,
-			"took": time.Since(begin).String(),
-		})
+		report.Took = time.Since(begin)
+		writeWeather(w, r, report)
 	})
+	if *sandboxMode {
+		weather = newSandbox().wrap(weather)
+	}
+	weather = withAPIVersion(checkWeatherRequest(weather))
+	http.Handle("/weather/", weather)
+	http.Handle("/v1/weather/", weather)
+	http.Handle("/v2/weather/", weather)
+	http.HandleFunc(weatherSchemaPath, serveWeatherSchema)
 
-	http.ListenAndServe(":8080", nil)
+	if cities := config.SplitList(*warmCities); len(cities) > 0 {
+		go warmCache(temps, provider, cities)
+	}
+
+	if *probeCity != "" {
+		go newProber(loopbackURL(settings.Addr), *probeCity, *probeInterval, *probeMaxLatency).run()
+	}
+
+	if hosts := config.SplitList(*tlsHosts); len(hosts) > 0 {
+		certs, err := newCertManager(hosts, *tlsDir, *acmeDirectory, *acmeEmail)
+		if err != nil {
+			log.Fatalf("Failed to set up HTTPS: %s", err)
+		}
+		if certs.acme != nil {
+			// Challenges must be answered before the first certificate is ordered
+			if err := sockets.serve("acme", settings.ACMEHTTPAddr, &http.Server{Addr: settings.ACMEHTTPAddr, Handler: certs.acme}); err != nil {
+				log.Fatalf("Failed to listen for ACME challenges: %s", err)
+			}
+		}
+		go certs.run()
+
+		server := &http.Server{Addr: settings.TLSAddr, TLSConfig: &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}}
+		if err := sockets.serve("https", settings.TLSAddr, server); err != nil {
+			log.Fatalf("Failed to listen for HTTPS: %s", err)
+		}
+		log.Printf("HTTPS listening on %s for %s", settings.TLSAddr, strings.Join(hosts, ", "))
+	}
+
+	if adminTLS != nil {
+		server := &http.Server{Addr: settings.AdminAddr, Handler: adminMux, TLSConfig: adminTLS}
+		if err := sockets.serve("admin", settings.AdminAddr, server); err != nil {
+			log.Fatalf("Failed to listen for admin requests: %s", err)
+		}
+		log.Printf("Admin endpoints listening on %s with mutual TLS", settings.AdminAddr)
+	}
+
+	if err := sockets.serve("http", settings.Addr, &http.Server{Addr: settings.Addr}); err != nil {
+		log.Fatalf("Failed to listen for HTTP: %s", err)
+	}
+	sockets.serving()
+	select {}
 }
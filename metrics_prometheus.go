@@ -0,0 +1,18 @@
+//go:build prometheus
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/muthubro/ready-set-go/cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func init() {
+	metricsExporters = append(metricsExporters, func(c *cache.LRUCache) {
+		prometheus.MustRegister(cache.NewCollector(c, "weather", nil))
+		http.Handle("/metrics", promhttp.Handler())
+	})
+}
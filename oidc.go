@@ -0,0 +1,548 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookie   = "session"
+	sessionLifetime = 8 * time.Hour
+	loginLifetime   = 10 * time.Minute
+	// maxPendingLogins bounds the sign in attempts kept at once, since
+	// anyone can start one
+	maxPendingLogins = 10000
+)
+
+// oidcConfig configures OpenID Connect sign in
+type oidcConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+
+	// GroupsClaim names the ID token claim listing the user's groups
+	GroupsClaim string
+	// AdminGroups and OperatorGroups are the groups whose members get the
+	// admin and operator roles. Everyone else who signs in is a viewer.
+	AdminGroups    []string
+	OperatorGroups []string
+}
+
+// session is a signed in user, stored under its cookie value
+type session struct {
+	Subject string
+	Email   string
+	Role    role
+}
+
+// pendingLogin is the state kept between redirecting to the provider
+// and handling its callback
+type pendingLogin struct {
+	Nonce    string
+	Verifier string
+	Next     string
+}
+
+// tokenStore keeps values under unguessable tokens, such as sessions under
+// their cookie values, in memory until they expire. It is not the shared
+// cache on purpose: that can be listed through /admin/cache/, is saved to
+// snapshots and state exports, and evicts. Tokens are kept hashed, so even
+// a dump of the process memory doesn't hold a usable cookie.
+type tokenStore struct {
+	// limit is how many entries may be kept at once, or 0 for no limit
+	limit int
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]tokenEntry
+	swept   time.Time
+}
+
+type tokenEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+func newTokenStore(limit int) *tokenStore {
+	return &tokenStore{limit: limit, entries: make(map[[sha256.Size]byte]tokenEntry)}
+}
+
+// set keeps value under token for ttl. It returns false, keeping nothing,
+// if the store is full of entries that haven't expired.
+func (s *tokenStore) set(token string, value interface{}, ttl time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	full := s.limit > 0 && len(s.entries) >= s.limit
+	if full || now.Sub(s.swept) > time.Minute {
+		s.sweep(now)
+	}
+	if s.limit > 0 && len(s.entries) >= s.limit {
+		return false
+	}
+	s.entries[sha256.Sum256([]byte(token))] = tokenEntry{value: value, expires: now.Add(ttl)}
+	return true
+}
+
+// get returns the value kept under token, if it hasn't expired
+func (s *tokenStore) get(token string) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[sha256.Sum256([]byte(token))]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e.value, true
+}
+
+// take is like get, and also forgets the token, so it can only be used once
+func (s *tokenStore) take(token string) (interface{}, bool) {
+	v, ok := s.get(token)
+	s.delete(token)
+	return v, ok
+}
+
+func (s *tokenStore) delete(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, sha256.Sum256([]byte(token)))
+}
+
+// sweep forgets the expired entries. s.mu must be held.
+func (s *tokenStore) sweep(now time.Time) {
+	for h, e := range s.entries {
+		if now.After(e.expires) {
+			delete(s.entries, h)
+		}
+	}
+	s.swept = now
+}
+
+// oidcAuth signs users in with an OpenID Connect provider using the
+// authorization code flow with PKCE. Sessions are only kept in memory, so
+// users sign in again after a restart.
+type oidcAuth struct {
+	config oidcConfig
+
+	authEndpoint  string
+	tokenEndpoint string
+	jwksURI       string
+
+	sessions *tokenStore
+	logins   *tokenStore
+
+	mu   sync.Mutex
+	keys map[string]crypto.PublicKey
+}
+
+// newOIDCAuth discovers the provider configuration of the issuer
+func newOIDCAuth(config oidcConfig) (*oidcAuth, error) {
+	resp, err := http.Get(strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc: discovery returned %s", resp.Status)
+	}
+
+	var discovery struct {
+		Issuer        string `json:"issuer"`
+		AuthEndpoint  string `json:"authorization_endpoint"`
+		TokenEndpoint string `json:"token_endpoint"`
+		JWKSURI       string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != config.Issuer {
+		return nil, fmt.Errorf("oidc: issuer mismatch: configured %q, provider reports %q", config.Issuer, discovery.Issuer)
+	}
+
+	return &oidcAuth{
+		config:        config,
+		authEndpoint:  discovery.AuthEndpoint,
+		tokenEndpoint: discovery.TokenEndpoint,
+		jwksURI:       discovery.JWKSURI,
+		sessions:      newTokenStore(0),
+		logins:        newTokenStore(maxPendingLogins),
+		keys:          make(map[string]crypto.PublicKey),
+	}, nil
+}
+
+// register mounts the login, callback and logout handlers
+func (a *oidcAuth) register(mux *http.ServeMux) {
+	mux.HandleFunc("/auth/login", a.login)
+	mux.HandleFunc("/auth/callback", a.callback)
+	mux.HandleFunc("/auth/logout", a.logout)
+}
+
+// redirectToLogin sends the browser to sign in and come back to r
+func (a *oidcAuth) redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/auth/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+}
+
+func (a *oidcAuth) session(r *http.Request) (session, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return session{}, false
+	}
+	v, ok := a.sessions.get(cookie.Value)
+	if !ok {
+		return session{}, false
+	}
+	return v.(session), true
+}
+
+func (a *oidcAuth) login(w http.ResponseWriter, r *http.Request) {
+	state, nonce, verifier := randomToken(), randomToken(), randomToken()
+
+	next := r.URL.Query().Get("next")
+	if !isLocalPath(next) {
+		next = "/"
+	}
+	if !a.logins.set(state, pendingLogin{Nonce: nonce, Verifier: verifier, Next: next}, loginLifetime) {
+		log.Printf("oidc: %d sign in attempts pending, refusing more", maxPendingLogins)
+		http.Error(w, "too many sign in attempts, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {a.config.ClientID},
+		"redirect_uri":          {a.config.RedirectURL},
+		"scope":                 {"openid email profile"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, a.authEndpoint+"?"+query.Encode(), http.StatusFound)
+}
+
+// isLocalPath reports whether next is a path on this server, safe to
+// redirect to after signing in. Browsers read "//host" and "/\host" as
+// another host, so both are rejected.
+func isLocalPath(next string) bool {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.ContainsRune(next, '\\') {
+		return false
+	}
+	u, err := url.Parse(next)
+	return err == nil && u.Scheme == "" && u.Host == ""
+}
+
+func (a *oidcAuth) callback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		http.Error(w, "sign in failed: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	state := query.Get("state")
+	v, ok := a.logins.take(state)
+	if !ok {
+		http.Error(w, "unknown or expired sign in attempt", http.StatusBadRequest)
+		return
+	}
+	pending := v.(pendingLogin)
+
+	claims, err := a.exchange(query.Get("code"), pending)
+	if err != nil {
+		log.Printf("oidc: sign in failed: %s", err)
+		http.Error(w, "sign in failed", http.StatusUnauthorized)
+		return
+	}
+
+	s := session{Subject: claims.Subject, Email: claims.Email, Role: a.role(claims)}
+	id := randomToken()
+	a.sessions.set(id, s, sessionLifetime)
+	log.Printf("oidc: %s (%s) signed in as %s", s.Subject, s.Email, s.Role)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(sessionLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(a.config.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, pending.Next, http.StatusFound)
+}
+
+func (a *oidcAuth) logout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		a.sessions.delete(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1})
+	w.Write([]byte("signed out"))
+}
+
+// idTokenClaims are the ID token claims used for sign in
+type idTokenClaims struct {
+	Issuer   string   `json:"iss"`
+	Subject  string   `json:"sub"`
+	Audience audience `json:"aud"`
+	Expiry   int64    `json:"exp"`
+	Nonce    string   `json:"nonce"`
+	Email    string   `json:"email"`
+	raw      json.RawMessage
+}
+
+// audience accepts both a single audience and a list of them
+type audience []string
+
+func (aud *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*aud = audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(aud))
+}
+
+// role maps the user's groups to the highest role any of them grants
+func (a *oidcAuth) role(claims *idTokenClaims) role {
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(claims.raw, &all); err != nil {
+		return roleViewer
+	}
+	var groups []string
+	if err := json.Unmarshal(all[a.config.GroupsClaim], &groups); err != nil {
+		return roleViewer
+	}
+
+	granted := roleViewer
+	for _, group := range groups {
+		for _, admin := range a.config.AdminGroups {
+			if group == admin {
+				return roleAdmin
+			}
+		}
+		for _, operator := range a.config.OperatorGroups {
+			if group == operator {
+				granted = roleOperator
+			}
+		}
+	}
+	return granted
+}
+
+// exchange redeems an authorization code and verifies the returned ID token
+func (a *oidcAuth) exchange(code string, pending pendingLogin) (*idTokenClaims, error) {
+	resp, err := http.PostForm(a.tokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {a.config.RedirectURL},
+		"client_id":     {a.config.ClientID},
+		"client_secret": {a.config.ClientSecret},
+		"code_verifier": {pending.Verifier},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+	if token.IDToken == "" {
+		return nil, errors.New("no ID token in token response")
+	}
+
+	claims, err := a.verify(token.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Nonce != pending.Nonce {
+		return nil, errors.New("ID token nonce mismatch")
+	}
+	return claims, nil
+}
+
+// verify checks the signature and standard claims of an ID token
+func (a *oidcAuth) verify(idToken string) (*idTokenClaims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	key, err := a.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := verifySignature(header.Alg, key, digest[:], signature); err != nil {
+		return nil, err
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	claims := &idTokenClaims{raw: payload}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, err
+	}
+	if claims.Issuer != a.config.Issuer {
+		return nil, fmt.Errorf("ID token issued by %q", claims.Issuer)
+	}
+	validAudience := false
+	for _, aud := range claims.Audience {
+		validAudience = validAudience || aud == a.config.ClientID
+	}
+	if !validAudience {
+		return nil, errors.New("ID token not issued for this client")
+	}
+	if time.Now().Unix() >= claims.Expiry {
+		return nil, errors.New("ID token expired")
+	}
+	return claims, nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, digest, signature []byte) error {
+	switch alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("RS256 token signed with a non-RSA key")
+		}
+		return rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest, signature)
+
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return errors.New("malformed ES256 signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest, r, s) {
+			return errors.New("invalid ES256 signature")
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported ID token algorithm %q", alg)
+	}
+}
+
+// key returns the provider's signing key with the given ID, refreshing
+// the key set when the ID is unknown to pick up key rotations
+func (a *oidcAuth) key(kid string) (crypto.PublicKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	keys, err := fetchJWKS(a.jwksURI)
+	if err != nil {
+		return nil, err
+	}
+	a.keys = keys
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func fetchJWKS(uri string) (map[string]crypto.PublicKey, error) {
+	resp, err := http.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc: JWKS returned %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		switch {
+		case k.Kty == "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	return keys, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// randomToken returns an unguessable URL-safe token
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Temperatures outside this range, in kelvin, are taken to be wrong
+const (
+	probeMinKelvin = 180
+	probeMaxKelvin = 340
+)
+
+// probeFailuresToAlert is how many probes in a row must fail before the
+// service is reported degraded
+const probeFailuresToAlert = 3
+
+// prober periodically asks the service for the weather in a canary city
+// over loopback, through the same HTTP stack users hit, and raises an
+// alert when it keeps failing or is too slow. Results are published as
+// the expvar variable "probe".
+type prober struct {
+	url        string
+	city       string
+	interval   time.Duration
+	maxLatency time.Duration
+	client     *http.Client
+
+	failures int
+	degraded bool
+
+	stats       *expvar.Map
+	lastLatency expvar.Float
+	lastError   expvar.String
+	isDegraded  expvar.Int
+}
+
+func newProber(baseURL, city string, interval, maxLatency time.Duration) *prober {
+	p := &prober{
+		url:        baseURL + "/weather/" + url.PathEscape(city),
+		city:       city,
+		interval:   interval,
+		maxLatency: maxLatency,
+		client:     &http.Client{Timeout: maxLatency * 2},
+		stats:      expvar.NewMap("probe"),
+	}
+	p.stats.Set("last_latency_seconds", &p.lastLatency)
+	p.stats.Set("last_error", &p.lastError)
+	p.stats.Set("degraded", &p.isDegraded)
+	return p
+}
+
+// run probes every interval, forever
+func (p *prober) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		p.probe()
+	}
+}
+
+func (p *prober) probe() {
+	begin := time.Now()
+	err := p.check()
+	latency := time.Since(begin)
+	if err == nil && latency > p.maxLatency {
+		err = fmt.Errorf("took %s, more than %s", latency, p.maxLatency)
+	}
+
+	p.stats.Add("runs", 1)
+	p.lastLatency.Set(latency.Seconds())
+	if err != nil {
+		p.stats.Add("failures", 1)
+		p.lastError.Set(err.Error())
+		p.failures++
+		log.Printf("probe: %s: %s", p.city, err)
+	} else {
+		p.lastError.Set("")
+		p.failures = 0
+	}
+
+	switch {
+	case !p.degraded && p.failures >= probeFailuresToAlert:
+		p.degraded = true
+		p.isDegraded.Set(1)
+		log.Printf("ALERT: probe: service degraded, %d probes of %s failed in a row: %s", p.failures, p.city, err)
+	case p.degraded && p.failures == 0:
+		p.degraded = false
+		p.isDegraded.Set(0)
+		log.Printf("probe: service recovered, %s answered in %s", p.city, latency)
+	}
+}
+
+// check requests the canary city and checks that the answer makes sense
+func (p *prober) check() error {
+	resp, err := p.client.Get(p.url)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+
+	var data struct {
+		City string  `json:"city"`
+		Temp float64 `json:"temp"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return err
+	}
+	if data.City != p.city {
+		return fmt.Errorf("asked for %q, got %q", p.city, data.City)
+	}
+	if data.Temp < probeMinKelvin || data.Temp > probeMaxKelvin {
+		return fmt.Errorf("implausible temperature %.2fK", data.Temp)
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+// Package providertest checks that a weather provider behaves like the
+// built-in ones: it converts recorded upstream responses to the right
+// temperature in kelvin, reports upstream failures and responses without a
+// temperature as errors and gives up as soon as its context is canceled or
+// times out.
+//
+// The provider under test must send its requests to the base URL it is
+// constructed with, where Check runs a fake upstream.
+package providertest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tolerance is how far off a temperature may be, in kelvin
+const tolerance = 0.01
+
+// giveUpWithin is how long a provider may take to return after its
+// context is done
+const giveUpWithin = time.Second
+
+// Provider returns the temperature in a city, in kelvin
+type Provider interface {
+	Temperature(ctx context.Context, city string) (float64, error)
+}
+
+// ProviderFunc adapts a function to a Provider
+type ProviderFunc func(ctx context.Context, city string) (float64, error)
+
+// Temperature calls f
+func (f ProviderFunc) Temperature(ctx context.Context, city string) (float64, error) {
+	return f(ctx, city)
+}
+
+// Fixture is a response recorded from a provider's upstream API and the
+// temperature the provider should read from it, or the error it should
+// return instead
+type Fixture struct {
+	City string `json:"city"`
+	// Status is the HTTP status of the response, 200 if zero
+	Status int             `json:"status,omitempty"`
+	Body   json.RawMessage `json:"body"`
+	Kelvin float64         `json:"kelvin"`
+	// Error, if set, is text the provider's error must contain, for a
+	// response it must reject
+	Error string `json:"error,omitempty"`
+}
+
+// LoadFixtures reads a JSON array of fixtures from a file
+func LoadFixtures(path string) ([]Fixture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fixtures []Fixture
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return fixtures, nil
+}
+
+// Check runs every check against the providers newProvider returns for
+// a fake upstream at baseURL. It returns an error describing each failed
+// check, or nil if they all passed.
+func Check(newProvider func(baseURL string) Provider, fixtures []Fixture) error {
+	if len(fixtures) == 0 {
+		return errors.New("providertest: no fixtures")
+	}
+
+	var errs []error
+	for _, f := range fixtures {
+		if err := checkFixture(newProvider, f); err != nil {
+			errs = append(errs, fmt.Errorf("fixture %s: %w", f.City, err))
+		}
+	}
+
+	city := fixtures[0].City
+	for _, f := range fixtures {
+		if f.Error == "" {
+			city = f.City
+			break
+		}
+	}
+	for _, c := range []struct {
+		name  string
+		check func(func(string) Provider, string) error
+	}{
+		{"server error", checkServerError},
+		{"malformed response", checkMalformed},
+		{"missing temperature", checkMissing},
+		{"canceled context", checkCanceled},
+		{"timeout", checkTimeout},
+	} {
+		if err := c.check(newProvider, city); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func checkFixture(newProvider func(string) Provider, f Fixture) error {
+	// requested is set by the upstream's goroutine, and read once the
+	// provider has returned, which may be before the handler is done
+	var mu sync.Mutex
+	var requested string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = r.URL.RequestURI()
+		mu.Unlock()
+		status := f.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(f.Body)
+	}))
+	defer upstream.Close()
+
+	kelvin, err := newProvider(upstream.URL).Temperature(context.Background(), f.City)
+	mu.Lock()
+	uri := requested
+	mu.Unlock()
+	if uri == "" {
+		return errors.New("no request reached the upstream")
+	}
+	if !mentions(uri, f.City) {
+		return fmt.Errorf("request %s doesn't mention the city", uri)
+	}
+	if f.Error != "" {
+		if err == nil {
+			return fmt.Errorf("got %.2fK, want an error containing %q", kelvin, f.Error)
+		}
+		if !strings.Contains(err.Error(), f.Error) {
+			return fmt.Errorf("error %q doesn't contain %q", err, f.Error)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if math.Abs(kelvin-f.Kelvin) > tolerance {
+		return fmt.Errorf("got %.2fK, want %.2fK", kelvin, f.Kelvin)
+	}
+	return nil
+}
+
+// mentions reports whether the request URI carries city, escaped either way
+func mentions(requestURI, city string) bool {
+	for _, s := range []string{city, url.QueryEscape(city), url.PathEscape(city)} {
+		if strings.Contains(requestURI, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkServerError(newProvider func(string) Provider, city string) error {
+	return expectError(newProvider, city, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": "internal"}`, http.StatusInternalServerError)
+	})
+}
+
+func checkMalformed(newProvider func(string) Provider, city string) error {
+	return expectError(newProvider, city, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>not the API</html>"))
+	})
+}
+
+// checkMissing checks that a well-formed response without a temperature
+// isn't read as 0K
+func checkMissing(newProvider func(string) Provider, city string) error {
+	return expectError(newProvider, city, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	})
+}
+
+// expectError checks that a failing upstream is reported as an error,
+// not as a temperature
+func expectError(newProvider func(string) Provider, city string, h http.HandlerFunc) error {
+	upstream := httptest.NewServer(h)
+	defer upstream.Close()
+
+	kelvin, err := newProvider(upstream.URL).Temperature(context.Background(), city)
+	if err == nil {
+		return fmt.Errorf("got %.2fK and no error", kelvin)
+	}
+	return nil
+}
+
+func checkCanceled(newProvider func(string) Provider, city string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return expectGiveUp(newProvider, city, ctx, context.Canceled)
+}
+
+func checkTimeout(newProvider func(string) Provider, city string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	return expectGiveUp(newProvider, city, ctx, context.DeadlineExceeded)
+}
+
+// expectGiveUp checks that the provider returns an error wrapping want
+// soon after ctx is done, against an upstream that never answers
+func expectGiveUp(newProvider func(string) Provider, city string, ctx context.Context, want error) error {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	type result struct {
+		kelvin float64
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		kelvin, err := newProvider(upstream.URL).Temperature(ctx, city)
+		done <- result{kelvin, err}
+	}()
+
+	<-ctx.Done()
+	select {
+	case r := <-done:
+		if r.err == nil {
+			return fmt.Errorf("got %.2fK and no error", r.kelvin)
+		}
+		if !errors.Is(r.err, want) {
+			return fmt.Errorf("error %q doesn't wrap %q", r.err, want)
+		}
+		return nil
+	case <-time.After(giveUpWithin):
+		return fmt.Errorf("still running %s after the context was done", giveUpWithin)
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/muthubro/ready-set-go/config"
+)
+
+// errQuotaExhausted means a provider wasn't called because it has been
+// called as often today as its quota allows
+var errQuotaExhausted = errors.New("daily quota exhausted")
+
+// quotaSaveInterval is how often changed counts are saved. Calls made since
+// the last save are forgotten if the server crashes.
+const quotaSaveInterval = 5 * time.Second
+
+// maxQuotaCities is how many cities a day are counted for each provider.
+// Cities come from requests, so the number is capped to bound the memory
+// and the file. Calls for the cities beyond it are only counted against
+// the provider's limit.
+const maxQuotaCities = 10000
+
+// upstreamQuotas counts the calls made each day to each provider, in total
+// and for each city, and refuses calls beyond daily limits, such as the
+// caps of the providers' free tiers. Days are UTC, like the providers'.
+//
+// The counts are kept apart from the cache, where evicting them or
+// flushing the cache would reset them. They are saved to a file of their
+// own every quotaSaveInterval, if they changed, and by close, so they
+// survive restarts.
+type upstreamQuotas struct {
+	// limits are the calls a day allowed to each provider; providers
+	// without one are unlimited
+	limits map[string]uint64
+	// perCity is the calls a day allowed to each provider for any one
+	// city, unlimited if 0
+	perCity   uint64
+	providers []string
+	// path is the file the counts are saved to, or "" to not save them
+	path string
+
+	mu     sync.Mutex
+	counts quotaCounts
+	// dirty is set when the counts change, and cleared when they are saved
+	dirty bool
+	// suspended is set by suspend and close, after which the counts are
+	// no longer saved
+	suspended bool
+
+	// saving is held while the file is written, so writes aren't reordered
+	saving sync.Mutex
+	// stop ends the saving started by start, which closes stopped when done
+	stop, stopped chan struct{}
+}
+
+// quotaCounts are the calls made in a day, as saved to the file
+type quotaCounts struct {
+	Date string `json:"date"`
+	// Providers are the calls made to each provider
+	Providers map[string]uint64 `json:"providers"`
+	// Cities are the calls made to each provider for each city, if there
+	// is a per-city limit
+	Cities map[string]map[string]uint64 `json:"cities"`
+}
+
+func newQuotaCounts(day string) quotaCounts {
+	return quotaCounts{Date: day, Providers: make(map[string]uint64), Cities: make(map[string]map[string]uint64)}
+}
+
+// newUpstreamQuotas counts the calls to providers, restoring today's counts
+// from path if it exists
+func newUpstreamQuotas(path string, providers []string, limits map[string]uint64, perCity uint64) (*upstreamQuotas, error) {
+	names := append([]string(nil), providers...)
+	sort.Strings(names)
+	day, _ := quotaDay(time.Now())
+	q := &upstreamQuotas{limits: limits, perCity: perCity, providers: names, path: path, counts: newQuotaCounts(day)}
+	if path == "" {
+		return q, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved quotaCounts
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	q.merge(saved)
+	// The file holds these counts already
+	q.dirty = false
+	return q, nil
+}
+
+// parseQuotas parses a comma-separated list of provider=calls limits
+func parseQuotas(s string) (map[string]uint64, error) {
+	limits := make(map[string]uint64)
+	for _, item := range config.SplitList(s) {
+		name, value, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		if !ok {
+			return nil, fmt.Errorf("%q: want provider=calls", item)
+		}
+		if _, known := providerFactories[name]; !known {
+			return nil, fmt.Errorf("%q: unknown provider %q", item, name)
+		}
+		limit, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		if err != nil || limit == 0 {
+			return nil, fmt.Errorf("%q: the limit must be a positive number of calls", item)
+		}
+		limits[name] = limit
+	}
+	return limits, nil
+}
+
+// take counts a call to provider for city, or returns an error wrapping
+// errQuotaExhausted if it would exceed a limit
+func (q *upstreamQuotas) take(provider, city string) error {
+	now := time.Now().UTC()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	resets := q.today(now)
+	cities := q.counts.Cities[provider]
+	calls, cityCalls := q.counts.Providers[provider], cities[city]
+	if limit, ok := q.limits[provider]; ok && calls >= limit {
+		return fmt.Errorf("%w: %d calls made, resets in %s", errQuotaExhausted, calls, resets.Sub(now).Round(time.Minute))
+	}
+	if q.perCity > 0 && cityCalls >= q.perCity {
+		return fmt.Errorf("%w for the city: %d calls made, resets in %s", errQuotaExhausted, cityCalls, resets.Sub(now).Round(time.Minute))
+	}
+	q.counts.Providers[provider] = calls + 1
+	if _, counted := cities[city]; q.perCity > 0 && (counted || len(cities) < maxQuotaCities) {
+		if cities == nil {
+			cities = make(map[string]uint64)
+			q.counts.Cities[provider] = cities
+		}
+		cities[city] = cityCalls + 1
+	}
+	q.dirty = true
+	return nil
+}
+
+// today starts counting afresh when the day of the counts is over, and
+// returns when today ends. q.mu must be held.
+func (q *upstreamQuotas) today(now time.Time) time.Time {
+	day, resets := quotaDay(now)
+	if q.counts.Date != day {
+		q.counts = newQuotaCounts(day)
+	}
+	return resets
+}
+
+// merge raises today's counts to those in saved, if they are for today,
+// and reports whether they were. Taking the higher count of each provider
+// and city, rather than adding them, means merging the same counts twice
+// doesn't count the calls twice.
+func (q *upstreamQuotas) merge(saved quotaCounts) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.today(time.Now())
+	if saved.Date != q.counts.Date {
+		return false
+	}
+	for provider, calls := range saved.Providers {
+		q.counts.Providers[provider] = max(q.counts.Providers[provider], calls)
+	}
+	if q.perCity > 0 {
+		for provider, saved := range saved.Cities {
+			cities := q.counts.Cities[provider]
+			if cities == nil {
+				cities = make(map[string]uint64, len(saved))
+				q.counts.Cities[provider] = cities
+			}
+			for city, calls := range saved {
+				if _, counted := cities[city]; counted || len(cities) < maxQuotaCities {
+					cities[city] = max(cities[city], calls)
+				}
+			}
+		}
+	}
+	q.dirty = true
+	return true
+}
+
+// export returns today's counts as they are saved to the file
+func (q *upstreamQuotas) export() ([]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.today(time.Now())
+	return json.MarshalIndent(q.counts, "", "  ")
+}
+
+// start saves the counts every interval while they change, until close
+func (q *upstreamQuotas) start(interval time.Duration) {
+	q.stop, q.stopped = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(q.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// Calls are allowed even if the counts can't be saved, or
+				// a full disk would stop the server answering
+				if err := q.save(); err != nil {
+					log.Printf("quota: failed to save the counts: %s", err)
+				}
+			case <-q.stop:
+				return
+			}
+		}
+	}()
+}
+
+// close stops saving the counts, after saving them one last time. Calls are
+// still counted afterwards, but only in memory.
+func (q *upstreamQuotas) close() error {
+	if q.stop != nil {
+		close(q.stop)
+		<-q.stopped
+		q.stop = nil
+	}
+	return q.suspend()
+}
+
+// suspend saves the counts one last time and stops saving them until
+// resume, for handing the file over to another process. If the counts
+// can't be saved, saving isn't suspended.
+func (q *upstreamQuotas) suspend() error {
+	q.saving.Lock()
+	defer q.saving.Unlock()
+
+	if err := q.write(); err != nil {
+		return err
+	}
+	q.mu.Lock()
+	q.suspended = true
+	q.mu.Unlock()
+	return nil
+}
+
+// resume saves the counts again after suspend
+func (q *upstreamQuotas) resume() {
+	q.mu.Lock()
+	q.suspended = false
+	q.mu.Unlock()
+}
+
+// save writes the counts to q.path if they changed since they were last
+// saved, unless saving is suspended
+func (q *upstreamQuotas) save() error {
+	q.saving.Lock()
+	defer q.saving.Unlock()
+
+	return q.write()
+}
+
+// write is save, replacing the file only once the counts are all written.
+// q.saving must be held.
+func (q *upstreamQuotas) write() error {
+	if q.path == "" {
+		return nil
+	}
+	q.mu.Lock()
+	if !q.dirty || q.suspended {
+		q.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(q.counts)
+	q.dirty = false
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(q.path, data); err != nil {
+		q.mu.Lock()
+		q.dirty = true
+		q.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to path, replacing the file only once it is
+// all written
+func writeFileAtomic(path string, data []byte) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, "."+base+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// quotaDay is the UTC date of t and when it ends
+func quotaDay(t time.Time) (string, time.Time) {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+	return t.Format("2006-01-02"), midnight
+}
+
+// providerQuota is a provider's usage today, as served by the admin endpoint
+type providerQuota struct {
+	Calls uint64 `json:"calls"`
+	// Limit and Remaining are left out for unlimited providers
+	Limit     *uint64 `json:"limit,omitempty"`
+	Remaining *uint64 `json:"remaining,omitempty"`
+}
+
+// quotaReport is today's usage of the quotas
+type quotaReport struct {
+	Date      string                   `json:"date"`
+	ResetsAt  time.Time                `json:"resets_at"`
+	Providers map[string]providerQuota `json:"providers"`
+	// CityLimit is the per-city limit, left out if there is none
+	CityLimit uint64 `json:"city_limit,omitempty"`
+	// Cities are the calls made today for each city, by provider
+	Cities map[string]map[string]uint64 `json:"cities"`
+}
+
+// report is today's usage of the quotas
+func (q *upstreamQuotas) report() quotaReport {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	resets := q.today(time.Now())
+	report := quotaReport{
+		Date:      q.counts.Date,
+		ResetsAt:  resets,
+		Providers: make(map[string]providerQuota),
+		CityLimit: q.perCity,
+		Cities:    make(map[string]map[string]uint64),
+	}
+	for _, provider := range q.providers {
+		usage := providerQuota{Calls: q.counts.Providers[provider]}
+		if limit, ok := q.limits[provider]; ok {
+			remaining := limit - min(usage.Calls, limit)
+			usage.Limit, usage.Remaining = &limit, &remaining
+		}
+		report.Providers[provider] = usage
+	}
+	for provider, cities := range q.counts.Cities {
+		for city, calls := range cities {
+			if report.Cities[city] == nil {
+				report.Cities[city] = make(map[string]uint64)
+			}
+			report.Cities[city][provider] = calls
+		}
+	}
+	return report
+}
+
+// ServeHTTP serves today's usage of the quotas as JSON on GET /
+func (q *upstreamQuotas) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(q.report())
+}
+
+// quotaAdminRole is the role needed for the quota endpoint, which only reads
+func quotaAdminRole(r *http.Request) role {
+	return roleViewer
+}
+
+// quotaProvider only calls a named provider while it has quota left
+type quotaProvider struct {
+	name     string
+	provider weatherProvider
+	quotas   *upstreamQuotas
+}
+
+func (p quotaProvider) temperature(ctx context.Context, city string) (float64, error) {
+	if err := p.quotas.take(p.name, city); err != nil {
+		return 0, fmt.Errorf("%s: %s: %w", p.name, city, err)
+	}
+	return p.provider.temperature(ctx, city)
+}
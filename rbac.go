@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// role is what a caller of the admin endpoints may do. Each role can do
+// everything the roles below it can.
+type role int
+
+const (
+	roleNone role = iota
+	// roleViewer may read stats
+	roleViewer
+	// roleOperator may also read keys and values, delete keys, flush and
+	// repair the cache
+	roleOperator
+	// roleAdmin may also change the cache configuration
+	roleAdmin
+)
+
+var roleNames = map[role]string{
+	roleNone:     "none",
+	roleViewer:   "viewer",
+	roleOperator: "operator",
+	roleAdmin:    "admin",
+}
+
+func (r role) String() string {
+	return roleNames[r]
+}
+
+func parseRole(name string) (role, error) {
+	for r, n := range roleNames {
+		if n == name && r != roleNone {
+			return r, nil
+		}
+	}
+	return roleNone, fmt.Errorf("unknown role %q", name)
+}
+
+// principal is an authenticated caller
+type principal struct {
+	name string
+	// via is how the caller authenticated: api-key, client-cert or oidc
+	via  string
+	role role
+}
+
+// rbacPolicy maps API keys and client certificates to roles.
+// It is read from a JSON file:
+//
+//	{
+//	  "api_keys": [{"name": "ci", "key": "...", "role": "operator"}],
+//	  "client_certs": [{"common_name": "ops-laptop", "role": "admin"}]
+//	}
+type rbacPolicy struct {
+	APIKeys []struct {
+		Name string `json:"name"`
+		Key  string `json:"key"`
+		Role string `json:"role"`
+	} `json:"api_keys"`
+	ClientCerts []struct {
+		CommonName string `json:"common_name"`
+		Role       string `json:"role"`
+	} `json:"client_certs"`
+}
+
+// authorizer authenticates callers of the admin endpoints and checks
+// their role against what each request requires
+type authorizer struct {
+	oidc *oidcAuth
+
+	mu     sync.RWMutex
+	policy rbacPolicy
+	// apiKeys is keyed by the SHA-256 of the key, so lookups don't leak
+	// key prefixes through timing
+	apiKeys     map[[sha256.Size]byte]principal
+	clientCerts map[string]principal
+	// trusted are client certificates the server issued itself, which
+	// policy changes leave alone
+	trusted map[string]principal
+
+	// allowLoopback lets requests from loopback addresses through while no
+	// way to authenticate is configured; otherwise every request is denied
+	allowLoopback bool
+}
+
+func newAuthorizer(oidc *oidcAuth) *authorizer {
+	return &authorizer{
+		oidc:        oidc,
+		apiKeys:     make(map[[sha256.Size]byte]principal),
+		clientCerts: make(map[string]principal),
+		trusted:     make(map[string]principal),
+	}
+}
+
+// trustClientCert lets callers with a verified client certificate for
+// commonName in as r, whatever the policy says
+func (az *authorizer) trustClientCert(commonName string, r role) {
+	az.mu.Lock()
+	defer az.mu.Unlock()
+
+	az.trusted[commonName] = principal{name: commonName, via: "client-cert", role: r}
+}
+
+// loadPolicy replaces the policy with the one in a policy file
+func (az *authorizer) loadPolicy(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var policy rbacPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	if err := az.setPolicy(policy); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+// setPolicy validates policy and replaces the current one with it
+func (az *authorizer) setPolicy(policy rbacPolicy) error {
+	apiKeys := make(map[[sha256.Size]byte]principal)
+	for _, k := range policy.APIKeys {
+		r, err := parseRole(k.Role)
+		if err != nil {
+			return fmt.Errorf("API key %q: %s", k.Name, err)
+		}
+		if k.Key == "" {
+			return fmt.Errorf("API key %q has no key", k.Name)
+		}
+		apiKeys[sha256.Sum256([]byte(k.Key))] = principal{name: k.Name, via: "api-key", role: r}
+	}
+	clientCerts := make(map[string]principal)
+	for _, c := range policy.ClientCerts {
+		r, err := parseRole(c.Role)
+		if err != nil {
+			return fmt.Errorf("client certificate %q: %s", c.CommonName, err)
+		}
+		clientCerts[c.CommonName] = principal{name: c.CommonName, via: "client-cert", role: r}
+	}
+
+	az.mu.Lock()
+	defer az.mu.Unlock()
+
+	az.policy = policy
+	az.apiKeys = apiKeys
+	az.clientCerts = clientCerts
+	return nil
+}
+
+// currentPolicy returns the policy in effect
+func (az *authorizer) currentPolicy() rbacPolicy {
+	az.mu.RLock()
+	defer az.mu.RUnlock()
+
+	return az.policy
+}
+
+// enabled reports whether any way to authenticate is configured
+func (az *authorizer) enabled() bool {
+	az.mu.RLock()
+	defer az.mu.RUnlock()
+
+	return len(az.apiKeys) > 0 || len(az.clientCerts) > 0 || len(az.trusted) > 0 || az.oidc != nil
+}
+
+// apiKey returns the API key the request carries, if any, either in
+// X-API-Key or as a bearer token
+func apiKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// authenticate identifies the caller from an API key, a verified client
+// certificate or a signed in session, in that order
+func (az *authorizer) authenticate(r *http.Request) (principal, bool) {
+	key := apiKey(r)
+	az.mu.RLock()
+	defer az.mu.RUnlock()
+
+	if key != "" {
+		p, ok := az.apiKeys[sha256.Sum256([]byte(key))]
+		return p, ok
+	}
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if p, ok := az.clientCerts[name]; ok {
+			return p, true
+		}
+		if p, ok := az.trusted[name]; ok {
+			return p, true
+		}
+	}
+
+	if az.oidc != nil {
+		if s, ok := az.oidc.session(r); ok {
+			return principal{name: s.Email, via: "oidc", role: s.Role}, true
+		}
+	}
+	return principal{}, false
+}
+
+// protect only lets callers through whose role is at least what
+// required returns for the request, and logs every decision.
+// While no way to authenticate is configured, every request is denied,
+// unless allowLoopback is set and it comes from a loopback address. Behind
+// a reverse proxy on the same host every request does, so that has to be
+// asked for.
+func (az *authorizer) protect(h http.Handler, required func(r *http.Request) role) http.Handler {
+	if !az.enabled() {
+		if az.allowLoopback {
+			log.Print("rbac: no API keys, client certificates or OpenID Connect configured; admin endpoints only answer on loopback")
+		} else {
+			log.Print("rbac: no API keys, client certificates or OpenID Connect configured; admin endpoints are disabled")
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !az.enabled() {
+			if !az.allowLoopback {
+				log.Printf("rbac: deny %s %s from %s: no authentication configured", r.Method, r.URL.Path, r.RemoteAddr)
+				http.Error(w, "admin endpoints are disabled until authentication is configured", http.StatusForbidden)
+				return
+			}
+			if !isLoopback(r.RemoteAddr) {
+				log.Printf("rbac: deny %s %s from %s: not loopback and no authentication configured", r.Method, r.URL.Path, r.RemoteAddr)
+				http.Error(w, "admin endpoints only answer on loopback until authentication is configured", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		need := required(r)
+		p, ok := az.authenticate(r)
+		if !ok {
+			log.Printf("rbac: deny %s %s from %s: not authenticated", r.Method, r.URL.Path, r.RemoteAddr)
+			if az.oidc != nil && r.Header.Get("Authorization") == "" && r.Method == http.MethodGet {
+				az.oidc.redirectToLogin(w, r)
+				return
+			}
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		if p.role < need {
+			log.Printf("rbac: deny %s %s to %s via %s: role %s, needs %s", r.Method, r.URL.Path, p.name, p.via, p.role, need)
+			http.Error(w, fmt.Sprintf("role %s required", need), http.StatusForbidden)
+			return
+		}
+		log.Printf("rbac: allow %s %s to %s via %s as %s", r.Method, r.URL.Path, p.name, p.via, p.role)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isLoopback reports whether addr, a host:port as in http.Request's
+// RemoteAddr, is a loopback address
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// cacheAdminRole is the role required for each cache admin request
+func cacheAdminRole(r *http.Request) role {
+	path := strings.TrimPrefix(r.URL.Path, "/admin/cache/")
+
+	switch {
+	case path == "capacity":
+		return roleAdmin
+	case path == "keys" || strings.HasPrefix(path, "keys/") || path == "entries":
+		// Keys and values show what clients asked for, not just how the
+		// cache is doing
+		return roleOperator
+	case path == "consistency" && r.URL.Query().Get("repair") != "":
+		return roleOperator
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return roleViewer
+	default:
+		return roleOperator
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/muthubro/ready-set-go/cache"
+)
+
+const (
+	// redisTimeout bounds each command, so a slow Redis only slows
+	// requests down to asking the providers
+	redisTimeout = time.Second
+	// redisIdleConns is how many connections are kept open between commands
+	redisIdleConns = 8
+	// redisDefaultTTL is how long entries set without a TTL are kept.
+	// Unlike the LRU cache, Redis may have no capacity bounding them.
+	redisDefaultTTL = 24 * time.Hour
+)
+
+// redisCache is a weatherCache in a Redis server, or anything else
+// speaking its protocol such as cache/server's RESP server. Values are
+// gob encoded like in cache snapshots, so they must be registered with
+// cache.RegisterValue.
+//
+// When Redis fails, lookups miss and sets are dropped, with the error
+// logged: the server carries on asking the providers.
+type redisCache struct {
+	addr     string
+	tls      *tls.Config
+	username string
+	password string
+	db       int
+	// prefix starts every key, so the cache can share a Redis database
+	prefix      string
+	negativeTTL time.Duration
+
+	idle chan *redisConn
+}
+
+// redisConn is a connection to Redis
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisError is an error reply from Redis
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// newRedisCache returns a cache in the Redis at rawURL, of the form
+// redis://[[user]:password@]host[:port][/db], or rediss:// for TLS. It
+// doesn't connect until the first command.
+func newRedisCache(rawURL, prefix string, negativeTTL time.Duration) (*redisCache, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisCache{
+		prefix:      prefix,
+		negativeTTL: negativeTTL,
+		idle:        make(chan *redisConn, redisIdleConns),
+	}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		c.tls = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	default:
+		return nil, fmt.Errorf("%s: want a redis:// or rediss:// URL", u.Redacted())
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("%s: no host", u.Redacted())
+	}
+	c.addr = u.Host
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil || c.db < 0 {
+			return nil, fmt.Errorf("%s: database %q isn't a number", u.Redacted(), db)
+		}
+	}
+	return c, nil
+}
+
+// redisEntry is how values are stored, so gob records their type
+type redisEntry struct {
+	Value cache.Value
+}
+
+func (c *redisCache) Lookup(key string) (cache.Value, cache.LookupResult) {
+	reply, err := c.do("GET", c.prefix+key)
+	if err != nil {
+		log.Printf("cache: redis: GET %s: %s", key, err)
+		return nil, cache.Miss
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, cache.Miss
+	}
+	var e redisEntry
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&e); err != nil {
+		log.Printf("cache: redis: %s: %s", key, err)
+		return nil, cache.Miss
+	}
+	if _, negative := e.Value.(cache.Negative); negative {
+		return e.Value, cache.NegativeHit
+	}
+	return e.Value, cache.Hit
+}
+
+func (c *redisCache) SetWithTTL(key string, value cache.Value, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = redisDefaultTTL
+	}
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(redisEntry{Value: value}); err != nil {
+		log.Printf("cache: redis: %s: %s", key, err)
+		return
+	}
+	ms := strconv.FormatInt(max(ttl.Milliseconds(), 1), 10)
+	if _, err := c.do("SET", c.prefix+key, data.String(), "PX", ms); err != nil {
+		log.Printf("cache: redis: SET %s: %s", key, err)
+	}
+}
+
+func (c *redisCache) SetNegative(key string, reason error) {
+	n := cache.Negative{}
+	if reason != nil {
+		n.Reason = reason.Error()
+	}
+	c.SetWithTTL(key, n, c.negativeTTL)
+}
+
+// do sends a command on an idle connection, or a new one, and returns
+// the reply: a string, an int64, a []byte or nil for a missing value
+func (c *redisCache) do(args ...string) (interface{}, error) {
+	var rc *redisConn
+	select {
+	case rc = <-c.idle:
+	default:
+		var err error
+		if rc, err = c.dial(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := rc.do(args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// The connection is out of step with the server
+		rc.conn.Close()
+		return nil, err
+	}
+	select {
+	case c.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+	return reply, err
+}
+
+// dial connects to Redis, authenticates and selects the database
+func (c *redisCache) dial() (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	var err error
+	if c.tls != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, c.tls)
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+
+	var setup [][]string
+	switch {
+	case c.username != "":
+		setup = append(setup, []string{"AUTH", c.username, c.password})
+	case c.password != "":
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	for _, args := range setup {
+		if _, err := rc.do(args...); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s: %s", args[0], err)
+		}
+	}
+	return rc, nil
+}
+
+// do sends a command and reads its reply
+func (rc *redisConn) do(args ...string) (interface{}, error) {
+	rc.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := rc.conn.Write(b.Bytes()); err != nil {
+		return nil, err
+	}
+	return rc.readReply()
+}
+
+// readReply reads a reply that isn't an array, the only kind the
+// commands used return
+func (rc *redisConn) readReply() (interface{}, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("bad reply %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	default:
+		return nil, fmt.Errorf("unexpected reply %q", line)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// compactProfile is the Accept profile parameter asking for compact
+// responses, as in Accept: application/json; profile="compact"
+const compactProfile = "compact"
+
+// weatherSchemaPath serves the schema of compact /weather responses
+const weatherSchemaPath = "/schema/weather"
+
+// schemaField describes one element of a compact response
+type schemaField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Unit string `json:"unit,omitempty"`
+}
+
+// weatherSchema lists the fields of a /weather response in the order
+// compact responses carry them
+var weatherSchema = []schemaField{
+	{Name: "city", Type: "string"},
+	{Name: "temp", Type: "number", Unit: "K"},
+	{Name: "took", Type: "string"},
+}
+
+// wantsCompact reports whether the client asked for compact responses
+func wantsCompact(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(accept)
+		if err == nil && mediaType == "application/json" && params["profile"] == compactProfile {
+			return true
+		}
+	}
+	return false
+}
+
+// weatherReport is what is known about the temperature a /weather
+// request is answered with
+type weatherReport struct {
+	City string
+	cachedTemperature
+	// Cached is set if the temperature comes from the cache, and Stale if
+	// it is older than --cache-fresh-for because a newer one couldn't be
+	// fetched
+	Cached bool
+	Stale  bool
+	Took   time.Duration
+}
+
+// checkWeatherRequest rejects /weather requests that can't be answered in
+// their API version before h fetches anything, so they spend no quota:
+// version 2 has no compact profile and checks ?unit=
+func checkWeatherRequest(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if apiVersion(r) >= apiV2 {
+			if wantsCompact(r) {
+				http.Error(w, "the compact profile is only available in API version 1", http.StatusNotAcceptable)
+				return
+			}
+			if _, err := requestedUnit(r); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// writeWeather writes a /weather response in the API version of r
+func writeWeather(w http.ResponseWriter, r *http.Request, report weatherReport) {
+	if apiVersion(r) >= apiV2 {
+		writeWeatherV2(w, r, report)
+		return
+	}
+	writeWeatherV1(w, r, report)
+}
+
+// writeWeatherV1 writes a version 1 response. By default it is a JSON
+// object; clients sending the compact profile get a JSON array of the
+// values in weatherSchema order instead, without the keys:
+//
+//	{"city":"London","temp":283.15,"took":"12ms"}
+//	["London",283.15,"12ms"]
+//
+// Version 1 is frozen: existing clients rely on exactly these fields.
+func writeWeatherV1(w http.ResponseWriter, r *http.Request, report weatherReport) {
+	w.Header().Add("Vary", "Accept")
+	if wantsCompact(r) {
+		w.Header().Set("Content-Type", `application/json; charset=utf-8; profile="`+compactProfile+`"`)
+		w.Header().Set("Link", "<"+weatherSchemaPath+`>; rel="describedby"`)
+		json.NewEncoder(w).Encode([]interface{}{report.City, report.Kelvin, report.Took.String()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"city": report.City,
+		"temp": report.Kelvin,
+		"took": report.Took.String(),
+	})
+}
+
+// temperatureUnits convert kelvin to the units /v2 responses can be in,
+// chosen with ?unit=
+var temperatureUnits = map[string]func(kelvin float64) float64{
+	"K": func(k float64) float64 { return k },
+	"C": func(k float64) float64 { return k - 273.15 },
+	"F": func(k float64) float64 { return k*9/5 - 459.67 },
+}
+
+// requestedUnit is the unit asked for with ?unit=, kelvin by default
+func requestedUnit(r *http.Request) (string, error) {
+	unit := r.URL.Query().Get("unit")
+	if unit == "" {
+		return "K", nil
+	}
+	if _, ok := temperatureUnits[unit]; !ok {
+		return "", fmt.Errorf("unknown unit %q, want K, C or F", unit)
+	}
+	return unit, nil
+}
+
+// temperatureV2 is a temperature in a /v2 response
+type temperatureV2 struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit"`
+}
+
+// providerV2 is what one provider answered, in a /v2 response
+type providerV2 struct {
+	Name        string        `json:"name"`
+	Temperature temperatureV2 `json:"temperature"`
+}
+
+// weatherV2 is a /v2 response:
+//
+//	{
+//	  "city": "London",
+//	  "temperature": {"value": 10.15, "unit": "C"},
+//	  "providers": [
+//	    {"name": "openweathermap", "temperature": {"value": 10.03, "unit": "C"}},
+//	    {"name": "weatherunderground", "temperature": {"value": 10.27, "unit": "C"}}
+//	  ],
+//	  "fetched": "2026-10-14T09:30:00Z",
+//	  "age": "4m12s",
+//	  "cached": true,
+//	  "stale": false,
+//	  "took": "85µs"
+//	}
+//
+// providers lists those that answered when the temperature was fetched,
+// and may be empty, such as for temperatures cached by older versions.
+type weatherV2 struct {
+	City        string        `json:"city"`
+	Temperature temperatureV2 `json:"temperature"`
+	Providers   []providerV2  `json:"providers"`
+	Fetched     time.Time     `json:"fetched"`
+	Age         string        `json:"age"`
+	Cached      bool          `json:"cached"`
+	Stale       bool          `json:"stale"`
+	// Error is why a stale temperature couldn't be refreshed
+	Error string `json:"error,omitempty"`
+	Took  string `json:"took"`
+}
+
+// writeWeatherV2 writes a version 2 response, in the unit of ?unit=,
+// kelvin by default
+func writeWeatherV2(w http.ResponseWriter, r *http.Request, report weatherReport) {
+	unit, err := requestedUnit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	convert := temperatureUnits[unit]
+	temperature := func(kelvin float64) temperatureV2 {
+		return temperatureV2{Value: math.Round(convert(kelvin)*100) / 100, Unit: unit}
+	}
+
+	resp := weatherV2{
+		City:        report.City,
+		Temperature: temperature(report.Kelvin),
+		Providers:   []providerV2{},
+		Fetched:     report.Fetched.UTC(),
+		Age:         time.Since(report.Fetched).Round(time.Second).String(),
+		Cached:      report.Cached,
+		Stale:       report.Stale,
+		Took:        report.Took.String(),
+	}
+	if report.Stale {
+		resp.Error = report.Reason
+	}
+	for _, reading := range report.Readings {
+		resp.Providers = append(resp.Providers, providerV2{Name: reading.Provider, Temperature: temperature(reading.Kelvin)})
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// serveWeatherSchema describes compact version 1 /weather responses
+func serveWeatherSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"profile": compactProfile,
+		"fields":  weatherSchema,
+	})
+}
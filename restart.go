@@ -0,0 +1,224 @@
+package main
+
+// On SIGHUP the server restarts without refusing a connection, to deploy a
+// new binary or configuration: it saves the cache and the quota counts and
+// stops saving them, starts its executable again with the same arguments,
+// handing over its listening sockets, and once the new process is serving,
+// stops accepting connections, finishes the requests in flight and exits.
+// The new process restores the cache from the snapshot just saved, so it
+// starts warm, and saves it from then on; the old one would overwrite its
+// snapshots while draining. If it fails to start, the old process resumes
+// saving and carries on serving.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// listenFDsEnv names the sockets a process inherits, comma-separated
+	// in the order of their file descriptors from 3
+	listenFDsEnv = "WEATHER_LISTEN_FDS"
+	// readyFDEnv is the descriptor a new process writes to once it is serving
+	readyFDEnv = "WEATHER_READY_FD"
+
+	// restartTimeout is how long a new process has to start serving
+	restartTimeout = time.Minute
+	// drainTimeout is how long requests in flight have to finish once a
+	// new process has taken over
+	drainTimeout = 30 * time.Second
+)
+
+// listeners are the named sockets the server accepts connections on, and
+// the servers accepting them
+type listeners struct {
+	// inherited are the sockets the previous process handed over, until
+	// they are served again
+	inherited map[string]*net.TCPListener
+	// ready tells the previous process this one is serving
+	ready *os.File
+
+	mu      sync.Mutex
+	names   []string
+	sockets []*net.TCPListener
+	servers []*http.Server
+}
+
+// newListeners picks up the sockets the previous process handed over, if
+// this process was started by a restart
+func newListeners() (*listeners, error) {
+	l := &listeners{inherited: make(map[string]*net.TCPListener)}
+	names := os.Getenv(listenFDsEnv)
+	readyFD := os.Getenv(readyFDEnv)
+	// Processes started for other reasons mustn't think they inherit anything
+	os.Unsetenv(listenFDsEnv)
+	os.Unsetenv(readyFDEnv)
+	if names == "" {
+		return l, nil
+	}
+
+	for i, name := range strings.Split(names, ",") {
+		f := os.NewFile(uintptr(3+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited %s socket: %s", name, err)
+		}
+		l.inherited[name] = ln.(*net.TCPListener)
+	}
+	if fd, err := strconv.Atoi(readyFD); err == nil {
+		l.ready = os.NewFile(uintptr(fd), "ready")
+	}
+	return l, nil
+}
+
+// serve has server accept connections on addr, over TLS if it has a
+// TLSConfig. The socket named name is reused if the previous process
+// handed it over and it is still for addr. The process exits if the
+// server fails.
+func (l *listeners) serve(name, addr string, server *http.Server) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ln, ok := l.inherited[name]
+	if ok && sameAddr(ln.Addr(), addr) {
+		delete(l.inherited, name)
+	} else {
+		sock, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		ln = sock.(*net.TCPListener)
+	}
+	l.names = append(l.names, name)
+	l.sockets = append(l.sockets, ln)
+	l.servers = append(l.servers, server)
+
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ServeTLS(ln, "", "")
+		} else {
+			err = server.Serve(ln)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("%s listener: %s", name, err)
+		}
+	}()
+	return nil
+}
+
+// serving tells the previous process, if there is one, that this one is
+// accepting connections, and closes the sockets it handed over that
+// aren't configured any more
+func (l *listeners) serving() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for name, ln := range l.inherited {
+		log.Printf("Closing the inherited %s socket on %s, which is no longer configured", name, ln.Addr())
+		ln.Close()
+	}
+	l.inherited = nil
+	if l.ready != nil {
+		l.ready.Write([]byte{1})
+		l.ready.Close()
+		l.ready = nil
+	}
+}
+
+// restart starts the executable again with the same arguments, handing it
+// the sockets, and returns once it is serving
+func (l *listeners) restart() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, ln := range l.sockets {
+		f, err := ln.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = append(os.Environ(),
+		listenFDsEnv+"="+strings.Join(l.names, ","),
+		readyFDEnv+"="+strconv.Itoa(3+len(files)))
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	log.Printf("Started process %d to take over", cmd.Process.Pid)
+
+	// The pipe closes without a byte if the new process exits first
+	r.SetReadDeadline(time.Now().Add(restartTimeout))
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("process %d didn't start serving within %s", cmd.Process.Pid, restartTimeout)
+		}
+		return fmt.Errorf("process %d exited before serving", cmd.Process.Pid)
+	}
+	return nil
+}
+
+// shutdown stops accepting connections and waits up to drainTimeout for
+// the requests in flight to finish
+func (l *listeners) shutdown() {
+	l.mu.Lock()
+	servers := l.servers
+	l.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("Gave up waiting for requests to %s: %s", server.Addr, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// sameAddr reports whether a socket bound to have is listening on addr
+func sameAddr(have net.Addr, addr string) bool {
+	want, err := net.ResolveTCPAddr("tcp", addr)
+	got, ok := have.(*net.TCPAddr)
+	if err != nil || !ok || want.Port != got.Port {
+		return false
+	}
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return got.IP.IsUnspecified()
+	}
+	return want.IP.Equal(got.IP)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/muthubro/ready-set-go/cache"
+)
+
+// geocodeTTL is how long a city's resolved country is cached
+const geocodeTTL = 24 * time.Hour
+
+// geocoder resolves a city to the ISO 3166 country code it is in
+type geocoder interface {
+	country(ctx context.Context, city string) (string, error)
+}
+
+// openWeatherMapGeocoder uses the OpenWeatherMap geocoding API
+type openWeatherMapGeocoder struct {
+	apiKey string
+}
+
+func (g openWeatherMapGeocoder) country(ctx context.Context, city string) (string, error) {
+	var places []struct {
+		Country string `json:"country"`
+	}
+
+	if err := getJSON(ctx, "http://api.openweathermap.org/geo/1.0/direct?limit=1&appid="+g.apiKey+"&q="+url.QueryEscape(city), &places); err != nil {
+		return "", fmt.Errorf("geocoding: %s: %w", city, err)
+	}
+	if len(places) == 0 {
+		return "", fmt.Errorf("geocoding: no such place %q", city)
+	}
+
+	log.Printf("openWeatherMapGeocoder: %s: %s", city, places[0].Country)
+	return strings.ToUpper(places[0].Country), nil
+}
+
+// cachedCountry is the cache value for a city's resolved country
+type cachedCountry struct {
+	Code string
+}
+
+func (c cachedCountry) Size() int {
+	return 1
+}
+
+// cachingGeocoder remembers the countries another geocoder resolves
+type cachingGeocoder struct {
+	geocoder
+	cache *cache.Namespace
+}
+
+func (g cachingGeocoder) country(ctx context.Context, city string) (string, error) {
+	if v, ok := g.cache.Get(city); ok {
+		return v.(cachedCountry).Code, nil
+	}
+	code, err := g.geocoder.country(ctx, city)
+	if err != nil {
+		return "", err
+	}
+	g.cache.SetWithTTL(city, cachedCountry{Code: code}, geocodeTTL)
+	return code, nil
+}
+
+// routingRule selects the providers for locations in the listed countries.
+// A rule without countries matches every location.
+type routingRule struct {
+	Countries []string `json:"countries"`
+	Providers []string `json:"providers"`
+}
+
+func (r routingRule) matches(country string) bool {
+	if len(r.Countries) == 0 {
+		return true
+	}
+	for _, c := range r.Countries {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+	return false
+}
+
+// routedWeatherProvider picks the providers to ask for a city by the
+// country it is in. Rules are read from a JSON file and tried in order:
+//
+//	[
+//	  {"countries": ["US"], "providers": ["weatherunderground"]},
+//	  {"countries": ["GB", "DE", "FR"], "providers": ["openweathermap"]}
+//	]
+//
+// Cities no rule matches, or that can't be geocoded, are asked of the
+// fallback provider.
+type routedWeatherProvider struct {
+	geocoder geocoder
+	rules    []routingRule
+	routes   []multiWeatherProvider
+	fallback weatherProvider
+}
+
+// loadRoutingRules reads the rules in path, resolving provider names
+// from providers
+func loadRoutingRules(path string, providers map[string]weatherProvider) ([]routingRule, []multiWeatherProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var rules []routingRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	routes := make([]multiWeatherProvider, len(rules))
+	for i, rule := range rules {
+		if len(rule.Providers) == 0 {
+			return nil, nil, fmt.Errorf("%s: rule %d has no providers", path, i+1)
+		}
+		for _, name := range rule.Providers {
+			p, ok := providers[name]
+			if !ok {
+				return nil, nil, fmt.Errorf("%s: rule %d: unknown provider %q", path, i+1, name)
+			}
+			routes[i] = append(routes[i], p)
+		}
+	}
+	return rules, routes, nil
+}
+
+func (w routedWeatherProvider) temperature(ctx context.Context, city string) (float64, error) {
+	country, err := w.geocoder.country(ctx, city)
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, err
+		}
+		log.Printf("routing: %s: %s; using the fallback providers", city, err)
+		return w.fallback.temperature(ctx, city)
+	}
+
+	for i, rule := range w.rules {
+		if rule.matches(country) {
+			log.Printf("routing: %s (%s): rule %d", city, country, i+1)
+			return w.routes[i].temperature(ctx, city)
+		}
+	}
+	return w.fallback.temperature(ctx, city)
+}
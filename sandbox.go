@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sandboxKeyPrefix marks the API keys that get sandbox responses
+const sandboxKeyPrefix = "sandbox-"
+
+// sandboxRequestsPerMinute is how many requests each sandbox key may make
+// in a calendar minute before it is rate limited
+const sandboxRequestsPerMinute = 60
+
+// sandboxCities are the cities the sandbox knows, in kelvin
+var sandboxCities = map[string]float64{
+	"london":    283.15,
+	"paris":     285.65,
+	"new york":  288.71,
+	"tokyo":     291.48,
+	"sydney":    295.37,
+	"reykjavik": 272.04,
+}
+
+// sandboxFailures are the cities that make the sandbox fail like the real
+// service does, so consumers can test their error handling
+var sandboxFailures = map[string]struct {
+	status  int
+	message string
+}{
+	"error":        {http.StatusInternalServerError, "sandbox: no provider could answer"},
+	"unavailable":  {http.StatusServiceUnavailable, "sandbox: service unavailable"},
+	"timeout":      {http.StatusGatewayTimeout, "sandbox: providers timed out"},
+	"rate-limited": {http.StatusTooManyRequests, "sandbox: rate limit exceeded"},
+}
+
+// sandbox answers /weather requests made with a sandbox API key from
+// canned data, without asking any provider. Responses are deterministic:
+//
+//   - the cities in sandboxCities always have the same temperature
+//   - the cities in sandboxFailures always fail with their status,
+//     "rate-limited" with a Retry-After like a real rate limit
+//   - any other city is a 404
+//
+// Each key is also really limited to sandboxRequestsPerMinute requests
+// per minute, with X-RateLimit-Limit and X-RateLimit-Remaining headers.
+// Every sandbox response carries "X-Sandbox: true".
+type sandbox struct {
+	mu     sync.Mutex
+	minute time.Time
+	counts map[string]int
+}
+
+func newSandbox() *sandbox {
+	return &sandbox{counts: make(map[string]int)}
+}
+
+// wrap serves requests with a sandbox key itself and passes all others to h
+func (s *sandbox) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := apiKey(r)
+		if !strings.HasPrefix(key, sandboxKeyPrefix) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		s.serve(w, r, key)
+	})
+}
+
+// take counts a request by key and returns how many it has left this
+// minute and when the minute is over
+func (s *sandbox) take(key string) (remaining int, reset time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	minute := time.Now().Truncate(time.Minute)
+	if !minute.Equal(s.minute) {
+		s.minute = minute
+		s.counts = make(map[string]int)
+	}
+	s.counts[key]++
+	return sandboxRequestsPerMinute - s.counts[key], minute.Add(time.Minute)
+}
+
+func (s *sandbox) serve(w http.ResponseWriter, r *http.Request, key string) {
+	begin := time.Now()
+	city := strings.SplitN(r.URL.Path, "/", 3)[2]
+
+	w.Header().Set("X-Sandbox", "true")
+	remaining, reset := s.take(key)
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(sandboxRequestsPerMinute))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(max(remaining, 0)))
+	retryAfter := strconv.Itoa(int(time.Until(reset).Seconds()) + 1)
+	if remaining < 0 {
+		w.Header().Set("Retry-After", retryAfter)
+		http.Error(w, "sandbox: rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	if f, ok := sandboxFailures[strings.ToLower(city)]; ok {
+		if f.status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		http.Error(w, f.message, f.status)
+		return
+	}
+	temp, ok := sandboxCities[strings.ToLower(city)]
+	if !ok {
+		http.Error(w, "sandbox: unknown city "+strconv.Quote(city), http.StatusNotFound)
+		return
+	}
+
+	writeWeather(w, r, weatherReport{
+		City:              city,
+		cachedTemperature: cachedTemperature{Kelvin: temp, Fetched: begin},
+		Took:              time.Since(begin),
+	})
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+)
+
+// savingsDays is how many days of upstream call counts are kept
+const savingsDays = 30
+
+// Reasons an upstream call was avoided
+const (
+	savedByCache         = "cache"
+	savedByNegativeCache = "negative_cache"
+	savedByCoalescing    = "coalesced"
+)
+
+// unknownProvider is counted for savings that can't be attributed to the
+// providers that would have been asked, such as cached failures
+const unknownProvider = "unknown"
+
+// upstreamCounts are a provider's calls made and avoided in a day
+type upstreamCounts struct {
+	Calls      uint64            `json:"calls"`
+	Avoided    map[string]uint64 `json:"avoided"`
+	SavedRatio float64           `json:"saved_ratio"`
+}
+
+// upstreamSavings counts, per day and provider, the upstream calls made
+// and those avoided by the cache and by sharing fetches between
+// concurrent requests for the same city. It is published as the expvar
+// variable "upstream_savings", keyed by UTC date and provider name.
+//
+// The providers don't support conditional requests, so there are no
+// savings from those to count.
+type upstreamSavings struct {
+	mu   sync.Mutex
+	days map[string]map[string]*upstreamCounts
+}
+
+func newUpstreamSavings() *upstreamSavings {
+	s := &upstreamSavings{days: make(map[string]map[string]*upstreamCounts)}
+	expvar.Publish("upstream_savings", expvar.Func(s.snapshot))
+	return s
+}
+
+// counts returns today's counts for provider. s.mu must be held.
+func (s *upstreamSavings) counts(provider string) *upstreamCounts {
+	today := time.Now().UTC().Format("2006-01-02")
+	day := s.days[today]
+	if day == nil {
+		day = make(map[string]*upstreamCounts)
+		s.days[today] = day
+		s.expire()
+	}
+	c := day[provider]
+	if c == nil {
+		c = &upstreamCounts{Avoided: make(map[string]uint64)}
+		day[provider] = c
+	}
+	return c
+}
+
+// expire forgets all but the last savingsDays days. s.mu must be held.
+func (s *upstreamSavings) expire() {
+	if len(s.days) <= savingsDays {
+		return
+	}
+	dates := make([]string, 0, len(s.days))
+	for date := range s.days {
+		dates = append(dates, date)
+	}
+	sort.Strings(dates)
+	for _, date := range dates[:len(dates)-savingsDays] {
+		delete(s.days, date)
+	}
+}
+
+// called counts a call made to provider
+func (s *upstreamSavings) called(provider string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts(provider).Calls++
+}
+
+// avoided counts a call to each of providers that was avoided for reason
+func (s *upstreamSavings) avoided(providers []string, reason string) {
+	if len(providers) == 0 {
+		providers = []string{unknownProvider}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range providers {
+		s.counts(p).Avoided[reason]++
+	}
+}
+
+func (s *upstreamSavings) snapshot() interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	days := make(map[string]map[string]upstreamCounts, len(s.days))
+	for date, day := range s.days {
+		days[date] = make(map[string]upstreamCounts, len(day))
+		for provider, c := range day {
+			counts := upstreamCounts{Calls: c.Calls, Avoided: make(map[string]uint64, len(c.Avoided))}
+			var avoided uint64
+			for reason, n := range c.Avoided {
+				counts.Avoided[reason] = n
+				avoided += n
+			}
+			if total := c.Calls + avoided; total > 0 {
+				counts.SavedRatio = float64(avoided) / float64(total)
+			}
+			days[date][provider] = counts
+		}
+	}
+	return days
+}
+
+// countedProvider counts the calls made to a named provider, and records
+// them and the temperatures returned in the providerCalls of the context,
+// if any
+type countedProvider struct {
+	name     string
+	provider weatherProvider
+	savings  *upstreamSavings
+}
+
+func (p countedProvider) temperature(ctx context.Context, city string) (float64, error) {
+	p.savings.called(p.name)
+	calls, _ := ctx.Value(providerCallsKey{}).(*providerCalls)
+	if calls != nil {
+		calls.add(p.name)
+	}
+	kelvin, err := p.provider.temperature(ctx, city)
+	if calls != nil && err == nil {
+		calls.read(p.name, kelvin)
+	}
+	return kelvin, err
+}
+
+type providerCallsKey struct{}
+
+// providerCalls collects the names of the providers asked for one
+// temperature, so later cache hits can be credited to them, and what
+// each answered
+type providerCalls struct {
+	mu       sync.Mutex
+	names    []string
+	readings []providerReading
+}
+
+// withProviderCalls returns a context recording the providers called with it
+func withProviderCalls(ctx context.Context) (context.Context, *providerCalls) {
+	calls := &providerCalls{}
+	return context.WithValue(ctx, providerCallsKey{}, calls), calls
+}
+
+func (c *providerCalls) add(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.names = append(c.names, name)
+}
+
+func (c *providerCalls) list() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.names...)
+}
+
+func (c *providerCalls) read(name string, kelvin float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readings = append(c.readings, providerReading{Provider: name, Kelvin: kelvin})
+}
+
+// answers are the temperatures the providers returned
+func (c *providerCalls) answers() []providerReading {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]providerReading(nil), c.readings...)
+}
+
+// fetchGroup lets concurrent requests for the same city share one fetch
+type fetchGroup struct {
+	mu    sync.Mutex
+	calls map[string]*fetch
+}
+
+type fetch struct {
+	done  chan struct{}
+	value cachedTemperature
+	err   error
+}
+
+// errFetchPanicked is the error of a shared fetch whose call panicked
+var errFetchPanicked = errors.New("the shared fetch panicked")
+
+// call runs fn for f and then lets the waiters go. Should fn panic, which
+// the HTTP server recovers from, they get errFetchPanicked instead of
+// waiting forever, as with x/sync/singleflight.
+func (g *fetchGroup) call(ctx context.Context, city string, f *fetch, fn func(ctx context.Context) (cachedTemperature, error)) {
+	f.err = errFetchPanicked
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, city)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	f.value, f.err = fn(ctx)
+}
+
+// do calls fn for city, unless a call for city is already running, in
+// which case it waits for that call's result and reports it as shared.
+// A shared call that failed because its own request went away is retried.
+// The value's Providers are set even if the call failed.
+func (g *fetchGroup) do(ctx context.Context, city string, fn func(ctx context.Context) (cachedTemperature, error)) (value cachedTemperature, shared bool, err error) {
+	for {
+		g.mu.Lock()
+		if g.calls == nil {
+			g.calls = make(map[string]*fetch)
+		}
+		f, running := g.calls[city]
+		if !running {
+			f = &fetch{done: make(chan struct{})}
+			g.calls[city] = f
+		}
+		g.mu.Unlock()
+
+		if !running {
+			g.call(ctx, city, f, fn)
+			return f.value, false, f.err
+		}
+
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return cachedTemperature{}, true, ctx.Err()
+		}
+		if errors.Is(f.err, context.Canceled) || errors.Is(f.err, context.DeadlineExceeded) {
+			continue
+		}
+		return f.value, true, f.err
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFetchGroupPanic(t *testing.T) {
+	var g fetchGroup
+	started, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer func() { recover() }()
+		g.do(context.Background(), "London", func(context.Context) (cachedTemperature, error) {
+			close(started)
+			<-release
+			panic("provider bug")
+		})
+	}()
+	<-started
+
+	waited := make(chan error, 1)
+	go func() {
+		_, shared, err := g.do(context.Background(), "London", func(context.Context) (cachedTemperature, error) {
+			return cachedTemperature{}, errors.New("the fetch wasn't shared")
+		})
+		if !shared {
+			err = errors.New("the fetch wasn't shared")
+		}
+		waited <- err
+	}()
+	// Give the second request time to start waiting on the first
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	select {
+	case err := <-waited:
+		if !errors.Is(err, errFetchPanicked) {
+			t.Errorf("the waiting request got %v, want errFetchPanicked", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the waiting request is still blocked after the fetch panicked")
+	}
+
+	value, shared, err := g.do(context.Background(), "London", func(context.Context) (cachedTemperature, error) {
+		return cachedTemperature{Kelvin: 280}, nil
+	})
+	if shared || err != nil || value.Kelvin != 280 {
+		t.Errorf("the next fetch got %v, %v, %v, want its own result", value, shared, err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/muthubro/ready-set-go/config"
+)
+
+const (
+	// selfCheckTimeout bounds each check that goes over the network
+	selfCheckTimeout = 10 * time.Second
+	// selfCheckCity is what the providers are asked for without --probe-city
+	selfCheckCity = "London"
+)
+
+// selfCheckReport prints the result of each check, like checkProviders
+type selfCheckReport struct {
+	failed bool
+}
+
+func (r *selfCheckReport) add(name, note string, err error) {
+	switch {
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "FAIL %s:\n%s\n", name, err)
+		r.failed = true
+	case note != "":
+		fmt.Printf("ok   %s: %s\n", name, note)
+	default:
+		fmt.Printf("ok   %s\n", name)
+	}
+}
+
+// selfCheck checks what the server needs to go live without starting it:
+// that the configuration is valid and its files load, that every provider
+// answers and that Redis does if it is configured, and that the TLS
+// certificates load and haven't expired. Nothing is written, so
+// certificates that startup would generate are only reported missing.
+// It returns the exit status: 0 if every check passed, 1 otherwise.
+// loadErr is the error loading the configuration, if any.
+func selfCheck(loadErr error) int {
+	var r selfCheckReport
+
+	r.add("config", "", errors.Join(loadErr, checkConfig()))
+	if *rbacPolicyFile != "" {
+		r.add("rbac-policy", *rbacPolicyFile, newAuthorizer(nil).loadPolicy(*rbacPolicyFile))
+	}
+
+	names := make([]string, 0, len(providerFactories))
+	providers := make(map[string]weatherProvider)
+	for name, newProvider := range providerFactories {
+		names = append(names, name)
+		providers[name] = newProvider("")
+	}
+	sort.Strings(names)
+	if *routingFile != "" {
+		_, _, err := loadRoutingRules(*routingFile, providers)
+		r.add("routing-rules", *routingFile, err)
+	}
+
+	city := *probeCity
+	if city == "" {
+		city = selfCheckCity
+	}
+	for _, name := range names {
+		ctx, cancel := context.WithTimeout(context.Background(), selfCheckTimeout)
+		kelvin, err := providers[name].temperature(ctx, city)
+		cancel()
+		r.add("provider "+name, fmt.Sprintf("%s is %.2fK", city, kelvin), err)
+	}
+
+	if url := serverConfig().Cache.URL; url != "" {
+		redis, err := newRedisCache(url, "", 0)
+		if err == nil {
+			_, err = redis.do("PING")
+		}
+		r.add("cache-url", "", err)
+	}
+
+	if hosts := config.SplitList(*tlsHosts); len(hosts) > 0 {
+		m := &certManager{hosts: hosts, dir: *tlsDir}
+		names := []string{"self-signed"}
+		if *acmeDirectory != "" {
+			names = []string{"acme", "self-signed"}
+		}
+		for _, name := range names {
+			certPath, keyPath := m.paths(name)
+			leaf, note, err := checkKeyPair(certPath, keyPath)
+			if err == nil && leaf != nil {
+				for _, h := range hosts {
+					if leaf.VerifyHostname(h) != nil {
+						err = fmt.Errorf("%s: isn't for %s", certPath, h)
+						break
+					}
+				}
+			}
+			r.add("tls-dir "+filepath.Base(certPath), note, err)
+		}
+	}
+
+	if *adminTLSDir != "" {
+		var ca *x509.Certificate
+		for _, name := range []string{"ca", "server", "client"} {
+			certPath, keyPath := adminKeyPairPaths(*adminTLSDir, name)
+			leaf, note, err := checkKeyPair(certPath, keyPath)
+			if err == nil && leaf != nil && ca != nil && leaf.CheckSignatureFrom(ca) != nil {
+				err = fmt.Errorf("%s: not issued by the CA in ca.pem", certPath)
+			}
+			if name == "ca" {
+				ca = leaf
+			}
+			r.add("admin-mtls "+filepath.Base(certPath), note, err)
+		}
+	}
+
+	if r.failed {
+		return 1
+	}
+	return 0
+}
+
+// checkKeyPair loads a certificate and its key, returning the certificate
+// and how long it is valid. It returns a nil certificate, and no error, if
+// either file is missing, as startup generates or orders those.
+func checkKeyPair(certPath, keyPath string) (*x509.Certificate, string, error) {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, "missing, made at startup", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %s", certPath, err)
+	}
+
+	leaf := pair.Leaf
+	now := time.Now()
+	switch {
+	case now.After(leaf.NotAfter):
+		return leaf, "", fmt.Errorf("%s: expired on %s", certPath, leaf.NotAfter.Format(time.DateOnly))
+	case now.Before(leaf.NotBefore):
+		return leaf, "", fmt.Errorf("%s: not valid until %s", certPath, leaf.NotBefore.Format(time.DateOnly))
+	case now.Add(certRenewBefore).After(leaf.NotAfter):
+		return leaf, fmt.Sprintf("expires on %s, due for renewal", leaf.NotAfter.Format(time.DateOnly)), nil
+	}
+	return leaf, fmt.Sprintf("valid until %s", leaf.NotAfter.Format(time.DateOnly)), nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/muthubro/ready-set-go/cache"
+)
+
+// stateVersion is the version of the state archive layout
+const stateVersion = 1
+
+// maxStateSize limits how much of an uploaded archive is read
+const maxStateSize = 64 << 20
+
+// maxStateUnpacked limits the size of the files in an uploaded archive
+// together, which compression lets be far larger than the archive
+const maxStateUnpacked = 256 << 20
+
+// Files in a state archive
+const (
+	stateManifestFile = "manifest.json"
+	stateCacheFile    = "cache.gob"
+	statePolicyFile   = "rbac-policy.json"
+	stateQuotaFile    = "quota.json"
+)
+
+// stateManifest describes a state archive
+type stateManifest struct {
+	Version    int       `json:"version"`
+	Created    time.Time `json:"created"`
+	Components []string  `json:"components"`
+}
+
+// stateAdminRole is the role needed for the state endpoints; the archive
+// holds API keys, so only admins may export or import it
+func stateAdminRole(r *http.Request) role {
+	return roleAdmin
+}
+
+// stateHandler exports the mutable state of the service as a single
+// gzipped tar archive and imports such archives, so an instance can be
+// moved or restored:
+//
+//	GET  /export   download the archive
+//	POST /import   load an archive into this instance
+//
+// The archive holds the cache snapshot, the RBAC policy and today's
+// upstream quota counts. Importing merges the snapshot into the cache,
+// like restoring one at startup: entries in the archive replace those with
+// the same key, and the others are kept, so an instance being moved to
+// keeps what it has cached since. The policy in the archive replaces the
+// current one. Quota counts are merged by taking the higher count of each
+// provider and city, so calls aren't counted twice if the same archive is
+// imported again; counts from an earlier day are skipped.
+type stateHandler struct {
+	cache  *cache.LRUCache
+	authz  *authorizer
+	quotas *upstreamQuotas
+
+	// policyFile is where an imported policy is saved, if set
+	policyFile string
+}
+
+func (s *stateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/export":
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.export(w)
+
+	case "/import":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.load(w, r)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *stateHandler) export(w http.ResponseWriter) {
+	var snapshot bytes.Buffer
+	if err := s.cache.SaveItems(&snapshot); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	policy, err := json.MarshalIndent(s.authz.currentPolicy(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	quota, err := s.quotas.export()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	created := time.Now().UTC()
+	manifest, err := json.MarshalIndent(stateManifest{
+		Version:    stateVersion,
+		Created:    created,
+		Components: []string{"cache", "rbac-policy", "quota"},
+	}, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"weather-state-%s.tar.gz\"", created.Format("20060102T150405Z")))
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{stateManifestFile, manifest},
+		{stateCacheFile, snapshot.Bytes()},
+		{statePolicyFile, policy},
+		{stateQuotaFile, quota},
+	} {
+		hdr := &tar.Header{Name: f.name, Mode: 0600, Size: int64(len(f.data)), ModTime: created}
+		if err := tw.WriteHeader(hdr); err != nil {
+			log.Printf("state: export: %s", err)
+			return
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			log.Printf("state: export: %s", err)
+			return
+		}
+	}
+	if err := tw.Close(); err != nil {
+		log.Printf("state: export: %s", err)
+		return
+	}
+	if err := gz.Close(); err != nil {
+		log.Printf("state: export: %s", err)
+	}
+}
+
+// load imports an archive. Everything is read and checked before any
+// state is replaced, so a bad archive leaves the instance unchanged.
+func (s *stateHandler) load(w http.ResponseWriter, r *http.Request) {
+	files, err := readStateArchive(http.MaxBytesReader(w, r.Body, maxStateSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var manifest stateManifest
+	if err := json.Unmarshal(files[stateManifestFile], &manifest); err != nil {
+		http.Error(w, "bad or missing "+stateManifestFile, http.StatusBadRequest)
+		return
+	}
+	if manifest.Version != stateVersion {
+		http.Error(w, fmt.Sprintf("unsupported state version %d", manifest.Version), http.StatusBadRequest)
+		return
+	}
+
+	var policy *rbacPolicy
+	if data, ok := files[statePolicyFile]; ok {
+		policy = new(rbacPolicy)
+		err := json.Unmarshal(data, policy)
+		if err == nil {
+			// Check the policy on a scratch authorizer before touching the cache
+			err = newAuthorizer(nil).setPolicy(*policy)
+		}
+		if err != nil {
+			http.Error(w, statePolicyFile+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var quota *quotaCounts
+	if data, ok := files[stateQuotaFile]; ok {
+		quota = new(quotaCounts)
+		if err := json.Unmarshal(data, quota); err != nil {
+			http.Error(w, stateQuotaFile+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var imported []string
+	if data, ok := files[stateCacheFile]; ok {
+		if err := s.cache.LoadItems(bytes.NewReader(data)); err != nil {
+			http.Error(w, stateCacheFile+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		imported = append(imported, "cache")
+	}
+	if policy != nil {
+		if err := s.authz.setPolicy(*policy); err != nil {
+			http.Error(w, statePolicyFile+": "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if s.policyFile != "" {
+			if err := os.WriteFile(s.policyFile, files[statePolicyFile], 0600); err != nil {
+				log.Printf("state: failed to save imported RBAC policy: %s", err)
+			}
+		}
+		imported = append(imported, "rbac-policy")
+	}
+	if quota != nil {
+		if s.quotas.merge(*quota) {
+			imported = append(imported, "quota")
+		} else {
+			log.Printf("state: skipped the quota counts for %s, which are not today's", quota.Date)
+		}
+	}
+
+	log.Printf("state: imported %v from archive created %s", imported, manifest.Created)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{"imported": imported})
+}
+
+// readStateArchive returns the contents of the files of a state archive in
+// a gzipped tar archive. Other files are skipped.
+func readStateArchive(r io.Reader) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	files := make(map[string][]byte)
+	remaining := int64(maxStateUnpacked)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		switch hdr.Name {
+		case stateManifestFile, stateCacheFile, statePolicyFile, stateQuotaFile:
+		default:
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, remaining+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) > remaining {
+			return nil, fmt.Errorf("archive unpacks to more than %d MiB", maxStateUnpacked>>20)
+		}
+		remaining -= int64(len(data))
+		files[hdr.Name] = data
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/muthubro/ready-set-go/cache"
+)
+
+// weatherCache holds the temperatures fetched for cities, which requests
+// check before asking the providers. By default it is a namespace of the
+// in-process LRU cache; with --cache-url it is a Redis server, so every
+// instance behind a load balancer shares what any of them fetched, see
+// rediscache.go.
+type weatherCache interface {
+	// Lookup returns the value cached for key: a cachedTemperature, or a
+	// cache.Negative with result NegativeHit for a failure still remembered
+	Lookup(key string) (cache.Value, cache.LookupResult)
+	// SetWithTTL caches value for key for ttl, or with 0 for as long as
+	// the cache keeps it
+	SetWithTTL(key string, value cache.Value, ttl time.Duration)
+	// SetNegative remembers that key failed, for the negative TTL
+	SetNegative(key string, reason error)
+}
+
+// cacheWarmer is a weatherCache that can warm itself without evicting
+// anything, like the LRU cache
+type cacheWarmer interface {
+	Warm(ctx context.Context, keys []string, loader func(key string) (cache.Value, error), parallelism int) (int, error)
+}
+
+// warm loads the keys missing from c with loader, running up to
+// parallelism loaders at once. It returns how many it loaded and the
+// loader errors.
+func warm(ctx context.Context, c weatherCache, keys []string, loader func(key string) (cache.Value, error), parallelism int) (int, error) {
+	if w, ok := c.(cacheWarmer); ok {
+		return w.Warm(ctx, keys, loader, parallelism)
+	}
+
+	var (
+		mu     sync.Mutex
+		loaded int
+		errs   []error
+		wg     sync.WaitGroup
+	)
+	slots := make(chan struct{}, max(parallelism, 1))
+	for _, key := range keys {
+		if _, result := c.Lookup(key); result != cache.Miss {
+			continue
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return loaded, ctx.Err()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			v, err := loader(key)
+			if err == nil {
+				c.SetWithTTL(key, v, 0)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%q: %w", key, err))
+				return
+			}
+			loaded++
+		}()
+	}
+	wg.Wait()
+	return loaded, errors.Join(errs...)
+}